@@ -0,0 +1,146 @@
+// Package auth implements the challenge-responses used to authenticate administrators without sending the password, and clients by their cjdns key.
+// For administrators the client derives a key from the admin password using PBKDF2 with HMAC-SHA256, and proves that it knows the key for a nonce
+// from the server as in SCRAM (RFC 5802). The server only keeps the stored key and server key derived from it, neither can be used to authenticate.
+// For clients the nonce is signed using the curve25519 shared secret between the client's cjdns key and an ephemeral key from the server.
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+
+	"github.com/willeponken/go-cjdns/key"
+	"golang.org/x/crypto/curve25519"
+)
+
+const (
+	// Iterations is the default number of PBKDF2 iterations for new keys.
+	Iterations = 10000
+	// SaltSize is the size of the salt for new keys in bytes.
+	SaltSize = 16
+	// NonceSize is the size of the nonce in a challenge in bytes.
+	NonceSize = 32
+)
+
+// Random returns n bytes from the cryptographically secure random number generator.
+func Random(n int) (b []byte, err error) {
+	b = make([]byte, n)
+	_, err = rand.Read(b)
+
+	return
+}
+
+// DeriveKey derives a 32 byte key from the password using PBKDF2 with HMAC-SHA256, as the key is the size of a single block only one is calculated.
+func DeriveKey(password string, salt []byte, iterations int) []byte {
+	prf := hmac.New(sha256.New, []byte(password))
+	prf.Write(salt)
+	prf.Write([]byte{0, 0, 0, 1}) // Block index
+
+	u := prf.Sum(nil)
+	key := append([]byte(nil), u...)
+
+	for i := 1; i < iterations; i++ {
+		prf.Reset()
+		prf.Write(u)
+		u = prf.Sum(u[:0])
+
+		for j := range key {
+			key[j] ^= u[j]
+		}
+	}
+
+	return key
+}
+
+// Proof signs the nonce using the derived key.
+func Proof(key, nonce []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(nonce)
+
+	return mac.Sum(nil)
+}
+
+// Verify checks the proof for a nonce in constant time.
+func Verify(key, nonce, proof []byte) bool {
+	return hmac.Equal(Proof(key, nonce), proof)
+}
+
+// clientKey returns the client key for a key derived with DeriveKey.
+func clientKey(salted []byte) []byte {
+	return Proof(salted, []byte("Client Key"))
+}
+
+// Keys returns the stored key, the SHA-256 hash of the client key, and the server key for a key derived with DeriveKey. The server keeps
+// these to verify client proofs and to sign its own, but can not create a client proof from them.
+func Keys(salted []byte) (storedKey, serverKey []byte) {
+	stored := sha256.Sum256(clientKey(salted))
+
+	return stored[:], Proof(salted, []byte("Server Key"))
+}
+
+// ClientProof proves that the client knows the key derived with DeriveKey, by the client key XOR the nonce signed with the stored key.
+func ClientProof(salted, nonce []byte) []byte {
+	key := clientKey(salted)
+	stored := sha256.Sum256(key)
+
+	proof := Proof(stored[:], nonce)
+	for i := range proof {
+		proof[i] ^= key[i]
+	}
+
+	return proof
+}
+
+// VerifyClient recovers the client key from a client proof for the nonce, and checks that it hashes to the stored key in constant time.
+func VerifyClient(storedKey, nonce, proof []byte) bool {
+	key := Proof(storedKey, nonce)
+	if len(proof) != len(key) {
+		return false
+	}
+
+	for i := range key {
+		key[i] ^= proof[i]
+	}
+
+	stored := sha256.Sum256(key)
+	return hmac.Equal(stored[:], storedKey)
+}
+
+// sharedSecret returns the curve25519 shared secret between a private key and the public key of the other side.
+// An all zero secret, from a public key of low order, is refused as anyone could calculate it.
+func sharedSecret(priv *key.Private, pub *key.Public) (secret []byte, err error) {
+	var shared, p, k [32]byte
+	p = [32]byte(*priv)
+	k = [32]byte(*pub)
+
+	curve25519.ScalarMult(&shared, &p, &k)
+
+	var zero [32]byte
+	if hmac.Equal(shared[:], zero[:]) {
+		err = errors.New("Invalid public key, the shared secret is zero")
+		return
+	}
+
+	return shared[:], nil
+}
+
+// KeyProof signs the nonce using the shared secret between a private key and the public key of the other side, only the owners of either private key can create it.
+func KeyProof(priv *key.Private, pub *key.Public, nonce []byte) (proof []byte, err error) {
+	secret, err := sharedSecret(priv, pub)
+	if err != nil {
+		return
+	}
+
+	return Proof(secret, nonce), nil
+}
+
+// VerifyKey checks the proof for a nonce, signed using the shared secret between priv and pub, in constant time.
+func VerifyKey(priv *key.Private, pub *key.Public, nonce, proof []byte) bool {
+	secret, err := sharedSecret(priv, pub)
+	if err != nil {
+		return false
+	}
+
+	return Verify(secret, nonce, proof)
+}
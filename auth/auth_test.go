@@ -0,0 +1,125 @@
+package auth_test
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/willeponken/elvisp/auth"
+	"github.com/willeponken/go-cjdns/key"
+)
+
+// TestDeriveKey checks the key against the PBKDF2-HMAC-SHA256 test vectors.
+func TestDeriveKey(t *testing.T) {
+	var deriveTests = []struct {
+		password, salt string
+		iterations     int
+		key            string
+	}{
+		{"password", "salt", 1, "120fb6cffcf8b32c43e7225256c4f837a86548c92ccc35480805987cb70be17b"},
+		{"password", "salt", 2, "ae4d0c95af6b46d32d0adff928f06dd02a303f8ef3c251dfd6e2d85a95474c43"},
+		{"password", "salt", 4096, "c5e478d59288c841aa530db6845c4c8d962893a001ce4e11a4963873aa98134a"},
+	}
+
+	for row, test := range deriveTests {
+		if key := hex.EncodeToString(auth.DeriveKey(test.password, []byte(test.salt), test.iterations)); key != test.key {
+			t.Errorf("Row: %d returned unexpected key, got: %s, wanted: %s", row, key, test.key)
+		}
+	}
+}
+
+// TestVerify checks that only a proof for the same key and nonce is accepted.
+func TestVerify(t *testing.T) {
+	salt, err := auth.Random(auth.SaltSize)
+	if err != nil {
+		t.Fatalf("Random returned unexpected error: %v", err)
+	}
+
+	nonce, _ := auth.Random(auth.NonceSize)
+	other, _ := auth.Random(auth.NonceSize)
+
+	key := auth.DeriveKey("secret", salt, auth.Iterations)
+	wrong := auth.DeriveKey("wrong", salt, auth.Iterations)
+
+	var verifyTests = []struct {
+		proof, nonce []byte
+		valid        bool
+	}{
+		{auth.Proof(key, nonce), nonce, true},
+		{auth.Proof(wrong, nonce), nonce, false},
+		{auth.Proof(key, other), nonce, false},
+		{nil, nonce, false},
+	}
+
+	for row, test := range verifyTests {
+		if valid := auth.Verify(key, test.nonce, test.proof); valid != test.valid {
+			t.Errorf("Row: %d returned unexpected validity, got: %t, wanted: %t", row, valid, test.valid)
+		}
+	}
+}
+
+// TestVerifyClient checks that only a client proof for the same password and nonce is accepted, and that the keys kept by the server can not
+// be used as the password.
+func TestVerifyClient(t *testing.T) {
+	salt, err := auth.Random(auth.SaltSize)
+	if err != nil {
+		t.Fatalf("Random returned unexpected error: %v", err)
+	}
+
+	nonce, _ := auth.Random(auth.NonceSize)
+	other, _ := auth.Random(auth.NonceSize)
+
+	salted := auth.DeriveKey("secret", salt, auth.Iterations)
+	storedKey, serverKey := auth.Keys(salted)
+
+	var verifyTests = []struct {
+		proof, nonce []byte
+		valid        bool
+	}{
+		{auth.ClientProof(salted, nonce), nonce, true},
+		{auth.ClientProof(auth.DeriveKey("wrong", salt, auth.Iterations), nonce), nonce, false},
+		{auth.ClientProof(salted, other), nonce, false},
+		{auth.ClientProof(storedKey, nonce), nonce, false},
+		{auth.ClientProof(serverKey, nonce), nonce, false},
+		{auth.Proof(storedKey, nonce), nonce, false},
+		{nil, nonce, false},
+	}
+
+	for row, test := range verifyTests {
+		if valid := auth.VerifyClient(storedKey, test.nonce, test.proof); valid != test.valid {
+			t.Errorf("Row: %d returned unexpected validity, got: %t, wanted: %t", row, valid, test.valid)
+		}
+	}
+}
+
+// TestVerifyKey checks that only the owner of the client key can create a proof for the server's ephemeral key.
+func TestVerifyKey(t *testing.T) {
+	client := key.Generate()
+	ephemeral := key.Generate()
+	other := key.Generate()
+
+	nonce, _ := auth.Random(auth.NonceSize)
+
+	proof, err := auth.KeyProof(client, ephemeral.Pubkey(), nonce)
+	if err != nil {
+		t.Fatalf("KeyProof returned unexpected error: %v", err)
+	}
+
+	forged, _ := auth.KeyProof(other, ephemeral.Pubkey(), nonce)
+
+	var verifyTests = []struct {
+		pub   *key.Public
+		proof []byte
+		valid bool
+	}{
+		{client.Pubkey(), proof, true},
+		{other.Pubkey(), proof, false},
+		{client.Pubkey(), forged, false},
+		{new(key.Public), auth.Proof(make([]byte, 32), nonce), false}, // Low order key
+	}
+
+	for row, test := range verifyTests {
+		if valid := auth.VerifyKey(ephemeral, test.pub, nonce, test.proof); valid != test.valid {
+			t.Errorf("Row: %d returned unexpected validity, got: %t, wanted: %t", row, valid, test.valid)
+		}
+	}
+}
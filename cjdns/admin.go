@@ -1,12 +1,39 @@
 package cjdns
 
-import "github.com/willeponken/go-cjdns/admin"
+import (
+	"net"
 
-// Conn wraps around a go-cjdns admin connection
+	"github.com/willeponken/go-cjdns/admin"
+	"github.com/willeponken/go-cjdns/key"
+)
+
+// Admin defines the cjdns admin methods needed by Elvisp, it is implemented by Conn using go-cjdns and by Recorder in memory.
+type Admin interface {
+	// AddUser allows a new IP tunnel connection for the public key with the IP address.
+	AddUser(publicKey *key.Public, ip net.IP) error
+	// AddPrefix allows a new IP tunnel connection for the public key with the IPv6 prefix of length alloc starting at ip.
+	AddPrefix(publicKey *key.Public, ip net.IP, alloc int) error
+	// DelUser removes every IP tunnel connection for the public key.
+	DelUser(publicKey *key.Public) error
+	// LookupPubKey finds the public key for a cjdns IPv6 address.
+	LookupPubKey(ip string) (key string, err error)
+	// ListTunnels returns every IP tunnel connection.
+	ListTunnels() (tunnels []Tunnel, err error)
+	// RemoveTunnel removes the IP tunnel connection with the index.
+	RemoveTunnel(index int) error
+}
+
+// Conn wraps around a go-cjdns admin connection, the address and password are kept for functions go-cjdns does not support.
 type Conn struct {
 	Conn *admin.Conn
+
+	addr     string
+	port     int
+	password string
 }
 
+var _ Admin = (*Conn)(nil)
+
 // Connect returns a connection to cjdns admin
 func Connect(addr string, port int, password string) (conn *Conn, err error) {
 	conf := admin.CjdnsAdminConfig{
@@ -17,7 +44,7 @@ func Connect(addr string, port int, password string) (conn *Conn, err error) {
 
 	c, err := admin.Connect(&conf)
 
-	conn = &Conn{c}
+	conn = &Conn{Conn: c, addr: addr, port: port, password: password}
 
 	return
 }
@@ -1 +1,66 @@
 package cjdns_test
+
+import (
+	"testing"
+
+	"github.com/willeponken/elvisp/cjdns"
+	"github.com/willeponken/elvisp/cjdns/cjdnstest"
+	"github.com/willeponken/go-cjdns/key"
+)
+
+const adminPassword = "cjdns-admin-password"
+
+// mustServe starts a fake cjdns admin server and connects to it with password.
+func mustServe(t *testing.T, password string) (*cjdnstest.Server, *cjdns.Conn) {
+	s, err := cjdnstest.NewServer(adminPassword)
+	if err != nil {
+		t.Fatalf("NewServer returned unexpected error: %v", err)
+	}
+
+	conn, err := cjdns.Connect(s.Addr, s.Port, password)
+	if err != nil {
+		s.Close()
+		t.Fatalf("Connect returned unexpected error: %v", err)
+	}
+
+	return s, conn
+}
+
+// TestConnect_auth checks if authenticated calls only succeed with the correct admin password.
+func TestConnect_auth(t *testing.T) {
+	var authTests = []struct {
+		password string
+		err      bool
+	}{
+		{adminPassword, false},
+		{"wrong-password", true},
+	}
+
+	for row, test := range authTests {
+		s, conn := mustServe(t, test.password)
+
+		_, err := conn.ListTunnels()
+
+		if err != nil && !test.err {
+			t.Errorf("Row: %d returned unexpected error: %v", row, err)
+		}
+
+		if err == nil && test.err {
+			t.Errorf("Row: %d expected error but got %v", row, err)
+		}
+
+		s.Close()
+	}
+}
+
+// TestConnect_failedCookie checks if a failure to retrieve a cookie is returned for authenticated calls.
+func TestConnect_failedCookie(t *testing.T) {
+	s, conn := mustServe(t, adminPassword)
+	defer s.Close()
+
+	s.Fail("cookie", "cookie jar is empty")
+
+	if err := conn.AddUser(key.Generate().Pubkey(), nil); err == nil {
+		t.Errorf("AddUser expected error but got %v", err)
+	}
+}
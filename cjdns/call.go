@@ -0,0 +1,89 @@
+package cjdns
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/ehmry/go-bencode"
+)
+
+// callTimeout is the longest time to wait for cjdns admin to answer a query made by call.
+const callTimeout = 5 * time.Second
+
+// callResponse holds the fields used from an answer to a query made by call.
+type callResponse struct {
+	Cookie string `bencode:"cookie"`
+	Error  string `bencode:"error"`
+}
+
+// query sends a bencoded query over conn, and decodes the answer.
+func query(conn net.Conn, q map[string]interface{}) (resp callResponse, err error) {
+	b, err := bencode.Marshal(q)
+	if err != nil {
+		return
+	}
+
+	if _, err = conn.Write(b); err != nil {
+		return
+	}
+
+	b = make([]byte, 65536)
+	n, err := conn.Read(b)
+	if err != nil {
+		return
+	}
+
+	err = bencode.Unmarshal(b[:n], &resp)
+	return
+}
+
+// call runs an authenticated admin function with the arguments over a separate UDP connection, for functions or arguments that
+// go-cjdns does not support. The query is hashed the same way as by go-cjdns, using a cookie and the password.
+func (c *Conn) call(function string, args map[string]interface{}) (err error) {
+	conn, err := net.Dial("udp", net.JoinHostPort(c.addr, strconv.Itoa(c.port)))
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	if err = conn.SetDeadline(time.Now().Add(callTimeout)); err != nil {
+		return
+	}
+
+	resp, err := query(conn, map[string]interface{}{"q": "cookie", "txid": "cookie"})
+	if err != nil {
+		return
+	}
+
+	h := sha256.Sum256([]byte(c.password + resp.Cookie))
+	q := map[string]interface{}{
+		"q":      "auth",
+		"aq":     function,
+		"args":   args,
+		"cookie": resp.Cookie,
+		"hash":   hex.EncodeToString(h[:]),
+		"txid":   function,
+	}
+
+	b, err := bencode.Marshal(q)
+	if err != nil {
+		return
+	}
+
+	h = sha256.Sum256(b)
+	q["hash"] = hex.EncodeToString(h[:])
+
+	if resp, err = query(conn, q); err != nil {
+		return
+	}
+
+	if resp.Error != "" && resp.Error != "none" {
+		err = errors.New(resp.Error)
+	}
+
+	return
+}
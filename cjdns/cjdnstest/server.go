@@ -0,0 +1,415 @@
+// Package cjdnstest provides a fake cjdns admin server for tests, speaking the bencoded UDP admin protocol.
+package cjdnstest
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ehmry/go-bencode"
+	"github.com/willeponken/elvisp/cjdns"
+	"github.com/willeponken/go-cjdns/key"
+)
+
+// request holds a query from an admin client.
+type request struct {
+	Q      string                 `bencode:"q"`
+	AQ     string                 `bencode:"aq"`
+	Cookie string                 `bencode:"cookie"`
+	Hash   string                 `bencode:"hash"`
+	Args   map[string]interface{} `bencode:"args"`
+	Txid   string                 `bencode:"txid"`
+}
+
+// String returns the string argument for name, or an empty string if it does not exist.
+func (r *request) String(name string) string {
+	v, _ := r.Args[name].([]byte)
+	return string(v)
+}
+
+// Int returns the integer argument for name, or -1 if it does not exist.
+func (r *request) Int(name string) int {
+	v, ok := r.Args[name].(int64)
+	if !ok {
+		return -1
+	}
+
+	return int(v)
+}
+
+// response holds the dictionary sent back to the admin client.
+type response map[string]interface{}
+
+// handler implements an admin function, the returned string is used as error if not empty.
+type handler func(s *Server, req *request, from *net.UDPAddr) (response, string)
+
+// Server is a fake cjdns admin server listening on a random UDP port on localhost.
+type Server struct {
+	Addr     string
+	Port     int
+	Password string
+
+	conn *net.UDPConn
+
+	mu          sync.Mutex
+	nodes       map[string]*key.Public
+	tunnels     map[int]cjdns.Tunnel
+	nextIndex   int
+	failures    map[string]string
+	calls       map[string]int
+	subscribers map[string]*net.UDPAddr
+}
+
+var handlers = map[string]handler{
+	"ping":                      handlePing,
+	"IpTunnel_allowConnection":  handleAllowConnection,
+	"IpTunnel_listConnections":  handleListConnections,
+	"IpTunnel_showConnection":   handleShowConnection,
+	"IpTunnel_removeConnection": handleRemoveConnection,
+	"NodeStore_nodeForAddr":     handleNodeForAddr,
+	"AdminLog_subscribe":        handleSubscribe,
+	"AdminLog_unsubscribe":      handleUnsubscribe,
+}
+
+// NewServer starts a fake cjdns admin server that authenticates clients with password.
+func NewServer(password string) (s *Server, err error) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return
+	}
+
+	addr := conn.LocalAddr().(*net.UDPAddr)
+
+	s = &Server{
+		Addr:        addr.IP.String(),
+		Port:        addr.Port,
+		Password:    password,
+		conn:        conn,
+		nodes:       make(map[string]*key.Public),
+		tunnels:     make(map[int]cjdns.Tunnel),
+		failures:    make(map[string]string),
+		calls:       make(map[string]int),
+		subscribers: make(map[string]*net.UDPAddr),
+	}
+
+	go s.serve()
+
+	return
+}
+
+// Close stops the server, clients will not receive any more responses.
+func (s *Server) Close() error {
+	return s.conn.Close()
+}
+
+// AddNode adds a node to the node store, it can be looked up using the cjdns IPv6 address for the public key.
+func (s *Server) AddNode(pubkey *key.Public) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nodes[pubkey.IP().String()] = pubkey
+}
+
+// DelNode removes a node from the node store.
+func (s *Server) DelNode(pubkey *key.Public) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.nodes, pubkey.IP().String())
+}
+
+// AddTunnel adds an IP tunnel connection as if it was allowed by cjdns, the index of the connection is returned.
+func (s *Server) AddTunnel(tunnel cjdns.Tunnel) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tunnel.Index = s.nextIndex
+	s.tunnels[tunnel.Index] = tunnel
+	s.nextIndex++
+
+	return tunnel.Index
+}
+
+// Tunnels returns every IP tunnel connection, sorted by index.
+func (s *Server) Tunnels() (tunnels []cjdns.Tunnel) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, index := range s.indexes() {
+		tunnels = append(tunnels, s.tunnels[index])
+	}
+
+	return
+}
+
+// Reset removes every IP tunnel connection, as if cjdroute was restarted.
+func (s *Server) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.tunnels = make(map[int]cjdns.Tunnel)
+}
+
+// Fail makes every following call to function return message as error, use "cookie" to fail authentication.
+func (s *Server) Fail(function, message string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.failures[function] = message
+}
+
+// Recover stops function from failing.
+func (s *Server) Recover(function string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.failures, function)
+}
+
+// Calls returns how many times function has been called.
+func (s *Server) Calls(function string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.calls[function]
+}
+
+// Log sends a log message to every subscriber.
+func (s *Server) Log(level, file string, line int, message string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for streamID, addr := range s.subscribers {
+		s.send(addr, response{
+			"txid":     "",
+			"streamId": streamID,
+			"level":    level,
+			"file":     file,
+			"line":     line,
+			"message":  message,
+			"time":     time.Now().Unix(),
+		})
+	}
+}
+
+// indexes returns the indexes of every IP tunnel connection in increasing order, the lock has to be held.
+func (s *Server) indexes() (indexes []int) {
+	for index := range s.tunnels {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+
+	return
+}
+
+// send encodes and writes a response to addr.
+func (s *Server) send(addr *net.UDPAddr, resp response) {
+	b, err := bencode.Marshal(resp)
+	if err != nil {
+		log.Printf("cjdnstest: unable to encode response: %s", err)
+		return
+	}
+
+	s.conn.WriteToUDP(b, addr)
+}
+
+// serve reads queries until the connection is closed.
+func (s *Server) serve() {
+	b := make([]byte, 65536)
+
+	for {
+		n, addr, err := s.conn.ReadFromUDP(b)
+		if err != nil {
+			return
+		}
+
+		packet := make([]byte, n)
+		copy(packet, b[:n])
+
+		s.handle(packet, addr)
+	}
+}
+
+// handle authenticates and dispatches a query, then responds to the client.
+func (s *Server) handle(packet []byte, addr *net.UDPAddr) {
+	req := new(request)
+	if err := bencode.Unmarshal(packet, req); err != nil {
+		log.Printf("cjdnstest: unable to decode query: %s", err)
+		return
+	}
+
+	function := req.Q
+	if req.Q == "auth" {
+		function = req.AQ
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.calls[function]++
+
+	resp := response{}
+	var failure string
+
+	switch {
+	case s.failures[function] != "":
+		failure = s.failures[function]
+	case req.Q == "cookie":
+		resp["cookie"] = fmt.Sprintf("%d", rand.Int63())
+	case req.Q == "auth" && !s.authenticated(packet, req):
+		failure = "Auth failed."
+	case handlers[function] == nil:
+		failure = "no such function"
+	default:
+		resp, failure = handlers[function](s, req, addr)
+	}
+
+	if failure != "" {
+		resp = response{"error": failure}
+	} else if _, ok := resp["error"]; !ok && req.Q == "auth" {
+		resp["error"] = "none"
+	}
+
+	resp["txid"] = req.Txid
+	s.send(addr, resp)
+}
+
+// authenticated verifies the hash for an authenticated query. The client hashes the query with the hash field set to sha256(password + cookie),
+// so the received hash is replaced with that value before hashing the raw query again.
+func (s *Server) authenticated(packet []byte, req *request) bool {
+	h := sha256.Sum256([]byte(s.Password + req.Cookie))
+	passHash := hex.EncodeToString(h[:])
+
+	field := []byte(fmt.Sprintf("4:hash%d:", len(req.Hash)))
+	raw := bytes.Replace(packet, append(field, req.Hash...), append(field, passHash...), 1)
+
+	h = sha256.Sum256(raw)
+	return hex.EncodeToString(h[:]) == req.Hash
+}
+
+func handlePing(s *Server, req *request, from *net.UDPAddr) (response, string) {
+	return response{"q": "pong"}, ""
+}
+
+func handleAllowConnection(s *Server, req *request, from *net.UDPAddr) (response, string) {
+	pubkey, err := key.DecodePublic(req.String("publicKeyOfAuthorizedNode"))
+	if err != nil {
+		return nil, "key must be 52 characters long"
+	}
+
+	tunnel := cjdns.Tunnel{Index: s.nextIndex, Key: pubkey}
+	if alloc := req.Int("ip6Alloc"); alloc != -1 {
+		tunnel.Alloc = alloc
+	}
+
+	for _, addr := range []string{req.String("ip4Address"), req.String("ip6Address")} {
+		if addr == "" {
+			continue
+		}
+
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return nil, "malformed address"
+		}
+
+		tunnel.IPs = append(tunnel.IPs, ip)
+	}
+
+	if len(tunnel.IPs) == 0 {
+		return nil, "Must specify ip6Address or ip4Address"
+	}
+
+	s.tunnels[tunnel.Index] = tunnel
+	s.nextIndex++
+
+	return response{"connection": tunnel.Index}, ""
+}
+
+func handleListConnections(s *Server, req *request, from *net.UDPAddr) (response, string) {
+	connections := []int{}
+	connections = append(connections, s.indexes()...)
+
+	return response{"connections": connections}, ""
+}
+
+func handleShowConnection(s *Server, req *request, from *net.UDPAddr) (response, string) {
+	tunnel, ok := s.tunnels[req.Int("connection")]
+	if !ok {
+		return nil, "connection not found"
+	}
+
+	resp := response{"key": tunnel.Key.String(), "outgoing": 0}
+	if tunnel.Outgoing {
+		resp["outgoing"] = 1
+	}
+
+	for _, ip := range tunnel.IPs {
+		if ip.To4() != nil {
+			resp["ip4Address"] = ip.String()
+		} else {
+			resp["ip6Address"] = ip.String()
+		}
+	}
+
+	if tunnel.Alloc != 0 {
+		resp["ip6Alloc"] = tunnel.Alloc
+	}
+
+	return resp, ""
+}
+
+func handleRemoveConnection(s *Server, req *request, from *net.UDPAddr) (response, string) {
+	connection := req.Int("connection")
+	if _, ok := s.tunnels[connection]; !ok {
+		return nil, "connection not found"
+	}
+
+	delete(s.tunnels, connection)
+
+	return response{}, ""
+}
+
+func handleNodeForAddr(s *Server, req *request, from *net.UDPAddr) (response, string) {
+	ip := net.ParseIP(req.String("ip"))
+	if ip == nil {
+		return nil, "parse_ip"
+	}
+
+	pubkey, ok := s.nodes[ip.String()]
+	if !ok {
+		return nil, "not_found"
+	}
+
+	return response{"result": response{
+		"key":             pubkey.String(),
+		"routeLabel":      "0000.0000.0000.0013",
+		"linkCount":       1,
+		"protocolVersion": 17,
+		"reach":           0,
+	}}, ""
+}
+
+func handleSubscribe(s *Server, req *request, from *net.UDPAddr) (response, string) {
+	streamID := fmt.Sprintf("%08x", rand.Uint32())
+	s.subscribers[streamID] = from
+
+	return response{"streamId": streamID}, ""
+}
+
+func handleUnsubscribe(s *Server, req *request, from *net.UDPAddr) (response, string) {
+	streamID := req.String("streamId")
+	if _, ok := s.subscribers[streamID]; !ok {
+		return nil, "No such subscription."
+	}
+
+	delete(s.subscribers, streamID)
+
+	return response{}, ""
+}
@@ -0,0 +1,44 @@
+package cjdnstest_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/willeponken/elvisp/cjdns/cjdnstest"
+	"github.com/willeponken/go-cjdns/admin"
+)
+
+// TestServer_AdminLog checks if log messages are sent to subscribers.
+func TestServer_AdminLog(t *testing.T) {
+	s, err := cjdnstest.NewServer("password")
+	if err != nil {
+		t.Fatalf("NewServer returned unexpected error: %v", err)
+	}
+	defer s.Close()
+
+	conn, err := admin.Connect(&admin.CjdnsAdminConfig{Addr: s.Addr, Port: s.Port, Password: "password"})
+	if err != nil {
+		t.Fatalf("Connect returned unexpected error: %v", err)
+	}
+
+	messages := make(chan *admin.LogMessage)
+	streamID, err := conn.AdminLog_subscribe(admin.INFO, "", -1, messages)
+	if err != nil {
+		t.Fatalf("AdminLog_subscribe returned unexpected error: %v", err)
+	}
+
+	s.Log(admin.INFO, "IpTunnel.c", 42, "hello")
+
+	select {
+	case m := <-messages:
+		if m.Message != "hello" || m.File != "IpTunnel.c" || m.Line != 42 {
+			t.Errorf("Received unexpected log message: %+v", m)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Timed out waiting for log message")
+	}
+
+	if streamID == "" {
+		t.Errorf("AdminLog_subscribe returned empty stream ID")
+	}
+}
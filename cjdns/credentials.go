@@ -0,0 +1,149 @@
+package cjdns
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// ErrNoCredentials is returned by FindCredentials if none of the files exist.
+var ErrNoCredentials = errors.New("No cjdns admin credentials found")
+
+// Credentials holds the address, port and password for cjdns admin, and the file they were read from.
+type Credentials struct {
+	Addr     string
+	Port     int
+	Password string
+	Path     string
+}
+
+// DefaultCredentialPaths returns the files that other cjdns tools read the admin credentials from, in the order they are tried:
+// ~/.cjdnsadmin and the cjdroute.conf in /etc.
+func DefaultCredentialPaths() (paths []string) {
+	if home, err := os.UserHomeDir(); err == nil {
+		paths = append(paths, filepath.Join(home, ".cjdnsadmin"))
+	}
+
+	return append(paths, "/etc/cjdroute.conf")
+}
+
+// stripComments removes the // and /* */ comments that cjdroute.conf, and .cjdnsadmin files written by hand, can hold. Comment
+// markers within strings are kept.
+func stripComments(data []byte) []byte {
+	out := make([]byte, 0, len(data))
+
+	for i := 0; i < len(data); i++ {
+		switch {
+		case data[i] == '"':
+			// Copy the string, with escaped characters, up to and including the closing quote.
+			start := i
+			for i++; i < len(data) && data[i] != '"'; i++ {
+				if data[i] == '\\' {
+					i++
+				}
+			}
+
+			if i >= len(data) {
+				i = len(data) - 1
+			}
+			out = append(out, data[start:i+1]...)
+		case bytes.HasPrefix(data[i:], []byte("//")):
+			for i < len(data) && data[i] != '\n' {
+				i++
+			}
+
+			if i < len(data) {
+				out = append(out, '\n')
+			}
+		case bytes.HasPrefix(data[i:], []byte("/*")):
+			end := bytes.Index(data[i+2:], []byte("*/"))
+			if end < 0 {
+				return out
+			}
+
+			i += end + 3
+		default:
+			out = append(out, data[i])
+		}
+	}
+
+	return out
+}
+
+// ParseCredentials parses the admin credentials from a .cjdnsadmin file, {"addr": ..., "port": ..., "password": ...}, or from the
+// admin block in cjdroute.conf, {"admin": {"bind": "<addr>:<port>", "password": ...}}.
+func ParseCredentials(data []byte) (c Credentials, err error) {
+	var file struct {
+		Addr     string `json:"addr"`
+		Port     int    `json:"port"`
+		Password string `json:"password"`
+		Admin    *struct {
+			Bind     string `json:"bind"`
+			Password string `json:"password"`
+		} `json:"admin"`
+	}
+
+	if err = json.Unmarshal(stripComments(data), &file); err != nil {
+		return
+	}
+
+	c = Credentials{Addr: file.Addr, Port: file.Port, Password: file.Password}
+
+	if file.Admin != nil {
+		var port string
+		if c.Addr, port, err = net.SplitHostPort(file.Admin.Bind); err != nil {
+			err = fmt.Errorf("Invalid admin bind address: %s", file.Admin.Bind)
+			return
+		}
+
+		if c.Port, err = strconv.Atoi(port); err != nil {
+			err = fmt.Errorf("Invalid admin port: %s", port)
+			return
+		}
+
+		c.Password = file.Admin.Password
+	}
+
+	if c.Password == "" {
+		err = errors.New("No admin password found")
+	}
+
+	return
+}
+
+// ReadCredentials reads the admin credentials from a .cjdnsadmin file or cjdroute.conf.
+func ReadCredentials(path string) (c Credentials, err error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+
+	if c, err = ParseCredentials(data); err != nil {
+		err = fmt.Errorf("Unable to read cjdns admin credentials from: %s, due to error: %s", path, err)
+		return
+	}
+
+	c.Path = path
+	return
+}
+
+// FindCredentials returns the admin credentials from the first of the files that exists, or ErrNoCredentials. Files that exist but
+// can not be parsed are refused, so a broken file is not silently skipped.
+func FindCredentials(paths []string) (c Credentials, err error) {
+	for _, path := range paths {
+		if _, err = os.Stat(path); os.IsNotExist(err) {
+			continue
+		}
+
+		return ReadCredentials(path)
+	}
+
+	err = ErrNoCredentials
+	return
+}
@@ -0,0 +1,97 @@
+package cjdns_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/willeponken/elvisp/cjdns"
+)
+
+const cjdrouteConf = `{
+    // Private key:
+    // Your confidentiality and data integrity depend on this key, keep it secret!
+    "privateKey": "0000000000000000000000000000000000000000000000000000000000000000",
+
+    /*
+     * The admin interface, used by tools such as elvispd.
+     */
+    "admin":
+    {
+        // Port to bind the admin RPC server to.
+        "bind": "127.0.0.1:11235",
+
+        // Password for admin RPC server.
+        "password": "//not-a-comment/*"
+    },
+
+    "router": {"ipTunnel": {"allowedConnections": []}}
+}
+`
+
+func TestParseCredentials(t *testing.T) {
+	var parseTests = []struct {
+		data     string
+		expected cjdns.Credentials
+		err      bool
+	}{
+		{`{"addr": "127.0.0.1", "port": 11234, "password": "secret", "config": "/etc/cjdroute.conf"}`, cjdns.Credentials{Addr: "127.0.0.1", Port: 11234, Password: "secret"}, false},
+		{cjdrouteConf, cjdns.Credentials{Addr: "127.0.0.1", Port: 11235, Password: "//not-a-comment/*"}, false},
+		{`{"admin": {"bind": "[::1]:11234", "password": "say \"hi\" // there"}}`, cjdns.Credentials{Addr: "::1", Port: 11234, Password: `say "hi" // there`}, false},
+		{`{"admin": {"bind": "127.0.0.1", "password": "secret"}}`, cjdns.Credentials{}, true},
+		{`{"admin": {"bind": "127.0.0.1:admin", "password": "secret"}}`, cjdns.Credentials{}, true},
+		{`{"addr": "127.0.0.1", "port": 11234}`, cjdns.Credentials{}, true},
+		{`{"addr": "127.0.0.1" /* unterminated`, cjdns.Credentials{}, true},
+		{`nope`, cjdns.Credentials{}, true},
+	}
+
+	for row, test := range parseTests {
+		c, err := cjdns.ParseCredentials([]byte(test.data))
+
+		if err != nil && !test.err {
+			t.Errorf("Row: %d returned unexpected error: %v", row, err)
+		}
+
+		if err == nil && test.err {
+			t.Errorf("Row: %d expected error but got %v", row, err)
+		}
+
+		if err == nil && c != test.expected {
+			t.Errorf("Row: %d returned unexpected credentials, got: %+v, wanted: %+v", row, c, test.expected)
+		}
+	}
+}
+
+func TestFindCredentials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "elvisp-cjdns")
+	if err != nil {
+		t.Fatalf("TempDir returned unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	missing := filepath.Join(dir, ".cjdnsadmin")
+	conf := filepath.Join(dir, "cjdroute.conf")
+	broken := filepath.Join(dir, "broken.conf")
+
+	if err = ioutil.WriteFile(conf, []byte(cjdrouteConf), 0600); err != nil {
+		t.Fatalf("WriteFile returned unexpected error: %v", err)
+	}
+
+	if err = ioutil.WriteFile(broken, []byte("{"), 0600); err != nil {
+		t.Fatalf("WriteFile returned unexpected error: %v", err)
+	}
+
+	c, err := cjdns.FindCredentials([]string{missing, conf})
+	if err != nil || c.Path != conf || c.Port != 11235 {
+		t.Errorf("FindCredentials returned unexpected credentials: %+v, error: %v", c, err)
+	}
+
+	if _, err = cjdns.FindCredentials([]string{missing}); err != cjdns.ErrNoCredentials {
+		t.Errorf("FindCredentials returned unexpected error, got: %v, wanted: %v", err, cjdns.ErrNoCredentials)
+	}
+
+	if _, err = cjdns.FindCredentials([]string{broken, conf}); err == nil || err == cjdns.ErrNoCredentials {
+		t.Errorf("FindCredentials returned unexpected error for a broken file: %v", err)
+	}
+}
@@ -7,6 +7,16 @@ import (
 	"github.com/willeponken/go-cjdns/key"
 )
 
+// Tunnel holds a cjdns IP tunnel connection and the addresses allowed for it. Alloc is the length of the IPv6 prefix allowed
+// for it, it is 0 for a single address or if cjdns does not report it.
+type Tunnel struct {
+	Index    int
+	Key      *key.Public
+	IPs      []net.IP
+	Alloc    int
+	Outgoing bool
+}
+
 // AddUser adds a new user to the database and allows a new iptunnel connection for the user.
 func (c *Conn) AddUser(publicKey *key.Public, ip net.IP) error {
 	admin := c.Conn
@@ -22,27 +32,84 @@ func (c *Conn) AddUser(publicKey *key.Public, ip net.IP) error {
 	return nil
 }
 
+// AddPrefix allows a new iptunnel connection for the user with an IPv6 prefix. go-cjdns does not support prefixes, so the
+// function is called over a separate admin connection.
+func (c *Conn) AddPrefix(publicKey *key.Public, ip net.IP, alloc int) error {
+	args := map[string]interface{}{
+		"publicKeyOfAuthorizedNode": publicKey.String(),
+		"ip6Address":                ip.String(),
+		"ip6Alloc":                  alloc,
+	}
+
+	if err := c.call("IpTunnel_allowConnection", args); err != nil {
+		return err
+	}
+
+	log.Printf("User: %s added to cjdns IP tunnel with prefix: %s/%d", publicKey.String(), ip.String(), alloc)
+
+	return nil
+}
+
 // DelUser looks up the user for the defined public key and deauthenticates the user from the iptunnel.
 func (c *Conn) DelUser(publicKey *key.Public) error {
+	tunnels, err := c.ListTunnels()
+	if err != nil {
+		return err
+	}
+
+	for _, tunnel := range tunnels {
+		if publicKey.Equal(tunnel.Key) {
+			if err := c.RemoveTunnel(tunnel.Index); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// ListTunnels returns every IP tunnel connection in cjdns.
+func (c *Conn) ListTunnels() (tunnels []Tunnel, err error) {
 	admin := c.Conn
 
-	tunnels, err := admin.IpTunnel_listConnections()
+	indexes, err := admin.IpTunnel_listConnections()
 	if err != nil {
-		return err
+		return
 	}
 
-	for i := range tunnels {
-		tunnel, err := admin.IpTunnel_showConnection(tunnels[i])
+	for _, index := range indexes {
+		conn, err := admin.IpTunnel_showConnection(index)
 		if err != nil {
-			return err
+			return nil, err
 		}
 
-		if publicKey.Equal(tunnel.Key) {
-			if err := admin.IpTunnel_removeConnection(tunnels[i]); err != nil {
-				return err
-			}
+		tunnel := Tunnel{
+			Index:    index,
+			Key:      conn.Key,
+			Outgoing: conn.Outgoing,
+		}
+
+		if conn.Ip4Address != nil {
+			tunnel.IPs = append(tunnel.IPs, *conn.Ip4Address)
 		}
+
+		if conn.Ip6Address != nil {
+			tunnel.IPs = append(tunnel.IPs, *conn.Ip6Address)
+		}
+
+		tunnels = append(tunnels, tunnel)
 	}
 
+	return
+}
+
+// RemoveTunnel removes the IP tunnel connection with the defined index.
+func (c *Conn) RemoveTunnel(index int) error {
+	if err := c.Conn.IpTunnel_removeConnection(index); err != nil {
+		return err
+	}
+
+	log.Printf("Removed IP tunnel connection: %d", index)
+
 	return nil
 }
@@ -1 +1,130 @@
 package cjdns_test
+
+import (
+	"net"
+	"testing"
+
+	"github.com/willeponken/elvisp/cjdns"
+	"github.com/willeponken/go-cjdns/key"
+)
+
+// TestAddUser_ListTunnels checks if allowed addresses are listed as IP tunnel connections for the user.
+func TestAddUser_ListTunnels(t *testing.T) {
+	s, conn := mustServe(t, adminPassword)
+	defer s.Close()
+
+	pubkey := key.Generate().Pubkey()
+	ips := []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("fd00::1")}
+
+	for _, ip := range ips {
+		if err := conn.AddUser(pubkey, ip); err != nil {
+			t.Fatalf("AddUser returned unexpected error: %v", err)
+		}
+	}
+
+	tunnels, err := conn.ListTunnels()
+	if err != nil {
+		t.Fatalf("ListTunnels returned unexpected error: %v", err)
+	}
+
+	if len(tunnels) != len(ips) {
+		t.Fatalf("ListTunnels returned unexpected number of tunnels, got: %d, wanted: %d", len(tunnels), len(ips))
+	}
+
+	for row, tunnel := range tunnels {
+		if !pubkey.Equal(tunnel.Key) {
+			t.Errorf("Row: %d returned unexpected key, got: %s, wanted: %s", row, tunnel.Key, pubkey)
+		}
+
+		if len(tunnel.IPs) != 1 || !tunnel.IPs[0].Equal(ips[row]) {
+			t.Errorf("Row: %d returned unexpected IPs, got: %v, wanted: %v", row, tunnel.IPs, ips[row])
+		}
+
+		if tunnel.Outgoing {
+			t.Errorf("Row: %d returned unexpected outgoing tunnel", row)
+		}
+	}
+}
+
+// TestDelUser checks if only the IP tunnel connections for the user are removed.
+func TestDelUser(t *testing.T) {
+	s, conn := mustServe(t, adminPassword)
+	defer s.Close()
+
+	remove := key.Generate().Pubkey()
+	keep := key.Generate().Pubkey()
+
+	s.AddTunnel(cjdns.Tunnel{Key: remove, IPs: []net.IP{net.ParseIP("10.0.0.1")}})
+	s.AddTunnel(cjdns.Tunnel{Key: keep, IPs: []net.IP{net.ParseIP("10.0.0.2")}})
+	s.AddTunnel(cjdns.Tunnel{Key: remove, IPs: []net.IP{net.ParseIP("fd00::1")}})
+
+	if err := conn.DelUser(remove); err != nil {
+		t.Fatalf("DelUser returned unexpected error: %v", err)
+	}
+
+	tunnels := s.Tunnels()
+	if len(tunnels) != 1 || !keep.Equal(tunnels[0].Key) {
+		t.Errorf("DelUser left unexpected tunnels: %v", tunnels)
+	}
+}
+
+// TestRemoveTunnel checks if a tunnel is removed by index, and that unknown indexes return an error.
+func TestRemoveTunnel(t *testing.T) {
+	s, conn := mustServe(t, adminPassword)
+	defer s.Close()
+
+	index := s.AddTunnel(cjdns.Tunnel{Key: key.Generate().Pubkey(), IPs: []net.IP{net.ParseIP("10.0.0.1")}, Outgoing: true})
+
+	tunnels, err := conn.ListTunnels()
+	if err != nil || len(tunnels) != 1 || !tunnels[0].Outgoing {
+		t.Fatalf("ListTunnels returned unexpected tunnels: %v, error: %v", tunnels, err)
+	}
+
+	if err = conn.RemoveTunnel(index); err != nil {
+		t.Errorf("RemoveTunnel returned unexpected error: %v", err)
+	}
+
+	if err = conn.RemoveTunnel(index); err == nil {
+		t.Errorf("RemoveTunnel expected error but got %v", err)
+	}
+}
+
+// TestAddUser_failure checks if errors from cjdns are returned.
+func TestAddUser_failure(t *testing.T) {
+	s, conn := mustServe(t, adminPassword)
+	defer s.Close()
+
+	s.Fail("IpTunnel_allowConnection", "out of memory")
+
+	if err := conn.AddUser(key.Generate().Pubkey(), net.ParseIP("10.0.0.1")); err == nil || err.Error() != "out of memory" {
+		t.Errorf("AddUser returned unexpected error: %v", err)
+	}
+
+	s.Recover("IpTunnel_allowConnection")
+
+	if err := conn.AddUser(key.Generate().Pubkey(), net.ParseIP("10.0.0.1")); err != nil {
+		t.Errorf("AddUser returned unexpected error: %v", err)
+	}
+}
+
+// TestAddPrefix checks if a prefix is allowed with its length, and if errors from cjdns are returned.
+func TestAddPrefix(t *testing.T) {
+	s, conn := mustServe(t, adminPassword)
+	defer s.Close()
+
+	pubkey := key.Generate().Pubkey()
+	if err := conn.AddPrefix(pubkey, net.ParseIP("fd00:0:0:1::"), 64); err != nil {
+		t.Fatalf("AddPrefix returned unexpected error: %v", err)
+	}
+
+	tunnels := s.Tunnels()
+	if len(tunnels) != 1 || !pubkey.Equal(tunnels[0].Key) || !tunnels[0].IPs[0].Equal(net.ParseIP("fd00:0:0:1::")) || tunnels[0].Alloc != 64 {
+		t.Errorf("AddPrefix allowed unexpected tunnels: %v", tunnels)
+	}
+
+	s.Fail("IpTunnel_allowConnection", "out of memory")
+
+	if err := conn.AddPrefix(pubkey, net.ParseIP("fd00:0:0:2::"), 64); err == nil || err.Error() != "out of memory" {
+		t.Errorf("AddPrefix returned unexpected error: %v", err)
+	}
+}
@@ -1 +1,43 @@
 package cjdns_test
+
+import (
+	"testing"
+
+	"github.com/willeponken/go-cjdns/key"
+)
+
+// TestLookupPubKey checks if the public key is found for nodes in the node store, and that unknown nodes return an error.
+func TestLookupPubKey(t *testing.T) {
+	s, conn := mustServe(t, adminPassword)
+	defer s.Close()
+
+	known := key.Generate().Pubkey()
+	unknown := key.Generate().Pubkey()
+	s.AddNode(known)
+
+	var lookupTests = []struct {
+		ip  string
+		key string
+		err bool
+	}{
+		{known.IP().String(), known.String(), false},
+		{unknown.IP().String(), "", true},
+		{"not-an-ip", "", true},
+	}
+
+	for row, test := range lookupTests {
+		k, err := conn.LookupPubKey(test.ip)
+
+		if k != test.key {
+			t.Errorf("Row: %d returned unexpected key, got: %s, wanted: %s", row, k, test.key)
+		}
+
+		if err != nil && !test.err {
+			t.Errorf("Row: %d returned unexpected error: %v", row, err)
+		}
+
+		if err == nil && test.err {
+			t.Errorf("Row: %d expected error but got %v", row, err)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package cjdns
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/willeponken/go-cjdns/key"
+)
+
+// Call holds a recorded call to a method that changes the IP tunnel.
+type Call struct {
+	Method string
+	Key    *key.Public
+	IP     net.IP
+	Alloc  int
+	Index  int
+}
+
+// String formats the call, e.g. "AddUser <key> <ip>" or "AddPrefix <key> <ip>/<alloc>".
+func (c Call) String() string {
+	switch c.Method {
+	case "AddUser":
+		return fmt.Sprintf("%s %s %s", c.Method, c.Key, c.IP)
+	case "AddPrefix":
+		return fmt.Sprintf("%s %s %s/%d", c.Method, c.Key, c.IP, c.Alloc)
+	case "DelUser":
+		return fmt.Sprintf("%s %s", c.Method, c.Key)
+	default:
+		return fmt.Sprintf("%s %d", c.Method, c.Index)
+	}
+}
+
+// Recorder is an in-memory Admin that records every call that changes the IP tunnel.
+// Without a backend it holds its own node store and IP tunnel, which makes it usable as a mock in tests.
+// With a backend, lookups are passed on and the IP tunnel starts as a copy of the backend's, but changes are only recorded. This makes it usable for dry-runs.
+type Recorder struct {
+	backend Admin
+
+	mu        sync.Mutex
+	nodes     map[string]string
+	tunnels   []Tunnel
+	loaded    bool
+	nextIndex int
+	calls     []Call
+}
+
+var _ Admin = (*Recorder)(nil)
+
+// NewRecorder returns a new recorder, backend may be nil.
+func NewRecorder(backend Admin) *Recorder {
+	return &Recorder{
+		backend: backend,
+		nodes:   make(map[string]string),
+		loaded:  backend == nil,
+	}
+}
+
+// AddNode adds a node to the recorder's node store, the cjdns IPv6 address is derived from the public key.
+func (r *Recorder) AddNode(publicKey *key.Public) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.nodes[publicKey.IP().String()] = publicKey.String()
+}
+
+// Calls returns every recorded call in order.
+func (r *Recorder) Calls() []Call {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]Call(nil), r.calls...)
+}
+
+// load copies the IP tunnel from the backend the first time it is needed, the lock has to be held.
+func (r *Recorder) load() error {
+	if r.loaded {
+		return nil
+	}
+
+	tunnels, err := r.backend.ListTunnels()
+	if err != nil {
+		return err
+	}
+
+	r.tunnels = tunnels
+	for _, tunnel := range tunnels {
+		if tunnel.Index >= r.nextIndex {
+			r.nextIndex = tunnel.Index + 1
+		}
+	}
+
+	r.loaded = true
+	return nil
+}
+
+// AddUser records the call and allows the IP tunnel connection in memory.
+func (r *Recorder) AddUser(publicKey *key.Public, ip net.IP) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.load(); err != nil {
+		return err
+	}
+
+	r.calls = append(r.calls, Call{Method: "AddUser", Key: publicKey, IP: ip})
+	r.tunnels = append(r.tunnels, Tunnel{Index: r.nextIndex, Key: publicKey, IPs: []net.IP{ip}})
+	r.nextIndex++
+
+	return nil
+}
+
+// AddPrefix records the call and allows the IP tunnel connection with the prefix in memory.
+func (r *Recorder) AddPrefix(publicKey *key.Public, ip net.IP, alloc int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.load(); err != nil {
+		return err
+	}
+
+	r.calls = append(r.calls, Call{Method: "AddPrefix", Key: publicKey, IP: ip, Alloc: alloc})
+	r.tunnels = append(r.tunnels, Tunnel{Index: r.nextIndex, Key: publicKey, IPs: []net.IP{ip}, Alloc: alloc})
+	r.nextIndex++
+
+	return nil
+}
+
+// DelUser records the call and removes every IP tunnel connection for the public key in memory.
+func (r *Recorder) DelUser(publicKey *key.Public) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.load(); err != nil {
+		return err
+	}
+
+	r.calls = append(r.calls, Call{Method: "DelUser", Key: publicKey})
+
+	var tunnels []Tunnel
+	for _, tunnel := range r.tunnels {
+		if !publicKey.Equal(tunnel.Key) {
+			tunnels = append(tunnels, tunnel)
+		}
+	}
+	r.tunnels = tunnels
+
+	return nil
+}
+
+// LookupPubKey finds the public key in the recorder's node store, or in the backend's if there is one.
+func (r *Recorder) LookupPubKey(ip string) (key string, err error) {
+	if r.backend != nil {
+		return r.backend.LookupPubKey(ip)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		err = fmt.Errorf("Unable to parse IP: %s", ip)
+		return
+	}
+
+	key, ok := r.nodes[parsed.String()]
+	if !ok {
+		err = errors.New("Node not in local routing table")
+	}
+
+	return
+}
+
+// ListTunnels returns the IP tunnel connections in memory.
+func (r *Recorder) ListTunnels() (tunnels []Tunnel, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err = r.load(); err != nil {
+		return
+	}
+
+	tunnels = append(tunnels, r.tunnels...)
+	return
+}
+
+// RemoveTunnel records the call and removes the IP tunnel connection in memory.
+func (r *Recorder) RemoveTunnel(index int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.load(); err != nil {
+		return err
+	}
+
+	for i, tunnel := range r.tunnels {
+		if tunnel.Index == index {
+			r.calls = append(r.calls, Call{Method: "RemoveTunnel", Index: index})
+			r.tunnels = append(r.tunnels[:i], r.tunnels[i+1:]...)
+
+			return nil
+		}
+	}
+
+	return fmt.Errorf("No IP tunnel connection with index: %d", index)
+}
@@ -0,0 +1,102 @@
+package cjdns_test
+
+import (
+	"net"
+	"testing"
+
+	"github.com/willeponken/elvisp/cjdns"
+	"github.com/willeponken/go-cjdns/key"
+)
+
+// TestRecorder checks if calls are recorded and applied to the in-memory IP tunnel.
+func TestRecorder(t *testing.T) {
+	r := cjdns.NewRecorder(nil)
+
+	a := key.Generate().Pubkey()
+	b := key.Generate().Pubkey()
+
+	r.AddUser(a, net.ParseIP("10.0.0.1"))
+	r.AddUser(b, net.ParseIP("10.0.0.2"))
+	r.AddUser(a, net.ParseIP("fd00::1"))
+	r.AddPrefix(a, net.ParseIP("fd00:0:0:1::"), 64)
+	r.DelUser(a)
+
+	if err := r.RemoveTunnel(0); err == nil {
+		t.Errorf("RemoveTunnel expected error but got %v", err)
+	}
+
+	if err := r.RemoveTunnel(1); err != nil {
+		t.Errorf("RemoveTunnel returned unexpected error: %v", err)
+	}
+
+	expected := []string{
+		"AddUser " + a.String() + " 10.0.0.1",
+		"AddUser " + b.String() + " 10.0.0.2",
+		"AddUser " + a.String() + " fd00::1",
+		"AddPrefix " + a.String() + " fd00:0:0:1::/64",
+		"DelUser " + a.String(),
+		"RemoveTunnel 1",
+	}
+
+	calls := r.Calls()
+	if len(calls) != len(expected) {
+		t.Fatalf("Calls returned unexpected calls: %v", calls)
+	}
+
+	for row, call := range calls {
+		if call.String() != expected[row] {
+			t.Errorf("Row: %d returned unexpected call, got: %s, wanted: %s", row, call, expected[row])
+		}
+	}
+
+	if tunnels, _ := r.ListTunnels(); len(tunnels) != 0 {
+		t.Errorf("ListTunnels returned unexpected tunnels: %v", tunnels)
+	}
+}
+
+// TestRecorder_LookupPubKey checks if nodes are found in the recorder's node store.
+func TestRecorder_LookupPubKey(t *testing.T) {
+	r := cjdns.NewRecorder(nil)
+
+	known := key.Generate().Pubkey()
+	r.AddNode(known)
+
+	if k, err := r.LookupPubKey(known.IP().String()); err != nil || k != known.String() {
+		t.Errorf("LookupPubKey returned unexpected key: %s, error: %v", k, err)
+	}
+
+	if _, err := r.LookupPubKey(key.Generate().Pubkey().IP().String()); err == nil {
+		t.Errorf("LookupPubKey expected error but got %v", err)
+	}
+}
+
+// TestRecorder_backend checks if a recorder on top of cjdns admin leaves cjdns untouched, but lists its tunnels and nodes.
+func TestRecorder_backend(t *testing.T) {
+	s, conn := mustServe(t, adminPassword)
+	defer s.Close()
+
+	node := key.Generate().Pubkey()
+	s.AddNode(node)
+	index := s.AddTunnel(cjdns.Tunnel{Key: node, IPs: []net.IP{net.ParseIP("10.0.0.1")}})
+
+	r := cjdns.NewRecorder(conn)
+
+	if k, err := r.LookupPubKey(node.IP().String()); err != nil || k != node.String() {
+		t.Errorf("LookupPubKey returned unexpected key: %s, error: %v", k, err)
+	}
+
+	if err := r.RemoveTunnel(index); err != nil {
+		t.Errorf("RemoveTunnel returned unexpected error: %v", err)
+	}
+
+	r.AddUser(node, net.ParseIP("10.0.0.2"))
+
+	tunnels, err := r.ListTunnels()
+	if err != nil || len(tunnels) != 1 || tunnels[0].Index == index {
+		t.Errorf("ListTunnels returned unexpected tunnels: %v, error: %v", tunnels, err)
+	}
+
+	if tunnels = s.Tunnels(); len(tunnels) != 1 || tunnels[0].Index != index {
+		t.Errorf("Recorder changed tunnels in cjdns: %v", tunnels)
+	}
+}
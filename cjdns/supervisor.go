@@ -0,0 +1,238 @@
+package cjdns
+
+import (
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/willeponken/go-cjdns/key"
+)
+
+// ErrUnavailable is returned by a Supervisor while cjdns admin does not answer.
+var ErrUnavailable = errors.New("cjdns admin is unavailable")
+
+// minBackoff is the time to wait after the first failed attempt to reconnect to cjdns admin, it is doubled for every failed attempt.
+const minBackoff = time.Second
+
+// Pinger is an Admin that can check that cjdns admin answers.
+type Pinger interface {
+	Admin
+	// Ping returns an error if cjdns admin does not answer an authenticated ping.
+	Ping() error
+}
+
+var _ Pinger = (*Conn)(nil)
+
+// Ping sends an authenticated ping to cjdns admin over a separate connection, so it times out if cjdns does not answer and fails
+// if the password is refused. go-cjdns does neither.
+func (c *Conn) Ping() error {
+	return c.call("ping", map[string]interface{}{})
+}
+
+// Supervisor is an Admin that pings cjdns admin every interval and reconnects when it stops answering, for example when cjdroute
+// restarts. While cjdns admin is unavailable, every call fails with ErrUnavailable instead of waiting for an answer.
+type Supervisor struct {
+	dial       func() (Pinger, error)
+	interval   time.Duration
+	maxBackoff time.Duration
+
+	mu    sync.RWMutex
+	admin Pinger
+	err   error
+}
+
+var _ Admin = (*Supervisor)(nil)
+
+// NewSupervisor connects to cjdns admin using dial, cjdns admin does not have to answer yet. It is pinged every interval once Run is
+// called, and reconnected with a backoff that doubles up to maxBackoff, or up to interval if maxBackoff is not positive.
+func NewSupervisor(dial func() (Pinger, error), interval, maxBackoff time.Duration) (s *Supervisor, err error) {
+	if maxBackoff <= 0 {
+		maxBackoff = interval
+	}
+
+	admin, err := dial()
+	if err != nil {
+		return
+	}
+
+	s = &Supervisor{dial: dial, interval: interval, maxBackoff: maxBackoff, admin: admin}
+
+	if err = admin.Ping(); err != nil {
+		log.Printf("cjdns admin is unavailable, due to error: %s", err)
+		s.err = err
+	}
+
+	return s, nil
+}
+
+// Available returns nil if cjdns admin answered the last ping, otherwise the error that made it unavailable.
+func (s *Supervisor) Available() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.err
+}
+
+// current returns the connection to cjdns admin, or ErrUnavailable.
+func (s *Supervisor) current() (Pinger, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.err != nil {
+		return nil, ErrUnavailable
+	}
+
+	return s.admin, nil
+}
+
+// set replaces the connection and the error from the last ping.
+func (s *Supervisor) set(admin Pinger, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.admin = admin
+	s.err = err
+}
+
+// reconnect pings cjdns admin on the current connection until it answers, waiting longer after every failed attempt, and only then
+// dials a new connection. It returns false if quit is closed first.
+func (s *Supervisor) reconnect(quit <-chan struct{}) bool {
+	s.mu.RLock()
+	current := s.admin
+	s.mu.RUnlock()
+
+	backoff := minBackoff
+	if backoff > s.maxBackoff {
+		backoff = s.maxBackoff
+	}
+
+	for {
+		// go-cjdns can not close a connection without its reader spinning, so the previous connection is left open. Probing
+		// first keeps that to one connection per outage, instead of one per attempt.
+		err := current.Ping()
+		if err == nil {
+			var admin Pinger
+			if admin, err = s.dial(); err == nil {
+				err = admin.Ping()
+			}
+
+			if err == nil {
+				s.set(admin, nil)
+				return true
+			}
+		}
+
+		log.Printf("Unable to reconnect to cjdns admin, retrying in: %s, due to error: %s", backoff, err)
+
+		select {
+		case <-time.After(backoff):
+		case <-quit:
+			return false
+		}
+
+		if backoff *= 2; backoff > s.maxBackoff {
+			backoff = s.maxBackoff
+		}
+	}
+}
+
+// Run pings cjdns admin every interval, until quit is closed. If it does not answer, it is reconnected and reconnected is called once
+// it answers again, so the IP tunnel can be provisioned again.
+func (s *Supervisor) Run(quit <-chan struct{}, reconnected func()) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-quit:
+			return
+		}
+
+		s.mu.RLock()
+		admin, unavailable := s.admin, s.err != nil
+		s.mu.RUnlock()
+
+		if !unavailable {
+			err := admin.Ping()
+			if err == nil {
+				continue
+			}
+
+			log.Printf("cjdns admin is unavailable, due to error: %s", err)
+			s.set(admin, err)
+		}
+
+		if !s.reconnect(quit) {
+			return
+		}
+
+		log.Printf("Reconnected to cjdns admin")
+
+		if reconnected != nil {
+			reconnected()
+		}
+	}
+}
+
+// AddUser allows a new IP tunnel connection, see Admin.
+func (s *Supervisor) AddUser(publicKey *key.Public, ip net.IP) error {
+	admin, err := s.current()
+	if err != nil {
+		return err
+	}
+
+	return admin.AddUser(publicKey, ip)
+}
+
+// AddPrefix allows a new IP tunnel connection for an IPv6 prefix, see Admin.
+func (s *Supervisor) AddPrefix(publicKey *key.Public, ip net.IP, alloc int) error {
+	admin, err := s.current()
+	if err != nil {
+		return err
+	}
+
+	return admin.AddPrefix(publicKey, ip, alloc)
+}
+
+// DelUser removes every IP tunnel connection for the public key, see Admin.
+func (s *Supervisor) DelUser(publicKey *key.Public) error {
+	admin, err := s.current()
+	if err != nil {
+		return err
+	}
+
+	return admin.DelUser(publicKey)
+}
+
+// LookupPubKey finds the public key for a cjdns IPv6 address, see Admin.
+func (s *Supervisor) LookupPubKey(ip string) (key string, err error) {
+	admin, err := s.current()
+	if err != nil {
+		return
+	}
+
+	return admin.LookupPubKey(ip)
+}
+
+// ListTunnels returns every IP tunnel connection, see Admin.
+func (s *Supervisor) ListTunnels() (tunnels []Tunnel, err error) {
+	admin, err := s.current()
+	if err != nil {
+		return
+	}
+
+	return admin.ListTunnels()
+}
+
+// RemoveTunnel removes the IP tunnel connection with the index, see Admin.
+func (s *Supervisor) RemoveTunnel(index int) error {
+	admin, err := s.current()
+	if err != nil {
+		return err
+	}
+
+	return admin.RemoveTunnel(index)
+}
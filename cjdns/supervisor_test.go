@@ -0,0 +1,115 @@
+package cjdns_test
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/willeponken/elvisp/cjdns"
+	"github.com/willeponken/go-cjdns/key"
+)
+
+func TestConn_Ping(t *testing.T) {
+	var pingTests = []struct {
+		password string
+		fail     bool
+		err      bool
+	}{
+		{adminPassword, false, false},
+		{"wrong-password", false, true},
+		{adminPassword, true, true},
+	}
+
+	for row, test := range pingTests {
+		s, conn := mustServe(t, test.password)
+		if test.fail {
+			s.Fail("ping", "down")
+		}
+
+		err := conn.Ping()
+
+		if err != nil && !test.err {
+			t.Errorf("Row: %d returned unexpected error: %v", row, err)
+		}
+
+		if err == nil && test.err {
+			t.Errorf("Row: %d expected error but got %v", row, err)
+		}
+
+		s.Close()
+	}
+}
+
+// waitFor polls cond until it is true, or fails the test after a few seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// TestSupervisor checks that calls fail with ErrUnavailable while cjdns admin does not answer pings, and that the supervisor
+// reconnects once it answers again, dialing only once for the outage.
+func TestSupervisor(t *testing.T) {
+	s, _ := mustServe(t, adminPassword)
+	defer s.Close()
+
+	var dials int32
+	dial := func() (cjdns.Pinger, error) {
+		atomic.AddInt32(&dials, 1)
+		return cjdns.Connect(s.Addr, s.Port, adminPassword)
+	}
+
+	sup, err := cjdns.NewSupervisor(dial, 10*time.Millisecond, 20*time.Millisecond)
+	if err != nil {
+		t.Fatalf("NewSupervisor returned unexpected error: %v", err)
+	}
+
+	if err = sup.Available(); err != nil {
+		t.Errorf("Available returned unexpected error: %v", err)
+	}
+
+	quit := make(chan struct{})
+	defer close(quit)
+
+	reconnected := make(chan struct{}, 1)
+	go sup.Run(quit, func() { reconnected <- struct{}{} })
+
+	s.Fail("ping", "down")
+	waitFor(t, "cjdns admin to be unavailable", func() bool { return sup.Available() != nil })
+
+	if _, err = sup.ListTunnels(); err != cjdns.ErrUnavailable {
+		t.Errorf("ListTunnels returned unexpected error, got: %v, wanted: %v", err, cjdns.ErrUnavailable)
+	}
+
+	pubkey := key.Generate().Pubkey()
+	if err = sup.AddUser(pubkey, pubkey.IP()); err != cjdns.ErrUnavailable {
+		t.Errorf("AddUser returned unexpected error, got: %v, wanted: %v", err, cjdns.ErrUnavailable)
+	}
+
+	// Several attempts to reconnect fail in the meantime.
+	time.Sleep(100 * time.Millisecond)
+	s.Recover("ping")
+
+	select {
+	case <-reconnected:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Supervisor did not reconnect")
+	}
+
+	if err = sup.Available(); err != nil {
+		t.Errorf("Available returned unexpected error after reconnecting: %v", err)
+	}
+
+	if _, err = sup.ListTunnels(); err != nil {
+		t.Errorf("ListTunnels returned unexpected error after reconnecting: %v", err)
+	}
+
+	if n := atomic.LoadInt32(&dials); n != 2 {
+		t.Errorf("Supervisor dialed unexpected number of times, got: %d, wanted: 2", n)
+	}
+}
@@ -1,33 +1,112 @@
 package main
 
 import (
+	"errors"
 	"flag"
-	"log"
+	"io/ioutil"
+	"strings"
+)
+
+// The environment variables that the secrets are read from, if neither the flag nor the file is given.
+const (
+	envPassword   = "ELVISPC_PASSWORD"
+	envPrivateKey = "ELVISPC_PRIVATE_KEY"
 )
 
 type flags struct {
-	leaseTask, removeTask bool
-	serverAddr            string
+	leaseTask, removeTask, releaseTask, renewTask bool
+	serverAddr, ip, password, privateKey, pool    string
+	passwordFile, privateKeyFile                  string
 }
 
 var context = flags{
-	leaseTask:  false,
-	removeTask: false,
-	serverAddr: "",
+	leaseTask:   false,
+	removeTask:  false,
+	releaseTask: false,
+	renewTask:   false,
+	serverAddr:  "",
 }
 
 func init() {
 	flag.BoolVar(&context.leaseTask, "l", context.leaseTask, "Request lease.")
 	flag.BoolVar(&context.removeTask, "r", context.removeTask, "Remove client.")
+	flag.BoolVar(&context.releaseTask, "release", context.releaseTask, "Release lease, but keep the client's addresses reserved.")
+	flag.BoolVar(&context.renewTask, "renew", context.renewTask, "Renew lease.")
 	flag.StringVar(&context.serverAddr, "a", context.serverAddr, "Address for server.")
+	flag.StringVar(&context.ip, "ip", context.ip, "Run the task for another node with this cjdns IPv6 address, as admin.")
+	flag.StringVar(&context.password, "password", context.password, "Password for admin, needed with -ip. Discouraged, as other users can read the command line, use -password-file or "+envPassword+" instead.")
+	flag.StringVar(&context.passwordFile, "password-file", context.passwordFile, "File to read the password for admin from, instead of -password.")
+	flag.StringVar(&context.pool, "pool", context.pool, "Pool to lease from, the server decides if it is empty. Only used with -l.")
+	flag.StringVar(&context.privateKey, "private-key", context.privateKey, "Private cjdns key for the node, used to prove the client's identity instead of a node store lookup. Discouraged, as other users can read the command line, use -private-key-file or "+envPrivateKey+" instead.")
+	flag.StringVar(&context.privateKeyFile, "private-key-file", context.privateKeyFile, "File to read the private cjdns key for the node from, instead of -private-key.")
+}
+
+// readSecret returns the secret given as a flag, else read from file, else from the environment variable env. Surrounding white space
+// in the file is ignored, so it may end with a newline.
+func readSecret(value, file, env string, getenv func(string) string) (secret string, err error) {
+	if value != "" && file != "" {
+		err = errors.New("A secret can not be given both as a flag and as a file")
+		return
+	}
+
+	if value != "" {
+		return value, nil
+	}
+
+	if file == "" {
+		return getenv(env), nil
+	}
+
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return
+	}
 
-	flag.Parse()
+	return strings.TrimSpace(string(b)), nil
+}
+
+// withSecrets returns the flags with the password and the private key read from their files, or environment variables, unless
+// they were given as flags.
+func (f flags) withSecrets(getenv func(string) string) (flags, error) {
+	var err error
+
+	if f.password, err = readSecret(f.password, f.passwordFile, envPassword, getenv); err != nil {
+		return f, err
+	}
+
+	f.privateKey, err = readSecret(f.privateKey, f.privateKeyFile, envPrivateKey, getenv)
+	return f, err
+}
 
-	if context.serverAddr == "" {
-		log.Fatal("No server address defined")
+// command returns the command to send to the server for the defined task.
+func (f flags) command() (cmd string, err error) {
+	if f.serverAddr == "" {
+		err = errors.New("No server address defined")
+		return
 	}
 
-	if !context.leaseTask && !context.removeTask {
-		log.Fatal("No task defined")
+	if f.ip != "" && f.password == "" {
+		err = errors.New("No password defined for admin")
+		return
 	}
+
+	if f.pool != "" && !f.leaseTask {
+		err = errors.New("A pool can only be defined for a lease")
+		return
+	}
+
+	switch {
+	case f.leaseTask:
+		cmd = "lease"
+	case f.removeTask:
+		cmd = "remove"
+	case f.releaseTask:
+		cmd = "release"
+	case f.renewTask:
+		cmd = "renew"
+	default:
+		err = errors.New("No task defined")
+	}
+
+	return
 }
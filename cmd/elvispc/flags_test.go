@@ -0,0 +1,90 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFlags_command(t *testing.T) {
+	var commandTests = []struct {
+		flags flags
+		cmd   string
+		err   bool
+	}{
+		{flags{leaseTask: true, serverAddr: "[::1]:4132"}, "lease", false},
+		{flags{removeTask: true, serverAddr: "[::1]:4132"}, "remove", false},
+		{flags{releaseTask: true, serverAddr: "[::1]:4132"}, "release", false},
+		{flags{renewTask: true, serverAddr: "[::1]:4132"}, "renew", false},
+		{flags{serverAddr: "[::1]:4132"}, "", true},
+		{flags{leaseTask: true}, "", true},
+		{flags{leaseTask: true, serverAddr: "[::1]:4132", ip: "fc00::1", password: "secret"}, "lease", false},
+		{flags{leaseTask: true, serverAddr: "[::1]:4132", ip: "fc00::1"}, "", true},
+		{flags{leaseTask: true, serverAddr: "[::1]:4132", pool: "guests"}, "lease", false},
+		{flags{renewTask: true, serverAddr: "[::1]:4132", pool: "guests"}, "", true},
+	}
+
+	for row, test := range commandTests {
+		cmd, err := test.flags.command()
+
+		if cmd != test.cmd {
+			t.Errorf("Row: %d returned unexpected command, got: %s, wanted: %s", row, cmd, test.cmd)
+		}
+
+		if err != nil && !test.err {
+			t.Errorf("Row: %d returned unexpected error: %v", row, err)
+		}
+
+		if err == nil && test.err {
+			t.Errorf("Row: %d expected error but got %v", row, err)
+		}
+	}
+}
+
+func TestFlags_withSecrets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "elvispc-")
+	if err != nil {
+		t.Fatalf("TempDir returned unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "secret")
+	if err = ioutil.WriteFile(file, []byte("from-file\n"), 0600); err != nil {
+		t.Fatalf("WriteFile returned unexpected error: %v", err)
+	}
+
+	env := map[string]string{envPassword: "password-from-env", envPrivateKey: "key-from-env"}
+	getenv := func(name string) string { return env[name] }
+
+	var secretTests = []struct {
+		flags      flags
+		password   string
+		privateKey string
+		err        bool
+	}{
+		{flags{password: "secret", privateKey: "key"}, "secret", "key", false},
+		{flags{passwordFile: file, privateKeyFile: file}, "from-file", "from-file", false},
+		{flags{}, "password-from-env", "key-from-env", false},
+		{flags{password: "secret", passwordFile: file}, "", "", true},
+		{flags{privateKey: "key", privateKeyFile: file}, "", "", true},
+		{flags{passwordFile: filepath.Join(dir, "missing")}, "", "", true},
+	}
+
+	for row, test := range secretTests {
+		f, err := test.flags.withSecrets(getenv)
+
+		if err != nil && !test.err {
+			t.Errorf("Row: %d returned unexpected error: %v", row, err)
+		}
+
+		if err == nil && test.err {
+			t.Errorf("Row: %d expected error but got %v", row, err)
+		}
+
+		if err == nil && (f.password != test.password || f.privateKey != test.privateKey) {
+			t.Errorf("Row: %d returned unexpected secrets, got: %q and %q, wanted: %q and %q", row, f.password, f.privateKey, test.password,
+				test.privateKey)
+		}
+	}
+}
@@ -2,12 +2,54 @@ package main
 
 import (
 	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
 	"log"
 	"net"
 	"os"
 	"strings"
+	"time"
+
+	"github.com/willeponken/elvisp/auth"
+	"github.com/willeponken/go-cjdns/key"
 )
 
+// address holds a leased address in a response.
+type address struct {
+	Address      string `json:"address"`
+	PrefixLength int    `json:"prefix_length"`
+	Delegated    bool   `json:"delegated"`
+}
+
+// response holds a protocol v3 response.
+type response struct {
+	ID     int    `json:"id"`
+	Status string `json:"status"`
+	Result *struct {
+		Message   string     `json:"message"`
+		Key       string     `json:"key"`
+		ServerKey string     `json:"server_key"`
+		Pool      string     `json:"pool"`
+		IPv4      []address  `json:"ipv4"`
+		IPv6      []address  `json:"ipv6"`
+		Expires   *time.Time `json:"expires"`
+		Challenge *struct {
+			Salt       string `json:"salt"`
+			Iterations int    `json:"iterations"`
+			Key        string `json:"key"`
+			Nonce      string `json:"nonce"`
+		} `json:"challenge"`
+		Signature string `json:"signature"`
+	} `json:"result"`
+	Error *struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
 func connect(addr string) (conn net.Conn, err error) {
 	tcpAddr, err := net.ResolveTCPAddr("tcp6", addr)
 	if err != nil {
@@ -17,44 +59,221 @@ func connect(addr string) (conn net.Conn, err error) {
 	return net.DialTCP("tcp", nil, tcpAddr)
 }
 
-func sendCmd(conn net.Conn, cmd string) (resp string, err error) {
+func readLine(r *bufio.Reader) (line string, err error) {
+	l, err := r.ReadString('\n')
+	if err != nil {
+		return
+	}
+
+	line = strings.TrimSpace(l)
+	return
+}
+
+func sendCmd(conn net.Conn, r *bufio.Reader, cmd string) (resp string, err error) {
 	_, err = conn.Write([]byte(cmd + "\n"))
 	if err != nil {
 		return
 	}
 
-	r, err := bufio.NewReader(conn).ReadString('\n')
+	return readLine(r)
+}
+
+// negotiate reads the server info sent on connect and switches the session to protocol v3.
+func negotiate(conn net.Conn, r *bufio.Reader) (err error) {
+	if _, err = readLine(r); err != nil {
+		return
+	}
+
+	resp, err := sendCmd(conn, r, "version 3")
+	if err != nil {
+		return
+	}
+
+	if resp != "success 3" {
+		err = fmt.Errorf("Server does not support protocol v3: %s", resp)
+	}
+
+	return
+}
+
+// request holds a protocol v3 request.
+type request struct {
+	ID      int      `json:"id"`
+	Command string   `json:"command"`
+	Args    []string `json:"args,omitempty"`
+	IP      string   `json:"ip,omitempty"`
+	Proof   string   `json:"proof,omitempty"`
+	Key     string   `json:"key,omitempty"`
+}
+
+// sendTask sends a task as a protocol v3 request and decodes the response.
+func sendTask(conn net.Conn, r *bufio.Reader, task request) (resp response, err error) {
+	req, err := json.Marshal(task)
+	if err != nil {
+		return
+	}
+
+	line, err := sendCmd(conn, r, string(req))
+	if err != nil {
+		return
+	}
+
+	if err = json.Unmarshal([]byte(line), &resp); err != nil {
+		return
+	}
+
+	if resp.Error != nil {
+		err = fmt.Errorf("%s (%s)", resp.Error.Message, resp.Error.Code)
+	} else if resp.Result == nil {
+		err = errors.New("Server returned an empty result")
+	}
+
+	return
+}
+
+// authenticate upgrades the session to admin, by a client proof for the challenge from the server using the key derived from password.
+// The server's signature for the challenge is checked, so a server that does not hold the keys derived from password is refused.
+func authenticate(conn net.Conn, r *bufio.Reader, password string) (err error) {
+	resp, err := sendTask(conn, r, request{ID: 1, Command: "auth"})
+	if err != nil {
+		return
+	}
+
+	c := resp.Result.Challenge
+	if c == nil {
+		return errors.New("Server returned no challenge for admin authentication")
+	}
+
+	salt, err := hex.DecodeString(c.Salt)
+	if err != nil {
+		return
+	}
+
+	nonce, err := hex.DecodeString(c.Nonce)
 	if err != nil {
 		return
 	}
 
-	resp = strings.TrimSpace(string(r))
+	salted := auth.DeriveKey(password, salt, c.Iterations)
 
+	resp, err = sendTask(conn, r, request{ID: 2, Command: "auth", Proof: hex.EncodeToString(auth.ClientProof(salted, nonce))})
+	if err != nil {
+		return
+	}
+
+	_, serverKey := auth.Keys(salted)
+	if signature, _ := hex.DecodeString(resp.Result.Signature); !auth.Verify(serverKey, nonce, signature) {
+		return errors.New("Server returned an invalid signature for admin authentication")
+	}
+
+	return
+}
+
+// identify proves that the client owns the private key for its cjdns address, by signing the challenge from the server with the shared secret.
+func identify(conn net.Conn, r *bufio.Reader, privateKey string) (err error) {
+	priv, err := key.DecodePrivate(privateKey)
+	if err != nil {
+		return
+	}
+
+	pub := priv.Pubkey().String()
+
+	resp, err := sendTask(conn, r, request{ID: 1, Command: "identify", Key: pub})
+	if err != nil {
+		return
+	}
+
+	c := resp.Result.Challenge
+	if c == nil {
+		return errors.New("Server returned no challenge for identification")
+	}
+
+	ephemeral, err := key.DecodePublic(c.Key)
+	if err != nil {
+		return
+	}
+
+	nonce, err := hex.DecodeString(c.Nonce)
+	if err != nil {
+		return
+	}
+
+	proof, err := auth.KeyProof(priv, ephemeral, nonce)
+	if err != nil {
+		return
+	}
+
+	_, err = sendTask(conn, r, request{ID: 2, Command: "identify", Key: pub, Proof: hex.EncodeToString(proof)})
 	return
 }
 
 func main() {
-	var err error
-	var resp string
+	flag.Parse()
+
+	f, err := context.withSecrets(os.Getenv)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	conn, err := connect(context.serverAddr)
+	cmd, err := f.command()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	conn, err := connect(f.serverAddr)
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer conn.Close()
 
-	if context.leaseTask {
-		resp, err = sendCmd(conn, "lease")
+	r := bufio.NewReader(conn)
+	if err = negotiate(conn, r); err != nil {
+		log.Fatal(err)
 	}
 
-	if context.removeTask {
-		resp, err = sendCmd(conn, "remove")
+	if f.privateKey != "" {
+		if err = identify(conn, r, f.privateKey); err != nil {
+			log.Fatal(err)
+		}
 	}
 
+	if f.ip != "" {
+		if err = authenticate(conn, r, f.password); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var args []string
+	if f.pool != "" {
+		args = append(args, f.pool)
+	}
+
+	resp, err := sendTask(conn, r, request{ID: 3, Command: cmd, Args: args, IP: f.ip})
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	log.Println(resp)
+	result := resp.Result
+	if result.Pool != "" {
+		log.Printf("Pool: %s", result.Pool)
+	}
+
+	for _, addr := range append(result.IPv4, result.IPv6...) {
+		if addr.Delegated {
+			log.Printf("Delegated prefix: %s/%d", addr.Address, addr.PrefixLength)
+			continue
+		}
+
+		log.Printf("Address: %s/%d", addr.Address, addr.PrefixLength)
+	}
+
+	if result.Expires != nil {
+		log.Printf("Expires: %s", result.Expires.Local())
+	}
+
+	if len(result.IPv4)+len(result.IPv6) == 0 {
+		log.Println(result.Message)
+	}
+
 	os.Exit(0)
 }
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/willeponken/elvisp/database"
+)
+
+// fileArg parses the flags in set from args, and returns the single file argument left.
+func fileArg(set *flag.FlagSet, args []string) (file string, err error) {
+	if err = set.Parse(args); err != nil {
+		return
+	}
+
+	if set.NArg() != 1 {
+		err = fmt.Errorf("Expected one file argument for %s, got: %v", set.Name(), set.Args())
+		return
+	}
+
+	return set.Arg(0), nil
+}
+
+// downloadBackup writes a backup of the database in use by a running elvispd, from the HTTP management API at api, to w.
+func downloadBackup(api, password string, w io.Writer) (n int64, err error) {
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(api, "/")+"/api/backup", nil)
+	if err != nil {
+		return
+	}
+	req.SetBasicAuth("admin", password)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("HTTP management API responded with: %s", resp.Status)
+		return
+	}
+
+	return io.Copy(w, resp.Body)
+}
+
+// backup writes a copy of the database given with -db to a file. With -api the database in use by a running elvispd is backed up
+// using the HTTP management API, otherwise the database may not be in use. The copy is written to a temporary file next to the
+// file, which is only replaced once the copy is complete. It is run as: elvispd [flags] backup [-api <url>] <file>
+func backup(w io.Writer, f flags, args []string) (err error) {
+	set := flag.NewFlagSet("backup", flag.ContinueOnError)
+	api := set.String("api", "", "URL for the HTTP management API of a running elvispd, the -password flag is used to authenticate.")
+
+	name, err := fileArg(set, args)
+	if err != nil {
+		return
+	}
+
+	if *api == "" && f.dbBackend != database.BackendBolt {
+		return errors.New("Only Bolt databases can be backed up without -api, use export instead")
+	}
+
+	file, err := ioutil.TempFile(filepath.Dir(name), "."+filepath.Base(name)+"-")
+	if err != nil {
+		return
+	}
+
+	var n int64
+	if *api != "" {
+		n, err = downloadBackup(*api, f.password, file)
+	} else {
+		n, err = database.BackupFile(f.db, file)
+	}
+
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+
+	if err == nil {
+		err = os.Rename(file.Name(), name)
+	}
+
+	if err != nil {
+		os.Remove(file.Name())
+		return
+	}
+
+	fmt.Fprintf(w, "Wrote backup of %d bytes to: %s\n", n, name)
+	return
+}
+
+// formatFlag adds the -format flag for exports to set.
+func formatFlag(set *flag.FlagSet) *string {
+	return set.String("format", "json", "Format of the export, json for users and admin settings, or csv for only users.")
+}
+
+// checkFormat returns an error for unknown export formats.
+func checkFormat(format string) error {
+	if format != "json" && format != "csv" {
+		return errors.New("Format has to be either json or csv")
+	}
+
+	return nil
+}
+
+// export writes every user, and the admin settings for JSON, from the database given with -db to a file.
+// It is run as: elvispd [flags] export [-format json|csv] <file>
+func export(w io.Writer, f flags, args []string) (err error) {
+	set := flag.NewFlagSet("export", flag.ContinueOnError)
+	format := formatFlag(set)
+
+	name, err := fileArg(set, args)
+	if err != nil {
+		return
+	}
+
+	if err = checkFormat(*format); err != nil {
+		return
+	}
+
+	db, err := database.OpenStore(f.dbBackend, f.db)
+	if err != nil {
+		return
+	}
+	defer db.Close()
+
+	file, err := os.Create(name)
+	if err != nil {
+		return
+	}
+
+	if *format == "csv" {
+		err = db.ExportCSV(file)
+	} else {
+		err = db.Export(file)
+	}
+
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		return
+	}
+
+	fmt.Fprintf(w, "Exported database at: %s to: %s\n", f.db, name)
+	return
+}
+
+// importFile imports users, and the admin settings for JSON, from a file into the empty database given with -db.
+// It is run as: elvispd [flags] import [-format json|csv] <file>
+func importFile(w io.Writer, f flags, args []string) (err error) {
+	set := flag.NewFlagSet("import", flag.ContinueOnError)
+	format := formatFlag(set)
+
+	name, err := fileArg(set, args)
+	if err != nil {
+		return
+	}
+
+	if err = checkFormat(*format); err != nil {
+		return
+	}
+
+	file, err := os.Open(name)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	db, err := database.OpenStore(f.dbBackend, f.db)
+	if err != nil {
+		return
+	}
+	defer db.Close()
+
+	var n int
+	if *format == "csv" {
+		n, err = db.ImportCSV(file)
+	} else {
+		n, err = db.Import(file)
+	}
+
+	if err != nil {
+		return
+	}
+
+	fmt.Fprintf(w, "Imported %d users from: %s into database at: %s\n", n, name, f.db)
+	return
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/willeponken/elvisp/database"
+	"github.com/willeponken/go-cjdns/key"
+)
+
+func TestBackup_Export_Import(t *testing.T) {
+	dir, err := ioutil.TempDir("", "elvispd-")
+	if err != nil {
+		t.Fatalf("TempDir returned unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "db")
+	db, err := database.Open(path)
+	if err != nil {
+		t.Fatalf("Open returned unexpected error: %v", err)
+	}
+
+	pubkey := key.Generate().Pubkey()
+	if _, err := db.AddUser(pubkey); err != nil {
+		t.Fatalf("AddUser returned unexpected error: %v", err)
+	}
+	db.Close()
+
+	in := func(name string) string { return filepath.Join(dir, name) }
+
+	var commandTests = []struct {
+		command  func(w io.Writer, f flags, args []string) error
+		path     string
+		args     []string
+		expected string
+		err      bool
+	}{
+		{backup, path, []string{in("backup")}, "Wrote backup of", false},
+		{backup, path, nil, "", true},
+		{backup, in("missing"), []string{in("missing-backup")}, "", true},
+		{export, in("backup"), []string{in("export.json")}, "Exported database", false},
+		{export, path, []string{"-format", "csv", in("export.csv")}, "Exported database", false},
+		{export, path, []string{"-format", "xml", in("export.xml")}, "", true},
+		{importFile, in("json"), []string{in("export.json")}, "Imported 1 users", false},
+		{importFile, in("json"), []string{in("export.json")}, "", true}, // The database is no longer empty
+		{importFile, in("csv"), []string{"-format", "csv", in("export.csv")}, "Imported 1 users", false},
+		{importFile, in("missing"), []string{in("missing.json")}, "", true},
+	}
+
+	for row, test := range commandTests {
+		var out bytes.Buffer
+		err := test.command(&out, flags{db: test.path, dbBackend: database.BackendBolt}, test.args)
+
+		if !strings.Contains(out.String(), test.expected) {
+			t.Errorf("Row: %d returned unexpected output, got: %s, wanted it to contain: %s", row, out.String(), test.expected)
+		}
+
+		if err != nil && !test.err {
+			t.Errorf("Row: %d returned unexpected error: %v", row, err)
+		}
+
+		if err == nil && test.err {
+			t.Errorf("Row: %d expected error but got %v", row, err)
+		}
+	}
+
+	for _, name := range []string{"json", "csv"} {
+		db, err := database.Open(in(name))
+		if err != nil {
+			t.Fatalf("Open returned unexpected error: %v", err)
+		}
+
+		if id, err := db.GetID(pubkey); err != nil || id != 1 {
+			t.Errorf("Import into: %s returned unexpected ID: %d, error: %v", name, id, err)
+		}
+		db.Close()
+	}
+
+	if _, err := os.Stat(in("missing-backup")); !os.IsNotExist(err) {
+		t.Errorf("Failed backup left a file behind, got error: %v", err)
+	}
+
+	if err := backup(ioutil.Discard, flags{db: path, dbBackend: database.BackendMemory}, []string{in("memory-backup")}); err == nil {
+		t.Errorf("Backup of a memory database expected error but got %v", err)
+	}
+
+	if _, err := os.Stat(in("memory-backup")); !os.IsNotExist(err) {
+		t.Errorf("Backup of a memory database created a file, got error: %v", err)
+	}
+
+	// A failed backup leaves the previous backup in place, and no temporary files.
+	previous, _ := ioutil.ReadFile(in("backup"))
+	if err := backup(ioutil.Discard, flags{db: in("missing"), dbBackend: database.BackendBolt}, []string{in("backup")}); err == nil {
+		t.Errorf("Backup of a missing database expected error but got %v", err)
+	}
+
+	if b, err := ioutil.ReadFile(in("backup")); err != nil || !bytes.Equal(b, previous) {
+		t.Errorf("Failed backup replaced the previous backup, got error: %v", err)
+	}
+
+	if temp, _ := filepath.Glob(in(".*")); len(temp) != 0 {
+		t.Errorf("Failed backup left temporary files behind: %v", temp)
+	}
+}
+
+func TestDownloadBackup(t *testing.T) {
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, password, _ := r.BasicAuth(); password != "secret" || r.URL.Path != "/api/backup" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		w.Write([]byte("backup"))
+	}))
+	defer api.Close()
+
+	var downloadTests = []struct {
+		password string
+		expected string
+		err      bool
+	}{
+		{"secret", "backup", false},
+		{"wrong", "", true},
+	}
+
+	for row, test := range downloadTests {
+		var out bytes.Buffer
+		_, err := downloadBackup(api.URL+"/", test.password, &out)
+
+		if out.String() != test.expected {
+			t.Errorf("Row: %d returned unexpected backup, got: %s, wanted: %s", row, out.String(), test.expected)
+		}
+
+		if err != nil && !test.err {
+			t.Errorf("Row: %d returned unexpected error: %v", row, err)
+		}
+
+		if err == nil && test.err {
+			t.Errorf("Row: %d expected error but got %v", row, err)
+		}
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/willeponken/elvisp/database"
+)
+
+// duration is a time.Duration written as a string in the config file, such as "1m30s".
+type duration time.Duration
+
+// UnmarshalJSON parses a duration string
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var str string
+	if err := json.Unmarshal(data, &str); err != nil {
+		return fmt.Errorf("Invalid duration: %s, expected a string such as \"1m30s\"", data)
+	}
+
+	parsed, err := time.ParseDuration(str)
+	if err != nil {
+		return fmt.Errorf("Invalid duration: %q", str)
+	}
+
+	if parsed < 0 {
+		return fmt.Errorf("Invalid duration: %q, it can not be negative", str)
+	}
+
+	*d = duration(parsed)
+	return nil
+}
+
+// secret is a string in the config file that is either written as is, or read from a file or an environment variable, written as
+// {"file": "<path>"} or {"env": "<name>"}, so it does not have to be kept in the config file. Trailing newlines are trimmed from files.
+type secret string
+
+// UnmarshalJSON reads the secret as is, from a file or from an environment variable
+func (s *secret) UnmarshalJSON(data []byte) error {
+	var str string
+	if err := json.Unmarshal(data, &str); err == nil {
+		*s = secret(str)
+		return nil
+	}
+
+	var from struct {
+		File string `json:"file"`
+		Env  string `json:"env"`
+	}
+	if err := json.Unmarshal(data, &from); err != nil || (from.File == "") == (from.Env == "") {
+		return fmt.Errorf("Invalid secret: %s, expected a string, {\"file\": \"<path>\"} or {\"env\": \"<name>\"}", data)
+	}
+
+	if from.Env != "" {
+		value, ok := os.LookupEnv(from.Env)
+		if !ok {
+			return fmt.Errorf("Environment variable: %s for secret is not set", from.Env)
+		}
+
+		*s = secret(value)
+		return nil
+	}
+
+	value, err := ioutil.ReadFile(from.File)
+	if err != nil {
+		return fmt.Errorf("Unable to read secret from file, due to error: %s", err)
+	}
+
+	*s = secret(strings.TrimRight(string(value), "\r\n"))
+	return nil
+}
+
+// config holds the settings in a config file, every setting is optional and the flag is used if it is left out. Flags given on the
+// command line always override the config file.
+type config struct {
+	Listen            string              `json:"listen"`
+	HTTPListen        string              `json:"http_listen"`
+	HTTPCert          string              `json:"http_cert"`
+	HTTPKey           string              `json:"http_key"`
+	DB                string              `json:"db"`
+	DBBackend         string              `json:"db_backend"`
+	Password          *secret             `json:"password"`
+	Cjdns             cjdnsConfig         `json:"cjdns"`
+	CIDRs             []string            `json:"cidrs"`
+	Pools             map[string][]string `json:"pools"`
+	Groups            map[string][]string `json:"groups"`
+	Policies          map[string][]string `json:"policies"`
+	Allocator         string              `json:"allocator"`
+	AllocatorKey      *secret             `json:"allocator_key"`
+	LeaseTime         *duration           `json:"lease_time"`
+	ReapInterval      *duration           `json:"reap_interval"`
+	ReconcileInterval *duration           `json:"reconcile_interval"`
+	ReconcileDryRun   *bool               `json:"reconcile_dry_run"`
+	UsageInterval     *duration           `json:"usage_interval"`
+	UsageThresholds   *[]int              `json:"usage_thresholds"`
+	ShutdownTimeout   *duration           `json:"shutdown_timeout"`
+}
+
+// cjdnsConfig holds the settings for cjdns admin in a config file.
+type cjdnsConfig struct {
+	IP           string    `json:"ip"`
+	Port         int       `json:"port"`
+	Password     *secret   `json:"password"`
+	PingInterval *duration `json:"ping_interval"`
+	MaxBackoff   *duration `json:"max_backoff"`
+}
+
+// lineColumn returns the line and column, counted from 1, for an offset in data.
+func lineColumn(data []byte, offset int64) (line, column int) {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	} else if offset < 0 {
+		offset = 0
+	}
+
+	before := data[:offset]
+	line = bytes.Count(before, []byte("\n")) + 1
+	column = len(before) - bytes.LastIndexByte(before, '\n')
+
+	return
+}
+
+// parseConfig parses a config file in JSON, unknown settings are refused so misspelled settings are not silently ignored.
+func parseConfig(data []byte) (c config, err error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+
+	if err = dec.Decode(&c); err != nil {
+		var syntax *json.SyntaxError
+		var typ *json.UnmarshalTypeError
+
+		switch {
+		case errors.As(err, &syntax):
+			// The offset is after the invalid character.
+			line, column := lineColumn(data, syntax.Offset-1)
+			err = fmt.Errorf("Invalid JSON on line: %d, column: %d: %s", line, column, syntax)
+		case errors.As(err, &typ):
+			line, column := lineColumn(data, typ.Offset)
+			err = fmt.Errorf("Invalid value for: %s on line: %d, column: %d, expected %s", typ.Field, line, column, typ.Type)
+		}
+
+		return
+	}
+
+	return c, c.check()
+}
+
+// check returns an error for settings that are invalid on their own, the pools and policies are checked by the server.
+func (c config) check() error {
+	switch c.DBBackend {
+	case "", database.BackendBolt, database.BackendSQLite, database.BackendMemory:
+	default:
+		return fmt.Errorf("Unknown db_backend: %s", c.DBBackend)
+	}
+
+	if c.Cjdns.Port < 0 || c.Cjdns.Port > 65535 {
+		return fmt.Errorf("Invalid cjdns port: %d", c.Cjdns.Port)
+	}
+
+	for name, cidrs := range c.Pools {
+		if len(cidrs) == 0 {
+			return fmt.Errorf("Pool: %s needs atleast one CIDR", name)
+		}
+	}
+
+	return nil
+}
+
+// loadConfig reads and parses the config file at path.
+func loadConfig(path string) (c config, err error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+
+	if c, err = parseConfig(data); err != nil {
+		err = fmt.Errorf("Invalid config file: %s, %s", path, err)
+	}
+
+	return
+}
+
+// apply returns the flags with the settings from the config file, except for the flags in set, which were given on the command line.
+func (c config) apply(f flags, set map[string]bool) flags {
+	str := func(name string, dst *string, value string) {
+		if !set[name] && value != "" {
+			*dst = value
+		}
+	}
+
+	dur := func(name string, dst *time.Duration, value *duration) {
+		if !set[name] && value != nil {
+			*dst = time.Duration(*value)
+		}
+	}
+
+	sec := func(name string, dst *string, value *secret) {
+		if !set[name] && value != nil {
+			*dst = string(*value)
+		}
+	}
+
+	named := func(name string, dst *namedList, values map[string][]string) {
+		if !set[name] && values != nil {
+			dst.values = values
+		}
+	}
+
+	str("listen", &f.listen, c.Listen)
+	str("http-listen", &f.httpListen, c.HTTPListen)
+	str("http-cert", &f.httpCert, c.HTTPCert)
+	str("http-key", &f.httpKey, c.HTTPKey)
+	str("db", &f.db, c.DB)
+	str("db-backend", &f.dbBackend, c.DBBackend)
+	str("cjdns-ip", &f.cjdnsIP, c.Cjdns.IP)
+	str("allocator", &f.allocator, c.Allocator)
+
+	sec("password", &f.password, c.Password)
+	sec("cjdns-password", &f.cjdnsPassword, c.Cjdns.Password)
+	sec("allocator-key", &f.allocatorKey, c.AllocatorKey)
+
+	dur("lease-time", &f.leaseTime, c.LeaseTime)
+	dur("reap-interval", &f.reapInterval, c.ReapInterval)
+	dur("reconcile-interval", &f.reconcileInterval, c.ReconcileInterval)
+	dur("usage-interval", &f.usageInterval, c.UsageInterval)
+	dur("shutdown-timeout", &f.shutdownTimeout, c.ShutdownTimeout)
+	dur("cjdns-ping-interval", &f.cjdnsPingInterval, c.Cjdns.PingInterval)
+	dur("cjdns-max-backoff", &f.cjdnsMaxBackoff, c.Cjdns.MaxBackoff)
+
+	named("pool", &f.pools, c.Pools)
+	named("group", &f.groups, c.Groups)
+	named("policy", &f.policies, c.Policies)
+
+	if !set["cjdns-port"] && c.Cjdns.Port != 0 {
+		f.cjdnsPort = c.Cjdns.Port
+	}
+
+	if !set["cidr"] && c.CIDRs != nil {
+		f.cidrList = cidrList(c.CIDRs)
+	}
+
+	if !set["reconcile-dry-run"] && c.ReconcileDryRun != nil {
+		f.reconcileDryRun = *c.ReconcileDryRun
+	}
+
+	if !set["usage-thresholds"] && c.UsageThresholds != nil {
+		f.usageThresholds = thresholdList(*c.UsageThresholds)
+	}
+
+	return f
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/willeponken/elvisp/server"
+)
+
+func TestParseConfig(t *testing.T) {
+	file, err := ioutil.TempFile("", "elvispd-secret")
+	if err != nil {
+		t.Fatalf("TempFile returned unexpected error: %v", err)
+	}
+	defer os.Remove(file.Name())
+
+	file.WriteString("from-file\n")
+	file.Close()
+
+	os.Setenv("ELVISPD_TEST_SECRET", "from-env")
+	defer os.Unsetenv("ELVISPD_TEST_SECRET")
+
+	var parseTests = []struct {
+		data string
+		err  string
+	}{
+		{`{}`, ""},
+		{`{"listen": "[::1]:4132", "cidrs": ["10.0.0.0/24"], "pools": {"guests": ["10.1.0.0/24"]}, "lease_time": "24h", "usage_thresholds": []}`, ""},
+		{`{"password": {"file": "` + file.Name() + `"}, "cjdns": {"password": {"env": "ELVISPD_TEST_SECRET"}}}`, ""},
+		{`{"lisen": ":4132"}`, `unknown field "lisen"`},
+		{"{\n  \"listen\": \":4132\"\n  \"db\": \"/tmp/db\"\n}", "line: 3, column: 3"},
+		{`{"cjdns": {"port": "11234"}}`, "Invalid value for: cjdns.port"},
+		{`{"lease_time": "1 day"}`, `Invalid duration: "1 day"`},
+		{`{"lease_time": "-1h"}`, "can not be negative"},
+		{`{"password": {"env": "ELVISPD_TEST_MISSING"}}`, "ELVISPD_TEST_MISSING for secret is not set"},
+		{`{"password": {"file": "/nope/nope"}}`, "Unable to read secret from file"},
+		{`{"password": {"file": "a", "env": "b"}}`, "Invalid secret"},
+		{`{"db_backend": "mysql"}`, "Unknown db_backend: mysql"},
+		{`{"pools": {"guests": []}}`, "Pool: guests needs atleast one CIDR"},
+		{`{"cjdns": {"max_backoff": "1 min"}}`, `Invalid duration: "1 min"`},
+	}
+
+	for row, test := range parseTests {
+		_, err := parseConfig([]byte(test.data))
+
+		if err != nil && (test.err == "" || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("Row: %d returned unexpected error: %v, wanted: %s", row, err, test.err)
+		}
+
+		if err == nil && test.err != "" {
+			t.Errorf("Row: %d expected error: %s but got %v", row, test.err, err)
+		}
+	}
+
+	c, _ := parseConfig([]byte(`{"password": {"file": "` + file.Name() + `"}, "cjdns": {"password": {"env": "ELVISPD_TEST_SECRET"}}}`))
+	if *c.Password != "from-file" || *c.Cjdns.Password != "from-env" {
+		t.Errorf("parseConfig returned unexpected secrets, got: %q and %q", *c.Password, *c.Cjdns.Password)
+	}
+}
+
+// TestConfig_apply checks that the config file replaces the default flags, but not the flags given on the command line.
+func TestConfig_apply(t *testing.T) {
+	c, err := parseConfig([]byte(`{"listen": "[::1]:4132", "db": "/var/lib/elvispd", "cidrs": ["10.0.0.0/24"],
+		"pools": {"guests": ["10.1.0.0/24"]}, "cjdns": {"port": 11235, "password": "secret", "ping_interval": "0s"}, "lease_time": "24h",
+		"reconcile_dry_run": true, "usage_thresholds": [], "shutdown_timeout": "5s"}`))
+	if err != nil {
+		t.Fatalf("parseConfig returned unexpected error: %v", err)
+	}
+
+	f := flags{listen: ":4132", db: "/tmp/elvispd-db", cidrList: cidrList{"10.2.0.0/16"}, cjdnsPort: 11234, cjdnsPingInterval: 10 * time.Second,
+		leaseTime: time.Hour, usageThresholds: thresholdList{80, 95}}
+	applied := c.apply(f, map[string]bool{"db": true, "cidr": true})
+
+	expected := f
+	expected.listen = "[::1]:4132"
+	expected.pools.values = map[string][]string{"guests": {"10.1.0.0/24"}}
+	expected.cjdnsPort = 11235
+	expected.cjdnsPassword = "secret"
+	expected.cjdnsPingInterval = 0
+	expected.leaseTime = 24 * time.Hour
+	expected.reconcileDryRun = true
+	expected.usageThresholds = thresholdList{}
+	expected.shutdownTimeout = 5 * time.Second
+
+	if !reflect.DeepEqual(applied, expected) {
+		t.Errorf("apply returned unexpected flags, got: %+v, wanted: %+v", applied, expected)
+	}
+}
+
+// TestWithConfig_credentials checks that the cjdns admin credentials are read from -cjdns-config, overridden by the config file, and
+// that flags given on the command line override both.
+func TestWithConfig_credentials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "elvispd-config")
+	if err != nil {
+		t.Fatalf("TempDir returned unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	cjdnsConfig := filepath.Join(dir, "cjdroute.conf")
+	if err = ioutil.WriteFile(cjdnsConfig, []byte(`{"admin": {"bind": "127.0.0.2:11235", "password": "from-cjdroute"}} // comment`), 0600); err != nil {
+		t.Fatalf("WriteFile returned unexpected error: %v", err)
+	}
+
+	config := filepath.Join(dir, "elvispd.json")
+	if err = ioutil.WriteFile(config, []byte(`{"cjdns": {"port": 11236}}`), 0600); err != nil {
+		t.Fatalf("WriteFile returned unexpected error: %v", err)
+	}
+
+	defaults := flags{cjdnsIP: "127.0.0.1", cjdnsPort: 11234, cjdnsConfig: cjdnsConfig}
+
+	var credentialTests = []struct {
+		config   string
+		set      map[string]bool
+		password string
+		ip       string
+		port     int
+		err      bool
+	}{
+		{"", nil, "from-cjdroute", "127.0.0.2", 11235, false},
+		{config, nil, "from-cjdroute", "127.0.0.2", 11236, false},
+		{config, map[string]bool{"cjdns-password": true, "cjdns-port": true}, "from-flag", "127.0.0.2", 11234, false},
+		{filepath.Join(dir, "nope.json"), nil, "", "", 0, true},
+	}
+
+	for row, test := range credentialTests {
+		f := defaults
+		f.config = test.config
+		if test.set["cjdns-password"] {
+			f.cjdnsPassword = "from-flag"
+		}
+
+		f, err := withConfig(f, test.set)
+		if (err != nil) != test.err {
+			t.Errorf("Row: %d returned unexpected error: %v", row, err)
+			continue
+		}
+
+		if err == nil && (f.cjdnsPassword != test.password || f.cjdnsIP != test.ip || f.cjdnsPort != test.port) {
+			t.Errorf("Row: %d returned unexpected credentials, got: %s %s:%d, wanted: %s %s:%d", row, f.cjdnsPassword, f.cjdnsIP, f.cjdnsPort,
+				test.password, test.ip, test.port)
+		}
+	}
+
+	f := defaults
+	f.cjdnsConfig = filepath.Join(dir, "nope.conf")
+	if _, err = withConfig(f, nil); err == nil {
+		t.Errorf("withConfig returned no error for a missing -cjdns-config")
+	}
+}
+
+// TestReloadOn checks that reloaded settings are sent, and that a reload waiting for a stopped server to receive it returns once done
+// is closed.
+func TestReloadOn(t *testing.T) {
+	dir, err := ioutil.TempDir("", "elvispd-config")
+	if err != nil {
+		t.Fatalf("TempDir returned unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := filepath.Join(dir, "elvispd.json")
+	if err = ioutil.WriteFile(config, []byte(`{"cidrs": ["10.1.0.0/24"]}`), 0600); err != nil {
+		t.Fatalf("WriteFile returned unexpected error: %v", err)
+	}
+
+	f := flags{config: config}
+	signals := make(chan os.Signal, 1)
+	reload := make(chan server.Settings)
+	done := make(chan struct{})
+
+	returned := make(chan struct{})
+	go func() {
+		reloadOn(signals, f, map[string]bool{"cjdns-ip": true, "cjdns-port": true, "cjdns-password": true}, reload, done)
+		close(returned)
+	}()
+
+	signals <- syscall.SIGHUP
+	if settings := <-reload; len(settings.CIDRs) != 1 || settings.CIDRs[0] != "10.1.0.0/24" {
+		t.Errorf("reloadOn sent unexpected settings: %+v", settings)
+	}
+
+	// Nothing receives the second reload, as if the server was stopped.
+	signals <- syscall.SIGHUP
+	close(done)
+
+	select {
+	case <-returned:
+	case <-time.After(5 * time.Second):
+		t.Errorf("reloadOn did not return after done was closed")
+	}
+}
@@ -1,25 +1,74 @@
 package main
 
-import "flag"
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/willeponken/elvisp/database"
+	"github.com/willeponken/elvisp/tasks"
+)
 
 type cidrList []string
 
+type thresholdList []int
+
+// namedList holds values by name, set as name=value. If split is true, the value is a comma separated list.
+type namedList struct {
+	values map[string][]string
+	split  bool
+}
+
 type flags struct {
-	listen        string
-	db            string
-	password      string
-	cidrList      cidrList
-	cjdnsIP       string
-	cjdnsPort     int
-	cjdnsPassword string
+	config            string
+	listen            string
+	httpListen        string
+	httpCert          string
+	httpKey           string
+	db                string
+	dbBackend         string
+	password          string
+	cidrList          cidrList
+	cjdnsIP           string
+	cjdnsPort         int
+	cjdnsPassword     string
+	cjdnsConfig       string
+	cjdnsPingInterval time.Duration
+	cjdnsMaxBackoff   time.Duration
+	leaseTime         time.Duration
+	reapInterval      time.Duration
+	reconcileInterval time.Duration
+	reconcileDryRun   bool
+	usageInterval     time.Duration
+	usageThresholds   thresholdList
+	shutdownTimeout   time.Duration
+	pools             namedList
+	groups            namedList
+	policies          namedList
+	allocator         string
+	allocatorKey      string
 }
 
 // Default values for flags
 var context = flags{
-	listen:    ":4132",
-	db:        "/tmp/elvispd-db",
-	cjdnsIP:   "127.0.0.1",
-	cjdnsPort: 11234,
+	listen:            ":4132",
+	db:                "/tmp/elvispd-db",
+	dbBackend:         database.BackendBolt,
+	cjdnsIP:           "127.0.0.1",
+	cjdnsPort:         11234,
+	cjdnsPingInterval: 10 * time.Second,
+	cjdnsMaxBackoff:   time.Minute,
+	reapInterval:      time.Minute,
+	reconcileInterval: 5 * time.Minute,
+	usageInterval:     time.Minute,
+	usageThresholds:   thresholdList{80, 95},
+	shutdownTimeout:   30 * time.Second,
+	groups:            namedList{split: true},
+	policies:          namedList{split: true},
+	allocator:         tasks.AllocatorSequential,
 }
 
 // List cidrList lists all the CIDR's as a slice of strings
@@ -47,19 +96,119 @@ func (c *cidrList) Set(cidr string) error {
 	return nil
 }
 
+// String thresholdList stringifies the list of thresholds as comma separated percentages
+func (t *thresholdList) String() string {
+	var strs []string
+	for _, threshold := range *t {
+		strs = append(strs, strconv.Itoa(threshold))
+	}
+
+	return strings.Join(strs, ",")
+}
+
+// Set thresholdList replaces the list of thresholds with comma separated percentages
+func (t *thresholdList) Set(str string) error {
+	var thresholds thresholdList
+	for _, s := range strings.Split(str, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+
+		threshold, err := strconv.Atoi(s)
+		if err != nil {
+			return err
+		}
+
+		thresholds = append(thresholds, threshold)
+	}
+
+	*t = thresholds
+	return nil
+}
+
+// String namedList stringifies the values as space separated name=value pairs, sorted by name
+func (n *namedList) String() string {
+	var names []string
+	for name := range n.values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var strs []string
+	for _, name := range names {
+		if n.split {
+			strs = append(strs, name+"="+strings.Join(n.values[name], ","))
+			continue
+		}
+
+		for _, value := range n.values[name] {
+			strs = append(strs, name+"="+value)
+		}
+	}
+
+	return strings.Join(strs, " ")
+}
+
+// Set namedList appends the values of a name=value pair to the values for the name
+func (n *namedList) Set(str string) error {
+	pair := strings.SplitN(str, "=", 2)
+	name := strings.TrimSpace(pair[0])
+	if len(pair) != 2 || name == "" {
+		return fmt.Errorf("Invalid value: %s, expected <name>=<value>", str)
+	}
+
+	values := []string{pair[1]}
+	if n.split {
+		values = strings.Split(pair[1], ",")
+	}
+
+	if n.values == nil {
+		n.values = make(map[string][]string)
+	}
+
+	for _, value := range values {
+		if value = strings.TrimSpace(value); value != "" {
+			n.values[name] = append(n.values[name], value)
+		}
+	}
+
+	return nil
+}
+
 func init() {
 
+	flag.StringVar(&context.config, "config", context.config, "Config file in JSON, flags given on the command line override it. The pools and policies in it are reloaded on SIGHUP.")
 	flag.StringVar(&context.listen, "listen", context.listen, "Listen address for TCP.")
+	flag.StringVar(&context.httpListen, "http-listen", context.httpListen, "Listen address for the HTTP management API, the API is disabled if empty. The admin password is sent with every request, so without -http-cert it has to be a loopback or cjdns address.")
+	flag.StringVar(&context.httpCert, "http-cert", context.httpCert, "Certificate file for serving the HTTP management API over TLS, on any address.")
+	flag.StringVar(&context.httpKey, "http-key", context.httpKey, "Private key file for the -http-cert certificate.")
 	flag.StringVar(&context.db, "db", context.db, "Directory to use for the database.")
+	flag.StringVar(&context.dbBackend, "db-backend", context.dbBackend, "Backend for the database, either bolt, sqlite (if built with the sqlite tag) or memory.")
 	flag.StringVar(&context.password, "password", context.password, "Password for administrating Elvisp.")
 	flag.StringVar(&context.cjdnsIP, "cjdns-ip", context.cjdnsIP, "IP address for cjdns admin.")
-	flag.StringVar(&context.cjdnsPassword, "cjdns-password", context.cjdnsPassword, "Password for cjdns admin.")
+	flag.StringVar(&context.allocator, "allocator", context.allocator, "Allocator for the addresses within a pool, either sequential, the lowest free address, or hash, derived from the public key.")
+	flag.StringVar(&context.allocatorKey, "allocator-key", context.allocatorKey, "Secret key for the hash allocator, gateways using the same key and pools give a node the same addresses.")
+	flag.StringVar(&context.cjdnsPassword, "cjdns-password", context.cjdnsPassword, "Password for cjdns admin, read from -cjdns-config if not given.")
+	flag.StringVar(&context.cjdnsConfig, "cjdns-config", context.cjdnsConfig, "File to read the cjdns admin IP, port and password from, either .cjdnsadmin or cjdroute.conf. If empty ~/.cjdnsadmin and /etc/cjdroute.conf are tried.")
 
-	flag.Var(&context.cidrList, "cidr", "CIDR to use for IP leasing, use flag repeatedly for multiple CIDR's.")
+	flag.Var(&context.usageThresholds, "usage-thresholds", "Comma separated pool utilisation thresholds, in percent, to warn about when reached, empty disables the warnings.")
+	flag.Var(&context.pools, "pool", "Named pool to lease from, as <name>=<CIDR>, use flag repeatedly for multiple CIDR's and pools. The CIDR's given with -cidr are the default pool.")
+	flag.Var(&context.groups, "group", "Group of public keys, as <name>=<key>[,<key>...], use flag repeatedly for multiple groups.")
+	flag.Var(&context.policies, "policy", "Pools that a public key or a group may lease from, as <key or group>=<pool>[,<pool>...], the first pool is leased from unless another is asked for. Keys without a policy lease from the default pool.")
+	flag.Var(&context.cidrList, "cidr", "CIDR to use for IP leasing, use flag repeatedly for multiple CIDR's. Addresses can be excluded with ,exclude=<address>[-<address>], and IPv6 prefixes delegated with ,delegate=<prefix length>.")
 
 	flag.IntVar(&context.cjdnsPort, "cjdns-port", context.cjdnsPort, "Port for cjdns admin.")
 
-	flag.Parse()
+	flag.DurationVar(&context.cjdnsPingInterval, "cjdns-ping-interval", context.cjdnsPingInterval, "Interval for pinging cjdns admin, it is reconnected if it does not answer. 0 disables the pings and reconnection.")
+	flag.DurationVar(&context.cjdnsMaxBackoff, "cjdns-max-backoff", context.cjdnsMaxBackoff, "Longest time to wait between attempts to reconnect to cjdns admin, 0 uses the ping interval.")
 
-	return
+	flag.DurationVar(&context.leaseTime, "lease-time", context.leaseTime, "Duration of a lease before it has to be renewed, 0 means that leases never expire.")
+	flag.DurationVar(&context.reapInterval, "reap-interval", context.reapInterval, "Interval for removing users with expired leases, 0 disables the removal.")
+	flag.DurationVar(&context.reconcileInterval, "reconcile-interval", context.reconcileInterval, "Interval for reconciling the cjdns IP tunnel with the database, 0 only reconciles on startup.")
+
+	flag.DurationVar(&context.shutdownTimeout, "shutdown-timeout", context.shutdownTimeout, "Duration to wait for running tasks on SIGINT or SIGTERM before disconnecting the clients.")
+
+	flag.DurationVar(&context.usageInterval, "usage-interval", context.usageInterval, "Interval for checking the pool utilisation against the thresholds, 0 only checks on startup.")
+
+	flag.BoolVar(&context.reconcileDryRun, "reconcile-dry-run", context.reconcileDryRun, "Only report the difference between the cjdns IP tunnel and the database, do not change it.")
 }
@@ -61,3 +61,62 @@ func TestCidrList_Set(t *testing.T) {
 		}
 	}
 }
+
+func TestThresholdList_Set(t *testing.T) {
+	var setTests = []struct {
+		str      string
+		expected string
+		err      bool
+	}{
+		{"80,95", "80,95", false},
+		{" 50, 75 ,100 ", "50,75,100", false},
+		{"", "", false},
+		{"80,high", "", true},
+	}
+
+	for row, test := range setTests {
+		var thresholds thresholdList
+		err := thresholds.Set(test.str)
+
+		if (err != nil) != test.err {
+			t.Errorf("Row: %d returned unexpected error: %v", row, err)
+		}
+
+		if str := thresholds.String(); str != test.expected {
+			t.Errorf("Row: %d returned unexpected string, got: %s, wanted: %s", row, str, test.expected)
+		}
+	}
+}
+
+func TestNamedList_Set(t *testing.T) {
+	var setTests = []struct {
+		strs     []string
+		split    bool
+		expected string
+		err      bool
+	}{
+		{[]string{"guests=10.1.0.0/24", "guests=fd01::/64,delegate=56", "infra=10.2.0.0/24"}, false, "guests=10.1.0.0/24 guests=fd01::/64,delegate=56 infra=10.2.0.0/24", false},
+		{[]string{"staff=a.k, b.k", "staff=c.k", "admins=a.k,"}, true, "admins=a.k staff=a.k,b.k,c.k", false},
+		{[]string{"guests"}, false, "", true},
+		{[]string{"=10.1.0.0/24"}, false, "", true},
+	}
+
+	for row, test := range setTests {
+		list := namedList{split: test.split}
+
+		var err error
+		for _, str := range test.strs {
+			if err = list.Set(str); err != nil {
+				break
+			}
+		}
+
+		if (err != nil) != test.err {
+			t.Errorf("Row: %d returned unexpected error: %v", row, err)
+		}
+
+		if str := list.String(); str != test.expected {
+			t.Errorf("Row: %d returned unexpected string, got: %s, wanted: %s", row, str, test.expected)
+		}
+	}
+}
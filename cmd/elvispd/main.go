@@ -1,8 +1,17 @@
 package main
 
 import (
+	// Imported as stdcontext, as context holds the flags.
+	stdcontext "context"
+	"flag"
+	"io"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"github.com/willeponken/elvisp/cjdns"
 	"github.com/willeponken/elvisp/server"
 )
 
@@ -13,21 +22,217 @@ func init() {
 	log.SetPrefix("[\033[32melvisp\033[0m] ")
 }
 
+// commands are run instead of the server, with the flags resolved from the command line and the config file, and the arguments after
+// the command name.
+var commands = map[string]func(w io.Writer, f flags, args []string) error{
+	"migrate": migrate,
+	"backup":  backup,
+	"export":  export,
+	"import":  importFile,
+}
+
+// setFlags returns the names of the flags given on the command line.
+func setFlags() map[string]bool {
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	return set
+}
+
+// withCredentials returns the flags with the cjdns admin credentials from the file given with -cjdns-config, or from the first of
+// the files other cjdns tools use, for the credentials not given on the command line. Only a broken -cjdns-config is an error, a
+// broken default file is logged and skipped.
+func withCredentials(f flags, set map[string]bool) (flags, error) {
+	if set["cjdns-ip"] && set["cjdns-port"] && set["cjdns-password"] {
+		return f, nil
+	}
+
+	var c cjdns.Credentials
+	var err error
+	if f.cjdnsConfig != "" {
+		if c, err = cjdns.ReadCredentials(f.cjdnsConfig); err != nil {
+			return f, err
+		}
+	} else if c, err = cjdns.FindCredentials(cjdns.DefaultCredentialPaths()); err != nil {
+		if err != cjdns.ErrNoCredentials {
+			log.Printf("Not using cjdns admin credentials from cjdns config files, due to error: %s", err)
+		}
+
+		return f, nil
+	}
+
+	log.Printf("Using cjdns admin credentials from: %s", c.Path)
+
+	if !set["cjdns-ip"] && c.Addr != "" {
+		f.cjdnsIP = c.Addr
+	}
+
+	if !set["cjdns-port"] && c.Port != 0 {
+		f.cjdnsPort = c.Port
+	}
+
+	if !set["cjdns-password"] {
+		f.cjdnsPassword = c.Password
+	}
+
+	return f, nil
+}
+
+// withConfig returns the flags with the cjdns admin credentials, and the settings from the config file if there is one, applied to
+// them. The config file overrides the credentials from cjdns config files, and flags given on the command line override both.
+func withConfig(f flags, set map[string]bool) (flags, error) {
+	f, err := withCredentials(f, set)
+	if err != nil || f.config == "" {
+		return f, err
+	}
+
+	c, err := loadConfig(f.config)
+	if err != nil {
+		return f, err
+	}
+
+	return c.apply(f, set), nil
+}
+
+// settings returns the server settings from the flags.
+func (f flags) settings() server.Settings {
+	return server.Settings{
+		Listen:            f.listen,
+		HTTPListen:        f.httpListen,
+		HTTPCert:          f.httpCert,
+		HTTPKey:           f.httpKey,
+		DB:                f.db,
+		DBBackend:         f.dbBackend,
+		Password:          f.password,
+		CjdnsIP:           f.cjdnsIP,
+		CjdnsPort:         f.cjdnsPort,
+		CjdnsPassword:     f.cjdnsPassword,
+		CjdnsPingInterval: f.cjdnsPingInterval,
+		CjdnsMaxBackoff:   f.cjdnsMaxBackoff,
+		CIDRs:             f.cidrList.List(),
+		Pools:             f.pools.values,
+		Groups:            f.groups.values,
+		Policies:          f.policies.values,
+		Allocator:         f.allocator,
+		AllocatorKey:      f.allocatorKey,
+		LeaseTime:         f.leaseTime,
+		ReapInterval:      f.reapInterval,
+		ReconcileInterval: f.reconcileInterval,
+		ReconcileDryRun:   f.reconcileDryRun,
+		UsageInterval:     f.usageInterval,
+		UsageThresholds:   f.usageThresholds,
+	}
+}
+
+// reloadOn reads the config file again on every signal, and sends the settings to reload. It returns once done is closed, also while
+// waiting to send, as the server no longer receives reloaded settings once it is stopping.
+func reloadOn(signals <-chan os.Signal, f flags, set map[string]bool, reload chan<- server.Settings, done <-chan struct{}) {
+	for {
+		select {
+		case <-signals:
+		case <-done:
+			return
+		}
+
+		reloaded, err := withConfig(f, set)
+		if err != nil {
+			log.Printf("Unable to reload config file, due to error: %s", err)
+
+			continue
+		}
+
+		log.Printf("Reloading config file: %s", f.config)
+
+		select {
+		case reload <- reloaded.settings():
+		case <-done:
+			return
+		}
+	}
+}
+
+// shutdownOn shuts the server down on the first signal, waiting at most timeout for the running tasks, and sends the result to done.
+// The signals are no longer caught after the first one, so a second signal kills the process at once.
+func shutdownOn(signals chan os.Signal, s *server.Server, timeout time.Duration, done chan<- error) {
+	sig := <-signals
+	signal.Stop(signals)
+
+	log.Printf("Received: %s, shutting down within: %s", sig, timeout)
+
+	ctx, cancel := stdcontext.WithTimeout(stdcontext.Background(), timeout)
+	defer cancel()
+
+	done <- s.Shutdown(ctx)
+}
+
 func main() {
-	if len(context.cidrList) < 1 {
+	flag.Parse()
+
+	set := setFlags()
+	f, err := withConfig(context, set)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if name := flag.Arg(0); name != "" {
+		command, ok := commands[name]
+		if !ok {
+			log.Fatalf("Unknown command: %s", name)
+		}
+
+		if err := command(os.Stdout, f, flag.Args()[1:]); err != nil {
+			log.Fatalf("Unable to %s database at: %s, due to error: %s", name, f.db, err)
+		}
+
+		return
+	}
+
+	if len(f.cidrList) < 1 {
 		log.Fatalln("Atleast one CIDR has to be defined")
 	}
 
-	settings := server.Settings{
-		Listen:        context.listen,
-		DB:            context.db,
-		Password:      context.password,
-		CjdnsIP:       context.cjdnsIP,
-		CjdnsPort:     context.cjdnsPort,
-		CjdnsPassword: context.cjdnsPassword,
-		CIDRs:         context.cidrList.List(),
+	settings := f.settings()
+
+	// Closed once the server stops, so nothing waits for it to receive anymore.
+	stopped := make(chan struct{})
+
+	// The signals are caught before the server starts, so a signal received while it is starting does not kill the process.
+	terminate := make(chan os.Signal, 1)
+	signal.Notify(terminate, os.Interrupt, syscall.SIGTERM)
+
+	// Flags given on the command line keep overriding the config file when it is reloaded.
+	if f.config != "" {
+		hangup := make(chan os.Signal, 1)
+		signal.Notify(hangup, syscall.SIGHUP)
+		defer signal.Stop(hangup)
+
+		reload := make(chan server.Settings)
+		settings.Reload = reload
+
+		go reloadOn(hangup, context, set, reload, stopped)
+	}
+
+	s, err := server.New(settings)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	shutdown := make(chan error, 1)
+	go shutdownOn(terminate, s, f.shutdownTimeout, shutdown)
+
+	log.Printf("Listening to: %s and using database at: %s", f.listen, f.db)
+	err = s.Serve(stdcontext.Background())
+	close(stopped)
+
+	if err != server.ErrServerClosed {
+		log.Fatal(err)
+	}
+
+	if err = <-shutdown; err != nil {
+		log.Fatalf("Unable to shut down gracefully, due to error: %s", err)
 	}
 
-	log.Printf("Listening to: %s and using database at: %s", context.listen, context.db)
-	log.Fatal(server.Listen(settings))
+	log.Printf("Shut down")
 }
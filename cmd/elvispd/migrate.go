@@ -0,0 +1,45 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+
+	"github.com/willeponken/elvisp/database"
+)
+
+// migrate applies pending migrations to the database given with -db, and reports them to w. It is run as: elvispd [flags] migrate [-dry-run]
+func migrate(w io.Writer, f flags, args []string) (err error) {
+	set := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	dryRun := set.Bool("dry-run", false, "Only report the migrations that would be applied, do not change the database.")
+
+	if err = set.Parse(args); err != nil {
+		return
+	}
+
+	if f.dbBackend != database.BackendBolt {
+		return errors.New("Migrations are only used by Bolt databases")
+	}
+
+	applied, err := database.Migrate(f.db, *dryRun)
+	if err != nil {
+		return
+	}
+
+	if len(applied) == 0 {
+		fmt.Fprintf(w, "Database at: %s is up to date with schema version: %d\n", f.db, database.SchemaVersion)
+		return
+	}
+
+	action := "Applied"
+	if *dryRun {
+		action = "Would apply"
+	}
+
+	for _, m := range applied {
+		fmt.Fprintf(w, "%s migration to schema version: %d, %s\n", action, m.Version, m.Description)
+	}
+
+	return
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/willeponken/elvisp/database"
+)
+
+func TestMigrate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "elvispd-")
+	if err != nil {
+		t.Fatalf("TempDir returned unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "db")
+	db, err := database.Open(path)
+	if err != nil {
+		t.Fatalf("Open returned unexpected error: %v", err)
+	}
+	db.Close()
+
+	var migrateTests = []struct {
+		path     string
+		backend  string
+		args     []string
+		expected string
+		err      bool
+	}{
+		{path, database.BackendBolt, []string{"--dry-run"}, "is up to date", false},
+		{path, database.BackendBolt, nil, "is up to date", false},
+		{path, database.BackendBolt, []string{"-lol"}, "", true},
+		{filepath.Join(dir, "missing"), database.BackendBolt, []string{"-dry-run"}, "", true},
+		{path, database.BackendMemory, nil, "", true},
+	}
+
+	for row, test := range migrateTests {
+		var out bytes.Buffer
+		err := migrate(&out, flags{db: test.path, dbBackend: test.backend}, test.args)
+
+		if !strings.Contains(out.String(), test.expected) {
+			t.Errorf("Row: %d returned unexpected output, got: %s, wanted it to contain: %s", row, out.String(), test.expected)
+		}
+
+		if err != nil && !test.err {
+			t.Errorf("Row: %d returned unexpected error: %v", row, err)
+		}
+
+		if err == nil && test.err {
+			t.Errorf("Row: %d expected error but got %v", row, err)
+		}
+	}
+}
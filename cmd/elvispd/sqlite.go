@@ -0,0 +1,7 @@
+//go:build sqlite
+// +build sqlite
+
+package main
+
+// The SQLite driver is only linked into elvispd when built with the sqlite tag, as it requires cgo.
+import _ "github.com/mattn/go-sqlite3"
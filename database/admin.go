@@ -1,6 +1,11 @@
 package database
 
-import "log"
+import (
+	"errors"
+	"log"
+
+	"github.com/willeponken/elvisp/auth"
+)
 
 // adminBucket defines the namespace for the admin bucket
 const adminBucket = "Admin"
@@ -8,31 +13,135 @@ const adminBucket = "Admin"
 // hashKey defines the key for storing hashed administration password
 const hashKey = "hash"
 
-// SetAdmin sets the hashed password for the administrator
-func (db *Database) SetAdmin(hash string) (err error) {
-	err = db.Update(func(tx *Tx) error {
+// verifierKey defines the key for storing the keys derived from the administration password
+const verifierKey = "verifier"
 
-		bucket := tx.Bucket([]byte(adminBucket))
+// errNoVerifier is returned if the administrator has no verifier.
+var errNoVerifier = errors.New("No verifier for administration, set the password again")
 
-		log.Printf("Updating password hash for administration")
-		err = bucket.Put([]byte(hashKey), []byte(hash))
+// keySize is the size of the stored key and the server key in a verifier.
+const keySize = 32
 
-		return nil // End of transaction after data is put
-	})
+// Verifier holds the salt and PBKDF2 iterations for the administration password, and the stored key and server key derived from it,
+// used for challenge-response authentication. Neither key can be used as the password
+type Verifier struct {
+	Salt       []byte
+	Iterations int
+	StoredKey  []byte
+	ServerKey  []byte
+}
+
+// encodeVerifier encodes a verifier as the iterations followed by the salt length, the salt, the stored key and the server key
+func encodeVerifier(v Verifier) []byte {
+	b := append(uint64ToBin(uint64(v.Iterations)), uint64ToBin(uint64(len(v.Salt)))...)
+	b = append(b, v.Salt...)
+	b = append(b, v.StoredKey...)
+
+	return append(b, v.ServerKey...)
+}
+
+// decodeVerifier decodes a verifier encoded by encodeVerifier. A verifier from before the stored key, holding the key derived from
+// the password itself, is converted
+func decodeVerifier(b []byte) (v Verifier, err error) {
+	if len(b) < 16 || uint64(len(b)-16) < binToUint64(b[8:16]) {
+		err = errors.New("Invalid verifier for administration")
+		return
+	}
+
+	saltLen := 16 + int(binToUint64(b[8:16]))
+
+	v.Iterations = int(binToUint64(b[:8]))
+	v.Salt = append([]byte(nil), b[16:saltLen]...)
+
+	switch keys := b[saltLen:]; len(keys) {
+	case 2 * keySize:
+		v.StoredKey = append([]byte(nil), keys[:keySize]...)
+		v.ServerKey = append([]byte(nil), keys[keySize:]...)
+	case keySize:
+		v.StoredKey, v.ServerKey = auth.Keys(keys)
+	default:
+		err = errors.New("Invalid verifier for administration")
+	}
 
 	return
 }
 
+// upgradeVerifier replaces a verifier holding the key derived from the password, which could be used as the password, with the
+// stored key and server key derived from it.
+func upgradeVerifier(tx *boltTx) (err error) {
+	bucket := tx.Bucket([]byte(adminBucket))
+
+	b := bucket.Get([]byte(verifierKey))
+	if b == nil {
+		return
+	}
+
+	v, err := decodeVerifier(b)
+	if err != nil {
+		return
+	}
+
+	return bucket.Put([]byte(verifierKey), encodeVerifier(v))
+}
+
+// SetAdmin sets the hashed password for the administrator within the transaction
+func (tx *boltTx) SetAdmin(hash string) error {
+	log.Printf("Updating password hash for administration")
+	return tx.Bucket([]byte(adminBucket)).Put([]byte(hashKey), []byte(hash))
+}
+
+// AdminHash retrieves the password hash for administrator within the transaction
+func (tx *boltTx) AdminHash() (hash string, err error) {
+	log.Printf("Retrieving password hash")
+	return string(tx.Bucket([]byte(adminBucket)).Get([]byte(hashKey))), nil
+}
+
+// SetVerifier sets the derived keys for the administrator within the transaction
+func (tx *boltTx) SetVerifier(v Verifier) error {
+	log.Printf("Updating verifier for administration")
+	return tx.Bucket([]byte(adminBucket)).Put([]byte(verifierKey), encodeVerifier(v))
+}
+
+// AdminVerifier retrieves the derived keys for the administrator within the transaction
+func (tx *boltTx) AdminVerifier() (v Verifier, err error) {
+	b := tx.Bucket([]byte(adminBucket)).Get([]byte(verifierKey))
+	if b == nil {
+		err = errNoVerifier
+		return
+	}
+
+	return decodeVerifier(b)
+}
+
+// SetAdmin sets the hashed password for the administrator
+func (db *Database) SetAdmin(hash string) (err error) {
+	return db.Update(func(tx Tx) error {
+		return tx.SetAdmin(hash)
+	})
+}
+
 // AdminHash retrieves the password hash for administrator
 func (db *Database) AdminHash() (hash string, err error) {
-	err = db.View(func(tx *Tx) error {
+	err = db.View(func(tx Tx) (err error) {
+		hash, err = tx.AdminHash()
+		return
+	})
 
-		bucket := tx.Bucket([]byte(adminBucket))
+	return
+}
 
-		log.Printf("Retrieving password hash")
-		hash = string(bucket.Get([]byte(hashKey)))
+// SetVerifier sets the derived keys for the administrator
+func (db *Database) SetVerifier(v Verifier) (err error) {
+	return db.Update(func(tx Tx) error {
+		return tx.SetVerifier(v)
+	})
+}
 
-		return nil // End of transaction after data is put
+// AdminVerifier retrieves the derived keys for the administrator
+func (db *Database) AdminVerifier() (v Verifier, err error) {
+	err = db.View(func(tx Tx) (err error) {
+		v, err = tx.AdminVerifier()
+		return
 	})
 
 	return
@@ -1,8 +1,11 @@
 package database_test
 
 import (
+	"bytes"
 	"strconv"
 	"testing"
+
+	"github.com/willeponken/elvisp/database"
 )
 
 // TestSetAdmin_AdminHash_replace checks if adding a hash again replaces the old one, it tests both the SetAdmin and AdminHash methods
@@ -31,3 +34,29 @@ func TestSetAdmin_AdminHash_replace(t *testing.T) {
 		}
 	}
 }
+
+// TestSetVerifier_AdminVerifier checks if a verifier is stored and retrieved unchanged.
+func TestSetVerifier_AdminVerifier(t *testing.T) {
+	db := MustOpen()
+	defer db.MustClose()
+
+	if _, err := db.AdminVerifier(); err == nil {
+		t.Errorf("AdminVerifier expected error but got %v", err)
+	}
+
+	v := database.Verifier{Salt: []byte("salt"), Iterations: 4096, StoredKey: []byte("0123456789abcdef0123456789abcdef"),
+		ServerKey: []byte("fedcba9876543210fedcba9876543210")}
+	if err := db.SetVerifier(v); err != nil {
+		t.Fatalf("SetVerifier returned unexpected error: %v", err)
+	}
+
+	retr, err := db.AdminVerifier()
+	if err != nil {
+		t.Fatalf("AdminVerifier returned unexpected error: %v", err)
+	}
+
+	if !bytes.Equal(retr.Salt, v.Salt) || retr.Iterations != v.Iterations || !bytes.Equal(retr.StoredKey, v.StoredKey) ||
+		!bytes.Equal(retr.ServerKey, v.ServerKey) {
+		t.Errorf("AdminVerifier returned unexpected verifier, got: %+v, wanted: %+v", retr, v)
+	}
+}
@@ -0,0 +1,22 @@
+package database
+
+import (
+	"errors"
+	"io"
+)
+
+// backuper is implemented by stores that can write a copy of themselves while in use.
+type backuper interface {
+	Backup(w io.Writer) (n int64, err error)
+}
+
+// Backup writes a consistent copy of the database to w, while the database can be used meanwhile. Only Bolt databases support backups.
+func (db *Database) Backup(w io.Writer) (n int64, err error) {
+	b, ok := db.Store.(backuper)
+	if !ok {
+		err = errors.New("Backups are not supported by the database backend, use export instead")
+		return
+	}
+
+	return b.Backup(w)
+}
@@ -0,0 +1,101 @@
+package database
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// lockTimeout is how long to wait for another process, such as a running elvispd, to release the lock on the database.
+const lockTimeout = time.Second
+
+// boltStore is a Store backed by a single-file Bolt database, which can only be opened by one process at a time.
+type boltStore struct {
+	*bolt.DB
+}
+
+// boltTx represents a Bolt transaction. Created holds the buckets created while migrating, so migrations can tell a database
+// from before a bucket existed.
+type boltTx struct {
+	*bolt.Tx
+	created map[string]bool
+}
+
+// View wrapps bolt.DB.View
+func (s *boltStore) View(fn func(Tx) error) error {
+	return s.DB.View(func(tx *bolt.Tx) error {
+		return fn(&boltTx{Tx: tx})
+	})
+}
+
+// Update wrapps bolt.DB.Update
+func (s *boltStore) Update(fn func(Tx) error) error {
+	return s.DB.Update(func(tx *bolt.Tx) error {
+		return fn(&boltTx{Tx: tx})
+	})
+}
+
+// Backup writes a consistent copy of the database to w, using a read transaction so the database can be used meanwhile.
+func (s *boltStore) Backup(w io.Writer) (n int64, err error) {
+	err = s.DB.View(func(tx *bolt.Tx) (err error) {
+		n, err = tx.WriteTo(w)
+		return
+	})
+
+	return
+}
+
+// openBolt opens the Bolt database at path, and fails if it is locked by another process.
+func openBolt(path string, readOnly bool) (db *bolt.DB, err error) {
+	db, err = bolt.Open(path, 0600, &bolt.Options{Timeout: lockTimeout, ReadOnly: readOnly})
+	if err == bolt.ErrTimeout {
+		err = fmt.Errorf("Database at: %s is in use by another process", path)
+	}
+
+	return
+}
+
+// openBoltStore initializes or opens a Bolt database from a defined path, and applies pending migrations.
+func openBoltStore(path string) (s *boltStore, err error) {
+	db, err := openBolt(path, false)
+	if err != nil {
+		return
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		applied, err := (&boltTx{Tx: tx}).migrate()
+		for _, m := range applied {
+			log.Printf("Migrated database to schema version: %d, %s", m.Version, m.Description)
+		}
+
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return
+	}
+
+	return &boltStore{db}, nil
+}
+
+// BackupFile writes a copy of the Bolt database at path to w, without opening it for writing. It fails if the database is in use
+// by a running elvispd, which has to be backed up using Backup instead.
+func BackupFile(path string, w io.Writer) (n int64, err error) {
+	if _, err = os.Stat(path); err != nil {
+		return
+	}
+
+	db, err := openBolt(path, true)
+	if err != nil {
+		return
+	}
+
+	s := &boltStore{db}
+	defer s.Close()
+
+	return s.Backup(w)
+}
@@ -0,0 +1,8 @@
+package database
+
+import "github.com/boltdb/bolt"
+
+// Bolt returns the Bolt database for a database opened with Open, for tests that use the buckets directly.
+func Bolt(db Database) *bolt.DB {
+	return db.Store.(*boltStore).DB
+}
@@ -1,60 +1,111 @@
 package database
 
 import (
-	"log"
+	"fmt"
+	"net"
+	"time"
 
-	"github.com/boltdb/bolt"
+	"github.com/willeponken/go-cjdns/key"
 )
 
-// Database represents a Bolt-backed data store
-type Database struct {
-	*bolt.DB
-}
+// Backends for OpenStore.
+const (
+	BackendBolt   = "bolt"   // Single-file Bolt database, the default
+	BackendSQLite = "sqlite" // SQLite database, requires a binary built with a SQLite driver
+	BackendMemory = "memory" // In-memory store that is lost on exit, the path is ignored
+)
 
-// Tx represents a Bolt transaction
-type Tx struct {
-	*bolt.Tx
+// Store represents a transactional data store for users, leases, reservations and the administrator settings.
+type Store interface {
+	// View runs fn within a read-only transaction.
+	View(fn func(Tx) error) error
+	// Update runs fn within a read-write transaction, which is rolled back if fn returns an error.
+	Update(fn func(Tx) error) error
+	// Close closes the store.
+	Close() error
 }
 
-// View wrapps bolt.DB.View
-func (db *Database) View(fn func(*Tx) error) error {
-	return db.DB.View(func(tx *bolt.Tx) error {
-		return fn(&Tx{tx})
-	})
-}
+// Tx represents a transaction in a store.
+type Tx interface {
+	// InsertUser inserts a new user record and returns the ID. A user without an ID gets the ID reserved for its public key,
+	// or the lowest free ID that is not reserved. A zero Created time is set to now, and an empty source to SourceClient.
+	InsertUser(u User) (id uint64, err error)
+	// FreeID returns the lowest ID that is not used by any user, and for which skip returns false.
+	FreeID(skip func(id uint64) bool) (id uint64, err error)
+	// GetUser returns the user record for a registered user ID.
+	GetUser(id uint64) (u User, err error)
+	// PutUser replaces the user record for a registered user, the public key of the user can not be changed.
+	PutUser(u User) error
+	// GetID returns the ID for a registered user.
+	GetID(pubkey *key.Public) (id uint64, err error)
+	// DelUser removes a registered user, identified by public key or ID, and its lease. The ID is freed for new users.
+	DelUser(identifier interface{}) error
+	// Users returns every registered user, sorted by ID.
+	Users() (users []User, err error)
+	// ImportUsers adds users with their IDs, the store may not have any users.
+	ImportUsers(users []User) error
+	// PoolUser returns the public key of the user in a pool with an index, its Index or its ID if it has none, or nil if there is none.
+	PoolUser(pool string, index uint64) (pubkey *key.Public, err error)
+
+	// SetReservation stores a reservation, replacing any reservation for the same public key.
+	SetReservation(r Reservation) error
+	// GetReservation returns the reservation for a public key.
+	GetReservation(pubkey *key.Public) (r Reservation, err error)
+	// DelReservation removes the reservation for a public key.
+	DelReservation(pubkey *key.Public) error
+	// Reservations returns every reservation, sorted by public key.
+	Reservations() (reservations []Reservation, err error)
+	// ReservedID returns the public key that an ID is reserved for, or nil if it is not reserved.
+	ReservedID(id uint64) (pubkey *key.Public, err error)
+	// ReservedWithin returns the public keys with a reserved address within a network, sorted by address.
+	ReservedWithin(network *net.IPNet) (keys []*key.Public, err error)
+
+	// SetLease stores when the lease for a user ID was granted and when it expires, a zero expires means that it never expires.
+	SetLease(id uint64, granted, expires time.Time) error
+	// GetLease returns the lease for a user ID.
+	GetLease(id uint64) (l Lease, err error)
+	// DelLease removes the lease for a user ID, but keeps the user.
+	DelLease(id uint64) error
+	// Leases returns all active leases, sorted by ID.
+	Leases() (leases []Lease, err error)
 
-// Update wrapps bolt.DB.Update
-func (db *Database) Update(fn func(*Tx) error) error {
-	return db.DB.Update(func(tx *bolt.Tx) error {
-		return fn(&Tx{tx})
-	})
+	// SetAdmin sets the hashed password for the administrator.
+	SetAdmin(hash string) error
+	// AdminHash retrieves the password hash for the administrator, it is empty if there is none.
+	AdminHash() (hash string, err error)
+	// SetVerifier sets the derived keys for the administrator.
+	SetVerifier(v Verifier) error
+	// AdminVerifier retrieves the derived keys for the administrator.
+	AdminVerifier() (v Verifier, err error)
 }
 
-// initBuckets iterates over every bucket that should always exist
-func (db *Database) initBuckets(buckets []string) {
-	db.Update(func(tx *Tx) error {
-		for _, bucket := range buckets {
-			if _, err := tx.CreateBucketIfNotExists([]byte(bucket)); err != nil {
-				log.Fatal(err)
-			}
-		}
-
-		return nil
-	})
+// Database represents a data store, with helpers that run a single operation in its own transaction.
+type Database struct {
+	Store
 }
 
-// Open initializes or opens a database from a defined directory
+// Open initializes or opens a Bolt database from a defined path.
 func Open(path string) (db Database, err error) {
+	return OpenStore(BackendBolt, path)
+}
 
-	db.DB, err = bolt.Open(path, 0600, nil)
-	if err != nil {
-		db.Close()
+// OpenStore initializes or opens a database using a backend from a defined path.
+func OpenStore(backend, path string) (db Database, err error) {
+	var store Store
+	switch backend {
+	case BackendBolt:
+		store, err = openBoltStore(path)
+	case BackendSQLite:
+		store, err = openSQLiteStore(path)
+	case BackendMemory:
+		store = newMemoryStore()
+	default:
+		err = fmt.Errorf("Unknown database backend: %s", backend)
+	}
 
+	if err != nil {
 		return
 	}
 
-	var buckets = []string{usersBucket, adminBucket}
-	db.initBuckets(buckets)
-
-	return
+	return Database{store}, nil
 }
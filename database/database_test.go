@@ -26,15 +26,22 @@ func tempFile() string {
 
 type TestDB struct {
 	database.Database
+	path string
 }
 
 func MustOpen() TestDB {
-	db, err := database.Open(tempFile())
+	path := tempFile()
+	db, err := database.Open(path)
 	if err != nil {
 		panic(err)
 	}
 
-	return TestDB{db}
+	return TestDB{db, path}
+}
+
+// Path returns the path to the Bolt database.
+func (t *TestDB) Path() string {
+	return t.path
 }
 
 func (t *TestDB) Close() error {
@@ -0,0 +1,358 @@
+package database
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// exportVersion is the version of the JSON export format.
+const exportVersion = 1
+
+// csvHeader is the header of a CSV export, which only holds users. Times are RFC 3339 and labels are URL query encoded.
+// Exports from before pools have no pool and index columns.
+var csvHeader = []string{"id", "key", "created", "last_seen", "last_ip", "source", "labels", "pool", "index"}
+
+// csvFieldsBeforePools is the number of columns in a CSV export from before pools.
+const csvFieldsBeforePools = 7
+
+// exportUser is a user record with its ID in an export.
+type exportUser struct {
+	ID uint64 `json:"id"`
+	userRecord
+}
+
+// exportAdmin holds the settings for the administrator in an export. The verifier is left out, as exports are copied around
+// more freely than the database, and is derived again when the admin password is set.
+type exportAdmin struct {
+	Hash string `json:"hash,omitempty"`
+}
+
+// export is the portable JSON form of the database, holding every user with its ID, the reservations and the settings for the administrator.
+type export struct {
+	Version      int                 `json:"version"`
+	Schema       uint64              `json:"schema"`
+	Users        []exportUser        `json:"users"`
+	Reservations []reservationRecord `json:"reservations,omitempty"`
+	Admin        exportAdmin         `json:"admin"`
+}
+
+// newExport returns the portable form of the database within the transaction.
+func newExport(tx Tx) (e export, err error) {
+	e = export{Version: exportVersion, Schema: SchemaVersion, Users: []exportUser{}}
+
+	users, err := tx.Users()
+	if err != nil {
+		return
+	}
+
+	for _, u := range users {
+		e.Users = append(e.Users, exportUser{ID: u.ID, userRecord: newUserRecord(u)})
+	}
+
+	reservations, err := tx.Reservations()
+	if err != nil {
+		return
+	}
+
+	for _, r := range reservations {
+		e.Reservations = append(e.Reservations, newReservationRecord(r))
+	}
+
+	e.Admin.Hash, err = tx.AdminHash()
+	return
+}
+
+// ImportUsers adds users with their IDs within the transaction, the database may not have any users.
+// The IDs in the gaps between the users are freed, so they are reused before new IDs.
+func (tx *boltTx) ImportUsers(users []User) (err error) {
+	if k, _ := tx.Bucket([]byte(usersBucket)).Cursor().First(); k != nil {
+		return errors.New("Database already has users, users can only be imported into an empty database")
+	}
+
+	if err = tx.DeleteBucket([]byte(freeIDsBucket)); err != nil {
+		return
+	}
+
+	if _, err = tx.CreateBucket([]byte(freeIDsBucket)); err != nil {
+		return
+	}
+
+	log.Printf("Importing %d users", len(users))
+
+	for _, u := range users {
+		if u.ID == 0 {
+			return fmt.Errorf("Invalid ID: 0 for user with public key: %s", u.Key.String())
+		}
+
+		if tx.Bucket([]byte(usersBucket)).Get(uint64ToBin(u.ID)) != nil {
+			return fmt.Errorf("User with ID: %d is imported more than once", u.ID)
+		}
+
+		record, err := encodeUser(u)
+		if err != nil {
+			return err
+		}
+
+		if err = tx.Bucket([]byte(usersBucket)).Put(uint64ToBin(u.ID), record); err != nil {
+			return err
+		}
+
+		if tx.Bucket([]byte(pubKeysBucket)).Get([]byte(u.Key.String())) != nil {
+			return fmt.Errorf("User with public key: %s is imported more than once", u.Key.String())
+		}
+
+		if err = tx.Bucket([]byte(pubKeysBucket)).Put([]byte(u.Key.String()), uint64ToBin(u.ID)); err != nil {
+			return err
+		}
+
+		if err = tx.putPoolIndex(u); err != nil {
+			return err
+		}
+	}
+
+	// Every ID in a gap between the imported users is free.
+	lastID := uint64(0)
+	return tx.Bucket([]byte(usersBucket)).ForEach(func(k, v []byte) error {
+		id := binToUint64(k)
+
+		for gap := lastID + 1; gap < id; gap++ {
+			if err := tx.Bucket([]byte(freeIDsBucket)).Put(uint64ToBin(gap), []byte{}); err != nil {
+				return err
+			}
+		}
+		lastID = id
+
+		return nil
+	})
+}
+
+// Export writes every user with its ID, the reservations and the settings for the administrator to w as JSON.
+func (db *Database) Export(w io.Writer) (err error) {
+	var e export
+	err = db.View(func(tx Tx) (err error) {
+		e, err = newExport(tx)
+		return
+	})
+	if err != nil {
+		return
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+
+	return enc.Encode(e)
+}
+
+// Import adds the users and reservations, and replaces the settings for the administrator, from a JSON export, and returns the number of imported users.
+// The database may not have any users.
+func (db *Database) Import(r io.Reader) (n int, err error) {
+	var e export
+	if err = json.NewDecoder(r).Decode(&e); err != nil {
+		return
+	}
+
+	if e.Version > exportVersion {
+		err = fmt.Errorf("Unsupported export version: %d", e.Version)
+		return
+	}
+
+	var users []User
+	for _, eu := range e.Users {
+		u, err := eu.user(eu.ID)
+		if err != nil {
+			return 0, err
+		}
+
+		users = append(users, u)
+	}
+
+	var reservations []Reservation
+	for _, rr := range e.Reservations {
+		r, err := rr.reservation()
+		if err != nil {
+			return 0, err
+		}
+
+		reservations = append(reservations, r)
+	}
+
+	err = db.Update(func(tx Tx) (err error) {
+		if err = tx.ImportUsers(users); err != nil {
+			return
+		}
+
+		for _, r := range reservations {
+			if err = tx.SetReservation(r); err != nil {
+				return
+			}
+		}
+
+		if e.Admin.Hash != "" {
+			err = tx.SetAdmin(e.Admin.Hash)
+		}
+
+		return
+	})
+	if err != nil {
+		return
+	}
+
+	return len(users), nil
+}
+
+// formatTime formats t as RFC 3339 for a CSV export, the zero time is left empty.
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+
+	return t.UTC().Format(time.RFC3339)
+}
+
+// parseTime parses a time formatted by formatTime.
+func parseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+
+	return time.Parse(time.RFC3339, s)
+}
+
+// ExportCSV writes every user with its ID to w as CSV, the settings for the administrator are not included.
+func (db *Database) ExportCSV(w io.Writer) (err error) {
+	var users []User
+	err = db.View(func(tx Tx) (err error) {
+		users, err = tx.Users()
+		return
+	})
+	if err != nil {
+		return
+	}
+
+	cw := csv.NewWriter(w)
+	if err = cw.Write(csvHeader); err != nil {
+		return
+	}
+
+	for _, u := range users {
+		lastIP := ""
+		if u.LastIP != nil {
+			lastIP = u.LastIP.String()
+		}
+
+		labels := url.Values{}
+		for k, v := range u.Labels {
+			labels.Set(k, v)
+		}
+
+		index := ""
+		if u.Index != 0 {
+			index = strconv.FormatUint(u.Index, 10)
+		}
+
+		row := []string{strconv.FormatUint(u.ID, 10), u.Key.String(), formatTime(u.Created), formatTime(u.LastSeen), lastIP, u.Source, labels.Encode(), u.Pool, index}
+		if err = cw.Write(row); err != nil {
+			return
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+// parseCSVUser parses a row in a CSV export into a user.
+func parseCSVUser(row []string) (u User, err error) {
+	r := userRecord{Version: userRecordVersion, Key: row[1], LastIP: row[4], Source: row[5]}
+
+	id, err := strconv.ParseUint(row[0], 10, 64)
+	if err != nil {
+		return
+	}
+
+	if r.LastIP != "" && net.ParseIP(r.LastIP) == nil {
+		err = fmt.Errorf("Invalid IP address: %s", r.LastIP)
+		return
+	}
+
+	labels, err := url.ParseQuery(row[6])
+	if err != nil {
+		return
+	}
+
+	if len(labels) > 0 {
+		r.Labels = make(map[string]string)
+		for k := range labels {
+			r.Labels[k] = labels.Get(k)
+		}
+	}
+
+	if len(row) > csvFieldsBeforePools {
+		r.Pool = row[7]
+		if row[8] != "" {
+			if r.Index, err = strconv.ParseUint(row[8], 10, 64); err != nil {
+				return
+			}
+		}
+	}
+
+	if u, err = r.user(id); err != nil {
+		return
+	}
+
+	if u.Created, err = parseTime(row[2]); err != nil {
+		return
+	}
+
+	u.LastSeen, err = parseTime(row[3])
+	return
+}
+
+// ImportCSV adds the users from a CSV export, and returns the number of imported users. The database may not have any users.
+func (db *Database) ImportCSV(r io.Reader) (n int, err error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+
+	rows, err := cr.ReadAll()
+	if err != nil {
+		return
+	}
+
+	if len(rows) == 0 || rows[0][0] != csvHeader[0] {
+		err = errors.New("Missing header in CSV export")
+		return
+	}
+
+	fields := len(rows[0])
+	if fields != len(csvHeader) && fields != csvFieldsBeforePools {
+		err = fmt.Errorf("Unexpected number of columns in CSV export: %d", fields)
+		return
+	}
+
+	var users []User
+	for line, row := range rows[1:] {
+		if len(row) != fields {
+			return 0, fmt.Errorf("Invalid user on line: %d, due to error: expected %d columns but got %d", line+2, fields, len(row))
+		}
+
+		u, err := parseCSVUser(row)
+		if err != nil {
+			return 0, fmt.Errorf("Invalid user on line: %d, due to error: %v", line+2, err)
+		}
+
+		users = append(users, u)
+	}
+
+	if err = db.Update(func(tx Tx) error { return tx.ImportUsers(users) }); err != nil {
+		return
+	}
+
+	return len(users), nil
+}
@@ -0,0 +1,258 @@
+package database_test
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/willeponken/elvisp/database"
+	"github.com/willeponken/go-cjdns/key"
+)
+
+// mustPopulateRecords adds three users with rich records to the database, and removes the second to leave a gap at ID 2.
+func mustPopulateRecords(t *testing.T, db TestDB) (users []database.User) {
+	for i := 0; i < 3; i++ {
+		pubkey := key.Generate().Pubkey()
+		if _, err := db.AddUser(pubkey); err != nil {
+			t.Fatalf("AddUser returned unexpected error: %v", err)
+		}
+	}
+
+	if err := db.DelUser(uint64(2)); err != nil {
+		t.Fatalf("DelUser returned unexpected error: %v", err)
+	}
+
+	err := db.Update(func(tx database.Tx) error {
+		u, err := tx.GetUser(3)
+		if err != nil {
+			return err
+		}
+
+		u.LastSeen = time.Unix(1467374400, 0)
+		u.LastIP = net.ParseIP("fc00::1")
+		u.Labels = map[string]string{"owner": "alice & bob", "site": "a=b"}
+		u.Source = database.SourceAdmin
+		u.Pool, u.Index = "guests", 1
+		return tx.PutUser(u)
+	})
+	if err != nil {
+		t.Fatalf("Update returned unexpected error: %v", err)
+	}
+
+	users, err = db.Users()
+	if err != nil {
+		t.Fatalf("Users returned unexpected error: %v", err)
+	}
+
+	return
+}
+
+// checkImported checks if the users were imported unchanged, and that the gap is filled before new IDs.
+func checkImported(t *testing.T, db TestDB, want []database.User) {
+	users, err := db.Users()
+	if err != nil {
+		t.Fatalf("Users returned unexpected error: %v", err)
+	}
+
+	if len(users) != len(want) {
+		t.Fatalf("Users returned unexpected users, got: %+v, wanted: %+v", users, want)
+	}
+
+	for i, u := range users {
+		if u.ID != want[i].ID || !u.Key.Equal(want[i].Key) || !u.Created.Equal(want[i].Created) || !u.LastSeen.Equal(want[i].LastSeen) ||
+			!u.LastIP.Equal(want[i].LastIP) || u.Source != want[i].Source || !reflect.DeepEqual(u.Labels, want[i].Labels) ||
+			u.Pool != want[i].Pool || u.Index != want[i].Index {
+			t.Errorf("Row: %d returned unexpected user, got: %+v, wanted: %+v", i, u, want[i])
+		}
+
+		if id, err := db.GetID(u.Key); err != nil || id != u.ID {
+			t.Errorf("Row: %d returned unexpected ID: %d, error: %v, wanted: %d", i, id, err, u.ID)
+		}
+	}
+
+	if id, err := db.AddUser(key.Generate().Pubkey()); err != nil || id != 2 {
+		t.Errorf("AddUser returned unexpected ID: %d, error: %v, wanted: 2", id, err)
+	}
+}
+
+func TestExport_Import(t *testing.T) {
+	db := MustOpen()
+	defer db.MustClose()
+
+	want := mustPopulateRecords(t, db)
+	verifier := database.Verifier{Salt: []byte("salt"), Iterations: 4096, StoredKey: []byte("0123456789abcdef0123456789abcdef"),
+		ServerKey: []byte("fedcba9876543210fedcba9876543210")}
+	if err := db.SetAdmin("hash"); err != nil {
+		t.Fatalf("SetAdmin returned unexpected error: %v", err)
+	}
+	if err := db.SetVerifier(verifier); err != nil {
+		t.Fatalf("SetVerifier returned unexpected error: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := db.Export(&buf); err != nil {
+		t.Fatalf("Export returned unexpected error: %v", err)
+	}
+	export := buf.String()
+
+	imported := MustOpen()
+	defer imported.MustClose()
+
+	if n, err := imported.Import(strings.NewReader(export)); err != nil || n != len(want) {
+		t.Fatalf("Import returned unexpected count: %d, error: %v, wanted: %d", n, err, len(want))
+	}
+
+	checkImported(t, imported, want)
+
+	if hash, err := imported.AdminHash(); err != nil || hash != "hash" {
+		t.Errorf("AdminHash returned unexpected hash: %s, error: %v", hash, err)
+	}
+
+	// The verifier is derived again when the admin password is set.
+	if strings.Contains(export, "verifier") {
+		t.Errorf("Export returned unexpected verifier: %s", export)
+	}
+
+	if v, err := imported.AdminVerifier(); err == nil {
+		t.Errorf("AdminVerifier returned unexpected verifier: %+v", v)
+	}
+
+	// Users are only imported into an empty database.
+	if _, err := imported.Import(strings.NewReader(export)); err == nil {
+		t.Errorf("Import expected error but got %v", err)
+	}
+}
+
+func TestExportCSV_ImportCSV(t *testing.T) {
+	db := MustOpen()
+	defer db.MustClose()
+
+	want := mustPopulateRecords(t, db)
+
+	var buf bytes.Buffer
+	if err := db.ExportCSV(&buf); err != nil {
+		t.Fatalf("ExportCSV returned unexpected error: %v", err)
+	}
+
+	imported := MustOpen()
+	defer imported.MustClose()
+
+	if n, err := imported.ImportCSV(&buf); err != nil || n != len(want) {
+		t.Fatalf("ImportCSV returned unexpected count: %d, error: %v, wanted: %d", n, err, len(want))
+	}
+
+	checkImported(t, imported, want)
+}
+
+// TestImportCSV_beforePools checks if a CSV export from before pools, without the pool and index columns, can be imported.
+func TestImportCSV_beforePools(t *testing.T) {
+	db := MustOpen()
+	defer db.MustClose()
+
+	pubkey := key.Generate().Pubkey()
+	data := "id,key,created,last_seen,last_ip,source,labels\n4," + pubkey.String() + ",,,,admin,owner=alice\n"
+
+	if n, err := db.ImportCSV(strings.NewReader(data)); err != nil || n != 1 {
+		t.Fatalf("ImportCSV returned unexpected count: %d, error: %v, wanted: 1", n, err)
+	}
+
+	u, err := db.GetUser(4)
+	if err != nil || !u.Key.Equal(pubkey) || u.Source != database.SourceAdmin || u.Pool != "" || u.Index != 0 {
+		t.Errorf("GetUser returned unexpected user: %+v, error: %v", u, err)
+	}
+}
+
+func TestImport_invalid(t *testing.T) {
+	pubkey := key.Generate().Pubkey().String()
+
+	var importTests = []struct {
+		csv  bool
+		data string
+	}{
+		{false, `nope`},
+		{false, `{"version":2,"users":[]}`},
+		{false, `{"version":1,"users":[{"id":1,"key":"nope"}]}`},
+		{false, `{"version":1,"users":[{"id":0,"key":"` + pubkey + `"}]}`},
+		{false, `{"version":1,"users":[{"id":1,"key":"` + pubkey + `"},{"id":2,"key":"` + pubkey + `"}]}`},
+		{false, `{"version":1,"users":[{"id":1,"version":2,"key":"` + pubkey + `"}]}`},
+		{true, ``},
+		{true, "1," + pubkey + ",,,,,\n"},
+		{true, "id,key,created,last_seen,last_ip,source,labels\nx," + pubkey + ",,,,,\n"},
+		{true, "id,key,created,last_seen,last_ip,source,labels\n1," + pubkey + ",yesterday,,,,\n"},
+		{true, "id,key,created,last_seen,last_ip,source,labels\n1," + pubkey + ",,,nope,,\n"},
+		{true, "id,key,created,last_seen,last_ip,source,labels\n1," + pubkey + "\n"},
+		{true, "id,key,created,last_seen,last_ip,source,labels,pool,index\n1," + pubkey + ",,,,,,guests,x\n"},
+		{true, "id,key,created,last_seen,last_ip,source,labels,pool,index\n1," + pubkey + ",,,,,\n"},
+		{true, "id,key,created,last_seen,last_ip,source,labels,pool\n1," + pubkey + ",,,,,,guests\n"},
+	}
+
+	for row, test := range importTests {
+		db := MustOpen()
+
+		var err error
+		if test.csv {
+			_, err = db.ImportCSV(strings.NewReader(test.data))
+		} else {
+			_, err = db.Import(strings.NewReader(test.data))
+		}
+
+		if err == nil {
+			t.Errorf("Row: %d expected error but got %v", row, err)
+		}
+
+		if users, _ := db.Users(); len(users) != 0 {
+			t.Errorf("Row: %d imported unexpected users: %+v", row, users)
+		}
+
+		db.MustClose()
+	}
+}
+
+func TestBackup(t *testing.T) {
+	db := MustOpen()
+	defer db.MustClose()
+
+	want := mustPopulateRecords(t, db)
+
+	path := tempFile()
+	defer os.Remove(path)
+
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("Create returned unexpected error: %v", err)
+	}
+
+	if n, err := db.Backup(file); err != nil || n == 0 {
+		t.Fatalf("Backup returned unexpected size: %d, error: %v", n, err)
+	}
+	file.Close()
+
+	// The database is in use, so it can only be backed up using Backup.
+	if _, err := database.BackupFile(db.Path(), &bytes.Buffer{}); err == nil {
+		t.Errorf("BackupFile expected error but got %v", err)
+	}
+
+	var buf bytes.Buffer
+	if n, err := database.BackupFile(path, &buf); err != nil || n != int64(buf.Len()) {
+		t.Errorf("BackupFile returned unexpected size: %d, error: %v", n, err)
+	}
+
+	if _, err := database.BackupFile(tempFile(), &buf); err == nil {
+		t.Errorf("BackupFile expected error for missing database but got %v", err)
+	}
+
+	restored, err := database.Open(path)
+	if err != nil {
+		t.Fatalf("Open returned unexpected error: %v", err)
+	}
+	defer restored.Close()
+
+	users, err := restored.Users()
+	if err != nil || len(users) != len(want) {
+		t.Errorf("Users returned unexpected users: %+v, error: %v, wanted: %+v", users, err, want)
+	}
+}
@@ -0,0 +1,126 @@
+package database
+
+import (
+	"log"
+
+	"github.com/willeponken/go-cjdns/key"
+)
+
+// pubKeysBucket defines the namespace for the index of public keys, mapping every public key to the ID of the user.
+const pubKeysBucket = "PubKeys"
+
+// freeIDsBucket defines the namespace for IDs freed by removed users, which are reused before new IDs.
+const freeIDsBucket = "FreeIDs"
+
+// buildIndex builds the public key index and free IDs for a database created before they existed. It does nothing if the index is already built.
+func buildIndex(tx *boltTx) (err error) {
+	users := tx.Bucket([]byte(usersBucket))
+	index := tx.Bucket([]byte(pubKeysBucket))
+	free := tx.Bucket([]byte(freeIDsBucket))
+
+	if k, _ := index.Cursor().First(); k != nil {
+		return
+	}
+
+	if k, _ := users.Cursor().First(); k == nil {
+		return
+	}
+
+	log.Printf("Building public key index for existing users")
+
+	lastID := uint64(0)
+	return users.ForEach(func(k, v []byte) error {
+		id := binToUint64(k)
+
+		// Every ID in the gap between the last and the current user is free.
+		for gap := lastID + 1; gap < id; gap++ {
+			if err := free.Put(uint64ToBin(gap), []byte{}); err != nil {
+				return err
+			}
+		}
+		lastID = id
+
+		r, err := decodeRecord(v)
+		if err != nil {
+			return err
+		}
+
+		return index.Put([]byte(r.Key), k)
+	})
+}
+
+// poolIndexBucket defines the namespace for the index of users within their pools, mapping the pool and index of every user to its public key.
+const poolIndexBucket = "PoolIndexes"
+
+// poolIndex returns the position of the addresses for the user within its pool, its Index or its ID if it has none.
+func (u User) poolIndex() uint64 {
+	if u.Index != 0 {
+		return u.Index
+	}
+
+	return u.ID
+}
+
+// poolIndexKey returns the key for a pool and index in the pool index, the pool name followed by a zero byte and the index.
+func poolIndexKey(pool string, index uint64) []byte {
+	return append(append([]byte(pool), 0), uint64ToBin(index)...)
+}
+
+// putPoolIndex adds the user to the pool index.
+func (tx *boltTx) putPoolIndex(u User) error {
+	return tx.Bucket([]byte(poolIndexBucket)).Put(poolIndexKey(u.Pool, u.poolIndex()), []byte(u.Key.String()))
+}
+
+// delPoolIndex removes the public key from the pool index, unless the pool and index has been given to another user.
+func (tx *boltTx) delPoolIndex(pubkey, pool string, index uint64) error {
+	bucket := tx.Bucket([]byte(poolIndexBucket))
+	k := poolIndexKey(pool, index)
+	if string(bucket.Get(k)) != pubkey {
+		return nil
+	}
+
+	return bucket.Delete(k)
+}
+
+// PoolUser returns the public key of the user in a pool with an index within the transaction, or nil if there is none.
+func (tx *boltTx) PoolUser(pool string, index uint64) (pubkey *key.Public, err error) {
+	v := tx.Bucket([]byte(poolIndexBucket)).Get(poolIndexKey(pool, index))
+	if v == nil {
+		return
+	}
+
+	return key.DecodePublic(string(v))
+}
+
+// indexLookups builds the pool index and the indexes of reserved IDs and addresses, for a database created before they existed.
+func indexLookups(tx *boltTx) (err error) {
+	for _, bucket := range []string{poolIndexBucket, reservedIDsBucket, reservedAddressesBucket} {
+		if _, err = tx.CreateBucketIfNotExists([]byte(bucket)); err != nil {
+			return
+		}
+	}
+
+	users, err := tx.Users()
+	if err != nil {
+		return
+	}
+
+	for _, u := range users {
+		if err = tx.putPoolIndex(u); err != nil {
+			return
+		}
+	}
+
+	reservations, err := tx.Reservations()
+	if err != nil {
+		return
+	}
+
+	for _, r := range reservations {
+		if err = tx.indexReservation(r); err != nil {
+			return
+		}
+	}
+
+	return
+}
@@ -0,0 +1,216 @@
+package database_test
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"github.com/willeponken/elvisp/database"
+	"github.com/willeponken/go-cjdns/key"
+)
+
+// TestBuildIndex checks if the index and free IDs are built when opening a database with users added before the index existed.
+func TestBuildIndex(t *testing.T) {
+	db := MustOpen()
+	path := db.Path()
+
+	mockUsers := generateMockUsers(4)
+	existing := []mockUser{mockUsers[0], mockUsers[1], mockUsers[3]}
+
+	// Add the users without the index, leaving a gap at ID 3, in a database from before the schema was versioned.
+	err := database.Bolt(db.Database).Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket([]byte("Meta")); err != nil {
+			return err
+		}
+
+		for _, u := range existing {
+			if err := tx.Bucket([]byte("Users")).Put(uint64ToBin(u.id), []byte(u.pubkey.String())); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Update returned unexpected error: %v", err)
+	}
+	db.Database.Close()
+
+	reopened, err := database.Open(path)
+	if err != nil {
+		t.Fatalf("Open returned unexpected error: %v", err)
+	}
+	db = TestDB{reopened, path}
+	defer db.MustClose()
+
+	for row, u := range existing {
+		if id, err := db.GetID(u.pubkey); err != nil || id != u.id {
+			t.Errorf("Row: %d returned unexpected ID: %d, error: %v, wanted: %d", row, id, err, u.id)
+		}
+	}
+
+	var addTests = []struct {
+		pubkey *key.Public
+		id     uint64
+	}{
+		{mockUsers[2].pubkey, 3}, // The gap is filled first
+		{key.Generate().Pubkey(), 5},
+	}
+
+	for row, test := range addTests {
+		if id, err := db.AddUser(test.pubkey); err != nil || id != test.id {
+			t.Errorf("Row: %d returned unexpected ID: %d, error: %v, wanted: %d", row, id, err, test.id)
+		}
+	}
+}
+
+// TestDelUser_index checks if a removed user is removed from the index, and that its ID is reused.
+func TestDelUser_index(t *testing.T) {
+	db := MustOpen()
+	defer db.MustClose()
+
+	mockUsers := generateMockUsers(5)
+	for _, u := range mockUsers {
+		db.AddUser(u.pubkey)
+	}
+
+	for _, id := range []uint64{4, 2} {
+		if err := db.DelUser(id); err != nil {
+			t.Fatalf("DelUser returned unexpected error: %v", err)
+		}
+	}
+
+	if _, err := db.GetID(mockUsers[1].pubkey); err == nil {
+		t.Errorf("GetID expected error for removed user but got %v", err)
+	}
+
+	for row, want := range []uint64{2, 4, 6} {
+		if id, err := db.AddUser(key.Generate().Pubkey()); err != nil || id != want {
+			t.Errorf("Row: %d returned unexpected ID: %d, error: %v, wanted: %d", row, id, err, want)
+		}
+	}
+}
+
+// uint64ToBin returns an 8-byte big endian representation of v, as stored by the database.
+func uint64ToBin(v uint64) []byte {
+	b := make([]byte, 8)
+	for i := range b {
+		b[7-i] = byte(v >> (8 * uint(i)))
+	}
+
+	return b
+}
+
+// randomPubkey returns a random public key, it is not a valid cjdns key but much faster to create than using key.Generate.
+func randomPubkey() *key.Public {
+	pubkey := new(key.Public)
+	rand.Read(pubkey[:])
+
+	return pubkey
+}
+
+// mustPopulate opens a database with n users, without syncing to disk as it is only used for benchmarks. Logging is disabled as every user is logged.
+func mustPopulate(b *testing.B, n int) TestDB {
+	log.SetOutput(ioutil.Discard)
+
+	db := MustOpen()
+	database.Bolt(db.Database).NoSync = true
+
+	for i := 0; i < n; i++ {
+		if _, err := db.AddUser(randomPubkey()); err != nil {
+			b.Fatalf("AddUser returned unexpected error: %v", err)
+		}
+	}
+
+	return db
+}
+
+// scanPubKey looks up the ID for a public key by scanning every user, as was done before the index existed.
+func scanPubKey(db TestDB, pubkey *key.Public) (id []byte) {
+	database.Bolt(db.Database).View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket([]byte("Users")).Cursor()
+
+		for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
+			if string(v) == pubkey.String() {
+				id = k
+				return nil
+			}
+		}
+
+		return nil
+	})
+
+	return
+}
+
+func benchmarkGetID(b *testing.B, n int) {
+	db := mustPopulate(b, n)
+	defer db.MustClose()
+
+	pubkey := randomPubkey()
+	id, _ := db.AddUser(pubkey) // The last user is the worst case for a scan
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if got, err := db.GetID(pubkey); err != nil || got != id {
+			b.Fatalf("GetID returned unexpected ID: %d, error: %v", got, err)
+		}
+	}
+}
+
+func benchmarkScanPubKey(b *testing.B, n int) {
+	db := mustPopulate(b, n)
+	defer db.MustClose()
+
+	pubkey := randomPubkey()
+	db.AddUser(pubkey)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if id := scanPubKey(db, pubkey); id == nil {
+			b.Fatal("scanPubKey did not find the user")
+		}
+	}
+}
+
+func benchmarkAddDelUser(b *testing.B, n int) {
+	db := mustPopulate(b, n)
+	defer db.MustClose()
+
+	pubkeys := make([]*key.Public, b.N)
+	for i := range pubkeys {
+		pubkeys[i] = randomPubkey()
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := db.AddUser(pubkeys[i]); err != nil {
+			b.Fatalf("AddUser returned unexpected error: %v", err)
+		}
+
+		if err := db.DelUser(pubkeys[i]); err != nil {
+			b.Fatalf("DelUser returned unexpected error: %v", err)
+		}
+	}
+}
+
+func BenchmarkGetID(b *testing.B) {
+	for _, n := range []int{100, 1000, 10000} {
+		b.Run(fmt.Sprintf("users=%d", n), func(b *testing.B) { benchmarkGetID(b, n) })
+	}
+}
+
+func BenchmarkScanPubKey(b *testing.B) {
+	for _, n := range []int{100, 1000, 10000} {
+		b.Run(fmt.Sprintf("users=%d", n), func(b *testing.B) { benchmarkScanPubKey(b, n) })
+	}
+}
+
+func BenchmarkAddDelUser(b *testing.B) {
+	for _, n := range []int{100, 1000, 10000} {
+		b.Run(fmt.Sprintf("users=%d", n), func(b *testing.B) { benchmarkAddDelUser(b, n) })
+	}
+}
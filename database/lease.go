@@ -0,0 +1,184 @@
+package database
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// leasesBucket defines the namespace for the leases bucket.
+const leasesBucket = "Leases"
+
+// Lease holds when a lease was granted and when it expires for a user ID. A zero Expires means that the lease never expires.
+type Lease struct {
+	ID      uint64
+	Granted time.Time
+	Expires time.Time
+}
+
+// Expired returns true if the lease has an expiry time which is before now.
+func (l Lease) Expired(now time.Time) bool {
+	return !l.Expires.IsZero() && l.Expires.Before(now)
+}
+
+// timeToBin returns an 8-byte big endian representation of the Unix time for t, the zero time is represented as 0.
+func timeToBin(t time.Time) []byte {
+	if t.IsZero() {
+		return uint64ToBin(0)
+	}
+
+	return uint64ToBin(uint64(t.Unix()))
+}
+
+// binToTime takes an 8-byte big endian Unix time and converts it into a time.Time, 0 is converted to the zero time.
+func binToTime(v []byte) time.Time {
+	sec := binToUint64(v)
+	if sec == 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(int64(sec), 0)
+}
+
+// encodeLease encodes the granted and expires times as 16 bytes.
+func encodeLease(l Lease) []byte {
+	return append(timeToBin(l.Granted), timeToBin(l.Expires)...)
+}
+
+// decodeLease decodes 16 bytes into a lease for the defined ID.
+func decodeLease(id uint64, v []byte) (l Lease, err error) {
+	if len(v) != 16 {
+		err = fmt.Errorf("Invalid length of lease: %d", len(v))
+		return
+	}
+
+	l = Lease{
+		ID:      id,
+		Granted: binToTime(v[:8]),
+		Expires: binToTime(v[8:]),
+	}
+
+	return
+}
+
+// SetLease stores when the lease for a user ID was granted and when it expires within the transaction, a zero expires means that it never expires.
+func (tx *boltTx) SetLease(id uint64, granted, expires time.Time) (err error) {
+	if tx.Bucket([]byte(usersBucket)).Get(uint64ToBin(id)) == nil {
+		err = fmt.Errorf("User with ID: %d does not exist", id)
+		log.Println(err)
+		return
+	}
+
+	log.Printf("Setting lease for user with ID: %d, expires: %v", id, expires)
+	return tx.Bucket([]byte(leasesBucket)).Put(uint64ToBin(id), encodeLease(Lease{id, granted, expires}))
+}
+
+// GetLease returns the lease for a user ID within the transaction.
+func (tx *boltTx) GetLease(id uint64) (l Lease, err error) {
+	v := tx.Bucket([]byte(leasesBucket)).Get(uint64ToBin(id))
+	if v == nil {
+		err = fmt.Errorf("No lease found for user with ID: %d", id)
+		return
+	}
+
+	return decodeLease(id, v)
+}
+
+// DelLease removes the lease for a user ID within the transaction, but keeps the user.
+func (tx *boltTx) DelLease(id uint64) (err error) {
+	log.Printf("Deleting lease for user with ID: %d", id)
+	return tx.Bucket([]byte(leasesBucket)).Delete(uint64ToBin(id))
+}
+
+// Leases returns all active leases within the transaction.
+func (tx *boltTx) Leases() (leases []Lease, err error) {
+	err = tx.Bucket([]byte(leasesBucket)).ForEach(func(k, v []byte) error {
+		l, err := decodeLease(binToUint64(k), v)
+		if err != nil {
+			return err
+		}
+
+		leases = append(leases, l)
+		return nil
+	})
+
+	return
+}
+
+// addLeases grants a lease that never expires to every user in a database created before leases existed, as those users were
+// registered for good. A database that already had leases is left unchanged, its users without a lease were released.
+func addLeases(tx *boltTx) (err error) {
+	if !tx.created[leasesBucket] {
+		return
+	}
+
+	var ids []uint64
+	err = tx.Bucket([]byte(usersBucket)).ForEach(func(k, v []byte) error {
+		ids = append(ids, binToUint64(k))
+		return nil
+	})
+	if err != nil || len(ids) == 0 {
+		return
+	}
+
+	log.Printf("Adding leases for %d users registered before leases existed", len(ids))
+
+	now := time.Now()
+	for _, id := range ids {
+		if err = tx.SetLease(id, now, time.Time{}); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// SetLease stores when the lease for a user ID was granted and when it expires, a zero expires means that it never expires.
+func (db *Database) SetLease(id uint64, granted, expires time.Time) (err error) {
+	return db.Update(func(tx Tx) error {
+		return tx.SetLease(id, granted, expires)
+	})
+}
+
+// GetLease returns the lease for a user ID.
+func (db *Database) GetLease(id uint64) (l Lease, err error) {
+	err = db.View(func(tx Tx) error {
+		l, err = tx.GetLease(id)
+		return err
+	})
+
+	return
+}
+
+// DelLease removes the lease for a user ID, but keeps the user.
+func (db *Database) DelLease(id uint64) (err error) {
+	return db.Update(func(tx Tx) error {
+		return tx.DelLease(id)
+	})
+}
+
+// Leases returns all active leases.
+func (db *Database) Leases() (leases []Lease, err error) {
+	err = db.View(func(tx Tx) (err error) {
+		leases, err = tx.Leases()
+		return
+	})
+
+	return
+}
+
+// ExpiredLeases returns all leases that have expired at the time defined by now.
+func (db *Database) ExpiredLeases(now time.Time) (leases []Lease, err error) {
+	all, err := db.Leases()
+	if err != nil {
+		return
+	}
+
+	for _, l := range all {
+		if l.Expired(now) {
+			leases = append(leases, l)
+		}
+	}
+
+	return
+}
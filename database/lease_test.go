@@ -0,0 +1,174 @@
+package database_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/willeponken/elvisp/database"
+)
+
+func TestLease_Expired(t *testing.T) {
+	now := time.Unix(1000, 0)
+
+	var expiredTests = []struct {
+		lease   database.Lease
+		expired bool
+	}{
+		{database.Lease{Expires: time.Time{}}, false},
+		{database.Lease{Expires: now.Add(time.Second)}, false},
+		{database.Lease{Expires: now.Add(-time.Second)}, true},
+	}
+
+	for row, test := range expiredTests {
+		if expired := test.lease.Expired(now); expired != test.expired {
+			t.Errorf("Row: %d returned unexpected expired, got: %t, wanted: %t", row, expired, test.expired)
+		}
+	}
+}
+
+// TestSetLease_GetLease checks if a lease is stored and retrieved with the same times.
+func TestSetLease_GetLease(t *testing.T) {
+	db := MustOpen()
+	defer db.MustClose()
+
+	mockUser := generateMockUsers(1)[0]
+	id, err := db.AddUser(mockUser.pubkey)
+	if err != nil {
+		t.Fatalf("AddUser returned unexpected error: %v", err)
+	}
+
+	granted := time.Unix(1000, 0)
+	expires := time.Unix(2000, 0)
+	if err = db.SetLease(id, granted, expires); err != nil {
+		t.Errorf("SetLease returned unexpected error: %v", err)
+	}
+
+	l, err := db.GetLease(id)
+	if err != nil {
+		t.Errorf("GetLease returned unexpected error: %v", err)
+	}
+
+	if l.ID != id || !l.Granted.Equal(granted) || !l.Expires.Equal(expires) {
+		t.Errorf("GetLease returned unexpected lease, got: %v, wanted: %v", l, database.Lease{ID: id, Granted: granted, Expires: expires})
+	}
+}
+
+// TestSetLease_unknownUser checks if setting a lease for a non-existing user returns an error.
+func TestSetLease_unknownUser(t *testing.T) {
+	db := MustOpen()
+	defer db.MustClose()
+
+	if err := db.SetLease(1, time.Now(), time.Time{}); err == nil {
+		t.Errorf("SetLease expected error but got %v", err)
+	}
+}
+
+// TestDelLease checks if the lease is removed but the user kept.
+func TestDelLease(t *testing.T) {
+	db := MustOpen()
+	defer db.MustClose()
+
+	mockUser := generateMockUsers(1)[0]
+	id, _ := db.AddUser(mockUser.pubkey)
+	db.SetLease(id, time.Now(), time.Time{})
+
+	if err := db.DelLease(id); err != nil {
+		t.Errorf("DelLease returned unexpected error: %v", err)
+	}
+
+	if _, err := db.GetLease(id); err == nil {
+		t.Errorf("GetLease expected error but got %v", err)
+	}
+
+	if _, err := db.GetID(mockUser.pubkey); err != nil {
+		t.Errorf("GetID returned unexpected error: %v", err)
+	}
+}
+
+// TestDelUser_lease checks if removing a user also removes the lease.
+func TestDelUser_lease(t *testing.T) {
+	db := MustOpen()
+	defer db.MustClose()
+
+	mockUser := generateMockUsers(1)[0]
+	id, _ := db.AddUser(mockUser.pubkey)
+	db.SetLease(id, time.Now(), time.Time{})
+	db.DelUser(mockUser.pubkey)
+
+	if _, err := db.GetLease(id); err == nil {
+		t.Errorf("GetLease expected error but got %v", err)
+	}
+}
+
+// TestExpiredLeases checks if only the expired leases are returned.
+func TestExpiredLeases(t *testing.T) {
+	db := MustOpen()
+	defer db.MustClose()
+
+	now := time.Unix(10000, 0)
+	expires := []time.Time{
+		now.Add(-time.Hour),
+		now.Add(time.Hour),
+		{},
+		now.Add(-time.Minute),
+	}
+
+	mockUsers := generateMockUsers(len(expires))
+	for i, test := range mockUsers {
+		id, _ := db.AddUser(test.pubkey)
+		db.SetLease(id, now.Add(-2*time.Hour), expires[i])
+	}
+
+	leases, err := db.ExpiredLeases(now)
+	if err != nil {
+		t.Errorf("ExpiredLeases returned unexpected error: %v", err)
+	}
+
+	if len(leases) != 2 || leases[0].ID != mockUsers[0].id || leases[1].ID != mockUsers[3].id {
+		t.Errorf("ExpiredLeases returned unexpected leases: %v", leases)
+	}
+}
+
+// TestLeases checks if every lease is returned.
+func TestLeases(t *testing.T) {
+	db := MustOpen()
+	defer db.MustClose()
+
+	mockUsers := generateMockUsers(3)
+	for _, test := range mockUsers {
+		id, _ := db.AddUser(test.pubkey)
+		db.SetLease(id, time.Now(), time.Time{})
+	}
+	db.DelLease(mockUsers[1].id)
+
+	leases, err := db.Leases()
+	if err != nil {
+		t.Errorf("Leases returned unexpected error: %v", err)
+	}
+
+	if len(leases) != 2 || leases[0].ID != mockUsers[0].id || leases[1].ID != mockUsers[2].id {
+		t.Errorf("Leases returned unexpected leases: %v", leases)
+	}
+}
+
+// TestPublicKey checks if the public key is returned for a registered ID.
+func TestPublicKey(t *testing.T) {
+	db := MustOpen()
+	defer db.MustClose()
+
+	mockUser := generateMockUsers(1)[0]
+	id, _ := db.AddUser(mockUser.pubkey)
+
+	pubkey, err := db.PublicKey(id)
+	if err != nil {
+		t.Errorf("PublicKey returned unexpected error: %v", err)
+	}
+
+	if !pubkey.Equal(mockUser.pubkey) {
+		t.Errorf("PublicKey returned unexpected key, got: %s, wanted: %s", pubkey, mockUser.pubkey)
+	}
+
+	if _, err = db.PublicKey(id + 1); err == nil {
+		t.Errorf("PublicKey expected error but got %v", err)
+	}
+}
@@ -0,0 +1,495 @@
+package database
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/willeponken/go-cjdns/key"
+)
+
+// errReadOnly is returned when changing a memory store within a read-only transaction.
+var errReadOnly = errors.New("Transaction is read-only")
+
+// memoryData holds everything in a memory store.
+type memoryData struct {
+	users        map[uint64]User
+	ids          map[string]uint64
+	leases       map[uint64]Lease
+	reservations map[string]Reservation
+	hash         string
+	verifier     *Verifier
+}
+
+// cloneUser returns a deep copy of a user, so it can not be changed outside of a transaction.
+func cloneUser(u User) User {
+	if u.LastIP != nil {
+		u.LastIP = append(net.IP(nil), u.LastIP...)
+	}
+
+	if u.Addresses != nil {
+		addrs := make([]Assignment, len(u.Addresses))
+		for i, a := range u.Addresses {
+			addrs[i] = Assignment{Pool: a.Pool, IP: append(net.IP(nil), a.IP...)}
+		}
+		u.Addresses = addrs
+	}
+
+	if u.Labels != nil {
+		labels := make(map[string]string, len(u.Labels))
+		for k, v := range u.Labels {
+			labels[k] = v
+		}
+		u.Labels = labels
+	}
+
+	return u
+}
+
+// cloneReservation returns a deep copy of a reservation.
+func cloneReservation(r Reservation) Reservation {
+	if r.Addresses != nil {
+		addrs := make([]net.IP, len(r.Addresses))
+		for i, ip := range r.Addresses {
+			addrs[i] = append(net.IP(nil), ip...)
+		}
+		r.Addresses = addrs
+	}
+
+	return r
+}
+
+// clone returns a deep copy of the data, which is changed within a transaction and replaces the data on commit.
+func (d *memoryData) clone() *memoryData {
+	c := &memoryData{
+		users:        make(map[uint64]User, len(d.users)),
+		ids:          make(map[string]uint64, len(d.ids)),
+		leases:       make(map[uint64]Lease, len(d.leases)),
+		reservations: make(map[string]Reservation, len(d.reservations)),
+		hash:         d.hash,
+		verifier:     d.verifier,
+	}
+
+	for id, u := range d.users {
+		c.users[id] = cloneUser(u)
+	}
+
+	for k, id := range d.ids {
+		c.ids[k] = id
+	}
+
+	for id, l := range d.leases {
+		c.leases[id] = l
+	}
+
+	for k, r := range d.reservations {
+		c.reservations[k] = cloneReservation(r)
+	}
+
+	return c
+}
+
+// memoryStore is a Store kept in memory, intended for tests. Every read-write transaction works on a copy of the data,
+// which replaces the data if the transaction succeeds.
+type memoryStore struct {
+	mu   sync.RWMutex
+	data *memoryData
+}
+
+// memoryTx represents a transaction in a memory store.
+type memoryTx struct {
+	data     *memoryData
+	writable bool
+}
+
+// newMemoryStore returns an empty memory store.
+func newMemoryStore() *memoryStore {
+	return &memoryStore{data: (&memoryData{}).clone()}
+}
+
+// View runs fn within a read-only transaction.
+func (s *memoryStore) View(fn func(Tx) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return fn(&memoryTx{data: s.data})
+}
+
+// Update runs fn within a read-write transaction, which is rolled back if fn returns an error.
+func (s *memoryStore) Update(fn func(Tx) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data := s.data.clone()
+	if err := fn(&memoryTx{data: data, writable: true}); err != nil {
+		return err
+	}
+
+	s.data = data
+	return nil
+}
+
+// Close does nothing, the data is kept until the store is garbage collected.
+func (s *memoryStore) Close() error {
+	return nil
+}
+
+// check returns errReadOnly if the transaction is read-only.
+func (tx *memoryTx) check() error {
+	if !tx.writable {
+		return errReadOnly
+	}
+
+	return nil
+}
+
+// FreeID returns the lowest ID that is not used by any user within the transaction, and for which skip returns false.
+func (tx *memoryTx) FreeID(skip func(id uint64) bool) (id uint64, err error) {
+	for id = 1; ; id++ {
+		if _, ok := tx.data.users[id]; !ok && !skip(id) {
+			return
+		}
+	}
+}
+
+// userID takes a identifier, either a public key or a uint64, and returns the ID of the user. Ok is false if the user does not exist.
+func (tx *memoryTx) userID(identifier interface{}) (id uint64, ok bool, err error) {
+	switch i := identifier.(type) {
+	case *key.Public:
+		id, ok = tx.data.ids[i.String()]
+	case uint64:
+		_, ok = tx.data.users[i]
+		id = i
+	default:
+		err = errors.New("Unknown identifier specified")
+	}
+
+	return
+}
+
+// InsertUser inserts a new user record within the transaction, and returns the ID. A user without an ID gets the ID reserved for
+// its public key, or the lowest free ID that is not reserved.
+func (tx *memoryTx) InsertUser(u User) (id uint64, err error) {
+	if err = tx.check(); err != nil {
+		return
+	}
+
+	k := u.Key.String()
+	if _, ok := tx.data.ids[k]; ok {
+		err = fmt.Errorf("User with public key: %s already exists", k)
+		log.Println(err)
+		return
+	}
+
+	u = u.withDefaults()
+	if u.ID, err = newUserID(tx, u); err != nil {
+		return
+	}
+
+	if _, ok := tx.data.users[u.ID]; ok {
+		err = fmt.Errorf("User with ID: %d already exists", u.ID)
+		log.Println(err)
+		return
+	}
+
+	log.Printf("Adding new user with key: %s and ID: %d", k, u.ID)
+	tx.data.users[u.ID] = cloneUser(u)
+	tx.data.ids[k] = u.ID
+
+	return u.ID, nil
+}
+
+// GetUser returns the user record for a registered user ID within the transaction.
+func (tx *memoryTx) GetUser(id uint64) (u User, err error) {
+	u, ok := tx.data.users[id]
+	if !ok {
+		err = fmt.Errorf("User with ID: %d does not exist", id)
+		return
+	}
+
+	return cloneUser(u), nil
+}
+
+// PutUser replaces the user record for a registered user within the transaction, the public key of the user can not be changed.
+func (tx *memoryTx) PutUser(u User) (err error) {
+	if err = tx.check(); err != nil {
+		return
+	}
+
+	if id, ok := tx.data.ids[u.Key.String()]; !ok || id != u.ID {
+		return fmt.Errorf("User with ID: %d and public key: %s does not exist", u.ID, u.Key.String())
+	}
+
+	tx.data.users[u.ID] = cloneUser(u)
+	return
+}
+
+// GetID returns the ID for a registered user within the transaction.
+func (tx *memoryTx) GetID(pubkey *key.Public) (id uint64, err error) {
+	id, ok := tx.data.ids[pubkey.String()]
+	if !ok {
+		err = fmt.Errorf("User with public key: %s does not exist", pubkey.String())
+		log.Println(err)
+	}
+
+	return
+}
+
+// DelUser removes a registered user, identified by public key or ID, and its lease within the transaction.
+func (tx *memoryTx) DelUser(identifier interface{}) (err error) {
+	if err = tx.check(); err != nil {
+		return
+	}
+
+	id, ok, err := tx.userID(identifier)
+	if err != nil {
+		return
+	}
+
+	if !ok {
+		err = fmt.Errorf("User identified as: %v does not exist", identifier)
+		log.Println(err)
+		return
+	}
+
+	log.Printf("Deleting user identified as: %v", identifier)
+	delete(tx.data.ids, tx.data.users[id].Key.String())
+	delete(tx.data.users, id)
+	delete(tx.data.leases, id) // The lease is useless without the user
+
+	return
+}
+
+// Users returns every registered user within the transaction, sorted by ID.
+func (tx *memoryTx) Users() (users []User, err error) {
+	for _, u := range tx.data.users {
+		users = append(users, cloneUser(u))
+	}
+
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+	return
+}
+
+// ImportUsers adds users with their IDs within the transaction, the store may not have any users.
+func (tx *memoryTx) ImportUsers(users []User) (err error) {
+	if err = tx.check(); err != nil {
+		return
+	}
+
+	if len(tx.data.users) != 0 {
+		return errors.New("Database already has users, users can only be imported into an empty database")
+	}
+
+	log.Printf("Importing %d users", len(users))
+
+	for _, u := range users {
+		k := u.Key.String()
+
+		switch _, exists := tx.data.users[u.ID]; {
+		case u.ID == 0:
+			return fmt.Errorf("Invalid ID: 0 for user with public key: %s", k)
+		case exists:
+			return fmt.Errorf("User with ID: %d is imported more than once", u.ID)
+		}
+
+		if _, ok := tx.data.ids[k]; ok {
+			return fmt.Errorf("User with public key: %s is imported more than once", k)
+		}
+
+		tx.data.users[u.ID] = cloneUser(u)
+		tx.data.ids[k] = u.ID
+	}
+
+	return
+}
+
+// PoolUser returns the public key of the user in a pool with an index within the transaction, or nil if there is none.
+func (tx *memoryTx) PoolUser(pool string, index uint64) (pubkey *key.Public, err error) {
+	for _, u := range tx.data.users {
+		if u.Pool == pool && u.poolIndex() == index {
+			return u.Key, nil
+		}
+	}
+
+	return
+}
+
+// SetReservation stores a reservation within the transaction, replacing any reservation for the same public key.
+func (tx *memoryTx) SetReservation(r Reservation) (err error) {
+	if err = tx.check(); err != nil {
+		return
+	}
+
+	log.Printf("Setting reservation for public key: %s, ID: %d, addresses: %v", r.Key.String(), r.ID, r.Addresses)
+	tx.data.reservations[r.Key.String()] = cloneReservation(r)
+
+	return
+}
+
+// GetReservation returns the reservation for a public key within the transaction.
+func (tx *memoryTx) GetReservation(pubkey *key.Public) (r Reservation, err error) {
+	r, ok := tx.data.reservations[pubkey.String()]
+	if !ok {
+		err = fmt.Errorf("No reservation found for public key: %s", pubkey.String())
+		return
+	}
+
+	return cloneReservation(r), nil
+}
+
+// DelReservation removes the reservation for a public key within the transaction.
+func (tx *memoryTx) DelReservation(pubkey *key.Public) (err error) {
+	if err = tx.check(); err != nil {
+		return
+	}
+
+	if _, ok := tx.data.reservations[pubkey.String()]; !ok {
+		err = fmt.Errorf("No reservation found for public key: %s", pubkey.String())
+		log.Println(err)
+		return
+	}
+
+	log.Printf("Deleting reservation for public key: %s", pubkey.String())
+	delete(tx.data.reservations, pubkey.String())
+
+	return
+}
+
+// Reservations returns every reservation within the transaction, sorted by public key.
+func (tx *memoryTx) Reservations() (reservations []Reservation, err error) {
+	for _, r := range tx.data.reservations {
+		reservations = append(reservations, cloneReservation(r))
+	}
+
+	sort.Slice(reservations, func(i, j int) bool { return reservations[i].Key.String() < reservations[j].Key.String() })
+	return
+}
+
+// ReservedID returns the public key that an ID is reserved for within the transaction, or nil if it is not reserved.
+func (tx *memoryTx) ReservedID(id uint64) (pubkey *key.Public, err error) {
+	for _, r := range tx.data.reservations {
+		if id != 0 && r.ID == id {
+			return r.Key, nil
+		}
+	}
+
+	return
+}
+
+// ReservedWithin returns the public keys with a reserved address within a network within the transaction, sorted by address.
+func (tx *memoryTx) ReservedWithin(network *net.IPNet) (keys []*key.Public, err error) {
+	type reserved struct {
+		ip  net.IP
+		key *key.Public
+	}
+
+	var within []reserved
+	for _, r := range tx.data.reservations {
+		for _, ip := range r.Addresses {
+			if network.Contains(ip) {
+				within = append(within, reserved{ip.To16(), r.Key})
+			}
+		}
+	}
+
+	sort.Slice(within, func(i, j int) bool { return bytes.Compare(within[i].ip, within[j].ip) < 0 })
+	for _, r := range within {
+		keys = append(keys, r.key)
+	}
+
+	return
+}
+
+// SetLease stores when the lease for a user ID was granted and when it expires within the transaction.
+func (tx *memoryTx) SetLease(id uint64, granted, expires time.Time) (err error) {
+	if err = tx.check(); err != nil {
+		return
+	}
+
+	if _, ok := tx.data.users[id]; !ok {
+		err = fmt.Errorf("User with ID: %d does not exist", id)
+		log.Println(err)
+		return
+	}
+
+	log.Printf("Setting lease for user with ID: %d, expires: %v", id, expires)
+	tx.data.leases[id] = Lease{id, granted, expires}
+
+	return
+}
+
+// GetLease returns the lease for a user ID within the transaction.
+func (tx *memoryTx) GetLease(id uint64) (l Lease, err error) {
+	l, ok := tx.data.leases[id]
+	if !ok {
+		err = fmt.Errorf("No lease found for user with ID: %d", id)
+	}
+
+	return
+}
+
+// DelLease removes the lease for a user ID within the transaction, but keeps the user.
+func (tx *memoryTx) DelLease(id uint64) (err error) {
+	if err = tx.check(); err != nil {
+		return
+	}
+
+	log.Printf("Deleting lease for user with ID: %d", id)
+	delete(tx.data.leases, id)
+
+	return
+}
+
+// Leases returns all active leases within the transaction, sorted by ID.
+func (tx *memoryTx) Leases() (leases []Lease, err error) {
+	for _, l := range tx.data.leases {
+		leases = append(leases, l)
+	}
+
+	sort.Slice(leases, func(i, j int) bool { return leases[i].ID < leases[j].ID })
+	return
+}
+
+// SetAdmin sets the hashed password for the administrator within the transaction.
+func (tx *memoryTx) SetAdmin(hash string) (err error) {
+	if err = tx.check(); err != nil {
+		return
+	}
+
+	log.Printf("Updating password hash for administration")
+	tx.data.hash = hash
+
+	return
+}
+
+// AdminHash retrieves the password hash for administrator within the transaction.
+func (tx *memoryTx) AdminHash() (hash string, err error) {
+	return tx.data.hash, nil
+}
+
+// SetVerifier sets the derived keys for the administrator within the transaction.
+func (tx *memoryTx) SetVerifier(v Verifier) (err error) {
+	if err = tx.check(); err != nil {
+		return
+	}
+
+	log.Printf("Updating verifier for administration")
+	tx.data.verifier = &v
+
+	return
+}
+
+// AdminVerifier retrieves the derived keys for the administrator within the transaction.
+func (tx *memoryTx) AdminVerifier() (v Verifier, err error) {
+	if tx.data.verifier == nil {
+		err = errNoVerifier
+		return
+	}
+
+	return *tx.data.verifier, nil
+}
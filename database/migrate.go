@@ -0,0 +1,137 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/boltdb/bolt"
+)
+
+// metaBucket defines the namespace for information about the database itself, such as the schema version.
+const metaBucket = "Meta"
+
+// schemaKey is the key for the schema version in the meta bucket.
+const schemaKey = "schema"
+
+// buckets are the buckets that should always exist. Buckets added later are created by their migrations.
+var buckets = []string{usersBucket, adminBucket, leasesBucket, pubKeysBucket, freeIDsBucket, metaBucket}
+
+// Migration describes a change to the schema. Version is the schema version after the migration has been applied.
+type Migration struct {
+	Version     uint64
+	Description string
+	migrate     func(*boltTx) error
+}
+
+// migrations is the ordered registry of every migration, the schema version is the number of applied migrations.
+// New migrations are only ever appended, and have to handle a database created before the buckets they use existed.
+var migrations = []Migration{
+	{1, "Convert users stored as public key strings into user records", migrateUsers},
+	{2, "Build the public key index and free IDs for existing users", buildIndex},
+	{3, "Add static reservations of IDs and addresses for public keys", addReservations},
+	{4, "Add leases for users registered before leases existed", addLeases},
+	{5, "Replace the key derived from the admin password with a stored key and server key", upgradeVerifier},
+	{6, "Index users by their index within their pool, and reservations by ID and address", indexLookups},
+}
+
+// SchemaVersion is the schema version used by this binary.
+var SchemaVersion = uint64(len(migrations))
+
+// errDryRun is returned to roll back the transaction for a dry run.
+var errDryRun = errors.New("Dry run")
+
+// schemaVersion returns the schema version of the database, a database created before the schema was versioned has version 0.
+func (tx *boltTx) schemaVersion() (version uint64, err error) {
+	bucket := tx.Bucket([]byte(metaBucket))
+	if bucket == nil {
+		return
+	}
+
+	v := bucket.Get([]byte(schemaKey))
+	if v == nil {
+		return
+	}
+
+	return binToUint64(v), nil
+}
+
+// createBuckets creates every bucket that should always exist, and records the buckets it created.
+func (tx *boltTx) createBuckets() error {
+	tx.created = make(map[string]bool)
+
+	for _, bucket := range buckets {
+		if tx.Bucket([]byte(bucket)) != nil {
+			continue
+		}
+
+		if _, err := tx.CreateBucket([]byte(bucket)); err != nil {
+			return err
+		}
+
+		tx.created[bucket] = true
+	}
+
+	return nil
+}
+
+// migrate applies every migration newer than the schema version of the database, and returns the applied migrations.
+// A database with a newer schema version than this binary is refused.
+func (tx *boltTx) migrate() (applied []Migration, err error) {
+	version, err := tx.schemaVersion()
+	if err != nil {
+		return
+	}
+
+	if version > SchemaVersion {
+		err = fmt.Errorf("Database has schema version: %d, which is newer than the supported version: %d", version, SchemaVersion)
+		return
+	}
+
+	if err = tx.createBuckets(); err != nil {
+		return
+	}
+
+	for _, m := range migrations[version:] {
+		if err = m.migrate(tx); err != nil {
+			err = fmt.Errorf("Unable to migrate to schema version: %d, due to error: %v", m.Version, err)
+			return
+		}
+
+		applied = append(applied, m)
+	}
+
+	err = tx.Bucket([]byte(metaBucket)).Put([]byte(schemaKey), uint64ToBin(SchemaVersion))
+	return
+}
+
+// Migrate opens an existing database, applies every pending migration and returns them. With dryRun the migrations are
+// rolled back, so only the pending migrations are returned and the database is left unchanged.
+func Migrate(path string, dryRun bool) (applied []Migration, err error) {
+	if _, err = os.Stat(path); err != nil {
+		return
+	}
+
+	db, err := openBolt(path, false)
+	if err != nil {
+		return
+	}
+	defer db.Close()
+
+	err = db.Update(func(tx *bolt.Tx) (err error) {
+		if applied, err = (&boltTx{Tx: tx}).migrate(); err != nil {
+			return
+		}
+
+		if dryRun {
+			return errDryRun
+		}
+
+		return
+	})
+	if err == errDryRun {
+		err = nil
+	}
+
+	return
+}
@@ -0,0 +1,290 @@
+package database_test
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"github.com/willeponken/elvisp/auth"
+	"github.com/willeponken/elvisp/database"
+	"github.com/willeponken/go-cjdns/key"
+)
+
+// mustLegacy creates a database from before the schema was versioned, with a user stored as a public key string. Unless leases is
+// true, the database is also from before leases existed.
+func mustLegacy(t *testing.T, leases bool) (path string) {
+	db := MustOpen()
+	path = db.Path()
+
+	err := database.Bolt(db.Database).Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket([]byte("Meta")); err != nil {
+			return err
+		}
+
+		if !leases {
+			if err := tx.DeleteBucket([]byte("Leases")); err != nil {
+				return err
+			}
+		}
+
+		return tx.Bucket([]byte("Users")).Put(uint64ToBin(1), []byte(key.Generate().Pubkey().String()))
+	})
+	if err != nil {
+		t.Fatalf("Update returned unexpected error: %v", err)
+	}
+
+	db.Database.Close()
+	return
+}
+
+// TestOpen_schemaVersion checks if a new database gets the schema version of the binary.
+func TestOpen_schemaVersion(t *testing.T) {
+	db := MustOpen()
+	defer db.MustClose()
+
+	var version []byte
+	database.Bolt(db.Database).View(func(tx *bolt.Tx) error {
+		version = append(version, tx.Bucket([]byte("Meta")).Get([]byte("schema"))...)
+		return nil
+	})
+
+	if !bytes.Equal(version, uint64ToBin(database.SchemaVersion)) {
+		t.Errorf("Open stored unexpected schema version: %v, wanted: %d", version, database.SchemaVersion)
+	}
+}
+
+// TestOpen_newerSchema checks if a database with a newer schema version than the binary is refused.
+func TestOpen_newerSchema(t *testing.T) {
+	db := MustOpen()
+	path := db.Path()
+	defer db.MustClose()
+
+	err := database.Bolt(db.Database).Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("Meta")).Put([]byte("schema"), uint64ToBin(database.SchemaVersion+1))
+	})
+	if err != nil {
+		t.Fatalf("Update returned unexpected error: %v", err)
+	}
+	db.Database.Close()
+
+	if _, err := database.Open(path); err == nil {
+		t.Errorf("Open expected error but got %v", err)
+	}
+
+	if _, err := database.Migrate(path, true); err == nil {
+		t.Errorf("Migrate expected error but got %v", err)
+	}
+}
+
+// TestMigrate checks if a dry run reports the pending migrations without applying them, and that they are applied otherwise.
+func TestMigrate(t *testing.T) {
+	path := mustLegacy(t, true)
+
+	var migrateTests = []struct {
+		dryRun  bool
+		applied int
+	}{
+		{true, int(database.SchemaVersion)},
+		{true, int(database.SchemaVersion)}, // Nothing changed by the dry run
+		{false, int(database.SchemaVersion)},
+		{false, 0},
+		{true, 0},
+	}
+
+	for row, test := range migrateTests {
+		applied, err := database.Migrate(path, test.dryRun)
+		if err != nil {
+			t.Errorf("Row: %d returned unexpected error: %v", row, err)
+		}
+
+		if len(applied) != test.applied {
+			t.Errorf("Row: %d returned unexpected migrations, got: %v, wanted: %d", row, applied, test.applied)
+		}
+	}
+
+	db, err := database.Open(path)
+	if err != nil {
+		t.Fatalf("Open returned unexpected error: %v", err)
+	}
+	defer (&TestDB{db, path}).MustClose()
+
+	if u, err := db.GetUser(1); err != nil || u.Source != database.SourceMigrated {
+		t.Errorf("GetUser returned unexpected user: %+v, error: %v", u, err)
+	}
+}
+
+// TestMigrate_leases checks if users in a database from before leases existed get leases that never expire, and that users without a
+// lease in a database that had leases are left released.
+func TestMigrate_leases(t *testing.T) {
+	var leaseTests = []struct {
+		leases bool
+		lease  bool
+	}{
+		{false, true},
+		{true, false},
+	}
+
+	for row, test := range leaseTests {
+		path := mustLegacy(t, test.leases)
+
+		db, err := database.Open(path)
+		if err != nil {
+			t.Fatalf("Row: %d returned unexpected error: %v", row, err)
+		}
+
+		l, err := db.GetLease(1)
+		if (err == nil) != test.lease {
+			t.Errorf("Row: %d returned unexpected lease: %+v, error: %v, wanted lease: %t", row, l, err, test.lease)
+		}
+
+		if err == nil && !l.Expires.IsZero() {
+			t.Errorf("Row: %d returned unexpected expiry: %v, wanted a lease that never expires", row, l.Expires)
+		}
+
+		(&TestDB{db, path}).MustClose()
+	}
+}
+
+// TestMigrate_verifier checks if a verifier holding the key derived from the admin password is replaced by the stored key and server key.
+func TestMigrate_verifier(t *testing.T) {
+	db := MustOpen()
+	path := db.Path()
+
+	salt := []byte("salt")
+	salted := auth.DeriveKey("secret", salt, 4096)
+
+	legacy := append(uint64ToBin(4096), uint64ToBin(uint64(len(salt)))...)
+	legacy = append(append(legacy, salt...), salted...)
+
+	err := database.Bolt(db.Database).Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket([]byte("Admin")).Put([]byte("verifier"), legacy); err != nil {
+			return err
+		}
+
+		return tx.Bucket([]byte("Meta")).Put([]byte("schema"), uint64ToBin(4))
+	})
+	if err != nil {
+		t.Fatalf("Update returned unexpected error: %v", err)
+	}
+	db.Database.Close()
+
+	if applied, err := database.Migrate(path, false); err != nil || len(applied) != int(database.SchemaVersion)-4 {
+		t.Fatalf("Migrate returned unexpected migrations: %v, error: %v", applied, err)
+	}
+
+	db.Database, err = database.Open(path)
+	if err != nil {
+		t.Fatalf("Open returned unexpected error: %v", err)
+	}
+	defer db.MustClose()
+
+	var stored []byte
+	database.Bolt(db.Database).View(func(tx *bolt.Tx) error {
+		stored = append(stored, tx.Bucket([]byte("Admin")).Get([]byte("verifier"))...)
+		return nil
+	})
+
+	if bytes.Contains(stored, salted) {
+		t.Errorf("Migrate left the key derived from the password in the verifier")
+	}
+
+	storedKey, serverKey := auth.Keys(salted)
+	if v, err := db.AdminVerifier(); err != nil || !bytes.Equal(v.StoredKey, storedKey) || !bytes.Equal(v.ServerKey, serverKey) {
+		t.Errorf("AdminVerifier returned unexpected verifier: %+v, error: %v", v, err)
+	}
+}
+
+// TestMigrate_reservations checks if the reservations bucket is created for a database from before reservations existed.
+func TestMigrate_reservations(t *testing.T) {
+	db := MustOpen()
+	path := db.Path()
+
+	err := database.Bolt(db.Database).Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket([]byte("Reservations")); err != nil {
+			return err
+		}
+
+		return tx.Bucket([]byte("Meta")).Put([]byte("schema"), uint64ToBin(2))
+	})
+	if err != nil {
+		t.Fatalf("Update returned unexpected error: %v", err)
+	}
+	db.Database.Close()
+
+	if db.Database, err = database.Open(path); err != nil {
+		t.Fatalf("Open returned unexpected error: %v", err)
+	}
+	defer db.MustClose()
+
+	if err = db.Reserve(database.Reservation{Key: key.Generate().Pubkey(), ID: 3}); err != nil {
+		t.Errorf("Reserve returned unexpected error: %v", err)
+	}
+}
+
+// TestMigrate_lookups checks if the pool index and the indexes of reserved IDs and addresses are built for existing users and
+// reservations.
+func TestMigrate_lookups(t *testing.T) {
+	db := MustOpen()
+	path := db.Path()
+
+	user, reserved := key.Generate().Pubkey(), key.Generate().Pubkey()
+	ip := net.ParseIP("10.0.0.5")
+
+	err := db.Update(func(tx database.Tx) error {
+		if _, err := tx.InsertUser(database.User{Key: user, Pool: "a", Index: 7}); err != nil {
+			return err
+		}
+
+		return tx.SetReservation(database.Reservation{Key: reserved, ID: 3, Addresses: []net.IP{ip}})
+	})
+	if err != nil {
+		t.Fatalf("Update returned unexpected error: %v", err)
+	}
+
+	err = database.Bolt(db.Database).Update(func(tx *bolt.Tx) error {
+		for _, bucket := range []string{"PoolIndexes", "ReservedIDs", "ReservedAddresses"} {
+			if err := tx.DeleteBucket([]byte(bucket)); err != nil {
+				return err
+			}
+		}
+
+		return tx.Bucket([]byte("Meta")).Put([]byte("schema"), uint64ToBin(5))
+	})
+	if err != nil {
+		t.Fatalf("Update returned unexpected error: %v", err)
+	}
+	db.Database.Close()
+
+	if db.Database, err = database.Open(path); err != nil {
+		t.Fatalf("Open returned unexpected error: %v", err)
+	}
+	defer db.MustClose()
+
+	err = db.View(func(tx database.Tx) error {
+		if k, err := tx.PoolUser("a", 7); err != nil || !k.Equal(user) {
+			t.Errorf("PoolUser returned unexpected public key: %v, error: %v", k, err)
+		}
+
+		if k, err := tx.ReservedID(3); err != nil || !k.Equal(reserved) {
+			t.Errorf("ReservedID returned unexpected public key: %v, error: %v", k, err)
+		}
+
+		_, network, _ := net.ParseCIDR("10.0.0.0/24")
+		if keys, err := tx.ReservedWithin(network); err != nil || len(keys) != 1 || !keys[0].Equal(reserved) {
+			t.Errorf("ReservedWithin returned unexpected public keys: %v, error: %v", keys, err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		t.Errorf("View returned unexpected error: %v", err)
+	}
+}
+
+// TestMigrate_missing checks if migrating a database that does not exist fails, instead of creating it.
+func TestMigrate_missing(t *testing.T) {
+	if _, err := database.Migrate(tempFile(), true); err == nil {
+		t.Errorf("Migrate expected error but got %v", err)
+	}
+}
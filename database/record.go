@@ -0,0 +1,224 @@
+package database
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/willeponken/go-cjdns/key"
+)
+
+// Sources of creation for a user.
+const (
+	SourceClient   = "client"   // Leased by the node itself
+	SourceAdmin    = "admin"    // Leased by an administrator for the node
+	SourceMigrated = "migrated" // Registered before the source was recorded
+)
+
+// userRecordVersion is the version of the encoded user record, stored in every record.
+const userRecordVersion = 1
+
+// Assignment holds an address assigned to a user from a pool.
+type Assignment struct {
+	Pool string
+	IP   net.IP
+}
+
+// User holds a registered user. Zero times mean that it has not happened, or happened before it was recorded.
+// Pool is the name of the pool the user leases from, and Index the position of its addresses within the pool. Both are empty
+// for a user registered before pools, which leases from the default pool with its ID as the index. Probes is the number of taken
+// indexes that were skipped after the index hashed from the public key, when the index was allocated by the hash allocator.
+type User struct {
+	ID        uint64
+	Key       *key.Public
+	Created   time.Time
+	LastSeen  time.Time
+	LastIP    net.IP
+	Addresses []Assignment
+	Labels    map[string]string
+	Source    string
+	Pool      string
+	Index     uint64
+	Probes    uint64
+}
+
+// withDefaults returns the user for insertion, a zero Created time is set to now and an empty source to SourceClient.
+func (u User) withDefaults() User {
+	if u.Created.IsZero() {
+		u.Created = time.Now()
+	}
+
+	if u.Source == "" {
+		u.Source = SourceClient
+	}
+
+	return u
+}
+
+// assignmentRecord is the encoded form of an assignment.
+type assignmentRecord struct {
+	Pool string `json:"pool"`
+	IP   string `json:"ip"`
+}
+
+// userRecord is the encoded form of a user, stored as JSON in the users bucket. Times are Unix seconds, 0 is the zero time.
+type userRecord struct {
+	Version   int                `json:"version"`
+	Key       string             `json:"key"`
+	Created   int64              `json:"created,omitempty"`
+	LastSeen  int64              `json:"last_seen,omitempty"`
+	LastIP    string             `json:"last_ip,omitempty"`
+	Addresses []assignmentRecord `json:"addresses,omitempty"`
+	Labels    map[string]string  `json:"labels,omitempty"`
+	Source    string             `json:"source,omitempty"`
+	Pool      string             `json:"pool,omitempty"`
+	Index     uint64             `json:"index,omitempty"`
+	Probes    uint64             `json:"probes,omitempty"`
+}
+
+// timeToUnix returns the Unix time for t, the zero time is represented as 0.
+func timeToUnix(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+
+	return t.Unix()
+}
+
+// unixToTime converts a Unix time into a time.Time, 0 is converted to the zero time.
+func unixToTime(sec int64) time.Time {
+	if sec == 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(sec, 0)
+}
+
+// isRecord returns true if v is an encoded user record, and not a public key string as stored before records existed.
+func isRecord(v []byte) bool {
+	return len(v) > 0 && v[0] == '{'
+}
+
+// newUserRecord converts a user into the encoded form.
+func newUserRecord(u User) userRecord {
+	r := userRecord{
+		Version:  userRecordVersion,
+		Key:      u.Key.String(),
+		Created:  timeToUnix(u.Created),
+		LastSeen: timeToUnix(u.LastSeen),
+		Labels:   u.Labels,
+		Source:   u.Source,
+		Pool:     u.Pool,
+		Index:    u.Index,
+		Probes:   u.Probes,
+	}
+
+	if u.LastIP != nil {
+		r.LastIP = u.LastIP.String()
+	}
+
+	for _, a := range u.Addresses {
+		r.Addresses = append(r.Addresses, assignmentRecord{Pool: a.Pool, IP: a.IP.String()})
+	}
+
+	return r
+}
+
+// encodeUser encodes a user as a record.
+func encodeUser(u User) ([]byte, error) {
+	return json.Marshal(newUserRecord(u))
+}
+
+// decodeRecord decodes a user record, a public key string stored before records existed is decoded as a migrated user.
+func decodeRecord(v []byte) (r userRecord, err error) {
+	if !isRecord(v) {
+		r = userRecord{Version: userRecordVersion, Key: string(v), Source: SourceMigrated}
+		return
+	}
+
+	if err = json.Unmarshal(v, &r); err != nil {
+		return
+	}
+
+	if r.Version > userRecordVersion {
+		err = fmt.Errorf("Unsupported user record version: %d", r.Version)
+	}
+
+	return
+}
+
+// user converts the encoded form into the user with an ID.
+func (r userRecord) user(id uint64) (u User, err error) {
+	if r.Version > userRecordVersion {
+		err = fmt.Errorf("Unsupported user record version: %d", r.Version)
+		return
+	}
+
+	u = User{
+		ID:       id,
+		Created:  unixToTime(r.Created),
+		LastSeen: unixToTime(r.LastSeen),
+		LastIP:   net.ParseIP(r.LastIP),
+		Labels:   r.Labels,
+		Source:   r.Source,
+		Pool:     r.Pool,
+		Index:    r.Index,
+		Probes:   r.Probes,
+	}
+
+	if u.Key, err = key.DecodePublic(r.Key); err != nil {
+		return
+	}
+
+	for _, a := range r.Addresses {
+		u.Addresses = append(u.Addresses, Assignment{Pool: a.Pool, IP: net.ParseIP(a.IP)})
+	}
+
+	return
+}
+
+// decodeUser decodes the user record for an ID.
+func decodeUser(id uint64, v []byte) (u User, err error) {
+	r, err := decodeRecord(v)
+	if err != nil {
+		return
+	}
+
+	return r.user(id)
+}
+
+// migrateUsers converts every public key string, stored before records existed, into a user record.
+func migrateUsers(tx *boltTx) (err error) {
+	bucket := tx.Bucket([]byte(usersBucket))
+
+	migrated := make(map[string][]byte)
+	err = bucket.ForEach(func(k, v []byte) error {
+		if isRecord(v) {
+			return nil
+		}
+
+		r, err := json.Marshal(userRecord{Version: userRecordVersion, Key: string(v), Source: SourceMigrated})
+		if err != nil {
+			return err
+		}
+
+		migrated[string(k)] = r
+		return nil
+	})
+	if err != nil || len(migrated) == 0 {
+		return
+	}
+
+	log.Printf("Migrating %d users to user records", len(migrated))
+
+	// The bucket can not be changed while iterating over it.
+	for k, r := range migrated {
+		if err = bucket.Put([]byte(k), r); err != nil {
+			return
+		}
+	}
+
+	return
+}
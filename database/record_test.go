@@ -0,0 +1,108 @@
+package database_test
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/willeponken/elvisp/database"
+	"github.com/willeponken/go-cjdns/key"
+)
+
+// TestPutUser_GetUser checks if every field in a user record is stored and retrieved unchanged.
+func TestPutUser_GetUser(t *testing.T) {
+	db := MustOpen()
+	defer db.MustClose()
+
+	pubkey := key.Generate().Pubkey()
+	id, err := db.AddUser(pubkey)
+	if err != nil {
+		t.Fatalf("AddUser returned unexpected error: %v", err)
+	}
+
+	u, err := db.GetUser(id)
+	if err != nil {
+		t.Fatalf("GetUser returned unexpected error: %v", err)
+	}
+
+	if u.Created.IsZero() || u.Source != database.SourceClient || !u.Key.Equal(pubkey) {
+		t.Errorf("GetUser returned unexpected new user: %+v", u)
+	}
+
+	now := time.Unix(time.Now().Unix(), 0)
+	want := database.User{
+		ID:       id,
+		Key:      pubkey,
+		Created:  now.Add(-time.Hour),
+		LastSeen: now,
+		LastIP:   pubkey.IP(),
+		Addresses: []database.Assignment{
+			{Pool: "10.0.0.0/24", IP: net.ParseIP("10.0.0.1")},
+			{Pool: "fd00::/64", IP: net.ParseIP("fd00::1")},
+		},
+		Labels: map[string]string{"owner": "alice"},
+		Source: database.SourceAdmin,
+	}
+
+	if err = db.PutUser(want); err != nil {
+		t.Fatalf("PutUser returned unexpected error: %v", err)
+	}
+
+	got, err := db.GetUser(id)
+	if err != nil {
+		t.Fatalf("GetUser returned unexpected error: %v", err)
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("GetUser returned unexpected user, got: %+v, wanted: %+v", got, want)
+	}
+
+	// The public key identifies the user and can not be changed.
+	want.Key = key.Generate().Pubkey()
+	if err = db.PutUser(want); err == nil {
+		t.Errorf("PutUser expected error for changed key but got %v", err)
+	}
+}
+
+// TestOpen_migrateUsers checks if users stored as a public key string are migrated to user records.
+func TestOpen_migrateUsers(t *testing.T) {
+	db := MustOpen()
+	path := db.Path()
+
+	pubkey := key.Generate().Pubkey()
+	err := database.Bolt(db.Database).Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket([]byte("Meta")); err != nil {
+			return err
+		}
+
+		return tx.Bucket([]byte("Users")).Put(uint64ToBin(1), []byte(pubkey.String()))
+	})
+	if err != nil {
+		t.Fatalf("Update returned unexpected error: %v", err)
+	}
+	db.Database.Close()
+
+	reopened, err := database.Open(path)
+	if err != nil {
+		t.Fatalf("Open returned unexpected error: %v", err)
+	}
+	db = TestDB{reopened, path}
+	defer db.MustClose()
+
+	var v []byte
+	database.Bolt(db.Database).View(func(tx *bolt.Tx) error {
+		v = append(v, tx.Bucket([]byte("Users")).Get(uint64ToBin(1))...)
+		return nil
+	})
+
+	if len(v) == 0 || v[0] != '{' {
+		t.Errorf("Open did not migrate user, got: %s", v)
+	}
+
+	u, err := db.GetUser(1)
+	if err != nil || !u.Key.Equal(pubkey) || u.Source != database.SourceMigrated || !u.Created.IsZero() {
+		t.Errorf("GetUser returned unexpected user: %+v, error: %v", u, err)
+	}
+}
@@ -0,0 +1,390 @@
+package database
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/boltdb/bolt"
+	"github.com/willeponken/go-cjdns/key"
+)
+
+// reservationsBucket defines the namespace for static reservations, mapping a public key to its reservation.
+const reservationsBucket = "Reservations"
+
+// Reservation pins a public key to an ID, and to addresses that are leased instead of the addresses generated from the ID.
+// A zero ID means that the ID is allocated as for any other user.
+type Reservation struct {
+	Key       *key.Public
+	ID        uint64
+	Addresses []net.IP
+}
+
+// Reserved returns the reserved address within network, or nil if there is none.
+func (r Reservation) Reserved(network *net.IPNet) net.IP {
+	for _, ip := range r.Addresses {
+		if network.Contains(ip) {
+			return ip
+		}
+	}
+
+	return nil
+}
+
+// reservationRecord is the encoded form of a reservation, stored as JSON.
+type reservationRecord struct {
+	Key       string   `json:"key"`
+	ID        uint64   `json:"id,omitempty"`
+	Addresses []string `json:"addresses,omitempty"`
+}
+
+// newReservationRecord converts a reservation into the encoded form.
+func newReservationRecord(r Reservation) reservationRecord {
+	rr := reservationRecord{Key: r.Key.String(), ID: r.ID}
+	for _, ip := range r.Addresses {
+		rr.Addresses = append(rr.Addresses, ip.String())
+	}
+
+	return rr
+}
+
+// reservation converts the encoded form into the reservation.
+func (rr reservationRecord) reservation() (r Reservation, err error) {
+	r.ID = rr.ID
+	if r.Key, err = key.DecodePublic(rr.Key); err != nil {
+		return
+	}
+
+	for _, a := range rr.Addresses {
+		ip := net.ParseIP(a)
+		if ip == nil {
+			err = fmt.Errorf("Invalid reserved address: %s for public key: %s", a, rr.Key)
+			return
+		}
+
+		r.Addresses = append(r.Addresses, ip)
+	}
+
+	return
+}
+
+// decodeReservation decodes a reservation stored as JSON.
+func decodeReservation(v []byte) (r Reservation, err error) {
+	var rr reservationRecord
+	if err = json.Unmarshal(v, &rr); err != nil {
+		return
+	}
+
+	return rr.reservation()
+}
+
+// newUserID returns the ID for a new user within the transaction. A user without an ID gets the ID reserved for its public key,
+// or the lowest free ID that is not reserved for another public key. An ID reserved for another public key is refused.
+func newUserID(tx Tx, u User) (id uint64, err error) {
+	if u.ID == 0 {
+		if r, err := tx.GetReservation(u.Key); err == nil && r.ID != 0 {
+			return r.ID, nil
+		}
+
+		var e error
+		id, err = tx.FreeID(func(id uint64) bool {
+			var k *key.Public
+			if k, e = tx.ReservedID(id); e != nil {
+				return false
+			}
+
+			return k != nil
+		})
+		if err == nil {
+			err = e
+		}
+
+		return
+	}
+
+	k, err := tx.ReservedID(u.ID)
+	if err != nil {
+		return
+	}
+
+	if k != nil && !k.Equal(u.Key) {
+		err = fmt.Errorf("ID: %d is reserved for public key: %s", u.ID, k.String())
+		return
+	}
+
+	return u.ID, nil
+}
+
+// hostNetwork returns a network with only ip.
+func hostNetwork(ip net.IP) *net.IPNet {
+	return &net.IPNet{IP: ip.To16(), Mask: net.CIDRMask(8*net.IPv6len, 8*net.IPv6len)}
+}
+
+// networkRange returns the first and the last address within a network, both in their 16-byte form. Both are nil if the mask
+// does not fit the address.
+func networkRange(network *net.IPNet) (first, last net.IP) {
+	ip := network.IP.Mask(network.Mask)
+	if ip == nil {
+		return
+	}
+
+	last = make(net.IP, len(ip))
+	for i := range ip {
+		last[i] = ip[i] | ^network.Mask[i]
+	}
+
+	return ip.To16(), last.To16()
+}
+
+// CheckReservation returns an error if a reservation conflicts with another reservation, or with the ID of a registered user, within the transaction.
+func CheckReservation(tx Tx, r Reservation) (err error) {
+	if r.ID != 0 {
+		k, err := tx.ReservedID(r.ID)
+		if err != nil {
+			return err
+		}
+
+		if k != nil && !k.Equal(r.Key) {
+			return fmt.Errorf("ID: %d is already reserved for public key: %s", r.ID, k.String())
+		}
+	}
+
+	for _, ip := range r.Addresses {
+		keys, err := tx.ReservedWithin(hostNetwork(ip))
+		if err != nil {
+			return err
+		}
+
+		for _, k := range keys {
+			if !k.Equal(r.Key) {
+				return fmt.Errorf("Address: %s is already reserved for public key: %s", ip, k.String())
+			}
+		}
+	}
+
+	if r.ID == 0 {
+		return
+	}
+
+	if id, err := tx.GetID(r.Key); err == nil && id != r.ID {
+		return fmt.Errorf("User with public key: %s already has ID: %d, remove it before reserving ID: %d", r.Key.String(), id, r.ID)
+	}
+
+	if u, err := tx.GetUser(r.ID); err == nil && !u.Key.Equal(r.Key) {
+		return fmt.Errorf("ID: %d is already used by user with public key: %s", r.ID, u.Key.String())
+	}
+
+	return
+}
+
+// FreeID returns the lowest ID that is not used by any user within the transaction, and for which skip returns false.
+// IDs freed by removed users are tried first, then the IDs after all users.
+func (tx *boltTx) FreeID(skip func(id uint64) bool) (id uint64, err error) {
+	c := tx.Bucket([]byte(freeIDsBucket)).Cursor()
+	for k, _ := c.First(); k != nil; k, _ = c.Next() {
+		if id = binToUint64(k); !skip(id) {
+			return
+		}
+	}
+
+	id = 1
+	if last, _ := tx.Bucket([]byte(usersBucket)).Cursor().Last(); last != nil {
+		id = binToUint64(last) + 1
+	}
+
+	for skip(id) {
+		id++
+	}
+
+	return
+}
+
+// SetReservation stores a reservation within the transaction, replacing any reservation for the same public key.
+func (tx *boltTx) SetReservation(r Reservation) (err error) {
+	v, err := json.Marshal(newReservationRecord(r))
+	if err != nil {
+		return
+	}
+
+	if old, e := tx.GetReservation(r.Key); e == nil {
+		if err = tx.unindexReservation(old); err != nil {
+			return
+		}
+	}
+
+	if err = tx.indexReservation(r); err != nil {
+		return
+	}
+
+	log.Printf("Setting reservation for public key: %s, ID: %d, addresses: %v", r.Key.String(), r.ID, r.Addresses)
+	return tx.Bucket([]byte(reservationsBucket)).Put([]byte(r.Key.String()), v)
+}
+
+// GetReservation returns the reservation for a public key within the transaction.
+func (tx *boltTx) GetReservation(pubkey *key.Public) (r Reservation, err error) {
+	v := tx.Bucket([]byte(reservationsBucket)).Get([]byte(pubkey.String()))
+	if v == nil {
+		err = fmt.Errorf("No reservation found for public key: %s", pubkey.String())
+		return
+	}
+
+	return decodeReservation(v)
+}
+
+// DelReservation removes the reservation for a public key within the transaction, the user keeps its ID until it is removed.
+func (tx *boltTx) DelReservation(pubkey *key.Public) (err error) {
+	bucket := tx.Bucket([]byte(reservationsBucket))
+	r, err := tx.GetReservation(pubkey)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	if err = tx.unindexReservation(r); err != nil {
+		return
+	}
+
+	log.Printf("Deleting reservation for public key: %s", pubkey.String())
+	return bucket.Delete([]byte(pubkey.String()))
+}
+
+// Reservations returns every reservation within the transaction, sorted by public key.
+func (tx *boltTx) Reservations() (reservations []Reservation, err error) {
+	err = tx.Bucket([]byte(reservationsBucket)).ForEach(func(k, v []byte) error {
+		r, err := decodeReservation(v)
+		if err != nil {
+			return err
+		}
+
+		reservations = append(reservations, r)
+		return nil
+	})
+
+	return
+}
+
+// reservedIDsBucket defines the namespace for the index of reserved IDs, mapping every reserved ID to the public key.
+const reservedIDsBucket = "ReservedIDs"
+
+// reservedAddressesBucket defines the namespace for the index of reserved addresses, mapping every reserved address in its
+// 16-byte form to the public key, so the addresses within a network are a range of keys.
+const reservedAddressesBucket = "ReservedAddresses"
+
+// indexReservation adds the reserved ID and addresses to their indexes.
+func (tx *boltTx) indexReservation(r Reservation) (err error) {
+	v := []byte(r.Key.String())
+	if r.ID != 0 {
+		if err = tx.Bucket([]byte(reservedIDsBucket)).Put(uint64ToBin(r.ID), v); err != nil {
+			return
+		}
+	}
+
+	for _, ip := range r.Addresses {
+		if err = tx.Bucket([]byte(reservedAddressesBucket)).Put(ip.To16(), v); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// unindexReservation removes the reserved ID and addresses from their indexes, except those reserved for another public key.
+func (tx *boltTx) unindexReservation(r Reservation) (err error) {
+	del := func(bucket *bolt.Bucket, k []byte) error {
+		if string(bucket.Get(k)) != r.Key.String() {
+			return nil
+		}
+
+		return bucket.Delete(k)
+	}
+
+	if err = del(tx.Bucket([]byte(reservedIDsBucket)), uint64ToBin(r.ID)); err != nil {
+		return
+	}
+
+	for _, ip := range r.Addresses {
+		if err = del(tx.Bucket([]byte(reservedAddressesBucket)), ip.To16()); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// ReservedID returns the public key that an ID is reserved for within the transaction, or nil if it is not reserved.
+func (tx *boltTx) ReservedID(id uint64) (pubkey *key.Public, err error) {
+	v := tx.Bucket([]byte(reservedIDsBucket)).Get(uint64ToBin(id))
+	if v == nil {
+		return
+	}
+
+	return key.DecodePublic(string(v))
+}
+
+// ReservedWithin returns the public keys with a reserved address within a network within the transaction, sorted by address.
+func (tx *boltTx) ReservedWithin(network *net.IPNet) (keys []*key.Public, err error) {
+	first, last := networkRange(network)
+	if first == nil {
+		err = fmt.Errorf("Invalid network: %s", network)
+		return
+	}
+
+	c := tx.Bucket([]byte(reservedAddressesBucket)).Cursor()
+	for k, v := c.Seek(first); k != nil && bytes.Compare(k, last) <= 0; k, v = c.Next() {
+		pubkey, err := key.DecodePublic(string(v))
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, pubkey)
+	}
+
+	return
+}
+
+// addReservations creates the bucket for static reservations in a database created before they existed.
+func addReservations(tx *boltTx) (err error) {
+	_, err = tx.CreateBucketIfNotExists([]byte(reservationsBucket))
+	return
+}
+
+// Reserve stores a reservation, replacing any reservation for the same public key. A reservation that conflicts with another
+// reservation, or with the ID of a registered user, is refused.
+func (db *Database) Reserve(r Reservation) error {
+	return db.Update(func(tx Tx) error {
+		if err := CheckReservation(tx, r); err != nil {
+			return err
+		}
+
+		return tx.SetReservation(r)
+	})
+}
+
+// GetReservation returns the reservation for a public key.
+func (db *Database) GetReservation(pubkey *key.Public) (r Reservation, err error) {
+	err = db.View(func(tx Tx) error {
+		r, err = tx.GetReservation(pubkey)
+		return err
+	})
+
+	return
+}
+
+// Unreserve removes the reservation for a public key.
+func (db *Database) Unreserve(pubkey *key.Public) error {
+	return db.Update(func(tx Tx) error {
+		return tx.DelReservation(pubkey)
+	})
+}
+
+// Reservations returns every reservation.
+func (db *Database) Reservations() (reservations []Reservation, err error) {
+	err = db.View(func(tx Tx) error {
+		reservations, err = tx.Reservations()
+		return err
+	})
+
+	return
+}
@@ -0,0 +1,712 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/willeponken/go-cjdns/key"
+)
+
+// sqliteDriver is the name of the database/sql driver used for SQLite. The driver is not part of elvisp, and has to be
+// linked into the binary, e.g. by building elvispd with the sqlite build tag.
+const sqliteDriver = "sqlite3"
+
+// sqliteSchema creates the tables for a SQLite store. Times are Unix seconds, 0 is the zero time. Addresses and labels are JSON,
+// a reservation without an ID has the ID 0. Reserved addresses are also stored in their 16-byte form, so the addresses within a
+// network are a range.
+var sqliteSchema = []string{
+	`CREATE TABLE IF NOT EXISTS users (
+		id INTEGER PRIMARY KEY,
+		key TEXT NOT NULL UNIQUE,
+		created INTEGER NOT NULL DEFAULT 0,
+		last_seen INTEGER NOT NULL DEFAULT 0,
+		last_ip TEXT NOT NULL DEFAULT '',
+		addresses TEXT NOT NULL DEFAULT 'null',
+		labels TEXT NOT NULL DEFAULT 'null',
+		source TEXT NOT NULL DEFAULT '',
+		pool TEXT NOT NULL DEFAULT '',
+		pool_index INTEGER NOT NULL DEFAULT 0,
+		probes INTEGER NOT NULL DEFAULT 0
+	)`,
+	`CREATE TABLE IF NOT EXISTS leases (
+		id INTEGER PRIMARY KEY REFERENCES users(id),
+		granted INTEGER NOT NULL,
+		expires INTEGER NOT NULL DEFAULT 0
+	)`,
+	`CREATE TABLE IF NOT EXISTS reservations (
+		key TEXT PRIMARY KEY,
+		id INTEGER NOT NULL DEFAULT 0,
+		addresses TEXT NOT NULL DEFAULT 'null'
+	)`,
+	`CREATE TABLE IF NOT EXISTS reserved_addresses (
+		address BLOB PRIMARY KEY,
+		key TEXT NOT NULL REFERENCES reservations(key)
+	)`,
+	`CREATE TABLE IF NOT EXISTS admin (
+		name TEXT PRIMARY KEY,
+		value BLOB NOT NULL
+	)`,
+}
+
+// sqliteColumns are the columns added to tables after they were first created, which are added to older databases when opened.
+var sqliteColumns = []struct {
+	table, column, definition string
+}{
+	{"users", "pool", "TEXT NOT NULL DEFAULT ''"},
+	{"users", "pool_index", "INTEGER NOT NULL DEFAULT 0"},
+	{"users", "probes", "INTEGER NOT NULL DEFAULT 0"},
+}
+
+// sqliteIndexes creates the indexes for a SQLite store, after the columns they use have been added.
+var sqliteIndexes = []string{
+	`CREATE INDEX IF NOT EXISTS users_pool ON users(pool, pool_index)`,
+	`CREATE INDEX IF NOT EXISTS reservations_id ON reservations(id)`,
+}
+
+// userColumns are the columns selected by scanUser.
+const userColumns = "id, key, created, last_seen, last_ip, addresses, labels, source, pool, pool_index, probes"
+
+// sqliteStore is a Store backed by SQLite, which can be queried by other processes while elvispd is running.
+type sqliteStore struct {
+	db *sql.DB
+}
+
+// sqliteTx represents a SQLite transaction.
+type sqliteTx struct {
+	*sql.Tx
+}
+
+// openSQLiteStore initializes or opens a SQLite database from a defined path.
+func openSQLiteStore(path string) (s *sqliteStore, err error) {
+	found := false
+	for _, d := range sql.Drivers() {
+		found = found || d == sqliteDriver
+	}
+
+	if !found {
+		err = fmt.Errorf("SQLite driver: %s is not linked into this binary, build it with the sqlite tag", sqliteDriver)
+		return
+	}
+
+	db, err := sql.Open(sqliteDriver, path)
+	if err != nil {
+		return
+	}
+
+	// SQLite only allows one writer at a time, so transactions are serialized instead of failing as busy.
+	db.SetMaxOpenConns(1)
+
+	for _, stmt := range sqliteSchema {
+		if _, err = db.Exec(stmt); err != nil {
+			db.Close()
+			return
+		}
+	}
+
+	if err = addColumns(db); err != nil {
+		db.Close()
+		return
+	}
+
+	for _, stmt := range sqliteIndexes {
+		if _, err = db.Exec(stmt); err != nil {
+			db.Close()
+			return
+		}
+	}
+
+	if err = addReservedAddresses(db); err != nil {
+		db.Close()
+		return
+	}
+
+	return &sqliteStore{db}, nil
+}
+
+// addColumns adds every column in sqliteColumns that is missing, to a database created by an older version.
+func addColumns(db *sql.DB) (err error) {
+	for _, c := range sqliteColumns {
+		var n int
+		if err = db.QueryRow("SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?", c.table, c.column).Scan(&n); err != nil {
+			return
+		}
+
+		if n > 0 {
+			continue
+		}
+
+		log.Printf("Adding column: %s to table: %s", c.column, c.table)
+		if _, err = db.Exec("ALTER TABLE " + c.table + " ADD COLUMN " + c.column + " " + c.definition); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// addReservedAddresses fills the reserved addresses from the reservations, in a database created before they were stored separately.
+func addReservedAddresses(db *sql.DB) (err error) {
+	var n int
+	if err = db.QueryRow(`SELECT COUNT(*) FROM reservations WHERE addresses != 'null'
+		AND NOT EXISTS (SELECT 1 FROM reserved_addresses)`).Scan(&n); err != nil || n == 0 {
+		return
+	}
+
+	log.Printf("Adding reserved addresses for %d reservations", n)
+	tx, err := db.Begin()
+	if err != nil {
+		return
+	}
+
+	stx := &sqliteTx{tx}
+	reservations, err := stx.Reservations()
+	if err != nil {
+		tx.Rollback()
+		return
+	}
+
+	for _, r := range reservations {
+		if err = stx.insertAddresses(r); err != nil {
+			tx.Rollback()
+			return
+		}
+	}
+
+	return tx.Commit()
+}
+
+// View runs fn within a transaction that is always rolled back.
+func (s *sqliteStore) View(fn func(Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	return fn(&sqliteTx{tx})
+}
+
+// Update runs fn within a transaction, which is rolled back if fn returns an error.
+func (s *sqliteStore) Update(fn func(Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if err = fn(&sqliteTx{tx}); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Close closes the SQLite database.
+func (s *sqliteStore) Close() error {
+	return s.db.Close()
+}
+
+// scanner is implemented by both sql.Row and sql.Rows.
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanUser scans a row with the userColumns into a user.
+func scanUser(row scanner) (u User, err error) {
+	var id uint64
+	var r userRecord
+	var addresses, labels string
+
+	if err = row.Scan(&id, &r.Key, &r.Created, &r.LastSeen, &r.LastIP, &addresses, &labels, &r.Source, &r.Pool, &r.Index, &r.Probes); err != nil {
+		return
+	}
+
+	if err = json.Unmarshal([]byte(addresses), &r.Addresses); err != nil {
+		return
+	}
+
+	if err = json.Unmarshal([]byte(labels), &r.Labels); err != nil {
+		return
+	}
+
+	r.Version = userRecordVersion
+	return r.user(id)
+}
+
+// userArgs returns the arguments for the columns after id in userColumns.
+func userArgs(u User) (args []interface{}, err error) {
+	r := newUserRecord(u)
+
+	addresses, err := json.Marshal(r.Addresses)
+	if err != nil {
+		return
+	}
+
+	labels, err := json.Marshal(r.Labels)
+	if err != nil {
+		return
+	}
+
+	return []interface{}{r.Key, r.Created, r.LastSeen, r.LastIP, string(addresses), string(labels), r.Source, r.Pool, r.Index, r.Probes}, nil
+}
+
+// insertUser inserts a user record with its ID.
+func (tx *sqliteTx) insertUser(u User) (err error) {
+	args, err := userArgs(u)
+	if err != nil {
+		return
+	}
+
+	_, err = tx.Exec("INSERT INTO users ("+userColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", append([]interface{}{u.ID}, args...)...)
+	return
+}
+
+// FreeID returns the lowest ID that is not used by any user within the transaction, and for which skip returns false.
+func (tx *sqliteTx) FreeID(skip func(id uint64) bool) (id uint64, err error) {
+	for from := uint64(1); ; from = id + 1 {
+		// The lowest unused ID from and after from, either from itself or the ID after a used ID that is followed by a gap.
+		err = tx.QueryRow(`SELECT CASE WHEN NOT EXISTS (SELECT 1 FROM users WHERE id = ?1) THEN ?1
+			ELSE (SELECT MIN(id) + 1 FROM users u WHERE u.id >= ?1 AND NOT EXISTS (SELECT 1 FROM users v WHERE v.id = u.id + 1)) END`, from).Scan(&id)
+		if err != nil || !skip(id) {
+			return
+		}
+	}
+}
+
+// exists returns true if the query returns a row.
+func (tx *sqliteTx) exists(query string, args ...interface{}) (ok bool, err error) {
+	err = tx.QueryRow("SELECT EXISTS ("+query+")", args...).Scan(&ok)
+	return
+}
+
+// InsertUser inserts a new user record within the transaction, and returns the ID. A user without an ID gets the ID reserved for
+// its public key, or the lowest free ID that is not reserved.
+func (tx *sqliteTx) InsertUser(u User) (id uint64, err error) {
+	k := u.Key.String()
+
+	exists, err := tx.exists("SELECT 1 FROM users WHERE key = ?", k)
+	if err != nil {
+		return
+	}
+
+	if exists {
+		err = fmt.Errorf("User with public key: %s already exists", k)
+		log.Println(err)
+		return
+	}
+
+	u = u.withDefaults()
+	if u.ID, err = newUserID(tx, u); err != nil {
+		return
+	}
+
+	if exists, err = tx.exists("SELECT 1 FROM users WHERE id = ?", u.ID); err != nil {
+		return
+	}
+
+	if exists {
+		err = fmt.Errorf("User with ID: %d already exists", u.ID)
+		log.Println(err)
+		return
+	}
+
+	log.Printf("Adding new user with key: %s and ID: %d", k, u.ID)
+	if err = tx.insertUser(u); err != nil {
+		return
+	}
+
+	return u.ID, nil
+}
+
+// GetUser returns the user record for a registered user ID within the transaction.
+func (tx *sqliteTx) GetUser(id uint64) (u User, err error) {
+	u, err = scanUser(tx.QueryRow("SELECT "+userColumns+" FROM users WHERE id = ?", id))
+	if err == sql.ErrNoRows {
+		err = fmt.Errorf("User with ID: %d does not exist", id)
+	}
+
+	return
+}
+
+// PutUser replaces the user record for a registered user within the transaction, the public key of the user can not be changed.
+func (tx *sqliteTx) PutUser(u User) (err error) {
+	args, err := userArgs(u)
+	if err != nil {
+		return
+	}
+
+	res, err := tx.Exec(`UPDATE users SET key = ?, created = ?, last_seen = ?, last_ip = ?, addresses = ?, labels = ?, source = ?,
+		pool = ?, pool_index = ?, probes = ? WHERE id = ? AND key = ?`, append(args, u.ID, u.Key.String())...)
+	if err != nil {
+		return
+	}
+
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return fmt.Errorf("User with ID: %d and public key: %s does not exist", u.ID, u.Key.String())
+	}
+
+	return
+}
+
+// GetID returns the ID for a registered user within the transaction.
+func (tx *sqliteTx) GetID(pubkey *key.Public) (id uint64, err error) {
+	err = tx.QueryRow("SELECT id FROM users WHERE key = ?", pubkey.String()).Scan(&id)
+	if err == sql.ErrNoRows {
+		err = fmt.Errorf("User with public key: %s does not exist", pubkey.String())
+		log.Println(err)
+	}
+
+	return
+}
+
+// DelUser removes a registered user, identified by public key or ID, and its lease within the transaction.
+func (tx *sqliteTx) DelUser(identifier interface{}) (err error) {
+	var res sql.Result
+	switch i := identifier.(type) {
+	case *key.Public:
+		if _, err = tx.Exec("DELETE FROM leases WHERE id = (SELECT id FROM users WHERE key = ?)", i.String()); err != nil {
+			return
+		}
+
+		res, err = tx.Exec("DELETE FROM users WHERE key = ?", i.String())
+	case uint64:
+		if _, err = tx.Exec("DELETE FROM leases WHERE id = ?", i); err != nil {
+			return
+		}
+
+		res, err = tx.Exec("DELETE FROM users WHERE id = ?", i)
+	default:
+		err = errors.New("Unknown identifier specified")
+	}
+	if err != nil {
+		return
+	}
+
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		err = fmt.Errorf("User identified as: %v does not exist", identifier)
+		log.Println(err)
+		return err
+	}
+
+	log.Printf("Deleting user identified as: %v", identifier)
+	return
+}
+
+// Users returns every registered user within the transaction, sorted by ID.
+func (tx *sqliteTx) Users() (users []User, err error) {
+	rows, err := tx.Query("SELECT " + userColumns + " FROM users ORDER BY id")
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		users = append(users, u)
+	}
+
+	return users, rows.Err()
+}
+
+// ImportUsers adds users with their IDs within the transaction, the store may not have any users.
+func (tx *sqliteTx) ImportUsers(users []User) (err error) {
+	exists, err := tx.exists("SELECT 1 FROM users")
+	if err != nil {
+		return
+	}
+
+	if exists {
+		return errors.New("Database already has users, users can only be imported into an empty database")
+	}
+
+	log.Printf("Importing %d users", len(users))
+
+	for _, u := range users {
+		if u.ID == 0 {
+			return fmt.Errorf("Invalid ID: 0 for user with public key: %s", u.Key.String())
+		}
+
+		// The primary key and unique key refuse users that are imported more than once.
+		if err = tx.insertUser(u); err != nil {
+			return fmt.Errorf("Unable to import user with ID: %d, due to error: %v", u.ID, err)
+		}
+	}
+
+	return
+}
+
+// SetReservation stores a reservation within the transaction, replacing any reservation for the same public key.
+func (tx *sqliteTx) SetReservation(r Reservation) (err error) {
+	addresses, err := json.Marshal(newReservationRecord(r).Addresses)
+	if err != nil {
+		return
+	}
+
+	log.Printf("Setting reservation for public key: %s, ID: %d, addresses: %v", r.Key.String(), r.ID, r.Addresses)
+	if _, err = tx.Exec("INSERT OR REPLACE INTO reservations (key, id, addresses) VALUES (?, ?, ?)", r.Key.String(), r.ID, string(addresses)); err != nil {
+		return
+	}
+
+	if _, err = tx.Exec("DELETE FROM reserved_addresses WHERE key = ?", r.Key.String()); err != nil {
+		return
+	}
+
+	return tx.insertAddresses(r)
+}
+
+// insertAddresses stores the reserved addresses of a reservation in their 16-byte form.
+func (tx *sqliteTx) insertAddresses(r Reservation) (err error) {
+	for _, ip := range r.Addresses {
+		if _, err = tx.Exec("INSERT OR REPLACE INTO reserved_addresses (address, key) VALUES (?, ?)", []byte(ip.To16()), r.Key.String()); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// scanReservation scans a row with the key, id and addresses columns into a reservation.
+func scanReservation(row scanner) (r Reservation, err error) {
+	var rr reservationRecord
+	var addresses string
+	if err = row.Scan(&rr.Key, &rr.ID, &addresses); err != nil {
+		return
+	}
+
+	if err = json.Unmarshal([]byte(addresses), &rr.Addresses); err != nil {
+		return
+	}
+
+	return rr.reservation()
+}
+
+// GetReservation returns the reservation for a public key within the transaction.
+func (tx *sqliteTx) GetReservation(pubkey *key.Public) (r Reservation, err error) {
+	r, err = scanReservation(tx.QueryRow("SELECT key, id, addresses FROM reservations WHERE key = ?", pubkey.String()))
+	if err == sql.ErrNoRows {
+		err = fmt.Errorf("No reservation found for public key: %s", pubkey.String())
+	}
+
+	return
+}
+
+// DelReservation removes the reservation for a public key within the transaction.
+func (tx *sqliteTx) DelReservation(pubkey *key.Public) (err error) {
+	if _, err = tx.Exec("DELETE FROM reserved_addresses WHERE key = ?", pubkey.String()); err != nil {
+		return
+	}
+
+	res, err := tx.Exec("DELETE FROM reservations WHERE key = ?", pubkey.String())
+	if err != nil {
+		return
+	}
+
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		err = fmt.Errorf("No reservation found for public key: %s", pubkey.String())
+		log.Println(err)
+		return err
+	}
+
+	log.Printf("Deleting reservation for public key: %s", pubkey.String())
+	return
+}
+
+// Reservations returns every reservation within the transaction, sorted by public key.
+func (tx *sqliteTx) Reservations() (reservations []Reservation, err error) {
+	rows, err := tx.Query("SELECT key, id, addresses FROM reservations ORDER BY key")
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		r, err := scanReservation(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		reservations = append(reservations, r)
+	}
+
+	return reservations, rows.Err()
+}
+
+// queryKey returns the public key in the only column of the row returned by the query, or nil if there is none.
+func (tx *sqliteTx) queryKey(query string, args ...interface{}) (pubkey *key.Public, err error) {
+	var k string
+	if err = tx.QueryRow(query, args...).Scan(&k); err != nil {
+		if err == sql.ErrNoRows {
+			err = nil
+		}
+
+		return
+	}
+
+	return key.DecodePublic(k)
+}
+
+// PoolUser returns the public key of the user in a pool with an index within the transaction, or nil if there is none.
+func (tx *sqliteTx) PoolUser(pool string, index uint64) (pubkey *key.Public, err error) {
+	return tx.queryKey("SELECT key FROM users WHERE pool = ?1 AND (pool_index = ?2 OR (pool_index = 0 AND id = ?2))", pool, index)
+}
+
+// ReservedID returns the public key that an ID is reserved for within the transaction, or nil if it is not reserved.
+func (tx *sqliteTx) ReservedID(id uint64) (pubkey *key.Public, err error) {
+	return tx.queryKey("SELECT key FROM reservations WHERE id = ? AND id != 0", id)
+}
+
+// ReservedWithin returns the public keys with a reserved address within a network within the transaction, sorted by address.
+func (tx *sqliteTx) ReservedWithin(network *net.IPNet) (keys []*key.Public, err error) {
+	first, last := networkRange(network)
+	if first == nil {
+		err = fmt.Errorf("Invalid network: %s", network)
+		return
+	}
+
+	rows, err := tx.Query("SELECT key FROM reserved_addresses WHERE address BETWEEN ? AND ? ORDER BY address", []byte(first), []byte(last))
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var k string
+		if err = rows.Scan(&k); err != nil {
+			return nil, err
+		}
+
+		pubkey, err := key.DecodePublic(k)
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, pubkey)
+	}
+
+	return keys, rows.Err()
+}
+
+// SetLease stores when the lease for a user ID was granted and when it expires within the transaction.
+func (tx *sqliteTx) SetLease(id uint64, granted, expires time.Time) (err error) {
+	exists, err := tx.exists("SELECT 1 FROM users WHERE id = ?", id)
+	if err != nil {
+		return
+	}
+
+	if !exists {
+		err = fmt.Errorf("User with ID: %d does not exist", id)
+		log.Println(err)
+		return
+	}
+
+	log.Printf("Setting lease for user with ID: %d, expires: %v", id, expires)
+	_, err = tx.Exec("INSERT OR REPLACE INTO leases (id, granted, expires) VALUES (?, ?, ?)", id, timeToUnix(granted), timeToUnix(expires))
+	return
+}
+
+// scanLease scans a row with the id, granted and expires columns into a lease.
+func scanLease(row scanner) (l Lease, err error) {
+	var granted, expires int64
+	if err = row.Scan(&l.ID, &granted, &expires); err != nil {
+		return
+	}
+
+	l.Granted, l.Expires = unixToTime(granted), unixToTime(expires)
+	return
+}
+
+// GetLease returns the lease for a user ID within the transaction.
+func (tx *sqliteTx) GetLease(id uint64) (l Lease, err error) {
+	l, err = scanLease(tx.QueryRow("SELECT id, granted, expires FROM leases WHERE id = ?", id))
+	if err == sql.ErrNoRows {
+		err = fmt.Errorf("No lease found for user with ID: %d", id)
+	}
+
+	return
+}
+
+// DelLease removes the lease for a user ID within the transaction, but keeps the user.
+func (tx *sqliteTx) DelLease(id uint64) (err error) {
+	log.Printf("Deleting lease for user with ID: %d", id)
+	_, err = tx.Exec("DELETE FROM leases WHERE id = ?", id)
+	return
+}
+
+// Leases returns all active leases within the transaction, sorted by ID.
+func (tx *sqliteTx) Leases() (leases []Lease, err error) {
+	rows, err := tx.Query("SELECT id, granted, expires FROM leases ORDER BY id")
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		l, err := scanLease(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		leases = append(leases, l)
+	}
+
+	return leases, rows.Err()
+}
+
+// setAdmin stores a setting for the administrator.
+func (tx *sqliteTx) setAdmin(name string, value []byte) (err error) {
+	_, err = tx.Exec("INSERT OR REPLACE INTO admin (name, value) VALUES (?, ?)", name, value)
+	return
+}
+
+// getAdmin retrieves a setting for the administrator, it is nil if the setting does not exist.
+func (tx *sqliteTx) getAdmin(name string) (value []byte, err error) {
+	err = tx.QueryRow("SELECT value FROM admin WHERE name = ?", name).Scan(&value)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	return
+}
+
+// SetAdmin sets the hashed password for the administrator within the transaction.
+func (tx *sqliteTx) SetAdmin(hash string) error {
+	log.Printf("Updating password hash for administration")
+	return tx.setAdmin(hashKey, []byte(hash))
+}
+
+// AdminHash retrieves the password hash for administrator within the transaction.
+func (tx *sqliteTx) AdminHash() (hash string, err error) {
+	log.Printf("Retrieving password hash")
+	v, err := tx.getAdmin(hashKey)
+	return string(v), err
+}
+
+// SetVerifier sets the derived keys for the administrator within the transaction.
+func (tx *sqliteTx) SetVerifier(v Verifier) error {
+	log.Printf("Updating verifier for administration")
+	return tx.setAdmin(verifierKey, encodeVerifier(v))
+}
+
+// AdminVerifier retrieves the derived keys for the administrator within the transaction.
+func (tx *sqliteTx) AdminVerifier() (v Verifier, err error) {
+	b, err := tx.getAdmin(verifierKey)
+	if err != nil {
+		return
+	}
+
+	if b == nil {
+		err = errNoVerifier
+		return
+	}
+
+	return decodeVerifier(b)
+}
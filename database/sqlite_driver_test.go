@@ -0,0 +1,7 @@
+//go:build sqlite
+// +build sqlite
+
+package database_test
+
+// The store tests run against SQLite when built with the sqlite tag, go test -tags sqlite ./database, as the driver requires cgo.
+import _ "github.com/mattn/go-sqlite3"
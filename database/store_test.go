@@ -0,0 +1,578 @@
+package database_test
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"net"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/willeponken/elvisp/database"
+	"github.com/willeponken/go-cjdns/key"
+)
+
+// hasDriver returns true if a database/sql driver is linked into the test binary.
+func hasDriver(name string) bool {
+	for _, d := range sql.Drivers() {
+		if d == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// mustOpenStore opens an empty database using a backend, and returns a function that closes and removes it.
+// The test is skipped if the backend is not available.
+func mustOpenStore(t *testing.T, backend string) (database.Database, func()) {
+	if backend == database.BackendSQLite && !hasDriver("sqlite3") {
+		t.Skip("No SQLite driver linked into the test binary, run the tests with -tags sqlite")
+	}
+
+	path := tempFile()
+	db, err := database.OpenStore(backend, path)
+	if err != nil {
+		t.Fatalf("OpenStore returned unexpected error: %v", err)
+	}
+
+	return db, func() {
+		db.Close()
+		os.Remove(path)
+	}
+}
+
+// backends are every backend that the store tests are run against.
+var backends = []string{database.BackendBolt, database.BackendMemory, database.BackendSQLite}
+
+// TestStore_users checks that every backend adds, changes and removes users in the same way.
+func TestStore_users(t *testing.T) {
+	for _, backend := range backends {
+		t.Run(backend, func(t *testing.T) {
+			db, closer := mustOpenStore(t, backend)
+			defer closer()
+
+			keys := []*key.Public{key.Generate().Pubkey(), key.Generate().Pubkey(), key.Generate().Pubkey()}
+			for i, k := range keys {
+				if id, err := db.AddUser(k); err != nil || id != uint64(i+1) {
+					t.Fatalf("AddUser returned unexpected ID: %d, error: %v, wanted: %d", id, err, i+1)
+				}
+			}
+
+			if _, err := db.AddUser(keys[0]); err == nil {
+				t.Errorf("AddUser expected error for duplicate but got %v", err)
+			}
+
+			if id, err := db.GetID(keys[1]); err != nil || id != 2 {
+				t.Errorf("GetID returned unexpected ID: %d, error: %v", id, err)
+			}
+
+			if pubkey, err := db.PublicKey(3); err != nil || !pubkey.Equal(keys[2]) {
+				t.Errorf("PublicKey returned unexpected key: %v, error: %v", pubkey, err)
+			}
+
+			u, err := db.GetUser(1)
+			if err != nil || u.Source != database.SourceClient || u.Created.IsZero() {
+				t.Fatalf("GetUser returned unexpected user: %+v, error: %v", u, err)
+			}
+
+			u.LastSeen = time.Unix(1467374400, 0)
+			u.LastIP = []byte{0xfc, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1}
+			u.Addresses = []database.Assignment{{Pool: "10.0.0.0/24", IP: []byte{10, 0, 0, 1}}}
+			u.Labels = map[string]string{"owner": "alice"}
+			u.Pool, u.Index = "guests", 7
+			if err := db.PutUser(u); err != nil {
+				t.Fatalf("PutUser returned unexpected error: %v", err)
+			}
+
+			got, err := db.GetUser(1)
+			if err != nil || !got.LastSeen.Equal(u.LastSeen) || !got.LastIP.Equal(u.LastIP) || !reflect.DeepEqual(got.Labels, u.Labels) ||
+				got.Pool != "guests" || got.Index != 7 || len(got.Addresses) != 1 || got.Addresses[0].Pool != "10.0.0.0/24" || !got.Addresses[0].IP.Equal(u.Addresses[0].IP) {
+				t.Errorf("GetUser returned unexpected user: %+v, error: %v, wanted: %+v", got, err, u)
+			}
+
+			u.Key = keys[1]
+			if err := db.PutUser(u); err == nil {
+				t.Errorf("PutUser expected error for changed key but got %v", err)
+			}
+
+			if err := db.DelUser(uint64(2)); err != nil {
+				t.Errorf("DelUser returned unexpected error: %v", err)
+			}
+
+			if err := db.DelUser(keys[1]); err == nil {
+				t.Errorf("DelUser expected error for removed user but got %v", err)
+			}
+
+			if err := db.DelUser("lol"); err == nil {
+				t.Errorf("DelUser expected error for unknown identifier but got %v", err)
+			}
+
+			// The freed ID is reused before new IDs.
+			for _, want := range []uint64{2, 4} {
+				if id, err := db.AddUser(key.Generate().Pubkey()); err != nil || id != want {
+					t.Errorf("AddUser returned unexpected ID: %d, error: %v, wanted: %d", id, err, want)
+				}
+			}
+
+			if users, err := db.Users(); err != nil || len(users) != 4 || users[0].ID != 1 || users[3].ID != 4 {
+				t.Errorf("Users returned unexpected users: %+v, error: %v", users, err)
+			}
+		})
+	}
+}
+
+// TestStore_leases checks that every backend stores leases in the same way, and removes them with the user.
+func TestStore_leases(t *testing.T) {
+	for _, backend := range backends {
+		t.Run(backend, func(t *testing.T) {
+			db, closer := mustOpenStore(t, backend)
+			defer closer()
+
+			now := time.Unix(time.Now().Unix(), 0)
+			for i := 0; i < 3; i++ {
+				if _, err := db.AddUser(key.Generate().Pubkey()); err != nil {
+					t.Fatalf("AddUser returned unexpected error: %v", err)
+				}
+			}
+
+			var leaseTests = []database.Lease{
+				{ID: 1, Granted: now, Expires: now.Add(-time.Minute)},
+				{ID: 2, Granted: now},
+				{ID: 3, Granted: now, Expires: now.Add(time.Hour)},
+			}
+
+			for row, l := range leaseTests {
+				if err := db.SetLease(l.ID, l.Granted, l.Expires); err != nil {
+					t.Errorf("Row: %d returned unexpected error: %v", row, err)
+				}
+
+				if got, err := db.GetLease(l.ID); err != nil || !reflect.DeepEqual(got, l) {
+					t.Errorf("Row: %d returned unexpected lease: %+v, error: %v, wanted: %+v", row, got, err, l)
+				}
+			}
+
+			if err := db.SetLease(4, now, now); err == nil {
+				t.Errorf("SetLease expected error for unknown user but got %v", err)
+			}
+
+			if expired, err := db.ExpiredLeases(now); err != nil || len(expired) != 1 || expired[0].ID != 1 {
+				t.Errorf("ExpiredLeases returned unexpected leases: %+v, error: %v", expired, err)
+			}
+
+			if err := db.DelLease(2); err != nil {
+				t.Errorf("DelLease returned unexpected error: %v", err)
+			}
+
+			if err := db.DelUser(uint64(3)); err != nil {
+				t.Errorf("DelUser returned unexpected error: %v", err)
+			}
+
+			if leases, err := db.Leases(); err != nil || len(leases) != 1 || leases[0].ID != 1 {
+				t.Errorf("Leases returned unexpected leases: %+v, error: %v", leases, err)
+			}
+		})
+	}
+}
+
+// TestStore_admin checks that every backend stores the settings for the administrator in the same way.
+func TestStore_admin(t *testing.T) {
+	for _, backend := range backends {
+		t.Run(backend, func(t *testing.T) {
+			db, closer := mustOpenStore(t, backend)
+			defer closer()
+
+			if hash, err := db.AdminHash(); err != nil || hash != "" {
+				t.Errorf("AdminHash returned unexpected hash: %s, error: %v", hash, err)
+			}
+
+			if _, err := db.AdminVerifier(); err == nil {
+				t.Errorf("AdminVerifier expected error but got %v", err)
+			}
+
+			v := database.Verifier{Salt: []byte("salt"), Iterations: 4096, StoredKey: []byte("0123456789abcdef0123456789abcdef"),
+				ServerKey: []byte("fedcba9876543210fedcba9876543210")}
+			if err := db.SetAdmin("hash"); err != nil {
+				t.Errorf("SetAdmin returned unexpected error: %v", err)
+			}
+
+			if err := db.SetVerifier(v); err != nil {
+				t.Errorf("SetVerifier returned unexpected error: %v", err)
+			}
+
+			if hash, err := db.AdminHash(); err != nil || hash != "hash" {
+				t.Errorf("AdminHash returned unexpected hash: %s, error: %v", hash, err)
+			}
+
+			if got, err := db.AdminVerifier(); err != nil || !reflect.DeepEqual(got, v) {
+				t.Errorf("AdminVerifier returned unexpected verifier: %+v, error: %v, wanted: %+v", got, err, v)
+			}
+		})
+	}
+}
+
+// TestStore_rollback checks that every backend rolls back a transaction that fails.
+func TestStore_rollback(t *testing.T) {
+	for _, backend := range backends {
+		t.Run(backend, func(t *testing.T) {
+			db, closer := mustOpenStore(t, backend)
+			defer closer()
+
+			pubkey := key.Generate().Pubkey()
+			errRollback := errors.New("rollback")
+
+			err := db.Update(func(tx database.Tx) error {
+				if _, err := tx.InsertUser(database.User{Key: pubkey}); err != nil {
+					return err
+				}
+
+				if err := tx.SetAdmin("hash"); err != nil {
+					return err
+				}
+
+				return errRollback
+			})
+			if err != errRollback {
+				t.Errorf("Update returned unexpected error: %v", err)
+			}
+
+			if _, err := db.GetID(pubkey); err == nil {
+				t.Errorf("GetID expected error for rolled back user but got %v", err)
+			}
+
+			if hash, _ := db.AdminHash(); hash != "" {
+				t.Errorf("AdminHash returned rolled back hash: %s", hash)
+			}
+		})
+	}
+}
+
+// TestStore_reservations checks that every backend allocates reserved IDs only to their public keys, and refuses conflicting reservations.
+func TestStore_reservations(t *testing.T) {
+	for _, backend := range backends {
+		t.Run(backend, func(t *testing.T) {
+			db, closer := mustOpenStore(t, backend)
+			defer closer()
+
+			keys := []*key.Public{key.Generate().Pubkey(), key.Generate().Pubkey(), key.Generate().Pubkey()}
+			reservations := []database.Reservation{
+				{Key: keys[0], ID: 2, Addresses: []net.IP{net.ParseIP("10.0.0.100")}},
+				{Key: keys[1], ID: 5},
+			}
+
+			for row, r := range reservations {
+				if err := db.Reserve(r); err != nil {
+					t.Errorf("Row: %d returned unexpected error: %v", row, err)
+				}
+			}
+
+			var conflictTests = []database.Reservation{
+				{Key: keys[2], ID: 2},
+				{Key: keys[2], Addresses: []net.IP{net.ParseIP("10.0.0.100")}},
+			}
+
+			for row, r := range conflictTests {
+				if err := db.Reserve(r); err == nil {
+					t.Errorf("Row: %d expected error but got %v", row, err)
+				}
+			}
+
+			// Dynamic IDs skip the reserved IDs, reserved IDs are allocated when the key is added.
+			for _, want := range []uint64{1, 3, 4, 6} {
+				if id, err := db.AddUser(key.Generate().Pubkey()); err != nil || id != want {
+					t.Errorf("AddUser returned unexpected ID: %d, error: %v, wanted: %d", id, err, want)
+				}
+			}
+
+			if id, err := db.AddUser(keys[1]); err != nil || id != 5 {
+				t.Errorf("AddUser returned unexpected ID: %d, error: %v, wanted: 5", id, err)
+			}
+
+			if err := db.Reserve(database.Reservation{Key: keys[2], ID: 5}); err == nil {
+				t.Errorf("Reserve expected error for used ID but got %v", err)
+			}
+
+			if err := db.Update(func(tx database.Tx) error {
+				_, err := tx.InsertUser(database.User{ID: 2, Key: keys[2]})
+				return err
+			}); err == nil {
+				t.Errorf("InsertUser expected error for ID reserved for another key but got %v", err)
+			}
+
+			got, err := db.Reservations()
+			if err != nil || len(got) != 2 {
+				t.Fatalf("Reservations returned unexpected reservations: %+v, error: %v", got, err)
+			}
+
+			if r, err := db.GetReservation(keys[0]); err != nil || r.ID != 2 || len(r.Addresses) != 1 || !r.Addresses[0].Equal(net.ParseIP("10.0.0.100")) {
+				t.Errorf("GetReservation returned unexpected reservation: %+v, error: %v", r, err)
+			}
+
+			if err := db.Unreserve(keys[0]); err != nil {
+				t.Errorf("Unreserve returned unexpected error: %v", err)
+			}
+
+			if err := db.Unreserve(keys[0]); err == nil {
+				t.Errorf("Unreserve expected error for removed reservation but got %v", err)
+			}
+
+			// The ID is no longer reserved.
+			if id, err := db.AddUser(key.Generate().Pubkey()); err != nil || id != 2 {
+				t.Errorf("AddUser returned unexpected ID: %d, error: %v, wanted: 2", id, err)
+			}
+		})
+	}
+}
+
+// TestStore_lookups checks that every backend finds users by pool and index, and reservations by ID and address, after they are changed.
+func TestStore_lookups(t *testing.T) {
+	for _, backend := range backends {
+		t.Run(backend, func(t *testing.T) {
+			db, closer := mustOpenStore(t, backend)
+			defer closer()
+
+			keys := []*key.Public{key.Generate().Pubkey(), key.Generate().Pubkey(), key.Generate().Pubkey()}
+
+			err := db.Update(func(tx database.Tx) error {
+				if _, err := tx.InsertUser(database.User{Key: keys[0]}); err != nil {
+					return err
+				}
+
+				id, err := tx.InsertUser(database.User{Key: keys[1], Pool: "a", Index: 4})
+				if err != nil {
+					return err
+				}
+
+				// Moved to another index within another pool.
+				if err = tx.PutUser(database.User{ID: id, Key: keys[1], Pool: "b", Index: 6}); err != nil {
+					return err
+				}
+
+				if err = tx.SetReservation(database.Reservation{Key: keys[2], ID: 8, Addresses: []net.IP{net.ParseIP("fd00::1:5")}}); err != nil {
+					return err
+				}
+
+				// Replaced by a reservation with other addresses.
+				return tx.SetReservation(database.Reservation{Key: keys[2], ID: 9, Addresses: []net.IP{net.ParseIP("fd00::2:7"), net.ParseIP("10.0.0.9")}})
+			})
+			if err != nil {
+				t.Fatalf("Update returned unexpected error: %v", err)
+			}
+
+			var poolTests = []struct {
+				pool  string
+				index uint64
+				want  *key.Public
+			}{
+				{"", 1, keys[0]},
+				{"", 2, nil},
+				{"a", 4, nil},
+				{"b", 6, keys[1]},
+				{"b", 2, nil},
+			}
+
+			var idTests = []struct {
+				id   uint64
+				want *key.Public
+			}{
+				{8, nil},
+				{9, keys[2]},
+				{0, nil},
+			}
+
+			var withinTests = []struct {
+				network string
+				want    int
+			}{
+				{"fd00::1:0/112", 0},
+				{"fd00::2:0/112", 1},
+				{"fd00::2:7/128", 1},
+				{"fd00::/16", 1},
+				{"10.0.0.0/24", 1},
+				{"10.0.1.0/24", 0},
+			}
+
+			check := func() {
+				db.View(func(tx database.Tx) error {
+					for row, test := range poolTests {
+						if k, err := tx.PoolUser(test.pool, test.index); err != nil || (k == nil) != (test.want == nil) || (k != nil && !k.Equal(test.want)) {
+							t.Errorf("Row: %d returned unexpected public key: %v, error: %v, wanted: %v", row, k, err, test.want)
+						}
+					}
+
+					for row, test := range idTests {
+						if k, err := tx.ReservedID(test.id); err != nil || (k == nil) != (test.want == nil) || (k != nil && !k.Equal(test.want)) {
+							t.Errorf("Row: %d returned unexpected public key: %v, error: %v, wanted: %v", row, k, err, test.want)
+						}
+					}
+
+					for row, test := range withinTests {
+						_, network, _ := net.ParseCIDR(test.network)
+						if keys, err := tx.ReservedWithin(network); err != nil || len(keys) != test.want {
+							t.Errorf("Row: %d returned unexpected public keys: %v, error: %v, wanted: %d", row, keys, err, test.want)
+						}
+					}
+
+					return nil
+				})
+			}
+			check()
+
+			if err = db.DelUser(keys[1]); err != nil {
+				t.Fatalf("DelUser returned unexpected error: %v", err)
+			}
+
+			if err = db.Unreserve(keys[2]); err != nil {
+				t.Fatalf("Unreserve returned unexpected error: %v", err)
+			}
+
+			poolTests[3].want, idTests[1].want = nil, nil
+			for i := range withinTests {
+				withinTests[i].want = 0
+			}
+			check()
+		})
+	}
+}
+
+// TestStore_export checks that an export from every backend can be imported into every other backend.
+func TestStore_export(t *testing.T) {
+	for _, from := range backends {
+		for _, to := range backends {
+			t.Run(from+"-"+to, func(t *testing.T) {
+				src, closeSrc := mustOpenStore(t, from)
+				defer closeSrc()
+
+				dst, closeDst := mustOpenStore(t, to)
+				defer closeDst()
+
+				for i := 0; i < 3; i++ {
+					if _, err := src.AddUser(key.Generate().Pubkey()); err != nil {
+						t.Fatalf("AddUser returned unexpected error: %v", err)
+					}
+				}
+				src.DelUser(uint64(2))
+				src.SetAdmin("hash")
+				src.Reserve(database.Reservation{Key: key.Generate().Pubkey(), ID: 9, Addresses: []net.IP{net.ParseIP("fd00::9")}})
+
+				var buf bytes.Buffer
+				if err := src.Export(&buf); err != nil {
+					t.Fatalf("Export returned unexpected error: %v", err)
+				}
+
+				if n, err := dst.Import(&buf); err != nil || n != 2 {
+					t.Fatalf("Import returned unexpected count: %d, error: %v", n, err)
+				}
+
+				if hash, err := dst.AdminHash(); err != nil || hash != "hash" {
+					t.Errorf("AdminHash returned unexpected hash: %s, error: %v", hash, err)
+				}
+
+				if id, err := dst.AddUser(key.Generate().Pubkey()); err != nil || id != 2 {
+					t.Errorf("AddUser returned unexpected ID: %d, error: %v, wanted: 2", id, err)
+				}
+
+				if reservations, err := dst.Reservations(); err != nil || len(reservations) != 1 || reservations[0].ID != 9 {
+					t.Errorf("Reservations returned unexpected reservations: %+v, error: %v", reservations, err)
+				}
+			})
+		}
+	}
+}
+
+// TestOpenStore_sqliteColumns checks if columns added after a SQLite database was created are added when it is opened.
+func TestOpenStore_sqliteColumns(t *testing.T) {
+	if !hasDriver("sqlite3") {
+		t.Skip("No SQLite driver linked into the test binary, run the tests with -tags sqlite")
+	}
+
+	path := tempFile()
+	defer os.Remove(path)
+
+	// The users table as created before pools.
+	old, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatalf("Open returned unexpected error: %v", err)
+	}
+
+	_, err = old.Exec(`CREATE TABLE users (id INTEGER PRIMARY KEY, key TEXT NOT NULL UNIQUE, created INTEGER NOT NULL DEFAULT 0,
+		last_seen INTEGER NOT NULL DEFAULT 0, last_ip TEXT NOT NULL DEFAULT '', addresses TEXT NOT NULL DEFAULT 'null',
+		labels TEXT NOT NULL DEFAULT 'null', source TEXT NOT NULL DEFAULT '')`)
+	old.Close()
+	if err != nil {
+		t.Fatalf("Exec returned unexpected error: %v", err)
+	}
+
+	db, err := database.OpenStore(database.BackendSQLite, path)
+	if err != nil {
+		t.Fatalf("OpenStore returned unexpected error: %v", err)
+	}
+	defer db.Close()
+
+	pubkey := key.Generate().Pubkey()
+	err = db.Update(func(tx database.Tx) error {
+		_, err := tx.InsertUser(database.User{Key: pubkey, Pool: "guests", Index: 3})
+		return err
+	})
+	if err != nil {
+		t.Fatalf("InsertUser returned unexpected error: %v", err)
+	}
+
+	if u, err := db.GetUser(1); err != nil || u.Pool != "guests" || u.Index != 3 {
+		t.Errorf("GetUser returned unexpected user: %+v, error: %v", u, err)
+	}
+}
+
+// TestOpenStore_sqliteReservedAddresses checks if the reserved addresses are filled from the reservations when a SQLite database
+// created before they were stored separately is opened.
+func TestOpenStore_sqliteReservedAddresses(t *testing.T) {
+	if !hasDriver("sqlite3") {
+		t.Skip("No SQLite driver linked into the test binary, run the tests with -tags sqlite")
+	}
+
+	path := tempFile()
+	defer os.Remove(path)
+
+	old, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatalf("Open returned unexpected error: %v", err)
+	}
+
+	pubkey := key.Generate().Pubkey()
+	_, err = old.Exec(`CREATE TABLE reservations (key TEXT PRIMARY KEY, id INTEGER NOT NULL DEFAULT 0, addresses TEXT NOT NULL DEFAULT 'null');
+		INSERT INTO reservations (key, addresses) VALUES (?, '["10.0.0.5"]')`, pubkey.String())
+	old.Close()
+	if err != nil {
+		t.Fatalf("Exec returned unexpected error: %v", err)
+	}
+
+	db, err := database.OpenStore(database.BackendSQLite, path)
+	if err != nil {
+		t.Fatalf("OpenStore returned unexpected error: %v", err)
+	}
+	defer db.Close()
+
+	_, network, _ := net.ParseCIDR("10.0.0.0/24")
+	db.View(func(tx database.Tx) error {
+		if keys, err := tx.ReservedWithin(network); err != nil || len(keys) != 1 || !keys[0].Equal(pubkey) {
+			t.Errorf("ReservedWithin returned unexpected public keys: %v, error: %v", keys, err)
+		}
+
+		return nil
+	})
+}
+
+// TestOpenStore_unknown checks if unknown backends are refused.
+func TestOpenStore_unknown(t *testing.T) {
+	if _, err := database.OpenStore("lol", tempFile()); err == nil {
+		t.Errorf("OpenStore expected error but got %v", err)
+	}
+
+	if !hasDriver("sqlite3") {
+		if _, err := database.OpenStore(database.BackendSQLite, tempFile()); err == nil {
+			t.Errorf("OpenStore expected error for SQLite without a driver but got %v", err)
+		}
+	}
+}
@@ -11,138 +11,277 @@ import (
 // usersBucket defines the namespace for the user bucket.
 const usersBucket = "Users"
 
-// userExists takes a identifier and tries to type cast it into either a public key or a uint64, and then lookups that identifier in the database.
-func (db *Database) userExists(identifier interface{}) (pos []byte, exists bool) {
-	err := db.View(func(tx *Tx) error {
-		bucket := tx.Bucket([]byte(usersBucket))
-
-		pubkey, isPubkey := identifier.(*key.Public)
-		if isPubkey {
-			strPubkey := pubkey.String()
-			cursor := bucket.Cursor()
-
-			for k, pk := cursor.First(); pk != nil; k, pk = cursor.Next() {
-				if string(pk) == strPubkey {
-					pos = k
-					exists = true
-					return nil
-				}
-			}
-
-			exists = false
-			return nil
+// userPos takes a identifier and tries to type cast it into either a public key or a uint64, and then lookups the position of that identifier in the users bucket.
+// The position is nil if the user does not exist.
+func (tx *boltTx) userPos(identifier interface{}) (pos []byte, err error) {
+	switch id := identifier.(type) {
+	case *key.Public:
+		// The index maps the public key to the ID, so the users do not have to be scanned.
+		if p := tx.Bucket([]byte(pubKeysBucket)).Get([]byte(id.String())); p != nil {
+			pos = append([]byte(nil), p...)
 		}
-
-		id, isID := identifier.(uint64)
-		if isID {
-			p := uint64ToBin(id)
-			if user := bucket.Get(p); user != nil {
-				pos = p
-				exists = true
-				return nil
-			}
-
-			exists = false
-			return nil
+	case uint64:
+		if p := uint64ToBin(id); tx.Bucket([]byte(usersBucket)).Get(p) != nil {
+			pos = p
 		}
+	default:
+		err = errors.New("Unknown identifier specified")
+	}
 
-		return errors.New("Unknown identifier specified")
-	})
+	return
+}
 
-	if err != nil {
-		exists = false
+// freeGap frees every ID between the last user and id, so IDs skipped by a new user are reused before new IDs.
+func (tx *boltTx) freeGap(id uint64) (err error) {
+	gap := uint64(1)
+	if last, _ := tx.Bucket([]byte(usersBucket)).Cursor().Last(); last != nil {
+		gap = binToUint64(last) + 1
+	}
+
+	for ; gap < id; gap++ {
+		if err = tx.Bucket([]byte(freeIDsBucket)).Put(uint64ToBin(gap), []byte{}); err != nil {
+			return
+		}
 	}
 
 	return
 }
 
-// nextUserID iterates over all users and tries to find a available slot between users, if there is no available it will return the next sequence available after all users.
-func (db *Database) nextUserID() (id uint64, err error) {
-	err = db.View(func(tx *Tx) error {
-		bucket := tx.Bucket([]byte(usersBucket))
+// InsertUser inserts a new user record within the transaction, and returns the ID. A user without an ID gets the ID reserved for
+// its public key, or the lowest free ID that is not reserved. A zero Created time is set to now, and an empty source to SourceClient.
+func (tx *boltTx) InsertUser(u User) (id uint64, err error) {
+	k := u.Key.String()
 
-		cursor := bucket.Cursor()
-		lastID := uint64(0)
-		for currentID, _ := cursor.First(); currentID != nil; currentID, _ = cursor.Next() {
+	pos, err := tx.userPos(u.Key)
+	if err != nil {
+		return
+	}
 
-			// The current ID is larger than the last found ID, this means that there is a "gap" that can be filled,
-			// so we'll stop the iteration and use the last ID + 1 as it's available.
-			if binToUint64(currentID) > lastID+1 {
-				break
-			}
+	if pos != nil {
+		err = fmt.Errorf("User with public key: %s already exists", k)
+		log.Println(err)
+		return
+	}
 
-			lastID = binToUint64(currentID)
-		}
+	u = u.withDefaults()
+	if u.ID, err = newUserID(tx, u); err != nil {
+		return
+	}
 
-		id = lastID + 1
+	if pos, _ = tx.userPos(u.ID); pos != nil {
+		err = fmt.Errorf("User with ID: %d already exists", u.ID)
+		log.Println(err)
+		return
+	}
 
-		return nil
-	})
+	record, err := encodeUser(u)
+	if err != nil {
+		return
+	}
+
+	id = u.ID
+	pos = uint64ToBin(id)
+
+	log.Printf("Adding new user with key: %s and ID: %d", k, id)
+
+	if err = tx.freeGap(id); err != nil {
+		return
+	}
+
+	if err = tx.Bucket([]byte(freeIDsBucket)).Delete(pos); err != nil {
+		return
+	}
 
+	if err = tx.Bucket([]byte(pubKeysBucket)).Put([]byte(k), pos); err != nil {
+		return
+	}
+
+	if err = tx.putPoolIndex(u); err != nil {
+		return
+	}
+
+	err = tx.Bucket([]byte(usersBucket)).Put(pos, record)
 	return
 }
 
-// AddUser inserts a new user into the UserBucket with public key and ID (used as seed for lease).
-func (db *Database) AddUser(pubkey *key.Public) (id uint64, err error) {
-	k := pubkey.String()
+// GetUser returns the user record for a registered user ID within the transaction.
+func (tx *boltTx) GetUser(id uint64) (u User, err error) {
+	v := tx.Bucket([]byte(usersBucket)).Get(uint64ToBin(id))
+	if v == nil {
+		err = fmt.Errorf("User with ID: %d does not exist", id)
+		return
+	}
 
-	_, exists := db.userExists(pubkey)
-	if exists {
-		err = fmt.Errorf("User with public key: %s already exists", k)
-		log.Println(err)
+	return decodeUser(id, v)
+}
+
+// PutUser replaces the user record for a registered user within the transaction, the public key of the user can not be changed.
+func (tx *boltTx) PutUser(u User) (err error) {
+	pos, err := tx.userPos(u.Key)
+	if err != nil {
 		return
 	}
 
-	err = db.Update(func(tx *Tx) error {
+	if pos == nil || binToUint64(pos) != u.ID {
+		err = fmt.Errorf("User with ID: %d and public key: %s does not exist", u.ID, u.Key.String())
+		return
+	}
 
-		bucket := tx.Bucket([]byte(usersBucket))
+	record, err := encodeUser(u)
+	if err != nil {
+		return
+	}
 
-		id, err = db.nextUserID()
-		if err != nil {
-			return err
-		}
+	old, err := tx.GetUser(u.ID)
+	if err != nil {
+		return
+	}
 
-		log.Printf("Adding new user with key: %s and ID: %d", k, id)
+	if err = tx.delPoolIndex(old.Key.String(), old.Pool, old.poolIndex()); err != nil {
+		return
+	}
 
-		return bucket.Put(uint64ToBin(id), []byte(k)) // End of transaction after data is put
-	})
+	if err = tx.putPoolIndex(u); err != nil {
+		return
+	}
 
-	return
+	return tx.Bucket([]byte(usersBucket)).Put(pos, record)
 }
 
-// GetID returns the ID for a registered user.
-func (db *Database) GetID(pubkey *key.Public) (id uint64, err error) {
-	pos, exists := db.userExists(pubkey)
-	if !exists {
+// GetID returns the ID for a registered user within the transaction.
+func (tx *boltTx) GetID(pubkey *key.Public) (id uint64, err error) {
+	pos, err := tx.userPos(pubkey)
+	if err != nil {
+		return
+	}
+
+	if pos == nil {
 		err = fmt.Errorf("User with public key: %s does not exist", pubkey.String())
 		log.Println(err)
 		return
 	}
 
 	id = binToUint64(pos)
-
 	return
 }
 
-// DelUser removes a registered user using the pubkey as identifier.
-func (db *Database) DelUser(identifier interface{}) (err error) {
+// DelUser removes a registered user, identified by public key or ID, and its lease within the transaction. The ID is freed for new users.
+func (tx *boltTx) DelUser(identifier interface{}) (err error) {
+	pos, err := tx.userPos(identifier)
+	if err != nil {
+		return
+	}
 
-	pos, exists := db.userExists(identifier)
-	if !exists {
+	if pos == nil {
 		err = fmt.Errorf("User identified as: %v does not exist", identifier)
 		log.Println(err)
 		return
 	}
 
-	err = db.Update(func(tx *Tx) error {
+	bucket := tx.Bucket([]byte(usersBucket))
+
+	r, err := decodeRecord(bucket.Get(pos))
+	if err != nil {
+		return
+	}
+
+	log.Printf("Deleting user identified as: %v", identifier)
+	if err = tx.Bucket([]byte(pubKeysBucket)).Delete([]byte(r.Key)); err != nil {
+		return
+	}
+
+	if err = tx.delPoolIndex(r.Key, r.Pool, User{ID: binToUint64(pos), Index: r.Index}.poolIndex()); err != nil {
+		return
+	}
 
-		bucket := tx.Bucket([]byte(usersBucket))
+	if err = bucket.Delete(pos); err != nil {
+		return
+	}
 
-		log.Printf("Deleting user identified as: %v", identifier)
-		err = bucket.Delete(pos)
+	if err = tx.Bucket([]byte(freeIDsBucket)).Put(pos, []byte{}); err != nil {
+		return
+	}
+
+	return tx.Bucket([]byte(leasesBucket)).Delete(pos) // The lease is useless without the user
+}
 
+// AddUser inserts a new user into the UserBucket with public key and ID (used as seed for lease).
+// The duplicate check, ID allocation and insertion are done in a single transaction.
+func (db *Database) AddUser(pubkey *key.Public) (id uint64, err error) {
+	err = db.Update(func(tx Tx) error {
+		id, err = tx.InsertUser(User{Key: pubkey})
+		return err
+	})
+
+	return
+}
+
+// GetID returns the ID for a registered user.
+func (db *Database) GetID(pubkey *key.Public) (id uint64, err error) {
+	err = db.View(func(tx Tx) error {
+		id, err = tx.GetID(pubkey)
+		return err
+	})
+
+	return
+}
+
+// DelUser removes a registered user using the pubkey or ID as identifier.
+func (db *Database) DelUser(identifier interface{}) (err error) {
+	return db.Update(func(tx Tx) error {
+		return tx.DelUser(identifier)
+	})
+}
+
+// PublicKey returns the public key for a registered user ID.
+func (db *Database) PublicKey(id uint64) (pubkey *key.Public, err error) {
+	err = db.View(func(tx Tx) error {
+		u, err := tx.GetUser(id)
+		pubkey = u.Key
+		return err
+	})
+
+	return
+}
+
+// GetUser returns the user record for a registered user ID.
+func (db *Database) GetUser(id uint64) (u User, err error) {
+	err = db.View(func(tx Tx) error {
+		u, err = tx.GetUser(id)
+		return err
+	})
+
+	return
+}
+
+// PutUser replaces the user record for a registered user.
+func (db *Database) PutUser(u User) (err error) {
+	return db.Update(func(tx Tx) error {
+		return tx.PutUser(u)
+	})
+}
+
+// Users returns every registered user within the transaction, sorted by ID.
+func (tx *boltTx) Users() (users []User, err error) {
+	err = tx.Bucket([]byte(usersBucket)).ForEach(func(k, v []byte) error {
+		u, err := decodeUser(binToUint64(k), v)
+		if err != nil {
+			return err
+		}
+
+		users = append(users, u)
 		return nil
 	})
 
 	return
 }
+
+// Users returns every registered user, sorted by ID.
+func (db *Database) Users() (users []User, err error) {
+	err = db.View(func(tx Tx) (err error) {
+		users, err = tx.Users()
+		return
+	})
+
+	return
+}
@@ -1,9 +1,15 @@
 package database_test
 
 import (
+	"bytes"
+	"encoding/json"
 	"log"
+	"sync"
+	"sync/atomic"
 	"testing"
 
+	"github.com/boltdb/bolt"
+	"github.com/willeponken/elvisp/database"
 	"github.com/willeponken/go-cjdns/key"
 )
 
@@ -128,3 +134,107 @@ func TestGetID_empty(t *testing.T) {
 		t.Errorf("GetID returned unexpected id: %d, or a nil error", id)
 	}
 }
+
+// TestUsers checks that every added user is listed in ID order.
+func TestUsers(t *testing.T) {
+	db := MustOpen()
+	defer db.MustClose()
+
+	mockUsers := generateMockUsers(10)
+	for _, test := range mockUsers {
+		if _, err := db.AddUser(test.pubkey); err != nil {
+			t.Fatalf("AddUser returned unexpected error: %v", err)
+		}
+	}
+
+	users, err := db.Users()
+	if err != nil {
+		t.Fatalf("Users returned unexpected error: %v", err)
+	}
+
+	if len(users) != len(mockUsers) {
+		t.Fatalf("Users returned unexpected number of users, got: %d, wanted: %d", len(users), len(mockUsers))
+	}
+
+	for row, test := range mockUsers {
+		if users[row].ID != test.id || users[row].Key.String() != test.pubkey.String() {
+			t.Errorf("Row: %d returned unexpected user, got: %d %s, wanted: %d %s", row, users[row].ID, users[row].Key, test.id, test.pubkey)
+		}
+	}
+}
+
+// TestAddDelUser_concurrent hammers AddUser and DelUser from many goroutines, every user has to get an unique ID and a key can only be added once.
+// Run it with the race detector, checkptr has to be disabled for the vendored Bolt: go test -race -gcflags=all=-d=checkptr=0
+func TestAddDelUser_concurrent(t *testing.T) {
+	db := MustOpen()
+	defer db.MustClose()
+	database.Bolt(db.Database).NoSync = true
+
+	const workers = 16
+	const rounds = 50
+
+	shared := randomPubkey()
+	var added int32
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			if _, err := db.AddUser(shared); err == nil {
+				atomic.AddInt32(&added, 1)
+			}
+
+			for i := 0; i < rounds; i++ {
+				pubkey := randomPubkey()
+
+				if _, err := db.AddUser(pubkey); err != nil {
+					t.Errorf("AddUser returned unexpected error: %v", err)
+					return
+				}
+
+				if i%2 == 0 {
+					continue
+				}
+
+				if err := db.DelUser(pubkey); err != nil {
+					t.Errorf("DelUser returned unexpected error: %v", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if added != 1 {
+		t.Errorf("AddUser added the same key %d times", added)
+	}
+
+	// Every ID has to be unique and the index has to agree with the users. The buckets are read directly, as the random keys are not valid cjdns keys.
+	err := database.Bolt(db.Database).View(func(tx *bolt.Tx) error {
+		users := tx.Bucket([]byte("Users"))
+		index := tx.Bucket([]byte("PubKeys"))
+
+		if want := 1 + workers*rounds/2; users.Stats().KeyN != want || index.Stats().KeyN != want {
+			t.Errorf("Unexpected number of users: %d and indexed keys: %d, wanted: %d", users.Stats().KeyN, index.Stats().KeyN, want)
+		}
+
+		return users.ForEach(func(id, v []byte) error {
+			var record struct{ Key string }
+			if err := json.Unmarshal(v, &record); err != nil {
+				return err
+			}
+
+			if pos := index.Get([]byte(record.Key)); !bytes.Equal(pos, id) {
+				t.Errorf("Index returned unexpected ID: %v for key: %s, wanted: %v", pos, record.Key, id)
+			}
+
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatalf("View returned unexpected error: %v", err)
+	}
+}
@@ -2,7 +2,8 @@ module github.com/willeponken/elvisp
 
 require (
 	github.com/boltdb/bolt v0.0.0-20160616193316-3f7947a25d97
-	github.com/ehmry/go-bencode v1.1.1 // indirect
+	github.com/ehmry/go-bencode v1.1.1
+	github.com/mattn/go-sqlite3 v2.0.3+incompatible
 	github.com/willeponken/go-cjdns v0.0.0-20160701150232-b68d38c777e9
 	golang.org/x/crypto v0.0.0-20160624093139-811831de4c4d
 	golang.org/x/lint v0.0.0-20181026193005-c67002cb31c3 // indirect
@@ -0,0 +1,51 @@
+package lease
+
+import (
+	"fmt"
+	"math"
+)
+
+// ExhaustedError is returned when an ID is beyond the capacity of a CIDR, i.e. there are no addresses or prefixes left for it.
+type ExhaustedError struct {
+	CIDR CIDR
+}
+
+// Error returns a message with the CIDR that is exhausted.
+func (e ExhaustedError) Error() string {
+	if e.CIDR.Delegate != 0 {
+		return fmt.Sprintf("No prefixes of length: %d left in CIDR: %s", e.CIDR.Delegate, e.CIDR.String())
+	}
+
+	return fmt.Sprintf("No addresses left in CIDR: %s", e.CIDR.String())
+}
+
+// Capacity returns the number of IDs that the CIDR has addresses or prefixes for, i.e. Generate succeeds for the IDs from 1 to the
+// capacity. The capacity is at most math.MaxUint64.
+func (c CIDR) Capacity() uint64 {
+	last := lastAddress(c.Network)
+	if isBroadcast(c.Network, last) {
+		last = uint32ToIP(ipToUint32(last.To4()) - 1)
+	}
+
+	raw, err := offset(c.base(), last, c.shift())
+	if err == errTooFar {
+		raw = math.MaxUint64
+	} else if err != nil {
+		return 0
+	}
+
+	capacity := raw
+	for _, r := range c.excluded() {
+		if r.first > raw {
+			break
+		}
+
+		if r.last > raw {
+			r.last = raw
+		}
+
+		capacity -= r.last - r.first + 1
+	}
+
+	return capacity
+}
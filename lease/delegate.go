@@ -0,0 +1,102 @@
+package lease
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// uint128Shl shifts a uint64 left by n bits into a pair of uint64 (as if it was a uint128).
+func uint128Shl(i uint64, n uint) (a, b uint64) {
+	switch {
+	case n == 0:
+		return 0, i
+	case n < 64:
+		return i >> (64 - n), i << n
+	default:
+		return i << (n - 64), 0
+	}
+}
+
+// uint128Shr shifts a pair of uint64 right by n bits (as if the pair was a uint128).
+func uint128Shr(a, b uint64, n uint) (uint64, uint64) {
+	switch {
+	case n == 0:
+		return a, b
+	case n < 64:
+		return a >> n, b>>n | a<<(64-n)
+	default:
+		return 0, a >> (n - 64)
+	}
+}
+
+// uint128AddPair adds two pairs of uint64 (as if both pairs were a uint128), overflow is true if the sum does not fit.
+func uint128AddPair(a, b, c, d uint64) (hi, lo uint64, overflow bool) {
+	var carry uint64
+	if lo = b + d; lo < b {
+		carry = 1
+	}
+
+	hi = a + c + carry
+	overflow = hi < a || hi == a && c+carry != 0
+
+	return
+}
+
+// parseDelegate parses the length of the prefixes delegated from an IPv6 network, which has to be longer than the network's.
+func parseDelegate(network *net.IPNet, str string) (length int, err error) {
+	ones, bits := network.Mask.Size()
+	if bits != 8*net.IPv6len {
+		err = fmt.Errorf("Prefixes can only be delegated from IPv6 networks, not: %s", network.String())
+		return
+	}
+
+	if length, err = strconv.Atoi(str); err != nil || length <= ones || length > bits {
+		err = fmt.Errorf("Invalid length of delegated prefixes: %s for network: %s", str, network.String())
+	}
+
+	return
+}
+
+// shift returns the number of bits that an ID is shifted left with, i.e. the number of host bits in a delegated prefix.
+func (c CIDR) shift() uint {
+	if c.Delegate == 0 {
+		return 0
+	}
+
+	return uint(8*net.IPv6len - c.Delegate)
+}
+
+// base returns the address that IDs are added to, the start address, or the first address of its prefix if prefixes are delegated.
+func (c CIDR) base() net.IP {
+	if c.Delegate == 0 {
+		return c.Start
+	}
+
+	return c.Prefix(c.Start).IP
+}
+
+// Prefix returns the delegated prefix holding ip, or a network with only ip if the CIDR does not delegate prefixes.
+func (c CIDR) Prefix(ip net.IP) *net.IPNet {
+	if c.Delegate == 0 {
+		bits := 8 * len(ip)
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 8*net.IPv4len
+		}
+
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	}
+
+	mask := net.CIDRMask(c.Delegate, 8*net.IPv6len)
+	return &net.IPNet{IP: ip.To16().Mask(mask), Mask: mask}
+}
+
+// lastAddress returns the last address within a network.
+func lastAddress(network *net.IPNet) net.IP {
+	ip := make(net.IP, len(network.IP))
+	for i := range ip {
+		ip[i] = network.IP[i] | ^network.Mask[i]
+	}
+
+	return ip
+}
@@ -0,0 +1,186 @@
+package lease
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"strings"
+)
+
+var (
+	errBefore = errors.New("IP address is before the start of the CIDR")
+	errTooFar = errors.New("IP address is too far from the start of the CIDR")
+)
+
+// Range holds the first and last address of an inclusive range of addresses.
+type Range struct {
+	First, Last net.IP
+}
+
+// String returns the range in the same format as it was parsed from, a single address if the range only has one address.
+func (r Range) String() string {
+	if r.First.Equal(r.Last) {
+		return r.First.String()
+	}
+
+	return r.First.String() + "-" + r.Last.String()
+}
+
+// ParseRange parses a single address, or a range of addresses as <first>-<last>.
+func ParseRange(str string) (r Range, err error) {
+	first, last := str, str
+	if i := strings.Index(str, "-"); i != -1 {
+		first, last = str[:i], str[i+1:]
+	}
+
+	if r.First, r.Last = net.ParseIP(first), net.ParseIP(last); r.First == nil || r.Last == nil {
+		err = fmt.Errorf("Invalid address range: %s", str)
+		return
+	}
+
+	if (r.First.To4() == nil) != (r.Last.To4() == nil) {
+		err = fmt.Errorf("Address range: %s mixes IPv4 and IPv6", str)
+		return
+	}
+
+	if bytes.Compare(r.First.To16(), r.Last.To16()) > 0 {
+		err = fmt.Errorf("Address range: %s ends before it starts", str)
+	}
+
+	return
+}
+
+// offset returns the difference between ip and the start IP address, if it fits in a uint64. Both are shifted right by shift
+// bits first, which is only supported for IPv6.
+func offset(start, ip net.IP, shift uint) (o uint64, err error) {
+	// Is the IP IPv4?
+	if s, i := start.To4(), ip.To4(); s != nil && i != nil {
+		if ipToUint32(i) < ipToUint32(s) {
+			return 0, errBefore
+		}
+
+		return uint64(ipToUint32(i) - ipToUint32(s)), nil
+	}
+
+	// Or is the IP IPv6?
+	if s, i := start.To16(), ip.To16(); s != nil && i != nil {
+		sa, sb := ipToUint128(s)
+		sa, sb = uint128Shr(sa, sb, shift)
+		ia, ib := ipToUint128(i)
+		ia, ib = uint128Shr(ia, ib, shift)
+
+		// The difference has to fit in a uint64, i.e. the high halves are equal or differ by the carry of the low halves.
+		switch {
+		case ia == sa && ib >= sb, ia == sa+1 && ib < sb:
+			return ib - sb, nil
+		case ia < sa || ia == sa && ib < sb:
+			return 0, errBefore
+		default:
+			return 0, errTooFar
+		}
+	}
+
+	return 0, errors.New("Invalid length of IP address")
+}
+
+// offsetRange is an inclusive range of offsets from the start IP address.
+type offsetRange struct {
+	first, last uint64
+}
+
+// excluded returns the excluded ranges as offsets from the start IP address, sorted and merged. The start address itself is
+// never generated for an allocated ID, so only offsets from 1 are included. For delegated prefixes the offsets count prefixes.
+func (c CIDR) excluded() (ranges []offsetRange) {
+	for _, r := range c.Exclude {
+		first, err := offset(c.base(), r.First, c.shift())
+		if err == errBefore {
+			first = 0
+		} else if err != nil {
+			continue
+		}
+
+		last, err := offset(c.base(), r.Last, c.shift())
+		if err == errTooFar {
+			last = math.MaxUint64
+		} else if err != nil {
+			continue
+		}
+
+		if first == 0 {
+			first = 1
+		}
+
+		if last >= first {
+			ranges = append(ranges, offsetRange{first, last})
+		}
+	}
+
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i].first < ranges[j].first
+	})
+
+	var merged []offsetRange
+	for _, r := range ranges {
+		if n := len(merged); n > 0 && (merged[n-1].last == math.MaxUint64 || r.first <= merged[n-1].last+1) {
+			if r.last > merged[n-1].last {
+				merged[n-1].last = r.last
+			}
+
+			continue
+		}
+
+		merged = append(merged, r)
+	}
+
+	return merged
+}
+
+// hasSpecial reports if network is an IPv4 network with a network and a broadcast address, i.e. a prefix length shorter than 31.
+func hasSpecial(network *net.IPNet) bool {
+	ones, bits := network.Mask.Size()
+	return bits == 8*net.IPv4len && bits-ones >= 2
+}
+
+// isBroadcast reports if ip is the broadcast address of an IPv4 network.
+func isBroadcast(network *net.IPNet, ip net.IP) bool {
+	return hasSpecial(network) && ip.To4() != nil && lastAddress(network).Equal(ip)
+}
+
+// notSpecial returns an error if ip is the network or broadcast address of an IPv4 network, networks with a prefix length
+// of 31 or 32 have neither.
+func notSpecial(network *net.IPNet, ip net.IP) error {
+	switch {
+	case !hasSpecial(network) || ip.To4() == nil:
+		return nil
+	case network.IP.Mask(network.Mask).Equal(ip):
+		return errors.New("IP address is the network address")
+	case isBroadcast(network, ip):
+		return errors.New("IP address is the broadcast address")
+	}
+
+	return nil
+}
+
+// Excludes reports if ip is never generated for the CIDR, as it is within an excluded range, or is the network or broadcast
+// address of an IPv4 network. For delegated prefixes ip is excluded if any address in its prefix is.
+func (c CIDR) Excludes(ip net.IP) bool {
+	if notSpecial(c.Network, ip) != nil {
+		return true
+	}
+
+	first, last := ip.To16(), ip.To16()
+	if c.Delegate != 0 {
+		first, last = c.Prefix(ip).IP, lastAddress(c.Prefix(ip))
+	}
+
+	for _, r := range c.Exclude {
+		if bytes.Compare(last, r.First.To16()) >= 0 && bytes.Compare(first, r.Last.To16()) <= 0 {
+			return true
+		}
+	}
+
+	return false
+}
@@ -2,8 +2,10 @@ package lease
 
 import (
 	"errors"
+	"fmt"
 	"math"
 	"net"
+	"strings"
 )
 
 // ipToUint32 takes a ip address represented as a slice of bytes and converts it into uint32.
@@ -44,17 +46,6 @@ func uint32ToIP(i uint32) net.IP {
 	return net.IPv4(byte(i>>24), byte(i>>16), byte(i>>8), byte(i))
 }
 
-// uint128Add takes a pair of uint64 and adds them with another uint64 (as if the pair was a uint128).
-func uint128Add(a, b, i uint64) (uint64, uint64) {
-	if math.MaxUint64-b < i {
-		a++
-	}
-
-	b += i
-
-	return a, b
-}
-
 // withinNetwork checks if the generated IP address fits within the network specified.
 func withinNetwork(network *net.IPNet, ip net.IP) error {
 	if !network.Contains(ip) {
@@ -64,39 +55,169 @@ func withinNetwork(network *net.IPNet, ip net.IP) error {
 	return nil
 }
 
-// CIDR holds a start address, the allowed network and a ID to add to the start IP.
+// CIDR holds a start address, the allowed network and a ID to add to the start IP. Addresses within the excluded ranges are
+// stepped over, and for IPv4 the network and broadcast addresses are never generated. If Delegate is set, every ID gets an
+// IPv6 prefix of that length instead of a single address, counted from the prefix holding the start address.
 type CIDR struct {
-	Start   net.IP
-	Network *net.IPNet
+	Start    net.IP
+	Network  *net.IPNet
+	Exclude  []Range
+	Delegate int
+}
+
+// String returns the CIDR in the same format as it was parsed from.
+func (c CIDR) String() string {
+	prefixLength, _ := c.Network.Mask.Size()
+
+	str := fmt.Sprintf("%s/%d", c.Start, prefixLength)
+	if c.Delegate != 0 {
+		str += fmt.Sprintf(",delegate=%d", c.Delegate)
+	}
+
+	for _, r := range c.Exclude {
+		str += ",exclude=" + r.String()
+	}
+
+	return str
 }
 
-// ParseCIDR acts as a wrapper for net.ParseCIDR and populates a lease.CIDR struct.
+// ParseCIDR acts as a wrapper for net.ParseCIDR and populates a lease.CIDR struct. The CIDR can be followed by comma separated
+// exclusions, e.g. 10.0.0.0/24,exclude=10.0.0.1-10.0.0.9,exclude=10.0.0.53, which have to be within the network, and for IPv6
+// by the length of the delegated prefixes, e.g. fd00::/48,delegate=64.
 func ParseCIDR(cidr string) (c CIDR, err error) {
-	c.Start, c.Network, err = net.ParseCIDR(cidr)
+	parts := strings.Split(cidr, ",")
+	if c.Start, c.Network, err = net.ParseCIDR(parts[0]); err != nil {
+		return
+	}
+
+	for _, part := range parts[1:] {
+		if strings.HasPrefix(part, "delegate=") {
+			if c.Delegate, err = parseDelegate(c.Network, strings.TrimPrefix(part, "delegate=")); err != nil {
+				return
+			}
+
+			continue
+		}
+
+		if !strings.HasPrefix(part, "exclude=") {
+			err = fmt.Errorf("Invalid option: %s for CIDR: %s", part, parts[0])
+			return
+		}
+
+		var r Range
+		if r, err = ParseRange(strings.TrimPrefix(part, "exclude=")); err != nil {
+			return
+		}
+
+		if !c.Network.Contains(r.First) || !c.Network.Contains(r.Last) {
+			err = fmt.Errorf("Excluded range: %s is outside of network: %s", r.String(), c.Network.String())
+			return
+		}
+
+		c.Exclude = append(c.Exclude, r)
+	}
+
 	return
 }
 
-// Generate takes the CIDR (both IPv4 and IPv6 is supported) and a ID (which is used to increment the IP address from the CIDR). Then the incremented IP address is returned.
-func Generate(cidr CIDR, id uint64) (ip net.IP, err error) {
-	start := cidr.Start
-	network := cidr.Network
-
+// add increments the IP address with i shifted left by shift bits, both IPv4 and IPv6 is supported. Only IPv6 can be shifted.
+// An error is returned instead of wrapping around past the last address.
+func add(start net.IP, i uint64, shift uint) (ip net.IP, err error) {
 	// Is the IP IPv4?
 	if s := start.To4(); s != nil {
-		ip = uint32ToIP(ipToUint32(s) + uint32(id))
-		err = withinNetwork(network, ip)
-		return
+		if i > math.MaxUint32-uint64(ipToUint32(s)) {
+			return nil, errTooFar
+		}
+
+		return uint32ToIP(ipToUint32(s) + uint32(i)), nil
 	}
 
 	// Or is the IP IPv6?
 	if s := start.To16(); s != nil {
 		a, b := ipToUint128(s)
-		ip = uint128ToIP(uint128Add(a, b, uint64(id)))
-		err = withinNetwork(network, ip)
-		return
+		c, d := uint128Shl(i, shift)
+
+		a, b, overflow := uint128AddPair(a, b, c, d)
+		if overflow {
+			return nil, errTooFar
+		}
+
+		return uint128ToIP(a, b), nil
 	}
 
 	// If ip.To16() returns nil, the IP has an invalid length.
-	err = errors.New("Invalid length of IP address")
+	return nil, errors.New("Invalid length of IP address")
+}
+
+// Generate takes the CIDR (both IPv4 and IPv6 is supported) and a ID (which is used to increment the IP address from the CIDR). Then the incremented IP address is returned.
+// Excluded addresses are stepped over, so every ID after an excluded range is incremented with the size of the range. For a CIDR
+// with delegated prefixes the first address of the prefix is returned, and prefixes holding an excluded address are stepped over.
+// An ExhaustedError is returned for an ID beyond the capacity of the CIDR.
+func Generate(cidr CIDR, id uint64) (ip net.IP, err error) {
+	n := id
+	for _, r := range cidr.excluded() {
+		if r.first > n {
+			break
+		}
+
+		if r.last == math.MaxUint64 {
+			err = ExhaustedError{cidr}
+			return
+		}
+
+		n += r.last - r.first + 1
+	}
+
+	shift := cidr.shift()
+	if shift >= 64 && n>>(128-shift) != 0 {
+		err = ExhaustedError{cidr}
+		return
+	}
+
+	if ip, err = add(cidr.base(), n, shift); err == errTooFar {
+		err = ExhaustedError{cidr}
+		return
+	} else if err != nil {
+		return
+	}
+
+	// The broadcast address is the last address in the network, so reaching it means that the CIDR is exhausted as well.
+	if withinNetwork(cidr.Network, ip) != nil || isBroadcast(cidr.Network, ip) {
+		err = ExhaustedError{cidr}
+		return
+	}
+
+	err = notSpecial(cidr.Network, ip)
+	return
+}
+
+// Offset returns the ID that Generate increments the start IP address of the CIDR with to get ip, it is the inverse of Generate.
+// Excluded addresses have no ID. For a CIDR with delegated prefixes the ID of the prefix holding ip is returned.
+func Offset(cidr CIDR, ip net.IP) (id uint64, err error) {
+	if err = withinNetwork(cidr.Network, ip); err != nil {
+		return
+	}
+
+	if err = notSpecial(cidr.Network, ip); err != nil {
+		return
+	}
+
+	if id, err = offset(cidr.base(), ip, cidr.shift()); err != nil {
+		return
+	}
+
+	raw := id
+	for _, r := range cidr.excluded() {
+		if r.first > raw {
+			break
+		}
+
+		if r.last >= raw {
+			return 0, fmt.Errorf("IP address: %s is excluded from the CIDR", ip)
+		}
+
+		id -= r.last - r.first + 1
+	}
+
 	return
 }
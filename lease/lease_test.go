@@ -1,6 +1,7 @@
 package lease_test
 
 import (
+	"math"
 	"net"
 	"testing"
 
@@ -21,6 +22,23 @@ func TestGenerate(t *testing.T) {
 		{"1234::1222:0/120", 256, net.ParseIP("1234::1222:100"), true},
 		{"3214:1261:afb2::0/96", 4294967296, net.ParseIP("3214:1261:afb2::1:0:0"), true},
 		{"3214:1261:afb2:ffff:ffff:ffff:ffff:ffff/96", 4294967296, net.ParseIP("3214:1261:afb3::ffff:ffff"), true},
+		{"192.168.1.0/24", 255, net.ParseIP("192.168.1.255"), true},
+		{"192.168.1.0/31", 1, net.ParseIP("192.168.1.1"), false},
+		{"192.168.1.0/24,exclude=192.168.1.1-192.168.1.9", 1, net.ParseIP("192.168.1.10"), false},
+		{"192.168.1.0/24,exclude=192.168.1.1-192.168.1.9,exclude=192.168.1.11", 2, net.ParseIP("192.168.1.12"), false},
+		{"192.168.1.0/24,exclude=192.168.1.5,exclude=192.168.1.3-192.168.1.6", 3, net.ParseIP("192.168.1.7"), false},
+		{"192.168.1.0/24,exclude=192.168.1.200-192.168.1.254", 199, net.ParseIP("192.168.1.199"), false},
+		{"192.168.1.0/24,exclude=192.168.1.200-192.168.1.254", 200, net.ParseIP("192.168.1.255"), true},
+		{"fd00::/64,exclude=fd00::1-fd00::ff", 1, net.ParseIP("fd00::100"), false},
+		{"fd00::/48,delegate=64", 1, net.ParseIP("fd00:0:0:1::"), false},
+		{"fd00::/48,delegate=64", 65535, net.ParseIP("fd00:0:0:ffff::"), false},
+		{"fd00::/48,delegate=64", 65536, net.ParseIP("fd00:0:1::"), true},
+		{"fd00::/32,delegate=56", 2, net.ParseIP("fd00:0:0:200::"), false},
+		{"fd00:0:0:10::1/48,delegate=64", 1, net.ParseIP("fd00:0:0:11::"), false},
+		{"fd00::/48,delegate=64,exclude=fd00:0:0:1::1", 1, net.ParseIP("fd00:0:0:2::"), false},
+		{"::/0,delegate=1", 2, nil, true},
+		{"255.255.255.0/0", 512, nil, true},
+		{"ffff:ffff:ffff:ffff:ffff:ffff:ffff:ff00/0", 512, nil, true},
 	}
 
 	for row, tests := range generateTests {
@@ -52,6 +70,55 @@ func TestGenerate_emptyCIDR(t *testing.T) {
 	}
 }
 
+func TestOffset(t *testing.T) {
+	var offsetTests = []struct {
+		cidr string
+		ip   net.IP
+		id   uint64
+		err  bool
+	}{
+		{"192.168.1.0/24", net.ParseIP("192.168.1.42"), 42, false},
+		{"192.168.1.10/24", net.ParseIP("192.168.1.5"), 0, true},
+		{"192.168.1.0/24", net.ParseIP("192.168.2.1"), 0, true},
+		{"192.168.1.0/24", net.ParseIP("1234::1"), 0, true},
+		{"1234::1222:0/16", net.ParseIP("1234::1228:75f3"), 423411, false},
+		{"3214:1261:afb2:ffff:ffff:ffff:ffff:ffff/32", net.ParseIP("3214:1261:afb3::ffff:fffe"), 4294967295, false},
+		{"1234::/16", net.ParseIP("1234:0:0:1::"), 0, true},
+		{"192.168.1.0/24", net.ParseIP("192.168.1.255"), 0, true},
+		{"192.168.1.0/24,exclude=192.168.1.1-192.168.1.9", net.ParseIP("192.168.1.5"), 0, true},
+		{"192.168.1.0/24,exclude=192.168.1.1-192.168.1.9,exclude=192.168.1.11", net.ParseIP("192.168.1.12"), 2, false},
+		{"fd00::/64,exclude=fd00::1-fd00::ff", net.ParseIP("fd00::1:0"), 65281, false},
+		{"fd00::/48,delegate=64", net.ParseIP("fd00:0:0:5::"), 5, false},
+		{"fd00::/48,delegate=64,exclude=fd00:0:0:1::1", net.ParseIP("fd00:0:0:1::"), 0, true},
+		{"fd00::/48,delegate=64,exclude=fd00:0:0:1::1", net.ParseIP("fd00:0:0:3::"), 2, false},
+	}
+
+	for row, test := range offsetTests {
+		cidr, err := lease.ParseCIDR(test.cidr)
+		if err != nil {
+			t.Fatalf("Row: %d returned unexpected error: %v", row, err)
+		}
+
+		id, err := lease.Offset(cidr, test.ip)
+		if err == nil && test.err {
+			t.Errorf("Row: %d expected error but got %v", row, err)
+		}
+
+		if err != nil && !test.err {
+			t.Errorf("Row: %d returned unexpected error: %v", row, err)
+		}
+
+		if id != test.id {
+			t.Errorf("Row: %d returned unexpected ID, got: %d, wanted: %d", row, id, test.id)
+		}
+
+		// Generate is the inverse of Offset.
+		if ip, _ := lease.Generate(cidr, id); err == nil && !ip.Equal(test.ip) {
+			t.Errorf("Row: %d returned ID: %d that generates unexpected IP, got: %v, wanted: %v", row, id, ip, test.ip)
+		}
+	}
+}
+
 func TestCIDR(t *testing.T) {
 
 	var cidrTests = []struct {
@@ -63,17 +130,126 @@ func TestCIDR(t *testing.T) {
 		{"192.168.1.0/128", true},
 		{"1234::1222:0/512", true},
 		{"wow:such:an:invalid:address::yes/lol", true},
+		{"192.168.1.0/24,exclude=192.168.1.1-192.168.1.9,exclude=192.168.1.53", false},
+		{"fd00::/64,exclude=fd00::1-fd00::ff", false},
+		{"192.168.1.0/24,exclude=192.168.2.1", true},
+		{"192.168.1.0/24,exclude=fd00::1", true},
+		{"192.168.1.0/24,exclude=192.168.1.9-192.168.1.1", true},
+		{"192.168.1.0/24,exclude=192.168.1.1-fd00::1", true},
+		{"192.168.1.0/24,include=192.168.1.1", true},
+		{"192.168.1.0/24,exclude=lol", true},
+		{"fd00::/48,delegate=64", false},
+		{"fd00::/48,delegate=64,exclude=fd00::1-fd00::ff", false},
+		{"192.168.1.0/24,delegate=28", true},
+		{"fd00::/48,delegate=48", true},
+		{"fd00::/48,delegate=129", true},
+		{"fd00::/48,delegate=lol", true},
 	}
 
 	for row, tests := range cidrTests {
-		_, err := lease.ParseCIDR(tests.cidr) // No reason to test the net.ParseCIDR() function, therefore ignoring first return
+		cidr, err := lease.ParseCIDR(tests.cidr)
 
 		if err != nil && !tests.err {
 			t.Errorf("Row: %d returned unexpected error: %v", row, err)
 		}
 
+		if err == nil && cidr.String() != tests.cidr {
+			t.Errorf("Row: %d returned unexpected string, got: %s, wanted: %s", row, cidr.String(), tests.cidr)
+		}
+
 		if err == nil && tests.err {
 			t.Errorf("Row: %d expected error but got %v", row, err)
 		}
 	}
 }
+
+func TestCIDR_Excludes(t *testing.T) {
+	var excludesTests = []struct {
+		cidr     string
+		ip       net.IP
+		excludes bool
+	}{
+		{"192.168.1.0/24", net.ParseIP("192.168.1.1"), false},
+		{"192.168.1.0/24", net.ParseIP("192.168.1.0"), true},
+		{"192.168.1.0/24", net.ParseIP("192.168.1.255"), true},
+		{"192.168.1.0/24,exclude=192.168.1.1-192.168.1.9", net.ParseIP("192.168.1.9"), true},
+		{"192.168.1.0/24,exclude=192.168.1.1-192.168.1.9", net.ParseIP("192.168.1.10"), false},
+		{"fd00::/48,delegate=64,exclude=fd00:0:0:1::1", net.ParseIP("fd00:0:0:1::"), true},
+		{"fd00::/48,delegate=64,exclude=fd00:0:0:1::1", net.ParseIP("fd00:0:0:2::"), false},
+	}
+
+	for row, test := range excludesTests {
+		cidr, err := lease.ParseCIDR(test.cidr)
+		if err != nil {
+			t.Fatalf("Row: %d returned unexpected error: %v", row, err)
+		}
+
+		if excludes := cidr.Excludes(test.ip); excludes != test.excludes {
+			t.Errorf("Row: %d returned unexpected result, got: %t, wanted: %t", row, excludes, test.excludes)
+		}
+	}
+}
+
+func TestCIDR_Prefix(t *testing.T) {
+	var prefixTests = []struct {
+		cidr   string
+		ip     net.IP
+		prefix string
+	}{
+		{"192.168.1.0/24", net.ParseIP("192.168.1.1"), "192.168.1.1/32"},
+		{"fd00::/64", net.ParseIP("fd00::1"), "fd00::1/128"},
+		{"fd00::/48,delegate=64", net.ParseIP("fd00:0:0:1::1"), "fd00:0:0:1::/64"},
+		{"fd00::/48,delegate=56", net.ParseIP("fd00:0:0:1ff::"), "fd00:0:0:100::/56"},
+	}
+
+	for row, test := range prefixTests {
+		cidr, err := lease.ParseCIDR(test.cidr)
+		if err != nil {
+			t.Fatalf("Row: %d returned unexpected error: %v", row, err)
+		}
+
+		if prefix := cidr.Prefix(test.ip).String(); prefix != test.prefix {
+			t.Errorf("Row: %d returned unexpected prefix, got: %s, wanted: %s", row, prefix, test.prefix)
+		}
+	}
+}
+
+func TestCIDR_Capacity(t *testing.T) {
+	var capacityTests = []struct {
+		cidr     string
+		capacity uint64
+	}{
+		{"192.168.1.0/24", 254},
+		{"192.168.1.10/24", 244},
+		{"192.168.1.0/31", 1},
+		{"192.168.1.0/32", 0},
+		{"192.168.1.0/24,exclude=192.168.1.1-192.168.1.9,exclude=192.168.1.250-192.168.1.255", 240},
+		{"fd00::/120", 255},
+		{"fd00::/48", math.MaxUint64},
+		{"fd00::/48,delegate=64", 65535},
+		{"fd00::/48,delegate=64,exclude=fd00:0:0:1::1", 65534},
+	}
+
+	for row, test := range capacityTests {
+		cidr, err := lease.ParseCIDR(test.cidr)
+		if err != nil {
+			t.Fatalf("Row: %d returned unexpected error: %v", row, err)
+		}
+
+		capacity := cidr.Capacity()
+		if capacity != test.capacity {
+			t.Errorf("Row: %d returned unexpected capacity, got: %d, wanted: %d", row, capacity, test.capacity)
+		}
+
+		// The last ID has an address, but not the one after it.
+		if _, err = lease.Generate(cidr, capacity); capacity != 0 && capacity != math.MaxUint64 && err != nil {
+			t.Errorf("Row: %d returned unexpected error for the last ID: %v", row, err)
+		}
+
+		if _, err = lease.Generate(cidr, capacity+1); capacity != math.MaxUint64 {
+			if _, ok := err.(lease.ExhaustedError); !ok {
+				t.Errorf("Row: %d returned unexpected error after the last ID: %v", row, err)
+			}
+		}
+	}
+}
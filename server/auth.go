@@ -0,0 +1,225 @@
+package server
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/willeponken/elvisp/auth"
+	"github.com/willeponken/elvisp/database"
+	"github.com/willeponken/elvisp/tasks"
+)
+
+const (
+	// maxAuthFailures is the number of failed admin authentications from an address before it is locked out.
+	maxAuthFailures = 3
+	// minAuthBackoff is how long an address is locked out after maxAuthFailures, it is doubled for every further failure.
+	minAuthBackoff = time.Second
+	// maxAuthBackoff is the longest an address is locked out, its failures are forgotten once this long has passed without another.
+	maxAuthBackoff = 5 * time.Minute
+)
+
+// errLocked is returned for every admin authentication from a locked out address.
+var errLocked = tasks.Error{Code: tasks.CodeUnauthorized, Err: fmt.Errorf("Address is locked out after %d failed admin authentications, try again later", maxAuthFailures)}
+
+// authFailures holds the number of failed admin authentications from an address, when the last one was and until when the
+// address is locked out.
+type authFailures struct {
+	count int
+	last  time.Time
+	until time.Time
+}
+
+// authLimiter counts failed admin authentications per remote address, over every connection and the HTTP management API. The zero
+// value is ready to use.
+type authLimiter struct {
+	mu       sync.Mutex
+	failures map[string]*authFailures
+}
+
+// remoteHost returns the host of a remote address, so every connection from the same address is counted together.
+func remoteHost(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+
+	return host
+}
+
+// locked returns true if the address is locked out at now.
+func (l *authLimiter) locked(host string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	f := l.failures[host]
+	return f != nil && now.Before(f.until)
+}
+
+// fail counts a failed admin authentication from the address, errLocked is returned instead of err if the address becomes locked out.
+func (l *authLimiter) fail(host string, now time.Time, err error) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.failures == nil {
+		l.failures = make(map[string]*authFailures)
+	}
+
+	// Forget the addresses that stopped failing, so the map does not grow with every address ever seen.
+	for h, f := range l.failures {
+		if now.Sub(f.last) > maxAuthBackoff {
+			delete(l.failures, h)
+		}
+	}
+
+	f := l.failures[host]
+	if f == nil {
+		f = &authFailures{}
+		l.failures[host] = f
+	}
+
+	f.count++
+	f.last = now
+
+	if f.count < maxAuthFailures {
+		return tasks.Error{Code: tasks.CodeUnauthorized, Err: err}
+	}
+
+	backoff := maxAuthBackoff
+	if shift := uint(f.count - maxAuthFailures); shift < 16 && minAuthBackoff<<shift < maxAuthBackoff {
+		backoff = minAuthBackoff << shift
+	}
+
+	f.until = now.Add(backoff)
+	log.Printf("Locking out: %s for: %s after %d failed admin authentications", host, backoff, f.count)
+
+	return errLocked
+}
+
+// succeed forgets the failed admin authentications from the address.
+func (l *authLimiter) succeed(host string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.failures, host)
+}
+
+// initVerifier derives the stored key and server key used for challenge-response authentication from the admin password, and saves them.
+func (s *Server) initVerifier(password string) error {
+	salt, err := auth.Random(auth.SaltSize)
+	if err != nil {
+		return err
+	}
+
+	storedKey, serverKey := auth.Keys(auth.DeriveKey(password, salt, auth.Iterations))
+
+	return s.db.SetVerifier(database.Verifier{
+		Salt:       salt,
+		Iterations: auth.Iterations,
+		StoredKey:  storedKey,
+		ServerKey:  serverKey,
+	})
+}
+
+// challenge creates a new nonce for the session and returns it with the salt and iterations needed to derive the key.
+func (s *Server) challenge(sess *session) (result *resultJSON, err error) {
+	v, err := s.db.AdminVerifier()
+	if err != nil {
+		return
+	}
+
+	if sess.nonce, err = auth.Random(auth.NonceSize); err != nil {
+		return
+	}
+
+	c := &challengeJSON{
+		Salt:       hex.EncodeToString(v.Salt),
+		Iterations: v.Iterations,
+		Nonce:      hex.EncodeToString(sess.nonce),
+	}
+
+	result = &resultJSON{
+		Message:   fmt.Sprintf("%s %d %s", c.Salt, c.Iterations, c.Nonce),
+		Challenge: c,
+	}
+
+	return
+}
+
+// verify checks the proof for the last challenge in the session, the challenge can only be used once.
+func (s *Server) verify(sess *session, proof string) (result *resultJSON, err error) {
+	nonce := sess.nonce
+	sess.nonce = nil
+
+	if nonce == nil {
+		err = tasks.Error{Code: tasks.CodeInvalidRequest, Err: errors.New("No challenge for admin authentication, send auth first")}
+		return
+	}
+
+	v, err := s.db.AdminVerifier()
+	if err != nil {
+		return
+	}
+
+	p, err := hex.DecodeString(proof)
+	if err != nil || !auth.VerifyClient(v.StoredKey, nonce, p) {
+		err = s.authLimit.fail(sess.host, time.Now(), errors.New("Invalid proof for admin authentication"))
+		return
+	}
+
+	sess.admin = true
+	s.authLimit.succeed(sess.host)
+
+	// The nonce signed with the server key lets the client check that the server holds the keys derived from the admin password.
+	result = &resultJSON{Message: "Authenticated as admin", Signature: hex.EncodeToString(auth.Proof(v.ServerKey, nonce))}
+	return
+}
+
+// authenticate handles the auth handshake, that upgrades a session to admin. Without a proof a new challenge is returned,
+// the client then sends a client proof for the nonce using the key derived from the admin password.
+func (s *Server) authenticate(sess *session, req request) string {
+	var result *resultJSON
+	var err error
+
+	switch {
+	case s.authLimit.locked(sess.host, time.Now()):
+		err = errLocked
+	case req.Proof == "":
+		result, err = s.challenge(sess)
+	default:
+		result, err = s.verify(sess, req.Proof)
+	}
+
+	if err != nil {
+		log.Printf("Admin authentication failed, due to error: %s", err)
+	}
+
+	return sess.reply(req.ID, result, err)
+}
+
+// authorize checks if a request may run a task for another node. The session has to be authenticated as admin,
+// or the request has to include the admin password.
+func (s *Server) authorize(sess *session, req request) error {
+	if s.authLimit.locked(sess.host, time.Now()) {
+		return errLocked
+	}
+
+	if req.Password == "" {
+		if !sess.admin {
+			return tasks.Error{Code: tasks.CodeUnauthorized, Err: errors.New("Session is not authenticated as admin, send auth first")}
+		}
+
+		return nil
+	}
+
+	if err := s.authAdmin(req.Password); err != nil {
+		return s.authLimit.fail(sess.host, time.Now(), err)
+	}
+
+	s.authLimit.succeed(sess.host)
+	return nil
+}
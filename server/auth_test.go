@@ -0,0 +1,232 @@
+package server
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/willeponken/elvisp/auth"
+	"github.com/willeponken/elvisp/tasks"
+	"github.com/willeponken/go-cjdns/key"
+)
+
+// mustProof parses a v2 challenge and returns the proof for password.
+func mustProof(t *testing.T, challenge, password string) string {
+	var salt, nonce string
+	var iterations int
+
+	if _, err := fmt.Sscanf(challenge, "success %s %d %s", &salt, &iterations, &nonce); err != nil {
+		t.Fatalf("Sscanf returned unexpected error: %v, for challenge: %q", err, challenge)
+	}
+
+	s, _ := hex.DecodeString(salt)
+	n, _ := hex.DecodeString(nonce)
+
+	return hex.EncodeToString(auth.ClientProof(auth.DeriveKey(password, s, iterations), n))
+}
+
+// TestAuthenticate checks that a session authenticated as admin can run tasks for other nodes without the password.
+func TestAuthenticate(t *testing.T) {
+	s := mustServe(t)
+	defer s.Close()
+
+	if err := s.initAdmin("secret"); err != nil {
+		t.Fatalf("initAdmin returned unexpected error: %v", err)
+	}
+
+	other := key.Generate().Pubkey()
+	s.cjdns.AddNode(other)
+	ip := other.IP().String()
+
+	conn, r := s.dial()
+	defer conn.Close()
+
+	mustSend(t, conn, r, "")
+
+	if resp := mustSend(t, conn, r, "lease "+ip); !strings.HasPrefix(resp, "error Session is not authenticated") {
+		t.Errorf("Unexpected response for unauthenticated admin lease: %q", resp)
+	}
+
+	if resp := mustSend(t, conn, r, "auth 00"); !strings.HasPrefix(resp, "error No challenge") {
+		t.Errorf("Unexpected response for proof without challenge: %q", resp)
+	}
+
+	proof := mustProof(t, mustSend(t, conn, r, "auth"), "secret")
+	if resp := mustSend(t, conn, r, "auth "+proof); resp != "success Authenticated as admin" {
+		t.Fatalf("Unexpected response for auth: %q", resp)
+	}
+
+	// The challenge can only be used once.
+	if resp := mustSend(t, conn, r, "auth "+proof); !strings.HasPrefix(resp, "error No challenge") {
+		t.Errorf("Unexpected response for replayed proof: %q", resp)
+	}
+
+	if resp := mustSend(t, conn, r, "lease "+ip); resp != "success 10.0.0.1 fd00::1" {
+		t.Errorf("Unexpected response for admin lease: %q", resp)
+	}
+
+	if resp := mustSend(t, conn, r, "remove "+ip); resp != "success Removed user: "+other.String() {
+		t.Errorf("Unexpected response for admin remove: %q", resp)
+	}
+
+	// The password is still accepted, it is not taken as a pool name.
+	if resp := mustSend(t, conn, r, "lease secret "+ip); resp != "success 10.0.0.1 fd00::1" {
+		t.Errorf("Unexpected response for admin lease with password: %q", resp)
+	}
+
+	if resp := mustSend(t, conn, r, "lease default "+ip); resp != "success 10.0.0.1 fd00::1" {
+		t.Errorf("Unexpected response for admin lease from pool: %q", resp)
+	}
+}
+
+// TestAuthenticate_lockout checks that the client address is locked out after repeated failures, also for the admin password, and
+// that a new connection from the same address is locked out as well.
+func TestAuthenticate_lockout(t *testing.T) {
+	s := mustServe(t)
+	defer s.Close()
+
+	if err := s.initAdmin("secret"); err != nil {
+		t.Fatalf("initAdmin returned unexpected error: %v", err)
+	}
+
+	conn, r := s.dial()
+	defer conn.Close()
+
+	mustSend(t, conn, r, "")
+
+	for i := 0; i < maxAuthFailures-1; i++ {
+		proof := mustProof(t, mustSend(t, conn, r, "auth"), "wrong")
+		if resp := mustSend(t, conn, r, "auth "+proof); resp != "error Invalid proof for admin authentication" {
+			t.Errorf("Row: %d returned unexpected response, got: %q", i, resp)
+		}
+	}
+
+	ip := s.client.IP().String()
+	if resp := mustSend(t, conn, r, "lease wrong "+ip); resp != "error "+errLocked.Error() {
+		t.Errorf("Unexpected response for wrong admin password: %q", resp)
+	}
+
+	var lockedTests = []string{"auth", "lease secret " + ip}
+	for row, cmd := range lockedTests {
+		if resp := mustSend(t, conn, r, cmd); resp != "error "+errLocked.Error() {
+			t.Errorf("Row: %d returned unexpected response, got: %q", row, resp)
+		}
+	}
+
+	other, otherR := s.dial()
+	defer other.Close()
+
+	mustSend(t, other, otherR, "")
+	if resp := mustSend(t, other, otherR, "auth"); resp != "error "+errLocked.Error() {
+		t.Errorf("Unexpected response for auth from a new connection: %q", resp)
+	}
+}
+
+// TestAuthLimiter checks that an address is locked out after maxAuthFailures, for a backoff that doubles up to maxAuthBackoff, and
+// that other addresses are not affected.
+func TestAuthLimiter(t *testing.T) {
+	var l authLimiter
+	now := time.Now()
+	failed := errors.New("failed")
+
+	var limitTests = []struct {
+		host    string
+		offset  time.Duration
+		fail    bool
+		locked  bool
+		backoff time.Duration
+	}{
+		{"fc00::1", 0, true, false, 0},
+		{"fc00::1", 0, true, false, 0},
+		{"fc00::1", 0, true, true, minAuthBackoff},
+		{"fc00::2", 0, false, false, 0},
+		{"fc00::1", minAuthBackoff, true, true, 2 * minAuthBackoff},
+		{"fc00::1", 20 * time.Minute, true, false, 0}, // Forgotten after maxAuthBackoff
+	}
+
+	for row, test := range limitTests {
+		at := now.Add(test.offset)
+
+		if test.fail {
+			err := l.fail(test.host, at, failed)
+			if (err == errLocked) != test.locked {
+				t.Errorf("Row: %d returned unexpected error, got: %v, wanted locked: %t", row, err, test.locked)
+			}
+		}
+
+		if locked := l.locked(test.host, at); locked != test.locked {
+			t.Errorf("Row: %d returned unexpected lock, got: %t, wanted: %t", row, locked, test.locked)
+		}
+
+		if test.backoff > 0 && (!l.locked(test.host, at.Add(test.backoff-time.Millisecond)) || l.locked(test.host, at.Add(test.backoff))) {
+			t.Errorf("Row: %d returned unexpected backoff, wanted: %s", row, test.backoff)
+		}
+	}
+
+	// The backoff stops doubling at maxAuthBackoff.
+	for i := 0; i < 20; i++ {
+		l.fail("fc00::3", now, failed)
+	}
+
+	if !l.locked("fc00::3", now.Add(maxAuthBackoff-time.Millisecond)) || l.locked("fc00::3", now.Add(maxAuthBackoff)) {
+		t.Errorf("locked returned unexpected lock, wanted a backoff of: %s", maxAuthBackoff)
+	}
+
+	l.succeed("fc00::3")
+	if l.locked("fc00::3", now) {
+		t.Errorf("locked returned true after succeed")
+	}
+}
+
+// TestAuthenticate_v3 checks the challenge in a v3 response.
+func TestAuthenticate_v3(t *testing.T) {
+	s := mustServe(t)
+	defer s.Close()
+
+	if err := s.initAdmin("secret"); err != nil {
+		t.Fatalf("initAdmin returned unexpected error: %v", err)
+	}
+
+	conn, r := s.dial()
+	defer conn.Close()
+
+	mustSend(t, conn, r, "")
+	mustSend(t, conn, r, "version 3")
+
+	var resp response
+	if err := json.Unmarshal([]byte(mustSend(t, conn, r, `{"id":1,"command":"auth"}`)), &resp); err != nil {
+		t.Fatalf("Unmarshal returned unexpected error: %v", err)
+	}
+
+	if resp.Result == nil || resp.Result.Challenge == nil {
+		t.Fatalf("Unexpected response for auth: %+v", resp)
+	}
+
+	c := resp.Result.Challenge
+	salt, _ := hex.DecodeString(c.Salt)
+	nonce, _ := hex.DecodeString(c.Nonce)
+	salted := auth.DeriveKey("secret", salt, c.Iterations)
+	proof := hex.EncodeToString(auth.ClientProof(salted, nonce))
+
+	resp = response{}
+	json.Unmarshal([]byte(mustSend(t, conn, r, `{"id":2,"command":"auth","proof":"`+proof+`"}`)), &resp)
+	if resp.Status != statusSuccess || resp.Result == nil || resp.Result.Message != "Authenticated as admin" {
+		t.Fatalf("Unexpected response for proof: %+v", resp)
+	}
+
+	// The signature proves that the server holds the keys derived from the password.
+	_, serverKey := auth.Keys(salted)
+	if signature, _ := hex.DecodeString(resp.Result.Signature); !auth.Verify(serverKey, nonce, signature) {
+		t.Errorf("Unexpected signature for proof: %q", resp.Result.Signature)
+	}
+
+	resp = response{}
+	json.Unmarshal([]byte(mustSend(t, conn, r, `{"id":3,"command":"renew","ip":"`+s.client.IP().String()+`"}`)), &resp)
+	if resp.Error == nil || resp.Error.Code != tasks.CodeNotFound {
+		t.Errorf("Unexpected response for admin renew: %+v", resp)
+	}
+}
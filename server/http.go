@@ -0,0 +1,699 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/willeponken/elvisp/database"
+	"github.com/willeponken/elvisp/lease"
+	"github.com/willeponken/elvisp/tasks"
+	"github.com/willeponken/go-cjdns/key"
+)
+
+// httpStatus maps error codes to HTTP status codes, unknown codes are internal server errors.
+var httpStatus = map[string]int{
+	tasks.CodeInvalidRequest:   http.StatusBadRequest,
+	tasks.CodeUnknownCommand:   http.StatusNotFound,
+	tasks.CodeUnauthorized:     http.StatusUnauthorized,
+	tasks.CodeUnknownNode:      http.StatusNotFound,
+	tasks.CodeNotFound:         http.StatusNotFound,
+	tasks.CodeConflict:         http.StatusConflict,
+	tasks.CodeExhausted:        http.StatusServiceUnavailable,
+	tasks.CodeCjdns:            http.StatusBadGateway,
+	tasks.CodeCjdnsUnavailable: http.StatusServiceUnavailable,
+}
+
+// infoJSON holds information about the server in an API response.
+type infoJSON struct {
+	ServerKey string          `json:"server_key,omitempty"`
+	CIDRs     []string        `json:"cidrs"`
+	LeaseTime string          `json:"lease_time"`
+	Users     int             `json:"users"`
+	Leases    int             `json:"leases"`
+	Pools     []poolUsageJSON `json:"pools"`
+}
+
+// poolUsageJSON holds the usage of a CIDR in a pool in an API response.
+type poolUsageJSON struct {
+	Pool     string `json:"pool"`
+	CIDR     string `json:"cidr"`
+	Capacity uint64 `json:"capacity"`
+	Used     uint64 `json:"used"`
+	Free     uint64 `json:"free"`
+	Percent  int    `json:"percent"`
+}
+
+// newPoolUsageJSON converts the usage of every pool for an API response.
+func newPoolUsageJSON(usage []tasks.PoolUsage) (pools []poolUsageJSON) {
+	pools = []poolUsageJSON{}
+	for _, u := range usage {
+		pools = append(pools, poolUsageJSON{Pool: u.Pool, CIDR: u.CIDR.String(), Capacity: u.Capacity, Used: u.Used, Free: u.Free, Percent: u.Percent()})
+	}
+
+	return
+}
+
+// labelsJSON holds the labels for a user in a request.
+type labelsJSON struct {
+	Labels map[string]string `json:"labels"`
+}
+
+// poolsJSON holds the CIDRs of the default pool and of every named pool, both in requests and responses. The named pools are
+// kept if they are left out of a request. The usage is only set in responses.
+type poolsJSON struct {
+	CIDRs []string            `json:"cidrs"`
+	Pools map[string][]string `json:"pools,omitempty"`
+	Usage []poolUsageJSON     `json:"usage,omitempty"`
+}
+
+// leaseRequestJSON holds the pool to lease from in a request, the body is optional.
+type leaseRequestJSON struct {
+	Pool string `json:"pool"`
+}
+
+// reservationJSON holds a reservation, both in requests and responses. The key and IP are only set in responses.
+type reservationJSON struct {
+	Key       string   `json:"key,omitempty"`
+	IP        string   `json:"ip,omitempty"`
+	ID        uint64   `json:"id,omitempty"`
+	Addresses []string `json:"addresses,omitempty"`
+}
+
+// newReservationJSON converts a reservation for an API response.
+func newReservationJSON(r database.Reservation) reservationJSON {
+	res := reservationJSON{Key: r.Key.String(), IP: r.Key.IP().String(), ID: r.ID}
+	for _, ip := range r.Addresses {
+		res.Addresses = append(res.Addresses, ip.String())
+	}
+
+	return res
+}
+
+// writeJSON writes v as the JSON body of a response.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Unable to write HTTP response, due to error: %s", err)
+	}
+}
+
+// writeError writes err as the JSON body of a response, the status is based on the error code.
+func writeError(w http.ResponseWriter, err error) {
+	code := tasks.ErrorCode(err)
+
+	status, ok := httpStatus[code]
+	if !ok {
+		status = http.StatusInternalServerError
+	}
+
+	writeJSON(w, status, errorJSON{Code: code, Message: err.Error()})
+}
+
+// methodNotAllowed writes an error for a method that is not supported by the resource.
+func methodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	err := fmt.Errorf("Method: %s is not allowed for: %s", r.Method, r.URL.Path)
+	writeJSON(w, http.StatusMethodNotAllowed, errorJSON{Code: tasks.CodeInvalidRequest, Message: err.Error()})
+}
+
+// cidrStrings formats every CIDR as a string.
+func cidrStrings(cidrs []lease.CIDR) (list []string) {
+	list = []string{}
+	for _, c := range cidrs {
+		list = append(list, c.String())
+	}
+
+	return
+}
+
+// namedCIDRs formats the CIDRs of every named pool as strings, by the name of the pool.
+func namedCIDRs(policy tasks.Policy) (named map[string][]string) {
+	for _, pool := range policy.Pools {
+		if pool.Name == tasks.DefaultPool {
+			continue
+		}
+
+		if named == nil {
+			named = make(map[string][]string)
+		}
+
+		named[pool.Name] = cidrStrings(pool.CIDRs)
+	}
+
+	return
+}
+
+// parseTarget parses the user in an API path, either a public key or a cjdns IPv6 address, and returns the cjdns IPv6 address. The
+// public key is nil if the user is identified by its address.
+func parseTarget(target string) (pubkey *key.Public, ip net.IP, err error) {
+	if ip = net.ParseIP(target); ip != nil {
+		if err = validCjdnsIPv6(ip); err != nil {
+			err = tasks.Error{Code: tasks.CodeInvalidRequest, Err: err}
+		}
+
+		return
+	}
+
+	if pubkey, err = key.DecodePublic(target); err != nil {
+		err = tasks.Error{Code: tasks.CodeInvalidRequest, Err: fmt.Errorf("Invalid public key or IP address: %s", target)}
+		return
+	}
+
+	return pubkey, pubkey.IP(), nil
+}
+
+// newUserJSON converts a user for an API response, with the addresses from its pool and the lease. A user leasing from a pool
+// that no longer exists has no addresses.
+func (s *Server) newUserJSON(u database.User) (user userJSON, err error) {
+	user = newRecordJSON(u)
+
+	r, err := s.db.GetReservation(u.Key)
+	if err != nil { // The user has no reservation
+		r = database.Reservation{}
+	}
+
+	addrs, err := s.policy().UserAddresses(u, r)
+	if err != nil && tasks.ErrorCode(err) != tasks.CodeNotFound {
+		return
+	}
+	user.IPv4, user.IPv6 = splitAddresses(addrs)
+
+	l, err := s.db.GetLease(u.ID)
+	if err != nil { // The user has no lease
+		return user, nil
+	}
+
+	user.Lease = &leaseJSON{Granted: l.Granted.UTC(), Expires: jsonTime(l.Expires)}
+	return
+}
+
+// findUser returns the registered user with a cjdns IPv6 address.
+func (s *Server) findUser(ip net.IP) (user database.User, err error) {
+	users, err := s.db.Users()
+	if err != nil {
+		return
+	}
+
+	for _, u := range users {
+		if u.Key.IP().Equal(ip) {
+			return u, nil
+		}
+	}
+
+	err = tasks.Error{Code: tasks.CodeNotFound, Err: fmt.Errorf("User with IP: %s does not exist", ip)}
+	return
+}
+
+// initTask returns a task with the arguments for the node with the public key, or with the cjdns IPv6 address if the key is nil. The key
+// of a registered user is used as is, so users that are offline or missing in the cjdns node store can still be managed. Only other
+// nodes are looked up in the node store.
+func (s *Server) initTask(pubkey *key.Public, ip net.IP, argv []string) (t tasks.Task, err error) {
+	if pubkey == nil {
+		u, err := s.findUser(ip)
+		if err != nil && tasks.ErrorCode(err) != tasks.CodeNotFound {
+			return t, err
+		}
+
+		pubkey = u.Key
+	}
+
+	if pubkey == nil {
+		return tasks.Init(argv, s.db, s.admin, ip, nil, s.policy(), s.leaseTime)
+	}
+
+	return tasks.InitKey(argv, s.db, s.admin, pubkey, nil, s.policy(), s.leaseTime)
+}
+
+// runTask runs a task with the arguments for the node with the public key, or with the cjdns IPv6 address, and writes the result.
+func (s *Server) runTask(w http.ResponseWriter, command string, pubkey *key.Public, ip net.IP, argv ...string) {
+	t, err := s.initTask(pubkey, ip, argv)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	result, err := s.run(newTask(command, t.WithSource(database.SourceAdmin)))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newResultJSON(result))
+}
+
+// leaseUser leases addresses for the user with the public key or cjdns IPv6 address, from the pool in the body if there is one.
+func (s *Server) leaseUser(w http.ResponseWriter, r *http.Request, pubkey *key.Public, ip net.IP) {
+	var req leaseRequestJSON
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		writeError(w, tasks.Error{Code: tasks.CodeInvalidRequest, Err: fmt.Errorf("Invalid JSON request: %v", err)})
+		return
+	}
+
+	var argv []string
+	if req.Pool != "" {
+		argv = append(argv, req.Pool)
+	}
+
+	s.runTask(w, "lease", pubkey, ip, argv...)
+}
+
+// setLabels replaces the labels for the user with a cjdns IPv6 address and writes the updated user.
+func (s *Server) setLabels(w http.ResponseWriter, r *http.Request, ip net.IP) {
+	var labels labelsJSON
+	if err := json.NewDecoder(r.Body).Decode(&labels); err != nil {
+		writeError(w, tasks.Error{Code: tasks.CodeInvalidRequest, Err: fmt.Errorf("Invalid JSON request: %v", err)})
+		return
+	}
+
+	u, err := s.findUser(ip)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	err = s.db.Update(func(tx database.Tx) (err error) {
+		if u, err = tx.GetUser(u.ID); err != nil {
+			return
+		}
+
+		u.Labels = labels.Labels
+		return tx.PutUser(u)
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	user, err := s.newUserJSON(u)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, user)
+}
+
+// handleInfo returns information about the server, the server key is only known if the API is requested over cjdns.
+func (s *Server) handleInfo(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, r)
+		return
+	}
+
+	users, err := s.db.Users()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	leases, err := s.db.Leases()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	policy := s.policy()
+	usage, err := tasks.Usage(s.db, policy)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	pool, _ := policy.Pool(tasks.DefaultPool)
+	info := infoJSON{
+		CIDRs:     cidrStrings(pool.CIDRs),
+		LeaseTime: s.leaseTime.String(),
+		Users:     len(users),
+		Leases:    len(leases),
+		Pools:     newPoolUsageJSON(usage),
+	}
+
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		if ip, err := parseCjdnsIPv6(addr); err == nil {
+			info.ServerKey, _ = s.admin.LookupPubKey(ip.String())
+		}
+	}
+
+	writeJSON(w, http.StatusOK, info)
+}
+
+// handleUsers lists every registered user.
+func (s *Server) handleUsers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, r)
+		return
+	}
+
+	users, err := s.db.Users()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	list := []userJSON{}
+	for _, u := range users {
+		user, err := s.newUserJSON(u)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		list = append(list, user)
+	}
+
+	writeJSON(w, http.StatusOK, list)
+}
+
+// handleUser looks up, leases, labels or removes a user identified by public key or cjdns IPv6 address,
+// i.e. /api/users/<user>[/lease|/labels].
+func (s *Server) handleUser(w http.ResponseWriter, r *http.Request) {
+	path := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/users/"), "/")
+
+	pubkey, ip, err := parseTarget(path[0])
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	switch {
+	case len(path) == 1 && r.Method == http.MethodGet:
+		u, err := s.findUser(ip)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		user, err := s.newUserJSON(u)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, user)
+	case len(path) == 1 && r.Method == http.MethodDelete:
+		s.runTask(w, "remove", pubkey, ip)
+	case len(path) == 2 && path[1] == "lease" && r.Method == http.MethodPost:
+		s.leaseUser(w, r, pubkey, ip)
+	case len(path) == 2 && path[1] == "labels" && r.Method == http.MethodPut:
+		s.setLabels(w, r, ip)
+	case len(path) == 1 || len(path) == 2 && (path[1] == "lease" || path[1] == "labels"):
+		methodNotAllowed(w, r)
+	default:
+		err = fmt.Errorf("No resource found for: %s", r.URL.Path)
+		writeError(w, tasks.Error{Code: tasks.CodeNotFound, Err: err})
+	}
+}
+
+// handlePools returns or replaces the CIDRs of the pools used for leasing. As the addresses for every user change with the CIDRs,
+// the cjdns IP tunnel is reconciled after replacing them.
+func (s *Server) handlePools(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		// The pools in a config file are applied again on SIGHUP, which would undo the change without notice.
+		if s.settings.Reload != nil {
+			writeError(w, tasks.Error{Code: tasks.CodeConflict, Err: errors.New("Pools are set by the config file, change it and send SIGHUP instead")})
+			return
+		}
+
+		var pools poolsJSON
+		if err := json.NewDecoder(r.Body).Decode(&pools); err != nil {
+			writeError(w, tasks.Error{Code: tasks.CodeInvalidRequest, Err: fmt.Errorf("Invalid JSON request: %v", err)})
+			return
+		}
+
+		cidrs, err := parseCIDRs(pools.CIDRs)
+		if err != nil {
+			writeError(w, tasks.Error{Code: tasks.CodeInvalidRequest, Err: err})
+			return
+		}
+
+		if len(cidrs) == 0 {
+			writeError(w, tasks.Error{Code: tasks.CodeInvalidRequest, Err: errors.New("Atleast one CIDR has to be defined")})
+			return
+		}
+
+		policy := s.policy()
+		if pools.Pools != nil {
+			if policy.Pools, err = parsePools(pools.Pools); err != nil {
+				writeError(w, tasks.Error{Code: tasks.CodeInvalidRequest, Err: err})
+				return
+			}
+		}
+
+		policy = policy.WithCIDRs(cidrs)
+		if err = policy.Check(); err != nil {
+			writeError(w, tasks.Error{Code: tasks.CodeInvalidRequest, Err: err})
+			return
+		}
+
+		s.setPolicy(policy)
+		log.Printf("Changed CIDRs for leasing to: %v and named pools to: %v", pools.CIDRs, namedCIDRs(policy))
+
+		if _, err = s.reconcile(s.reconcileDryRun); err != nil {
+			err = fmt.Errorf("Changed CIDRs, but unable to reconcile cjdns IP tunnel, due to error: %v", err)
+			writeError(w, tasks.Error{Code: tasks.CodeCjdns, Err: err})
+			return
+		}
+	default:
+		methodNotAllowed(w, r)
+		return
+	}
+
+	policy := s.policy()
+	usage, err := tasks.Usage(s.db, policy)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	pool, _ := policy.Pool(tasks.DefaultPool)
+	writeJSON(w, http.StatusOK, poolsJSON{CIDRs: cidrStrings(pool.CIDRs), Pools: namedCIDRs(policy), Usage: newPoolUsageJSON(usage)})
+}
+
+// handleReservations lists every reservation.
+func (s *Server) handleReservations(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, r)
+		return
+	}
+
+	reservations, err := s.db.Reservations()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	list := []reservationJSON{}
+	for _, res := range reservations {
+		list = append(list, newReservationJSON(res))
+	}
+
+	writeJSON(w, http.StatusOK, list)
+}
+
+// handleReservation looks up, sets or removes the reservation for a public key, i.e. /api/reservations/<key>.
+// The node does not have to be registered, or known by cjdns.
+func (s *Server) handleReservation(w http.ResponseWriter, r *http.Request) {
+	target := strings.TrimPrefix(r.URL.Path, "/api/reservations/")
+
+	pubkey, err := key.DecodePublic(target)
+	if err != nil {
+		writeError(w, tasks.Error{Code: tasks.CodeInvalidRequest, Err: fmt.Errorf("Invalid public key: %s", target)})
+		return
+	}
+
+	var command string
+	var argv []string
+
+	switch r.Method {
+	case http.MethodGet:
+		res, err := s.db.GetReservation(pubkey)
+		if err != nil {
+			writeError(w, tasks.Error{Code: tasks.CodeNotFound, Err: err})
+			return
+		}
+
+		writeJSON(w, http.StatusOK, newReservationJSON(res))
+		return
+	case http.MethodPut:
+		var res reservationJSON
+		if err := json.NewDecoder(r.Body).Decode(&res); err != nil {
+			writeError(w, tasks.Error{Code: tasks.CodeInvalidRequest, Err: fmt.Errorf("Invalid JSON request: %v", err)})
+			return
+		}
+
+		if res.ID != 0 {
+			argv = append(argv, strconv.FormatUint(res.ID, 10))
+		}
+
+		command, argv = "reserve", append(argv, res.Addresses...)
+	case http.MethodDelete:
+		command = "unreserve"
+	default:
+		methodNotAllowed(w, r)
+		return
+	}
+
+	t, err := tasks.InitKey(argv, s.db, s.admin, pubkey, nil, s.policy(), s.leaseTime)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	result, err := s.run(newTask(command, t.WithSource(database.SourceAdmin)))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newResultJSON(result))
+}
+
+// handleBackup writes a consistent copy of the database, while it is in use.
+func (s *Server) handleBackup(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="elvispd.db"`)
+
+	// The status is already written if the backup fails, so the error can only be logged.
+	if _, err := s.db.Backup(w); err != nil {
+		log.Printf("Unable to write backup of database, due to error: %s", err)
+	}
+}
+
+// handleExport writes every user and the settings for the administrator as JSON, or only the users as CSV with ?format=csv.
+func (s *Server) handleExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, r)
+		return
+	}
+
+	export, contentType := s.db.Export, "application/json"
+	if r.URL.Query().Get("format") == "csv" {
+		export, contentType = s.db.ExportCSV, "text/csv"
+	}
+
+	w.Header().Set("Content-Type", contentType)
+
+	if err := export(w); err != nil {
+		log.Printf("Unable to write export of database, due to error: %s", err)
+	}
+}
+
+// handleImport imports users, and the settings for the administrator, from an export into an empty database.
+// A body with the content type text/csv is imported as CSV, otherwise as JSON.
+func (s *Server) handleImport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, r)
+		return
+	}
+
+	importer := s.db.Import
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "text/csv") {
+		importer = s.db.ImportCSV
+	}
+
+	n, err := importer(r.Body)
+	if err != nil {
+		writeError(w, tasks.Error{Code: tasks.CodeInvalidRequest, Err: fmt.Errorf("Unable to import users, due to error: %v", err)})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, resultJSON{Message: fmt.Sprintf("Imported %d users", n)})
+}
+
+// requireAdmin only lets requests with the admin password, using HTTP basic authentication, through to next. The user name is ignored.
+// Wrong passwords are counted per client address together with the leasing protocol, and a locked out address is refused before the
+// password is checked.
+func (s *Server) requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := remoteHost(r.RemoteAddr)
+		_, password, ok := r.BasicAuth()
+
+		var err error
+		switch {
+		case s.authLimit.locked(host, time.Now()):
+			err = errLocked
+		case !ok:
+			err = errors.New("Missing password for admin")
+		default:
+			if err = s.authAdmin(password); err != nil {
+				err = s.authLimit.fail(host, time.Now(), err)
+			} else {
+				s.authLimit.succeed(host)
+			}
+		}
+
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Basic realm="elvisp"`)
+			writeError(w, tasks.Error{Code: tasks.CodeUnauthorized, Err: err})
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// apiHandler returns the handler for the HTTP management API.
+func (s *Server) apiHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/info", s.handleInfo)
+	mux.HandleFunc("/api/users", s.handleUsers)
+	mux.HandleFunc("/api/users/", s.handleUser)
+	mux.HandleFunc("/api/pools", s.handlePools)
+	mux.HandleFunc("/api/reservations", s.handleReservations)
+	mux.HandleFunc("/api/reservations/", s.handleReservation)
+	mux.HandleFunc("/api/backup", s.handleBackup)
+	mux.HandleFunc("/api/export", s.handleExport)
+	mux.HandleFunc("/api/import", s.handleImport)
+
+	return s.requireAdmin(mux)
+}
+
+// checkAPIListen returns an error if the HTTP management API would send the admin password in cleartext over the network, i.e. if it
+// is not served over TLS and listens on another address than a loopback address or a cjdns address, which cjdns encrypts.
+func checkAPIListen(listen string, tls bool) error {
+	if tls {
+		return nil
+	}
+
+	host, _, err := net.SplitHostPort(listen)
+	if err != nil {
+		return err
+	}
+
+	if ip := net.ParseIP(host); host == "localhost" || ip != nil && (ip.IsLoopback() || validCjdnsIPv6(ip) == nil) {
+		return nil
+	}
+
+	return fmt.Errorf("HTTP management API on: %s would send the admin password in cleartext, listen on a loopback or cjdns address or use a TLS certificate", listen)
+}
+
+// serveAPI serves the HTTP management API on the listener opened by New, over TLS if it has a certificate, until the server is shut
+// down.
+func (s *Server) serveAPI() {
+	log.Printf("Serving HTTP management API on: %s", s.apiLn.Addr())
+
+	serve := s.api.Serve
+	if s.api.TLSConfig != nil {
+		serve = func(l net.Listener) error { return s.api.ServeTLS(l, "", "") }
+	}
+
+	if err := serve(s.apiLn); err != nil && err != http.ErrServerClosed {
+		log.Printf("Unable to serve HTTP management API on: %s, due to error: %s", s.apiLn.Addr(), err)
+	}
+}
@@ -0,0 +1,377 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/willeponken/elvisp/database"
+	"github.com/willeponken/go-cjdns/key"
+)
+
+// mustRequest sends a request to the HTTP management API and returns the status code and body.
+func mustRequest(t *testing.T, url, method, path, password, body string) (int, string) {
+	req, err := http.NewRequest(method, url+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("NewRequest returned unexpected error: %v", err)
+	}
+
+	if password != "" {
+		req.SetBasicAuth("admin", password)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Do returned unexpected error: %v", err)
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("ReadAll returned unexpected error: %v", err)
+	}
+
+	return resp.StatusCode, strings.TrimSpace(string(b))
+}
+
+// TestAPI checks the HTTP management API against cjdns, using both public keys and cjdns IPv6 addresses to identify users.
+func TestAPI(t *testing.T) {
+	s := mustServe(t)
+	defer s.Close()
+
+	if err := s.initAdmin("secret"); err != nil {
+		t.Fatalf("initAdmin returned unexpected error: %v", err)
+	}
+
+	api := httptest.NewServer(s.apiHandler())
+	defer api.Close()
+
+	client, ip := s.client.String(), s.client.IP().String()
+
+	var apiTests = []struct {
+		method, path, password, body string
+		status                       int
+		resp                         string
+	}{
+		{"GET", "/api/info", "", "", http.StatusUnauthorized, ""},
+		{"GET", "/api/info", "wrong", "", http.StatusUnauthorized, ""},
+		{"GET", "/api/info", "secret", "", http.StatusOK, `{"cidrs":["10.0.0.0/24","fd00::/64"],"lease_time":"1h0m0s","users":0,"leases":0,"pools":[{"pool":"default","cidr":"10.0.0.0/24","capacity":254,"used":0,"free":254,"percent":0},`},
+		{"GET", "/api/users", "secret", "", http.StatusOK, `[]`},
+		{"GET", "/api/users/" + ip, "secret", "", http.StatusNotFound, ""},
+		{"POST", "/api/users/" + ip + "/lease", "secret", "", http.StatusOK, ""},
+		{"GET", "/api/users/" + client, "secret", "", http.StatusOK, `"ipv4":[{"address":"10.0.0.1","prefix_length":24}],"ipv6":[{"address":"fd00::1","prefix_length":64}],"lease":{"granted":`},
+		{"GET", "/api/users", "secret", "", http.StatusOK, `"key":"` + client + `","ip":"` + ip + `"`},
+		{"GET", "/api/users/" + ip, "secret", "", http.StatusOK, `"assigned":[{"pool":"10.0.0.0/24","address":"10.0.0.1"},{"pool":"fd00::/64","address":"fd00::1"}]`},
+		{"GET", "/api/users/" + ip, "secret", "", http.StatusOK, `"source":"admin"`},
+		{"PUT", "/api/users/" + ip + "/labels", "secret", `{"labels":{"owner":"alice"}}`, http.StatusOK, `"labels":{"owner":"alice"}`},
+		{"PUT", "/api/users/" + ip + "/labels", "secret", `nope`, http.StatusBadRequest, ""},
+		{"GET", "/api/users/" + client, "secret", "", http.StatusOK, `"labels":{"owner":"alice"}`},
+		{"GET", "/api/users/" + ip + "/labels", "secret", "", http.StatusMethodNotAllowed, ""},
+		{"PUT", "/api/pools", "secret", `{"cidrs":["10.1.0.0/16"]}`, http.StatusOK, `{"cidrs":["10.1.0.0/16"],"usage":[{"pool":"default","cidr":"10.1.0.0/16","capacity":65534,"used":1,"free":65533,"percent":0}]}`},
+		{"PUT", "/api/pools", "secret", `{"cidrs":["nope"]}`, http.StatusBadRequest, ""},
+		{"PUT", "/api/pools", "secret", `{"cidrs":[]}`, http.StatusBadRequest, ""},
+		{"GET", "/api/pools", "secret", "", http.StatusOK, `{"cidrs":["10.1.0.0/16"],"usage":[{"pool":"default","cidr":"10.1.0.0/16","capacity":65534,"used":1,"free":65533,"percent":0}]}`},
+		{"GET", "/api/users/" + ip, "secret", "", http.StatusOK, `"ipv4":[{"address":"10.1.0.1","prefix_length":16}]`},
+		{"PUT", "/api/pools", "secret", `{"cidrs":["10.1.0.0/16,exclude=10.1.0.1-10.1.0.9"]}`, http.StatusOK, `{"cidrs":["10.1.0.0/16,exclude=10.1.0.1-10.1.0.9"],"usage":[{"pool":"default","cidr":"10.1.0.0/16,exclude=10.1.0.1-10.1.0.9","capacity":65525,`},
+		{"PUT", "/api/pools", "secret", `{"cidrs":["10.1.0.0/16,exclude=10.2.0.1"]}`, http.StatusBadRequest, ""},
+		{"GET", "/api/users/" + ip, "secret", "", http.StatusOK, `"ipv4":[{"address":"10.1.0.10","prefix_length":16}]`},
+		{"PUT", "/api/pools", "secret", `{"cidrs":["10.1.0.0/16"],"pools":{"guests":["10.2.0.0/24"]}}`, http.StatusOK, `"pools":{"guests":["10.2.0.0/24"]}`},
+		{"PUT", "/api/pools", "secret", `{"cidrs":["10.1.0.0/16"],"pools":{"10.3.0.1":["10.3.0.0/24"]}}`, http.StatusBadRequest, ""},
+		{"POST", "/api/users/" + ip + "/lease", "secret", `{"pool":"guests"}`, http.StatusOK, `"pool":"guests","ipv4":[{"address":"10.2.0.1","prefix_length":24}]`},
+		{"POST", "/api/users/" + ip + "/lease", "secret", `{"pool":"nope"}`, http.StatusNotFound, ""},
+		{"GET", "/api/users/" + client, "secret", "", http.StatusOK, `"pool":"guests","ipv4":[{"address":"10.2.0.1","prefix_length":24}]`},
+		{"GET", "/api/pools", "secret", "", http.StatusOK, `{"pool":"guests","cidr":"10.2.0.0/24","capacity":254,"used":1,`},
+		{"DELETE", "/api/users/" + client, "secret", "", http.StatusOK, `"message":"Removed user: ` + client + `"`},
+		{"DELETE", "/api/users/" + ip, "secret", "", http.StatusNotFound, `"code":"not_found"`},
+		{"GET", "/api/users/10.0.0.1", "secret", "", http.StatusBadRequest, `"code":"invalid_request"`},
+		{"GET", "/api/users/" + ip + "/lease", "secret", "", http.StatusMethodNotAllowed, ""},
+		{"GET", "/api/users/" + ip + "/lol", "secret", "", http.StatusNotFound, ""},
+		{"POST", "/api/info", "secret", "", http.StatusMethodNotAllowed, ""},
+	}
+
+	for row, test := range apiTests {
+		status, resp := mustRequest(t, api.URL, test.method, test.path, test.password, test.body)
+
+		if status != test.status {
+			t.Errorf("Row: %d returned unexpected status, got: %d, wanted: %d, response: %s", row, status, test.status, resp)
+		}
+
+		if !strings.Contains(resp, test.resp) {
+			t.Errorf("Row: %d returned unexpected response, got: %s, wanted it to contain: %s", row, resp, test.resp)
+		}
+
+		if !json.Valid([]byte(resp)) {
+			t.Errorf("Row: %d returned invalid JSON: %s", row, resp)
+		}
+	}
+
+	if tunnels := s.cjdns.Tunnels(); len(tunnels) != 0 {
+		t.Errorf("API left unexpected tunnels: %v", tunnels)
+	}
+}
+
+// TestAPI_reservations checks if reservations can be managed for nodes that are not registered, and that they are leased.
+func TestAPI_reservations(t *testing.T) {
+	s := mustServe(t)
+	defer s.Close()
+
+	if err := s.initAdmin("secret"); err != nil {
+		t.Fatalf("initAdmin returned unexpected error: %v", err)
+	}
+
+	api := httptest.NewServer(s.apiHandler())
+	defer api.Close()
+
+	client, other := s.client.String(), key.Generate().Pubkey().String()
+
+	var apiTests = []struct {
+		method, path, body string
+		status             int
+		resp               string
+	}{
+		{"GET", "/api/reservations", "", http.StatusOK, `[]`},
+		{"PUT", "/api/reservations/" + client, `{"id":5,"addresses":["fd00::beef"]}`, http.StatusOK, `"ipv4":[{"address":"10.0.0.5","prefix_length":24}],"ipv6":[{"address":"fd00::beef","prefix_length":64}]`},
+		{"PUT", "/api/reservations/" + other, `{"id":5}`, http.StatusConflict, `"code":"conflict"`},
+		{"PUT", "/api/reservations/" + other, `{"addresses":["192.168.1.1"]}`, http.StatusBadRequest, `"code":"invalid_request"`},
+		{"PUT", "/api/reservations/" + other, `nope`, http.StatusBadRequest, ""},
+		{"PUT", "/api/reservations/" + other, `{"addresses":["10.0.0.1"]}`, http.StatusOK, `"message":"Reserved addresses: 10.0.0.1 for user: ` + other + `"`},
+		{"GET", "/api/reservations/" + client, "", http.StatusOK, `{"key":"` + client + `","ip":"` + s.client.IP().String() + `","id":5,"addresses":["fd00::beef"]}`},
+		{"GET", "/api/reservations", "", http.StatusOK, `"addresses":["10.0.0.1"]`},
+		{"POST", "/api/users/" + client + "/lease", "", http.StatusOK, `"ipv4":[{"address":"10.0.0.5","prefix_length":24}]`},
+		{"GET", "/api/users/" + client, "", http.StatusOK, `"id":5`},
+		{"DELETE", "/api/reservations/" + other, "", http.StatusOK, `"message":"Removed reservation for user: ` + other + `"`},
+		{"DELETE", "/api/reservations/" + other, "", http.StatusNotFound, `"code":"not_found"`},
+		{"GET", "/api/reservations/" + other, "", http.StatusNotFound, `"code":"not_found"`},
+		{"GET", "/api/reservations/fc00::1", "", http.StatusBadRequest, `"code":"invalid_request"`},
+		{"POST", "/api/reservations/" + client, "", http.StatusMethodNotAllowed, ""},
+	}
+
+	for row, test := range apiTests {
+		status, resp := mustRequest(t, api.URL, test.method, test.path, "secret", test.body)
+
+		if status != test.status {
+			t.Errorf("Row: %d returned unexpected status, got: %d, wanted: %d, response: %s", row, status, test.status, resp)
+		}
+
+		if !strings.Contains(resp, test.resp) {
+			t.Errorf("Row: %d returned unexpected response, got: %s, wanted it to contain: %s", row, resp, test.resp)
+		}
+	}
+}
+
+// TestAPI_backup checks if the database can be backed up, exported and imported while in use.
+func TestAPI_backup(t *testing.T) {
+	s := mustServe(t)
+	defer s.Close()
+
+	if err := s.initAdmin("secret"); err != nil {
+		t.Fatalf("initAdmin returned unexpected error: %v", err)
+	}
+
+	api := httptest.NewServer(s.apiHandler())
+	defer api.Close()
+
+	client := s.client.String()
+	if status, resp := mustRequest(t, api.URL, "POST", "/api/users/"+client+"/lease", "secret", ""); status != http.StatusOK {
+		t.Fatalf("Lease returned unexpected status: %d, response: %s", status, resp)
+	}
+
+	status, backup := mustRequest(t, api.URL, "GET", "/api/backup", "secret", "")
+	if status != http.StatusOK {
+		t.Fatalf("Backup returned unexpected status: %d, response: %s", status, backup)
+	}
+
+	file, err := ioutil.TempFile("", "elvisp-")
+	if err != nil {
+		t.Fatalf("TempFile returned unexpected error: %v", err)
+	}
+	defer os.Remove(file.Name())
+
+	file.WriteString(backup)
+	file.Close()
+
+	restored, err := database.Open(file.Name())
+	if err != nil {
+		t.Fatalf("Open returned unexpected error for backup: %v", err)
+	}
+
+	if users, err := restored.Users(); err != nil || len(users) != 1 || users[0].Key.String() != client {
+		t.Errorf("Backup has unexpected users: %+v, error: %v", users, err)
+	}
+	restored.Close()
+
+	_, export := mustRequest(t, api.URL, "GET", "/api/export", "secret", "")
+
+	var backupTests = []struct {
+		method, path, body string
+		status             int
+		resp               string
+	}{
+		{"POST", "/api/backup", "", http.StatusMethodNotAllowed, ""},
+		{"GET", "/api/export", "", http.StatusOK, `"key": "` + client + `"`},
+		{"GET", "/api/export?format=csv", "", http.StatusOK, "id,key,created,last_seen,last_ip,source,labels,pool,index\n1," + client},
+		{"POST", "/api/import", export, http.StatusBadRequest, `"code":"invalid_request"`},
+		{"DELETE", "/api/users/" + client, "", http.StatusOK, ""},
+		{"POST", "/api/import", "nope", http.StatusBadRequest, `"code":"invalid_request"`},
+		{"POST", "/api/import", export, http.StatusOK, `"message":"Imported 1 users"`},
+		{"GET", "/api/users/" + client, "", http.StatusOK, `"id":1`},
+		{"GET", "/api/import", "", http.StatusMethodNotAllowed, ""},
+	}
+
+	for row, test := range backupTests {
+		status, resp := mustRequest(t, api.URL, test.method, test.path, "secret", test.body)
+
+		if status != test.status {
+			t.Errorf("Row: %d returned unexpected status, got: %d, wanted: %d, response: %s", row, status, test.status, resp)
+		}
+
+		if !strings.Contains(resp, test.resp) {
+			t.Errorf("Row: %d returned unexpected response, got: %s, wanted it to contain: %s", row, resp, test.resp)
+		}
+	}
+}
+
+// TestAPI_lockout checks that the client address is locked out after repeated wrong passwords, even for the right password.
+func TestAPI_lockout(t *testing.T) {
+	s := mustServe(t)
+	defer s.Close()
+
+	if err := s.initAdmin("secret"); err != nil {
+		t.Fatalf("initAdmin returned unexpected error: %v", err)
+	}
+
+	api := httptest.NewServer(s.apiHandler())
+	defer api.Close()
+
+	var lockoutTests = []struct {
+		password string
+		status   int
+		resp     string
+	}{
+		{"secret", http.StatusOK, ""},
+		{"", http.StatusUnauthorized, "Missing password"}, // Not counted
+		{"wrong", http.StatusUnauthorized, ""},
+		{"wrong", http.StatusUnauthorized, ""},
+		{"wrong", http.StatusUnauthorized, errLocked.Error()},
+		{"secret", http.StatusUnauthorized, errLocked.Error()},
+	}
+
+	for row, test := range lockoutTests {
+		status, resp := mustRequest(t, api.URL, "GET", "/api/info", test.password, "")
+
+		if status != test.status {
+			t.Errorf("Row: %d returned unexpected status, got: %d, wanted: %d, response: %s", row, status, test.status, resp)
+		}
+
+		if !strings.Contains(resp, test.resp) {
+			t.Errorf("Row: %d returned unexpected response, got: %s, wanted it to contain: %s", row, resp, test.resp)
+		}
+	}
+}
+
+// TestAPI_poolsConfig checks that the pools can not be replaced when they are set by a config file, which would undo the change on
+// SIGHUP.
+func TestAPI_poolsConfig(t *testing.T) {
+	s := mustServe(t)
+	defer s.Close()
+
+	if err := s.initAdmin("secret"); err != nil {
+		t.Fatalf("initAdmin returned unexpected error: %v", err)
+	}
+	s.settings.Reload = make(chan Settings)
+
+	api := httptest.NewServer(s.apiHandler())
+	defer api.Close()
+
+	if status, resp := mustRequest(t, api.URL, "PUT", "/api/pools", "secret", `{"cidrs":["10.1.0.0/16"]}`); status != http.StatusConflict {
+		t.Errorf("PUT returned unexpected status: %d, response: %s", status, resp)
+	}
+
+	if status, resp := mustRequest(t, api.URL, "GET", "/api/pools", "secret", ""); status != http.StatusOK || !strings.Contains(resp, "10.0.0.0/24") {
+		t.Errorf("GET returned unexpected status: %d, response: %s", status, resp)
+	}
+}
+
+// TestAPI_offline checks that registered users can be leased and removed while they are missing in the cjdns node store, e.g.
+// because they are offline, and that unregistered users can be leased by public key.
+func TestAPI_offline(t *testing.T) {
+	s := mustServe(t)
+	defer s.Close()
+
+	if err := s.initAdmin("secret"); err != nil {
+		t.Fatalf("initAdmin returned unexpected error: %v", err)
+	}
+
+	api := httptest.NewServer(s.apiHandler())
+	defer api.Close()
+
+	if _, err := s.db.AddUser(s.client); err != nil {
+		t.Fatalf("AddUser returned unexpected error: %v", err)
+	}
+	s.cjdns.DelNode(s.client)
+
+	client, ip := s.client.String(), s.client.IP().String()
+	other := key.Generate().Pubkey()
+
+	var offlineTests = []struct {
+		method, path string
+		status       int
+		resp         string
+	}{
+		{"POST", "/api/users/" + ip + "/lease", http.StatusOK, `"ipv4":[{"address":"10.0.0.1","prefix_length":24}]`},
+		{"POST", "/api/users/" + client + "/lease", http.StatusOK, `"ipv4":[{"address":"10.0.0.1","prefix_length":24}]`},
+		{"DELETE", "/api/users/" + ip, http.StatusOK, `"message":"Removed user: ` + client + `"`},
+		{"POST", "/api/users/" + other.IP().String() + "/lease", http.StatusNotFound, `"code":"unknown_node"`},
+		{"POST", "/api/users/" + other.String() + "/lease", http.StatusOK, `"ipv4":[{"address":"10.0.0.1","prefix_length":24}]`},
+		{"DELETE", "/api/users/" + other.String(), http.StatusOK, `"message":"Removed user: ` + other.String() + `"`},
+	}
+
+	for row, test := range offlineTests {
+		status, resp := mustRequest(t, api.URL, test.method, test.path, "secret", "")
+
+		if status != test.status {
+			t.Errorf("Row: %d returned unexpected status, got: %d, wanted: %d, response: %s", row, status, test.status, resp)
+		}
+
+		if !strings.Contains(resp, test.resp) {
+			t.Errorf("Row: %d returned unexpected response, got: %s, wanted it to contain: %s", row, resp, test.resp)
+		}
+	}
+
+	if tunnels := s.cjdns.Tunnels(); len(tunnels) != 0 {
+		t.Errorf("API left unexpected tunnels: %v", tunnels)
+	}
+}
+
+// TestCheckAPIListen checks that the HTTP management API is only served in plain HTTP on loopback and cjdns addresses.
+func TestCheckAPIListen(t *testing.T) {
+	var listenTests = []struct {
+		listen string
+		tls    bool
+		err    bool
+	}{
+		{"[::1]:4133", false, false},
+		{"127.0.0.1:4133", false, false},
+		{"localhost:4133", false, false},
+		{"[fc12:3456::1]:4133", false, false},
+		{":4133", false, true},
+		{"[::]:4133", false, true},
+		{"192.168.1.1:4133", false, true},
+		{"192.168.1.1:4133", true, false},
+		{":4133", true, false},
+		{"nope", false, true},
+	}
+
+	for row, test := range listenTests {
+		err := checkAPIListen(test.listen, test.tls)
+		if err != nil && !test.err {
+			t.Errorf("Row: %d returned unexpected error: %v", row, err)
+		} else if err == nil && test.err {
+			t.Errorf("Row: %d expected error but got %v", row, err)
+		}
+	}
+}
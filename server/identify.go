@@ -0,0 +1,103 @@
+package server
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/willeponken/elvisp/auth"
+	"github.com/willeponken/elvisp/tasks"
+	"github.com/willeponken/go-cjdns/key"
+)
+
+// keyChallenge holds a pending challenge for a client key, the ephemeral key of the server is only used for one challenge.
+type keyChallenge struct {
+	key       *key.Public
+	ephemeral *key.Private
+	nonce     []byte
+}
+
+// newKeyChallenge creates a new challenge for the client key and returns the ephemeral public key and nonce.
+func newKeyChallenge(sess *session, pubkey *key.Public) (result *resultJSON, err error) {
+	nonce, err := auth.Random(auth.NonceSize)
+	if err != nil {
+		return
+	}
+
+	sess.identity = &keyChallenge{key: pubkey, ephemeral: key.Generate(), nonce: nonce}
+
+	c := &challengeJSON{
+		Key:   sess.identity.ephemeral.Pubkey().String(),
+		Nonce: hex.EncodeToString(nonce),
+	}
+
+	result = &resultJSON{
+		Message:   fmt.Sprintf("%s %s", c.Key, c.Nonce),
+		Challenge: c,
+	}
+
+	return
+}
+
+// verifyKey checks the proof for the last challenge in the session, the challenge can only be used once.
+func verifyKey(sess *session, pubkey *key.Public, proof string) (result *resultJSON, err error) {
+	c := sess.identity
+	sess.identity = nil
+
+	if c == nil || !c.key.Equal(pubkey) {
+		err = tasks.Error{Code: tasks.CodeInvalidRequest, Err: errors.New("No challenge for the public key, send identify with only the key first")}
+		return
+	}
+
+	p, err := hex.DecodeString(proof)
+	if err != nil || !auth.VerifyKey(c.ephemeral, pubkey, c.nonce, p) {
+		err = tasks.Error{Code: tasks.CodeUnauthorized, Err: errors.New("Invalid proof for the public key")}
+		return
+	}
+
+	sess.client = pubkey
+
+	result = &resultJSON{Message: "Identified as: " + pubkey.String(), Key: pubkey.String()}
+	return
+}
+
+// identify handles the identify handshake, that proves that the client owns the private key for its cjdns address. Without a proof a new challenge is returned,
+// the client then sends the nonce signed with the shared secret between its key and the ephemeral key as proof.
+// Tasks in an identified session use the proven key, instead of looking it up in the cjdns node store.
+func (s *Server) identify(conn net.Conn, sess *session, req request) string {
+	result, err := identifyKey(conn, sess, req)
+	if err != nil {
+		log.Printf("Identification failed for: %s, due to error: %s", conn.RemoteAddr().String(), err)
+	}
+
+	return sess.reply(req.ID, result, err)
+}
+
+// identifyKey checks that the client key belongs to the connecting address, and then creates or verifies a challenge.
+func identifyKey(conn net.Conn, sess *session, req request) (result *resultJSON, err error) {
+	pubkey, err := key.DecodePublic(req.Key)
+	if err != nil {
+		err = tasks.Error{Code: tasks.CodeInvalidRequest, Err: fmt.Errorf("Invalid public key: %s", req.Key)}
+		return
+	}
+
+	// A client can only identify as the node it connects from.
+	ip, err := parseCjdnsIPv6(conn.RemoteAddr())
+	if err != nil {
+		err = tasks.Error{Code: tasks.CodeInvalidRequest, Err: err}
+		return
+	}
+
+	if !pubkey.IP().Equal(ip) {
+		err = tasks.Error{Code: tasks.CodeUnauthorized, Err: fmt.Errorf("Public key: %s does not belong to: %s", pubkey.String(), ip)}
+		return
+	}
+
+	if req.Proof == "" {
+		return newKeyChallenge(sess, pubkey)
+	}
+
+	return verifyKey(sess, pubkey, req.Proof)
+}
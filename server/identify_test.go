@@ -0,0 +1,94 @@
+package server
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/willeponken/elvisp/auth"
+	"github.com/willeponken/go-cjdns/key"
+)
+
+// mustKeyProof parses a v2 key challenge and returns the proof for the private key.
+func mustKeyProof(t *testing.T, challenge string, priv *key.Private) string {
+	var ephemeral, nonce string
+
+	if _, err := fmt.Sscanf(challenge, "success %s %s", &ephemeral, &nonce); err != nil {
+		t.Fatalf("Sscanf returned unexpected error: %v, for challenge: %q", err, challenge)
+	}
+
+	pub, err := key.DecodePublic(ephemeral)
+	if err != nil {
+		t.Fatalf("DecodePublic returned unexpected error: %v", err)
+	}
+
+	n, _ := hex.DecodeString(nonce)
+
+	proof, err := auth.KeyProof(priv, pub, n)
+	if err != nil {
+		t.Fatalf("KeyProof returned unexpected error: %v", err)
+	}
+
+	return hex.EncodeToString(proof)
+}
+
+// TestIdentify checks that a client missing in the node store can lease after proving that it owns its key.
+func TestIdentify(t *testing.T) {
+	s := mustServe(t)
+	defer s.Close()
+
+	priv := key.Generate()
+	s.client = priv.Pubkey() // Not in the node store
+	client := s.client.String()
+
+	conn, r := s.dial()
+	defer conn.Close()
+
+	mustSend(t, conn, r, "") // Info fails, as the client is unknown
+
+	if resp := mustSend(t, conn, r, "lease"); !strings.HasPrefix(resp, "error ") {
+		t.Errorf("Unexpected response for lease before identify: %q", resp)
+	}
+
+	other := key.Generate()
+
+	// The proof is created from the challenge sent by the previous command, using the private key.
+	var identifyTests = []struct {
+		cmd  string
+		priv *key.Private
+		resp string
+	}{
+		{"identify nope", nil, "error Invalid public key: nope"},
+		{"identify " + other.Pubkey().String(), nil, "error Public key: " + other.Pubkey().String() + " does not belong to: " + s.client.IP().String()},
+		{"identify " + client + " 00", nil, "error No challenge for the public key, send identify with only the key first"},
+		{"identify " + client, nil, ""},
+		{"identify " + client, other, "error Invalid proof for the public key"},
+		{"identify " + client, nil, ""},
+		{"identify " + client, priv, "success Identified as: " + client},
+		{"lease", nil, "success 10.0.0.1 fd00::1"},
+		{"remove", nil, "success Removed user: " + client},
+	}
+
+	var challenge string
+	for row, test := range identifyTests {
+		cmd := test.cmd
+		if test.priv != nil {
+			cmd += " " + mustKeyProof(t, challenge, test.priv)
+		}
+
+		resp := mustSend(t, conn, r, cmd)
+		if test.resp == "" {
+			challenge = resp
+			continue
+		}
+
+		if resp != test.resp {
+			t.Errorf("Row: %d returned unexpected response, got: %q, wanted: %q", row, resp, test.resp)
+		}
+	}
+
+	if n := s.cjdns.Calls("NodeStore_nodeForAddr"); n > 4 { // The client is only looked up before identify, the server for every task
+		t.Errorf("Identified session looked up the node store %d times", n)
+	}
+}
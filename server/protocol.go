@@ -0,0 +1,359 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/willeponken/elvisp/database"
+	"github.com/willeponken/elvisp/tasks"
+	"github.com/willeponken/go-cjdns/key"
+)
+
+// Supported protocol versions, every session starts with version 2.
+const (
+	protocolV2 = 2
+	protocolV3 = 3
+)
+
+// request holds a command from a client, independent of the protocol version.
+type request struct {
+	ID       json.RawMessage `json:"id,omitempty"`
+	Command  string          `json:"command"`
+	Args     []string        `json:"args,omitempty"`
+	Password string          `json:"password,omitempty"`
+	IP       string          `json:"ip,omitempty"`
+	Version  int             `json:"version,omitempty"`
+	Proof    string          `json:"proof,omitempty"`
+	Key      string          `json:"key,omitempty"`
+}
+
+// admin returns true if the request targets another node than the one connecting.
+func (r request) admin() bool {
+	return r.IP != ""
+}
+
+// parseV2 parses a space separated command, "<command> [[<password>] <ip>]", "lease <pool> [[<password>] <ip>]", "version <version>",
+// "auth [<proof>]", "identify <key> [<proof>]", "reserve <key> [<id>] [<address>...]" or "unreserve <key>". In an admin session the
+// password is not needed, so "lease <pool> <ip>" names a pool instead of a password if it is the name of a pool in the policy.
+func parseV2(line string, admin bool, policy tasks.Policy) (req request, err error) {
+	array := strings.Split(line, " ")
+
+	req.Command = strings.ToLower(array[0])
+	req.Args = array[1:]
+
+	// A lease can name the pool to lease from before the password and the address, pool names are never addresses.
+	pooled := len(array) == 2 && net.ParseIP(array[1]) == nil || len(array) == 4 || admin && len(array) == 3 && isPool(policy, array[1])
+	if req.Command == "lease" && pooled {
+		req.Args = []string{array[1]}
+		array = append(array[:1], array[2:]...)
+	} else if req.Command != "reserve" && req.Command != "unreserve" {
+		req.Args = nil
+	}
+
+	switch {
+	case req.Command == "version" && len(array) == 2:
+		req.Version, err = strconv.Atoi(array[1])
+		if err != nil {
+			err = tasks.Error{Code: tasks.CodeInvalidRequest, Err: fmt.Errorf("Invalid protocol version: %s", array[1])}
+		}
+
+	case req.Command == "auth" && len(array) <= 2:
+		if len(array) == 2 {
+			req.Proof = array[1]
+		}
+
+	case req.Command == "identify" && (len(array) == 2 || len(array) == 3):
+		req.Key = array[1]
+		if len(array) == 3 {
+			req.Proof = array[2]
+		}
+
+	// Reservations are managed by public key, the session has to be authenticated as administrator.
+	case (req.Command == "reserve" || req.Command == "unreserve") && len(array) >= 2:
+		req.Key = array[1]
+		req.Args = array[2:]
+
+	// If the length is 2, the second element should be the address and the session authenticated as administrator.
+	case len(array) == 2:
+		req.IP = array[1]
+
+	// If the length is 3, the second element should be a password for the administrator, and the third the address.
+	case len(array) == 3:
+		req.Password = array[1]
+		req.IP = array[2]
+	}
+
+	return
+}
+
+// isPool returns true if name is the name of a pool in the policy.
+func isPool(policy tasks.Policy, name string) bool {
+	_, err := policy.Pool(name)
+	return err == nil
+}
+
+// parseV3 parses a JSON request.
+func parseV3(line string) (req request, err error) {
+	if err = json.Unmarshal([]byte(line), &req); err != nil {
+		err = tasks.Error{Code: tasks.CodeInvalidRequest, Err: fmt.Errorf("Invalid JSON request: %v", err)}
+		return
+	}
+
+	req.Command = strings.ToLower(req.Command)
+	return
+}
+
+// formatter formats the result of a task, or the error, as a response for a protocol version.
+type formatter func(id json.RawMessage, result tasks.Result, err error) string
+
+// formatV2 formats a response as "success <result>" or "error <error message>".
+func formatV2(id json.RawMessage, result tasks.Result, err error) string {
+	if err != nil {
+		return fmt.Sprintf("%s %v\n", statusError, err)
+	}
+
+	return fmt.Sprintf("%s %s\n", statusSuccess, result)
+}
+
+// addressJSON holds a leased address in a v3 response, or the first address of a delegated prefix.
+type addressJSON struct {
+	Address      string `json:"address"`
+	PrefixLength int    `json:"prefix_length"`
+	Delegated    bool   `json:"delegated,omitempty"`
+}
+
+// resultJSON holds the result in a v3 response.
+type resultJSON struct {
+	Message   string         `json:"message"`
+	Key       string         `json:"key,omitempty"`
+	ServerKey string         `json:"server_key,omitempty"`
+	Pool      string         `json:"pool,omitempty"`
+	IPv4      []addressJSON  `json:"ipv4,omitempty"`
+	IPv6      []addressJSON  `json:"ipv6,omitempty"`
+	Expires   *time.Time     `json:"expires,omitempty"`
+	Version   int            `json:"version,omitempty"`
+	Challenge *challengeJSON `json:"challenge,omitempty"`
+	Signature string         `json:"signature,omitempty"`
+	User      *userJSON      `json:"user,omitempty"`
+}
+
+// leaseJSON holds the lease for a user in a response.
+type leaseJSON struct {
+	Granted time.Time  `json:"granted"`
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// assignmentJSON holds an address assigned to a user from a pool in a response.
+type assignmentJSON struct {
+	Pool    string `json:"pool"`
+	Address string `json:"address"`
+}
+
+// userJSON holds a registered user in a response, Lease is nil if the user has released its lease. Times that have not happened are left out.
+type userJSON struct {
+	ID       uint64            `json:"id"`
+	Key      string            `json:"key"`
+	IP       string            `json:"ip"`
+	Pool     string            `json:"pool,omitempty"`
+	Probes   uint64            `json:"probes,omitempty"`
+	IPv4     []addressJSON     `json:"ipv4,omitempty"`
+	IPv6     []addressJSON     `json:"ipv6,omitempty"`
+	Lease    *leaseJSON        `json:"lease,omitempty"`
+	Created  *time.Time        `json:"created,omitempty"`
+	LastSeen *time.Time        `json:"last_seen,omitempty"`
+	LastIP   string            `json:"last_ip,omitempty"`
+	Assigned []assignmentJSON  `json:"assigned,omitempty"`
+	Labels   map[string]string `json:"labels,omitempty"`
+	Source   string            `json:"source,omitempty"`
+}
+
+// challengeJSON holds an admin authentication challenge, or a client key challenge with the ephemeral key of the server, in a v3 response.
+// The salt and nonce are hex encoded.
+type challengeJSON struct {
+	Salt       string `json:"salt,omitempty"`
+	Iterations int    `json:"iterations,omitempty"`
+	Key        string `json:"key,omitempty"`
+	Nonce      string `json:"nonce"`
+}
+
+// errorJSON holds the error in a v3 response.
+type errorJSON struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// response is a v3 response, it has either a result or an error.
+type response struct {
+	ID     json.RawMessage `json:"id,omitempty"`
+	Status string          `json:"status"`
+	Result *resultJSON     `json:"result,omitempty"`
+	Error  *errorJSON      `json:"error,omitempty"`
+}
+
+// splitAddresses converts leased addresses for a v3 response, separated by IP version.
+func splitAddresses(addrs []tasks.Address) (ipv4, ipv6 []addressJSON) {
+	for _, addr := range addrs {
+		a := addressJSON{Address: addr.IP.String(), PrefixLength: addr.PrefixLength, Delegated: addr.Delegated}
+
+		if addr.IP.To4() != nil {
+			ipv4 = append(ipv4, a)
+		} else {
+			ipv6 = append(ipv6, a)
+		}
+	}
+
+	return
+}
+
+// jsonTime returns t in UTC for a response, or nil for the zero time so it is left out.
+func jsonTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+
+	t = t.UTC()
+	return &t
+}
+
+// newRecordJSON converts a user record for a response.
+func newRecordJSON(u database.User) userJSON {
+	user := userJSON{
+		ID:       u.ID,
+		Key:      u.Key.String(),
+		IP:       u.Key.IP().String(),
+		Pool:     u.Pool,
+		Probes:   u.Probes,
+		Created:  jsonTime(u.Created),
+		LastSeen: jsonTime(u.LastSeen),
+		Labels:   u.Labels,
+		Source:   u.Source,
+	}
+
+	if u.LastIP != nil {
+		user.LastIP = u.LastIP.String()
+	}
+
+	for _, a := range u.Addresses {
+		user.Assigned = append(user.Assigned, assignmentJSON{Pool: a.Pool, Address: a.IP.String()})
+	}
+
+	return user
+}
+
+// newResultJSON converts the result of a task for a v3 response.
+func newResultJSON(result tasks.Result) *resultJSON {
+	r := &resultJSON{Message: result.Message, Pool: result.Pool}
+
+	if result.Key != nil {
+		r.Key = result.Key.String()
+	}
+
+	if result.ServerKey != nil {
+		r.ServerKey = result.ServerKey.String()
+	}
+
+	r.IPv4, r.IPv6 = splitAddresses(result.Addresses)
+
+	r.Expires = jsonTime(result.Expires)
+
+	if result.User != nil {
+		user := newRecordJSON(*result.User)
+		r.User = &user
+	}
+
+	return r
+}
+
+// encodeV3 encodes a v3 response as a line of JSON.
+func encodeV3(resp response) string {
+	b, err := json.Marshal(resp)
+	if err != nil { // Should never happen, as every type can be encoded
+		return fmt.Sprintf("{\"status\":\"%s\",\"error\":{\"code\":\"%s\",\"message\":%q}}\n", statusError, tasks.CodeInternal, err.Error())
+	}
+
+	return string(b) + "\n"
+}
+
+// formatV3 formats a response as a line of JSON.
+func formatV3(id json.RawMessage, result tasks.Result, err error) string {
+	resp := response{ID: id}
+
+	if err != nil {
+		resp.Status = statusError
+		resp.Error = &errorJSON{Code: tasks.ErrorCode(err), Message: err.Error()}
+	} else {
+		resp.Status = statusSuccess
+		resp.Result = newResultJSON(result)
+	}
+
+	return encodeV3(resp)
+}
+
+// session holds the state of a client connection. The nonce is the last admin authentication challenge, and host is the client address
+// that failed admin authentications are counted for. The client key is set once the client has proven that it owns the key, using the
+// identify handshake.
+type session struct {
+	version  int
+	admin    bool
+	nonce    []byte
+	host     string
+	client   *key.Public
+	identity *keyChallenge
+}
+
+// parse parses a line using the protocol version for the session, and the pools in the policy.
+func (s *session) parse(line string, policy tasks.Policy) (request, error) {
+	if s.version == protocolV3 {
+		return parseV3(line)
+	}
+
+	return parseV2(line, s.admin, policy)
+}
+
+// format returns the formatter for the protocol version of the session.
+func (s *session) format() formatter {
+	if s.version == protocolV3 {
+		return formatV3
+	}
+
+	return formatV2
+}
+
+// negotiate switches the protocol version for the session, the response is formatted using the previous version.
+func (s *session) negotiate(req request) string {
+	if req.Version != protocolV2 && req.Version != protocolV3 {
+		err := tasks.Error{Code: tasks.CodeInvalidRequest, Err: fmt.Errorf("Unsupported protocol version: %d", req.Version)}
+		return s.format()(req.ID, tasks.Result{}, err)
+	}
+
+	previous := s.version
+	s.version = req.Version
+
+	message := strconv.Itoa(req.Version)
+	if previous != protocolV3 {
+		return formatV2(req.ID, tasks.Result{Message: message}, nil)
+	}
+
+	return encodeV3(response{
+		ID:     req.ID,
+		Status: statusSuccess,
+		Result: &resultJSON{Message: message, Version: req.Version},
+	})
+}
+
+// reply formats a response to a command handled by the session itself, the fields besides the message are only sent using v3.
+func (s *session) reply(id json.RawMessage, result *resultJSON, err error) string {
+	if err != nil {
+		return s.format()(id, tasks.Result{}, err)
+	}
+
+	if s.version != protocolV3 {
+		return formatV2(id, tasks.Result{Message: result.Message}, nil)
+	}
+
+	return encodeV3(response{ID: id, Status: statusSuccess, Result: result})
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/willeponken/elvisp/tasks"
+)
+
+func TestParseV2(t *testing.T) {
+	var parseTests = []struct {
+		line  string
+		admin bool
+		req   request
+		err   bool
+	}{
+		{"lease", false, request{Command: "lease"}, false},
+		{"LEASE", false, request{Command: "lease"}, false},
+		{"remove password fc00::1", false, request{Command: "remove", Password: "password", IP: "fc00::1"}, false},
+		{"remove password fc00::1", true, request{Command: "remove", Password: "password", IP: "fc00::1"}, false},
+		{"version 3", false, request{Command: "version", Version: 3}, false},
+		{"version three", false, request{Command: "version"}, true},
+		{"lease fc00::1", false, request{Command: "lease", IP: "fc00::1"}, false},
+		{"lease guests", false, request{Command: "lease", Args: []string{"guests"}}, false},
+		{"lease password fc00::1", false, request{Command: "lease", Password: "password", IP: "fc00::1"}, false},
+		{"lease guests password fc00::1", false, request{Command: "lease", Args: []string{"guests"}, Password: "password", IP: "fc00::1"}, false},
+		{"lease", true, request{Command: "lease"}, false},
+		{"lease fc00::1", true, request{Command: "lease", IP: "fc00::1"}, false},
+		{"lease guests", true, request{Command: "lease", Args: []string{"guests"}}, false},
+		{"lease guests fc00::1", true, request{Command: "lease", Args: []string{"guests"}, IP: "fc00::1"}, false},
+		{"lease guests password fc00::1", true, request{Command: "lease", Args: []string{"guests"}, Password: "password", IP: "fc00::1"}, false},
+		{"lease password fc00::1", true, request{Command: "lease", Password: "password", IP: "fc00::1"}, false}, // Not a pool
+		{"auth", false, request{Command: "auth"}, false},
+		{"auth 00ff", false, request{Command: "auth", Proof: "00ff"}, false},
+		{"identify key.k", false, request{Command: "identify", Key: "key.k"}, false},
+		{"identify key.k 00ff", false, request{Command: "identify", Key: "key.k", Proof: "00ff"}, false},
+		{"reserve key.k 5 10.0.0.5", false, request{Command: "reserve", Key: "key.k"}, false},
+		{"unreserve key.k", false, request{Command: "unreserve", Key: "key.k"}, false},
+	}
+
+	policy := tasks.Policy{Pools: []tasks.Pool{{Name: tasks.DefaultPool}, {Name: "guests"}}}
+
+	for row, test := range parseTests {
+		req, err := parseV2(test.line, test.admin, policy)
+
+		if req.Command != test.req.Command || req.Password != test.req.Password || req.IP != test.req.IP || req.Version != test.req.Version || req.Proof != test.req.Proof || req.Key != test.req.Key ||
+			req.Command == "lease" && !reflect.DeepEqual(req.Args, test.req.Args) {
+			t.Errorf("Row: %d returned unexpected request, got: %+v, wanted: %+v", row, req, test.req)
+		}
+
+		if err != nil && !test.err {
+			t.Errorf("Row: %d returned unexpected error: %v", row, err)
+		}
+
+		if err == nil && test.err {
+			t.Errorf("Row: %d expected error but got %v", row, err)
+		}
+	}
+}
+
+func TestParseV3(t *testing.T) {
+	var parseTests = []struct {
+		line string
+		req  request
+		err  bool
+	}{
+		{`{"id":1,"command":"Lease"}`, request{ID: json.RawMessage("1"), Command: "lease"}, false},
+		{`{"id":"a","command":"remove","password":"password","ip":"fc00::1"}`, request{ID: json.RawMessage(`"a"`), Command: "remove", Password: "password", IP: "fc00::1"}, false},
+		{`lease`, request{}, true},
+	}
+
+	for row, test := range parseTests {
+		req, err := parseV3(test.line)
+
+		if string(req.ID) != string(test.req.ID) || req.Command != test.req.Command || req.Password != test.req.Password || req.IP != test.req.IP {
+			t.Errorf("Row: %d returned unexpected request, got: %+v, wanted: %+v", row, req, test.req)
+		}
+
+		if code := tasks.ErrorCode(err); test.err && code != tasks.CodeInvalidRequest {
+			t.Errorf("Row: %d returned unexpected error code: %s, error: %v", row, code, err)
+		}
+
+		if err != nil && !test.err {
+			t.Errorf("Row: %d returned unexpected error: %v", row, err)
+		}
+	}
+}
+
+func TestFormatV3(t *testing.T) {
+	expires := time.Date(2016, 7, 1, 12, 0, 0, 0, time.UTC)
+	result := tasks.Result{
+		Message: "10.0.0.1 fd00::1 ",
+		Addresses: []tasks.Address{
+			{IP: net.ParseIP("10.0.0.1"), PrefixLength: 24},
+			{IP: net.ParseIP("fd00::1"), PrefixLength: 64},
+		},
+		Expires: expires,
+	}
+
+	var formatTests = []struct {
+		result tasks.Result
+		err    error
+		resp   string
+	}{
+		{result, nil, `{"id":7,"status":"success","result":{"message":"10.0.0.1 fd00::1 ","ipv4":[{"address":"10.0.0.1","prefix_length":24}],"ipv6":[{"address":"fd00::1","prefix_length":64}],"expires":"2016-07-01T12:00:00Z"}}` + "\n"},
+		{tasks.Result{}, tasks.Error{Code: tasks.CodeNotFound, Err: errors.New("lol")}, `{"id":7,"status":"error","error":{"code":"not_found","message":"lol"}}` + "\n"},
+		{tasks.Result{}, errors.New("lol"), `{"id":7,"status":"error","error":{"code":"internal","message":"lol"}}` + "\n"},
+	}
+
+	for row, test := range formatTests {
+		if resp := formatV3(json.RawMessage("7"), test.result, test.err); resp != test.resp {
+			t.Errorf("Row: %d returned unexpected response, got: %s, wanted: %s", row, resp, test.resp)
+		}
+	}
+}
+
+func TestSession_negotiate(t *testing.T) {
+	sess := &session{version: protocolV2}
+
+	var negotiateTests = []struct {
+		req     request
+		resp    string
+		version int
+	}{
+		{request{Command: "version", Version: 4}, "error Unsupported protocol version: 4\n", protocolV2},
+		{request{Command: "version", Version: 3}, "success 3\n", protocolV3},
+		{request{ID: json.RawMessage("1"), Command: "version", Version: 3}, `{"id":1,"status":"success","result":{"message":"3","version":3}}` + "\n", protocolV3},
+		{request{Command: "version", Version: 2}, `{"status":"success","result":{"message":"2","version":2}}` + "\n", protocolV2},
+	}
+
+	for row, test := range negotiateTests {
+		if resp := sess.negotiate(test.req); resp != test.resp {
+			t.Errorf("Row: %d returned unexpected response, got: %s, wanted: %s", row, resp, test.resp)
+		}
+
+		if sess.version != test.version {
+			t.Errorf("Row: %d returned unexpected version, got: %d, wanted: %d", row, sess.version, test.version)
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/willeponken/elvisp/cjdns"
+	"github.com/willeponken/elvisp/database"
+	"github.com/willeponken/elvisp/lease"
+	"github.com/willeponken/elvisp/tasks"
+	"github.com/willeponken/go-cjdns/key"
+)
+
+// allowance holds a public key and an IP address that should be allowed in the cjdns IP tunnel. Alloc is the length of a
+// delegated prefix starting at the IP address, or 0 for a single address.
+type allowance struct {
+	Key   *key.Public
+	IP    net.IP
+	Alloc int
+}
+
+// String allowance formats the allowance as "<public key> <ip>".
+func (a allowance) String() string {
+	return a.Key.String() + " " + a.IP.String()
+}
+
+// tunnelDiff holds the allowances missing in cjdns and the IP tunnel connections that should not exist.
+type tunnelDiff struct {
+	Missing []allowance
+	Orphans []cjdns.Tunnel
+}
+
+// Empty returns true if cjdns and the database agree.
+func (d tunnelDiff) Empty() bool {
+	return len(d.Missing) == 0 && len(d.Orphans) == 0
+}
+
+// withinCIDRs returns true if every address is within one of the CIDRs, and there is at least one address.
+func withinCIDRs(cidrs []lease.CIDR, ips []net.IP) bool {
+	for _, ip := range ips {
+		within := false
+		for _, cidr := range cidrs {
+			if cidr.Network.Contains(ip) {
+				within = true
+			}
+		}
+
+		if !within {
+			return false
+		}
+	}
+
+	return len(ips) != 0
+}
+
+// diffTunnels compares the expected allowances with the IP tunnel connections in cjdns.
+// A connection is an orphan if any of its addresses are unexpected, or if it duplicates another connection. Outgoing connections, and
+// connections with addresses outside the managed CIDRs, are ignored as they were not allowed by Elvisp.
+func diffTunnels(expected []allowance, tunnels []cjdns.Tunnel, managed []lease.CIDR) (diff tunnelDiff) {
+	want := make(map[string]bool)
+	for _, a := range expected {
+		want[a.String()] = true
+	}
+
+	found := make(map[string]bool)
+	for _, tunnel := range tunnels {
+		if tunnel.Outgoing || !withinCIDRs(managed, tunnel.IPs) {
+			continue
+		}
+
+		orphan := tunnel.Key == nil
+		for _, ip := range tunnel.IPs {
+			if tunnel.Key == nil {
+				break
+			}
+
+			if a := (allowance{Key: tunnel.Key, IP: ip}).String(); !want[a] || found[a] {
+				orphan = true
+			}
+		}
+
+		if orphan {
+			diff.Orphans = append(diff.Orphans, tunnel)
+			continue
+		}
+
+		for _, ip := range tunnel.IPs {
+			found[allowance{Key: tunnel.Key, IP: ip}.String()] = true
+		}
+	}
+
+	for _, a := range expected {
+		if !found[a.String()] {
+			diff.Missing = append(diff.Missing, a)
+		}
+	}
+
+	return
+}
+
+// expectedAllowances returns the allowances for every user with an active lease, at its reserved addresses if any.
+func (s *Server) expectedAllowances() (expected []allowance, err error) {
+	leases, err := s.db.Leases()
+	if err != nil {
+		return
+	}
+
+	reservations, err := s.db.Reservations()
+	if err != nil {
+		return
+	}
+
+	reserved := make(map[string]database.Reservation)
+	for _, r := range reservations {
+		reserved[r.Key.String()] = r
+	}
+
+	policy := s.policy()
+	for _, l := range leases {
+		u, err := s.db.GetUser(l.ID)
+		if err != nil {
+			return nil, err
+		}
+		pubkey := u.Key
+
+		addrs, err := policy.UserAddresses(u, reserved[pubkey.String()])
+		if tasks.ErrorCode(err) == tasks.CodeNotFound {
+			log.Printf("Skipping user: %s leasing from a pool that no longer exists, due to error: %s", pubkey, err)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		for _, addr := range addrs {
+			a := allowance{Key: pubkey, IP: addr.IP}
+			if addr.Delegated {
+				a.Alloc = addr.PrefixLength
+			}
+
+			expected = append(expected, a)
+		}
+	}
+
+	return
+}
+
+// reconcile compares the IP tunnel connections in cjdns with the users in the database, it re-adds missing allowances and removes orphaned connections.
+// If dryRun is true, the changes are made to a recorder on top of cjdns admin and only logged. A failed change does not stop the
+// others, every failure is returned in the error. No tasks run while reconciling, as they change cjdns and the database one after
+// the other.
+func (s *Server) reconcile(dryRun bool) (diff tunnelDiff, err error) {
+	s.tunnelMu.Lock()
+	defer s.tunnelMu.Unlock()
+
+	admin := s.admin
+	if dryRun {
+		admin = cjdns.NewRecorder(s.admin)
+	}
+
+	expected, err := s.expectedAllowances()
+	if err != nil {
+		return
+	}
+
+	tunnels, err := admin.ListTunnels()
+	if err != nil {
+		return
+	}
+
+	diff = diffTunnels(expected, tunnels, s.managedCIDRs())
+
+	var failed []string
+	for _, a := range diff.Missing {
+		log.Printf("Reconcile: missing IP tunnel allowance for user: %s with IP: %s", a.Key.String(), a.IP.String())
+
+		if err := tasks.Allow(admin, a.Key, tasks.Address{IP: a.IP, PrefixLength: a.Alloc, Delegated: a.Alloc != 0}); err != nil {
+			log.Printf("Reconcile: unable to allow user: %s with IP: %s, due to error: %s", a.Key.String(), a.IP.String(), err)
+			failed = append(failed, fmt.Sprintf("allow %s: %s", a, err))
+		}
+	}
+
+	for _, tunnel := range diff.Orphans {
+		log.Printf("Reconcile: orphaned IP tunnel connection: %d for key: %s with IPs: %v", tunnel.Index, tunnel.Key, tunnel.IPs)
+
+		if err := admin.RemoveTunnel(tunnel.Index); err != nil {
+			log.Printf("Reconcile: unable to remove IP tunnel connection: %d, due to error: %s", tunnel.Index, err)
+			failed = append(failed, fmt.Sprintf("remove %d: %s", tunnel.Index, err))
+		}
+	}
+
+	if len(failed) > 0 {
+		err = fmt.Errorf("Unable to make %d of %d changes to the IP tunnel: %s", len(failed), len(diff.Missing)+len(diff.Orphans),
+			strings.Join(failed, ", "))
+	}
+
+	if dryRun && !diff.Empty() {
+		log.Printf("Reconcile: dry run, %d allowances would be added and %d connections removed", len(diff.Missing), len(diff.Orphans))
+	}
+
+	return
+}
+
+// reconciler calls reconcile every interval, until the server is shut down.
+func (s *Server) reconciler(interval time.Duration, dryRun bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := s.reconcile(dryRun); err != nil {
+				log.Printf("Unable to reconcile cjdns IP tunnel, due to error: %s", err)
+			}
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+// reprovision reconciles the cjdns IP tunnel after reconnecting to cjdns admin, which adds the allowances for every user again if
+// cjdroute was restarted.
+func (s *Server) reprovision() {
+	diff, err := s.reconcile(s.reconcileDryRun)
+	if err != nil {
+		log.Printf("Unable to provision cjdns IP tunnel after reconnecting, due to error: %s", err)
+
+		return
+	}
+
+	log.Printf("Provisioned cjdns IP tunnel after reconnecting, %d allowances were missing", len(diff.Missing))
+}
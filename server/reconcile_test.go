@@ -0,0 +1,82 @@
+package server
+
+import (
+	"net"
+	"testing"
+
+	"github.com/willeponken/elvisp/cjdns"
+	"github.com/willeponken/elvisp/lease"
+	"github.com/willeponken/go-cjdns/key"
+)
+
+// mustCIDRs parses every CIDR.
+func mustCIDRs(t *testing.T, list ...string) (cidrs []lease.CIDR) {
+	for _, c := range list {
+		cidr, err := lease.ParseCIDR(c)
+		if err != nil {
+			t.Fatalf("ParseCIDR returned unexpected error: %v", err)
+		}
+
+		cidrs = append(cidrs, cidr)
+	}
+
+	return
+}
+
+func TestDiffTunnels(t *testing.T) {
+	a := key.Generate().Pubkey()
+	b := key.Generate().Pubkey()
+	c := key.Generate().Pubkey()
+
+	ip4 := net.ParseIP("10.0.0.1")
+	ip6 := net.ParseIP("fd00::1")
+	other := net.ParseIP("10.0.0.2")
+	foreign := net.ParseIP("192.168.1.1")
+
+	expected := []allowance{{Key: a, IP: ip4}, {Key: a, IP: ip6}, {Key: b, IP: other}}
+
+	tunnels := []cjdns.Tunnel{
+		{Index: 0, Key: a, IPs: []net.IP{ip4}},                 // Expected
+		{Index: 1, Key: a, IPs: []net.IP{ip4}},                 // Duplicate of 0
+		{Index: 2, Key: c, IPs: []net.IP{ip6}},                 // Unknown user
+		{Index: 3, Key: b, IPs: []net.IP{ip4}},                 // Wrong address
+		{Index: 4, Key: c, IPs: []net.IP{ip4}, Outgoing: true}, // Ignored
+		{Index: 5, Key: c, IPs: []net.IP{foreign}},             // Outside the CIDRs
+		{Index: 6, Key: c, IPs: []net.IP{ip4, foreign}},        // Partly outside the CIDRs
+		{Index: 7, Key: c},                                     // Without addresses
+	}
+
+	diff := diffTunnels(expected, tunnels, mustCIDRs(t, "10.0.0.0/24", "fd00::/64"))
+
+	var missing = []allowance{{Key: a, IP: ip6}, {Key: b, IP: other}}
+	if len(diff.Missing) != len(missing) {
+		t.Fatalf("diffTunnels returned unexpected missing allowances: %v, wanted: %v", diff.Missing, missing)
+	}
+
+	for row, m := range missing {
+		if diff.Missing[row].String() != m.String() {
+			t.Errorf("Row: %d returned unexpected missing allowance, got: %s, wanted: %s", row, diff.Missing[row], m)
+		}
+	}
+
+	var orphans = []int{1, 2, 3}
+	if len(diff.Orphans) != len(orphans) {
+		t.Fatalf("diffTunnels returned unexpected orphans: %v, wanted indexes: %v", diff.Orphans, orphans)
+	}
+
+	for row, index := range orphans {
+		if diff.Orphans[row].Index != index {
+			t.Errorf("Row: %d returned unexpected orphan, got: %d, wanted: %d", row, diff.Orphans[row].Index, index)
+		}
+	}
+}
+
+func TestDiffTunnels_empty(t *testing.T) {
+	a := key.Generate().Pubkey()
+	ip := net.ParseIP("10.0.0.1")
+
+	diff := diffTunnels([]allowance{{Key: a, IP: ip}}, []cjdns.Tunnel{{Index: 7, Key: a, IPs: []net.IP{ip}}}, mustCIDRs(t, "10.0.0.0/24"))
+	if !diff.Empty() {
+		t.Errorf("diffTunnels returned unexpected difference: %v", diff)
+	}
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"log"
+	"reflect"
+)
+
+// restartNeeded returns the names of the settings that differ, but can only be changed by restarting the server. Only the pools,
+// policies and allocator are applied when reloading.
+func restartNeeded(settings, updated Settings) (names []string) {
+	fields := []struct {
+		name             string
+		current, updated interface{}
+	}{
+		{"listen", settings.Listen, updated.Listen},
+		{"http-listen", settings.HTTPListen, updated.HTTPListen},
+		{"http-cert", settings.HTTPCert, updated.HTTPCert},
+		{"http-key", settings.HTTPKey, updated.HTTPKey},
+		{"db", settings.DB, updated.DB},
+		{"db-backend", settings.DBBackend, updated.DBBackend},
+		{"password", settings.Password, updated.Password},
+		{"cjdns-ip", settings.CjdnsIP, updated.CjdnsIP},
+		{"cjdns-port", settings.CjdnsPort, updated.CjdnsPort},
+		{"cjdns-password", settings.CjdnsPassword, updated.CjdnsPassword},
+		{"cjdns-ping-interval", settings.CjdnsPingInterval, updated.CjdnsPingInterval},
+		{"cjdns-max-backoff", settings.CjdnsMaxBackoff, updated.CjdnsMaxBackoff},
+		{"lease-time", settings.LeaseTime, updated.LeaseTime},
+		{"reap-interval", settings.ReapInterval, updated.ReapInterval},
+		{"reconcile-interval", settings.ReconcileInterval, updated.ReconcileInterval},
+		{"reconcile-dry-run", settings.ReconcileDryRun, updated.ReconcileDryRun},
+		{"usage-interval", settings.UsageInterval, updated.UsageInterval},
+		{"usage-thresholds", settings.UsageThresholds, updated.UsageThresholds},
+	}
+
+	for _, f := range fields {
+		if !reflect.DeepEqual(f.current, f.updated) {
+			names = append(names, f.name)
+		}
+	}
+
+	return
+}
+
+// reload applies the pools, policies and allocator in the updated settings, and reconciles the cjdns IP tunnel as the addresses for
+// users can change with them. Invalid settings are refused, and the current settings are kept.
+func (s *Server) reload(settings, updated Settings) (err error) {
+	policy, err := newPolicy(updated)
+	if err != nil {
+		return
+	}
+
+	s.setPolicy(policy)
+
+	if names := restartNeeded(settings, updated); len(names) > 0 {
+		log.Printf("Reloaded pools and policies, but the changed settings: %v are only applied on restart", names)
+	} else {
+		log.Printf("Reloaded pools and policies")
+	}
+
+	if _, err := s.reconcile(s.reconcileDryRun); err != nil {
+		log.Printf("Unable to reconcile cjdns IP tunnel after reloading, due to error: %s", err)
+	}
+
+	return
+}
+
+// reloader reloads the settings received on the channel, until it is closed or the server is shut down. Changes that need a
+// restart are compared with the settings the server was started with.
+func (s *Server) reloader(settings Settings, reload <-chan Settings) {
+	for {
+		select {
+		case updated, ok := <-reload:
+			if !ok {
+				return
+			}
+
+			if err := s.reload(settings, updated); err != nil {
+				log.Printf("Unable to reload settings, due to error: %s", err)
+			}
+		case <-s.quit:
+			return
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/willeponken/elvisp/tasks"
+)
+
+// TestReload checks that reloading replaces the pools and policies, moves the leased addresses with them, and keeps the current
+// pools if the settings are invalid.
+func TestReload(t *testing.T) {
+	s := mustServe(t)
+	defer s.Close()
+
+	settings := Settings{CIDRs: []string{"10.0.0.0/24", "fd00::/64"}}
+
+	task, err := tasks.InitKey(nil, s.db, s.admin, s.client, nil, s.policy(), s.leaseTime)
+	if err != nil {
+		t.Fatalf("InitKey returned unexpected error: %v", err)
+	}
+
+	if _, err = (tasks.Lease{Task: task}).Run(); err != nil {
+		t.Fatalf("Lease returned unexpected error: %v", err)
+	}
+
+	updated := settings
+	updated.CIDRs = []string{"10.1.0.0/24"}
+	updated.Pools = map[string][]string{"guests": {"10.2.0.0/24"}}
+
+	if err = s.reload(settings, updated); err != nil {
+		t.Fatalf("reload returned unexpected error: %v", err)
+	}
+
+	if _, err = s.policy().Pool("guests"); err != nil {
+		t.Errorf("reload did not add pool: %v", err)
+	}
+
+	tunnels := s.cjdns.Tunnels()
+	if len(tunnels) != 1 || tunnels[0].IPs[0].String() != "10.1.0.1" {
+		t.Errorf("reload left unexpected tunnels: %v", tunnels)
+	}
+
+	invalid := updated
+	invalid.Policies = map[string][]string{s.client.String(): {"nope"}}
+
+	if err = s.reload(settings, invalid); err == nil {
+		t.Errorf("reload returned no error for a policy with an unknown pool")
+	}
+
+	if _, err = s.policy().Pool("guests"); err != nil {
+		t.Errorf("reload did not keep the pools after invalid settings: %v", err)
+	}
+}
+
+func TestRestartNeeded(t *testing.T) {
+	settings := Settings{Listen: ":4132", CIDRs: []string{"10.0.0.0/24"}, LeaseTime: time.Hour, UsageThresholds: []int{80, 95}}
+
+	updated := settings
+	updated.CIDRs = []string{"10.1.0.0/24"}
+	updated.Pools = map[string][]string{"guests": {"10.2.0.0/24"}}
+	updated.Allocator = tasks.AllocatorHash
+
+	if names := restartNeeded(settings, updated); len(names) != 0 {
+		t.Errorf("restartNeeded returned unexpected settings for pools and policies: %v", names)
+	}
+
+	updated.Listen = ":4133"
+	updated.LeaseTime = 2 * time.Hour
+	updated.UsageThresholds = []int{90}
+
+	expected := []string{"listen", "lease-time", "usage-thresholds"}
+	if names := restartNeeded(settings, updated); !reflect.DeepEqual(names, expected) {
+		t.Errorf("restartNeeded returned unexpected settings, got: %v, wanted: %v", names, expected)
+	}
+}
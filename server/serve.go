@@ -0,0 +1,317 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/willeponken/elvisp/cjdns"
+	"github.com/willeponken/elvisp/database"
+)
+
+// ErrServerClosed is returned by Serve after Shutdown has been called.
+var ErrServerClosed = errors.New("Server closed")
+
+// New connects to the database, sets a admin password if defined, listens on a defined port using TCP6 and connects to cjdns admin.
+// The server does not accept any connections until Serve is called.
+func New(settings Settings) (s *Server, err error) {
+	s = &Server{
+		leaseTime:       settings.LeaseTime,
+		reconcileDryRun: settings.ReconcileDryRun,
+		settings:        settings,
+		quit:            make(chan struct{}),
+		conns:           make(map[net.Conn]struct{}),
+	}
+
+	if s.leasePolicy, err = newPolicy(settings); err != nil {
+		return nil, err
+	}
+
+	if err = checkThresholds(settings.UsageThresholds); err != nil {
+		return nil, err
+	}
+	s.usageThresholds = settings.UsageThresholds
+
+	// First, we need to make sure we are able to communicate with the database.
+	if settings.DBBackend == "" {
+		settings.DBBackend = database.BackendBolt
+	}
+
+	db, err := database.OpenStore(settings.DBBackend, settings.DB)
+	if err != nil {
+		log.Printf("Unable to open database: %s", err)
+
+		return nil, err
+	}
+	s.db = &db
+
+	// Release everything opened so far if the server can not be created.
+	defer func() {
+		if err == nil {
+			return
+		}
+
+		if s.listener != nil {
+			s.listener.Close()
+		}
+
+		db.Close()
+		s = nil
+	}()
+
+	if settings.Password != "" {
+		s.initAdmin(settings.Password)
+	}
+
+	// Listen only to IPv6 network. Administrators can connect locally using [::1].
+	if s.listener, err = net.Listen("tcp6", settings.Listen); err != nil {
+		log.Printf("Unable to listen to port: %s, due to error: %s", settings.Listen, err)
+
+		return
+	}
+
+	// Connect to the cjdns admin interface, unless another implementation is used.
+	s.admin = settings.Admin
+	if s.admin == nil {
+		dial := func() (cjdns.Pinger, error) {
+			return cjdns.Connect(settings.CjdnsIP, settings.CjdnsPort, settings.CjdnsPassword)
+		}
+
+		// Supervise the connection, so the server keeps working when cjdroute restarts.
+		if settings.CjdnsPingInterval > 0 {
+			s.supervisor, err = cjdns.NewSupervisor(dial, settings.CjdnsPingInterval, settings.CjdnsMaxBackoff)
+			s.admin = s.supervisor
+		} else {
+			s.admin, err = dial()
+		}
+
+		if err != nil {
+			log.Printf("Unable to connect to cjdns admin on: %s:%d, due to error: %s", settings.CjdnsIP, settings.CjdnsPort, err)
+
+			return
+		}
+	}
+
+	// Administrators can manage users over HTTP, separately from the leasing protocol.
+	if settings.HTTPListen != "" {
+		if err = checkAPIListen(settings.HTTPListen, settings.HTTPCert != ""); err != nil {
+			return
+		}
+
+		s.api = &http.Server{Handler: s.apiHandler()}
+
+		if settings.HTTPCert != "" {
+			cert, err := tls.LoadX509KeyPair(settings.HTTPCert, settings.HTTPKey)
+			if err != nil {
+				log.Printf("Unable to load certificate for HTTP management API, due to error: %s", err)
+
+				return nil, err
+			}
+
+			s.api.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+		}
+
+		if s.apiLn, err = net.Listen("tcp", settings.HTTPListen); err != nil {
+			log.Printf("Unable to listen to HTTP management API on: %s, due to error: %s", settings.HTTPListen, err)
+
+			return
+		}
+	}
+
+	return
+}
+
+// Listen creates a server with New and serves it until it fails, see Serve.
+func Listen(settings Settings) (err error) {
+	s, err := New(settings)
+	if err != nil {
+		return
+	}
+
+	return s.Serve(context.Background())
+}
+
+// Addr returns the address that the server accepts connections on.
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// goBackground runs f in a goroutine that is waited for on Shutdown.
+func (s *Server) goBackground(f func()) {
+	s.background.Add(1)
+	go func() {
+		defer s.background.Done()
+		f()
+	}()
+}
+
+// Serve reconciles cjdns with the database and starts the background tasks, then accepts connections and initializes two handlers
+// for each, request and send handler, as goroutines. It returns ErrServerClosed after Shutdown, or the context's error if it is
+// cancelled. Either way the server stops accepting connections, Shutdown has to be called to wait for the connected clients and close
+// the database.
+func (s *Server) Serve(ctx context.Context) error {
+	settings := s.settings
+
+	if s.api != nil {
+		s.goBackground(s.serveAPI)
+	}
+
+	// Make sure cjdns and the database agree before accepting any connections, and keep them in sync in the background.
+	if _, err := s.reconcile(settings.ReconcileDryRun); err != nil {
+		log.Printf("Unable to reconcile cjdns IP tunnel, due to error: %s", err)
+	}
+
+	if settings.ReconcileInterval > 0 {
+		s.goBackground(func() { s.reconciler(settings.ReconcileInterval, settings.ReconcileDryRun) })
+	}
+
+	// Provision the cjdns IP tunnel again when cjdns admin answers after being unavailable, as cjdroute loses it on restart.
+	if s.supervisor != nil {
+		s.goBackground(func() { s.supervisor.Run(s.quit, s.reprovision) })
+	}
+
+	// Apply pools and policies from reloaded settings, without dropping any connections.
+	if settings.Reload != nil {
+		s.goBackground(func() { s.reloader(settings, settings.Reload) })
+	}
+
+	// Remove users with expired leases in the background.
+	if settings.ReapInterval > 0 {
+		s.goBackground(func() { s.reaper(settings.ReapInterval) })
+	}
+
+	// Warn about pools running out of addresses, starting with the usage on startup.
+	if len(s.usageThresholds) > 0 {
+		s.checkUsage()
+
+		if settings.UsageInterval > 0 {
+			s.goBackground(func() { s.usageChecker(settings.UsageInterval) })
+		}
+	}
+
+	// Stop accepting connections when the context is cancelled.
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.stop()
+		case <-s.quit:
+		}
+	}()
+
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			select {
+			case <-s.quit:
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+
+				return ErrServerClosed
+			default:
+			}
+
+			log.Printf("TCP connection returned error: %s", err)
+
+			continue
+		}
+
+		if !s.track(conn) {
+			conn.Close()
+
+			continue
+		}
+
+		log.Printf("New connection: %s", conn.RemoteAddr().String())
+
+		go s.handle(conn)
+	}
+}
+
+// track adds a connection to the connected clients, unless the server is stopping.
+func (s *Server) track(conn net.Conn) bool {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+
+	select {
+	case <-s.quit:
+		return false
+	default:
+	}
+
+	s.conns[conn] = struct{}{}
+	s.handlers.Add(1)
+
+	return true
+}
+
+// handle runs the request and send handler for a connection, and returns once every task started for it has written its result.
+func (s *Server) handle(conn net.Conn) {
+	defer s.handlers.Done()
+
+	channel := make(chan string)
+
+	go s.requestHandler(conn, channel)
+	s.sendHandler(conn, channel)
+
+	s.connsMu.Lock()
+	delete(s.conns, conn)
+	s.connsMu.Unlock()
+}
+
+// stop stops accepting connections and the background tasks, it is safe to call more than once.
+func (s *Server) stop() {
+	s.stopOnce.Do(func() {
+		s.connsMu.Lock()
+		close(s.quit)
+		s.connsMu.Unlock()
+
+		s.listener.Close()
+	})
+}
+
+// Shutdown stops accepting connections and disconnects the clients once their running tasks have written their results, so no
+// lease is cut off mid-transaction, then closes the database. If the context expires first, the clients are disconnected at once
+// and the context's error is returned, the database is then left open as tasks may still be using it.
+func (s *Server) Shutdown(ctx context.Context) (err error) {
+	s.stop()
+
+	if s.api != nil {
+		if err := s.api.Shutdown(ctx); err != nil {
+			log.Printf("Unable to shut down HTTP management API, due to error: %s", err)
+		}
+	}
+
+	// Interrupt reading, so no new tasks are started, the tasks already running still write their results.
+	s.connsMu.Lock()
+	for conn := range s.conns {
+		conn.SetReadDeadline(time.Now())
+	}
+	s.connsMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.handlers.Wait()
+		s.background.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		s.connsMu.Lock()
+		log.Printf("Unable to wait for %d connections to finish, due to error: %s", len(s.conns), ctx.Err())
+		for conn := range s.conns {
+			conn.Close()
+		}
+		s.connsMu.Unlock()
+
+		return ctx.Err()
+	}
+
+	return s.db.Close()
+}
@@ -0,0 +1,318 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/willeponken/elvisp/cjdns"
+	"github.com/willeponken/elvisp/cjdns/cjdnstest"
+	"github.com/willeponken/elvisp/tasks"
+	"github.com/willeponken/go-cjdns/key"
+)
+
+// blockingAdmin blocks AddUser until release is closed, so a lease is in flight while the server shuts down.
+type blockingAdmin struct {
+	cjdns.Admin
+	started chan struct{}
+	release chan struct{}
+}
+
+func (a blockingAdmin) AddUser(publicKey *key.Public, ip net.IP) error {
+	a.started <- struct{}{}
+	<-a.release
+
+	return a.Admin.AddUser(publicKey, ip)
+}
+
+// pipeListener accepts connections over pipes that look like connections over cjdns, from client to key.
+type pipeListener struct {
+	conns       chan net.Conn
+	closed      chan struct{}
+	once        sync.Once
+	client, key *key.Public
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, errors.New("Listener closed")
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr { return &net.TCPAddr{IP: l.key.IP(), Port: 4132} }
+
+// Dial connects a client to the listener, unless it is closed.
+func (l *pipeListener) Dial() (net.Conn, error) {
+	client, server := net.Pipe()
+
+	conn := addrConn{Conn: server, local: l.Addr(), remote: &net.TCPAddr{IP: l.client.IP(), Port: 43210}}
+
+	select {
+	case l.conns <- conn:
+		return client, nil
+	case <-l.closed:
+		return nil, errors.New("Listener closed")
+	}
+}
+
+// listenServer holds a server accepting connections from a pipe listener, with a blocking admin connected to a fake cjdns admin
+// server.
+type listenServer struct {
+	*Server
+	admin blockingAdmin
+	cjdns *cjdnstest.Server
+	pipes *pipeListener
+	dir   string
+}
+
+func mustListen(t *testing.T) *listenServer {
+	c, err := cjdnstest.NewServer("password")
+	if err != nil {
+		t.Fatalf("NewServer returned unexpected error: %v", err)
+	}
+
+	conn, err := cjdns.Connect(c.Addr, c.Port, "password")
+	if err != nil {
+		t.Fatalf("Connect returned unexpected error: %v", err)
+	}
+
+	dir, err := ioutil.TempDir("", "elvisp-")
+	if err != nil {
+		t.Fatalf("TempDir returned unexpected error: %v", err)
+	}
+
+	l := &listenServer{
+		admin: blockingAdmin{Admin: conn, started: make(chan struct{}, 1), release: make(chan struct{})},
+		cjdns: c,
+		pipes: &pipeListener{conns: make(chan net.Conn), closed: make(chan struct{}), client: key.Generate().Pubkey(),
+			key: key.Generate().Pubkey()},
+		dir: dir,
+	}
+	c.AddNode(l.pipes.client)
+	c.AddNode(l.pipes.key)
+
+	l.Server, err = New(Settings{Admin: l.admin, Listen: "[::1]:0", DB: filepath.Join(dir, "db"), CIDRs: []string{"10.0.0.0/24"},
+		LeaseTime: time.Hour})
+	if err != nil {
+		t.Fatalf("New returned unexpected error: %v", err)
+	}
+
+	// Clients connect over pipes instead, as tasks need the addresses of the client and the server to be within cjdns.
+	l.listener.Close()
+	l.listener = l.pipes
+
+	return l
+}
+
+func (l *listenServer) Close() {
+	l.cjdns.Close()
+	os.RemoveAll(l.dir)
+}
+
+// mustLease connects to the server and leases an address, it returns once the lease blocks in cjdns admin.
+func (l *listenServer) mustLease(t *testing.T) (net.Conn, *bufio.Reader) {
+	conn, err := l.pipes.Dial()
+	if err != nil {
+		t.Fatalf("Dial returned unexpected error: %v", err)
+	}
+	r := bufio.NewReader(conn)
+
+	// Info is sent on connect.
+	if _, err = r.ReadString('\n'); err != nil {
+		t.Fatalf("ReadString returned unexpected error: %v", err)
+	}
+
+	if _, err = conn.Write([]byte("lease\n")); err != nil {
+		t.Fatalf("Write returned unexpected error: %v", err)
+	}
+
+	select {
+	case <-l.admin.started:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Lease did not reach cjdns admin")
+	}
+
+	return conn, r
+}
+
+// TestShutdown checks that Shutdown stops accepting connections, waits for the running lease to write its result and then closes the
+// connection and the database.
+func TestShutdown(t *testing.T) {
+	s := mustListen(t)
+	defer s.Close()
+
+	served := make(chan error, 1)
+	go func() {
+		served <- s.Serve(context.Background())
+	}()
+
+	conn, r := s.mustLease(t)
+	defer conn.Close()
+
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- s.Shutdown(context.Background())
+	}()
+
+	if err := <-served; err != ErrServerClosed {
+		t.Errorf("Serve returned unexpected error, got: %v, wanted: %v", err, ErrServerClosed)
+	}
+
+	if c, err := s.pipes.Dial(); err == nil {
+		c.Close()
+		t.Errorf("Dial returned no error after Shutdown")
+	}
+
+	select {
+	case err := <-shutdown:
+		t.Fatalf("Shutdown returned before the lease finished: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(s.admin.release)
+
+	if resp, err := r.ReadString('\n'); err != nil || strings.TrimSpace(resp) != "success 10.0.0.1" {
+		t.Errorf("Lease returned unexpected response: %q, error: %v", resp, err)
+	}
+
+	if err := <-shutdown; err != nil {
+		t.Errorf("Shutdown returned unexpected error: %v", err)
+	}
+
+	if _, err := r.ReadString('\n'); err == nil {
+		t.Errorf("Connection was not closed by Shutdown")
+	}
+
+	if _, err := s.db.ExpiredLeases(time.Now()); err == nil {
+		t.Errorf("Database was not closed by Shutdown")
+	}
+}
+
+// TestShutdown_timeout checks that the clients are disconnected if the running tasks do not finish before the context expires.
+func TestShutdown_timeout(t *testing.T) {
+	s := mustListen(t)
+	defer s.Close()
+
+	go s.Serve(context.Background())
+
+	conn, r := s.mustLease(t)
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if err := s.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Shutdown returned unexpected error, got: %v, wanted: %v", err, context.DeadlineExceeded)
+	}
+
+	if _, err := r.ReadString('\n'); err == nil {
+		t.Errorf("Connection was not closed after the timeout")
+	}
+
+	close(s.admin.release)
+	s.handlers.Wait()
+	s.db.Close()
+}
+
+// TestServe_cancel checks that Serve returns the context's error when it is cancelled, and that Shutdown still closes the database.
+func TestServe_cancel(t *testing.T) {
+	s := mustListen(t)
+	defer s.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	served := make(chan error, 1)
+	go func() {
+		served <- s.Serve(ctx)
+	}()
+
+	cancel()
+
+	select {
+	case err := <-served:
+		if err != context.Canceled {
+			t.Errorf("Serve returned unexpected error, got: %v, wanted: %v", err, context.Canceled)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Serve did not return after the context was cancelled")
+	}
+
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Errorf("Shutdown returned unexpected error: %v", err)
+	}
+}
+
+// TestServe_reprovision checks that the IP tunnel is provisioned again for existing users when cjdns admin answers again, as if
+// cjdroute was restarted.
+func TestServe_reprovision(t *testing.T) {
+	c, err := cjdnstest.NewServer("password")
+	if err != nil {
+		t.Fatalf("NewServer returned unexpected error: %v", err)
+	}
+	defer c.Close()
+
+	dir, err := ioutil.TempDir("", "elvisp-")
+	if err != nil {
+		t.Fatalf("TempDir returned unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := New(Settings{Listen: "[::1]:0", DB: filepath.Join(dir, "db"), CjdnsIP: c.Addr, CjdnsPort: c.Port, CjdnsPassword: "password",
+		CjdnsPingInterval: 10 * time.Millisecond, CjdnsMaxBackoff: 10 * time.Millisecond, CIDRs: []string{"10.0.0.0/24"}})
+	if err != nil {
+		t.Fatalf("New returned unexpected error: %v", err)
+	}
+	defer s.Shutdown(context.Background())
+
+	client := key.Generate().Pubkey()
+	c.AddNode(client)
+
+	task, err := tasks.InitKey(nil, s.db, s.admin, client, nil, s.policy(), s.leaseTime)
+	if err != nil {
+		t.Fatalf("InitKey returned unexpected error: %v", err)
+	}
+
+	if _, err = (tasks.Lease{Task: task}).Run(); err != nil {
+		t.Fatalf("Lease returned unexpected error: %v", err)
+	}
+
+	go s.Serve(context.Background())
+
+	c.Fail("ping", "restarting")
+	c.Reset()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for s.supervisor.Available() == nil && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if _, err = s.admin.ListTunnels(); tasks.ErrorCode(err) != tasks.CodeCjdnsUnavailable {
+		t.Errorf("ListTunnels returned unexpected error while cjdns was unavailable: %v", err)
+	}
+
+	c.Recover("ping")
+
+	for len(c.Tunnels()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if tunnels := c.Tunnels(); len(tunnels) != 1 || !tunnels[0].IPs[0].Equal(net.ParseIP("10.0.0.1")) {
+		t.Errorf("Serve did not provision the IP tunnel again, got: %v", tunnels)
+	}
+}
@@ -3,12 +3,17 @@ package server
 import (
 	"bufio"
 	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"net/http"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"golang.org/x/crypto/bcrypt"
 
@@ -16,6 +21,7 @@ import (
 	"github.com/willeponken/elvisp/database"
 	"github.com/willeponken/elvisp/lease"
 	"github.com/willeponken/elvisp/tasks"
+	"github.com/willeponken/go-cjdns/key"
 )
 
 const (
@@ -23,22 +29,186 @@ const (
 	statusSuccess = "success"
 )
 
-// Server holds a database and a connection to cjdns admin.
+// Server holds a database and a connection to cjdns admin, it is created with New and serves clients with Serve until Shutdown.
 type Server struct {
-	db    *database.Database
-	admin *cjdns.Conn
-	cidrs []lease.CIDR
+	db              *database.Database
+	admin           cjdns.Admin
+	supervisor      *cjdns.Supervisor
+	leaseTime       time.Duration
+	reconcileDryRun bool
+	settings        Settings
+
+	// listener accepts clients and api serves the HTTP management API, if enabled. quit is closed when the server stops, and
+	// conns holds the connected clients, handlers and background count the goroutines that are waited for on shutdown.
+	listener   net.Listener
+	api        *http.Server
+	apiLn      net.Listener
+	quit       chan struct{}
+	stopOnce   sync.Once
+	connsMu    sync.Mutex
+	conns      map[net.Conn]struct{}
+	handlers   sync.WaitGroup
+	background sync.WaitGroup
+
+	// authLimit counts failed admin authentications per client address.
+	authLimit authLimiter
+
+	// tunnelMu is held for reading while tasks run and for writing while reconciling, so reconcile never sees a task halfway between
+	// changing the cjdns IP tunnel and the database.
+	tunnelMu sync.RWMutex
+
+	// usageThresholds are the pool utilisations in percent that are warned about, usageWarned holds the last warned about per pool.
+	usageThresholds []int
+	usageWarned     map[string]int
+
+	// leasePolicy holds the pools and policies used for leasing, retired holds the CIDRs of pools that have been replaced since
+	// the server started, so reconcile still removes the tunnels leased from them.
+	mu          sync.RWMutex
+	leasePolicy tasks.Policy
+	retired     []lease.CIDR
 }
 
-// Settings holds settings needed to setup the server.
+// Settings holds settings needed to setup the server. If Admin is nil, a connection to cjdns admin is made using CjdnsIP, CjdnsPort and CjdnsPassword.
+// The connection is pinged every CjdnsPingInterval, and reconnected with a backoff of up to CjdnsMaxBackoff when it does not answer.
+// The HTTP management API is only served if HTTPListen is set, over TLS with HTTPCert and HTTPKey if they are set, and otherwise only
+// on a loopback or cjdns address, as the admin password is sent with every request. The usage of every pool is checked every UsageInterval, and a warning
+// logged when it reaches one of the UsageThresholds in percent.
+// CIDRs are the default pool, and Pools holds the CIDRs for every named pool. Groups holds the public keys in every group, and
+// Policies the pools that a public key or a group may lease from, see tasks.Policy. Allocator picks the index for a user within its
+// pool, and AllocatorKey keys the hash allocator. The pools, policies and allocator are replaced by the settings received on Reload,
+// if it is set, other changes need a restart.
 type Settings struct {
-	Listen        string
-	DB            string
-	Password      string
-	CjdnsIP       string
-	CjdnsPort     int
-	CjdnsPassword string
-	CIDRs         []string
+	Admin             cjdns.Admin
+	Listen            string
+	HTTPListen        string
+	HTTPCert          string
+	HTTPKey           string
+	DB                string
+	DBBackend         string
+	Password          string
+	CjdnsIP           string
+	CjdnsPort         int
+	CjdnsPassword     string
+	CjdnsPingInterval time.Duration
+	CjdnsMaxBackoff   time.Duration
+	CIDRs             []string
+	Pools             map[string][]string
+	Groups            map[string][]string
+	Policies          map[string][]string
+	Allocator         string
+	AllocatorKey      string
+	LeaseTime         time.Duration
+	ReapInterval      time.Duration
+	ReconcileInterval time.Duration
+	ReconcileDryRun   bool
+	UsageInterval     time.Duration
+	UsageThresholds   []int
+	Reload            <-chan Settings
+}
+
+// policy returns the pools used for leasing, and the policies for which pools a user may lease from.
+func (s *Server) policy() tasks.Policy {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.leasePolicy
+}
+
+// setPolicy replaces the pools used for leasing, and the policies.
+func (s *Server) setPolicy(policy tasks.Policy) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	retired := make(map[string]bool)
+	for _, c := range s.retired {
+		retired[c.String()] = true
+	}
+
+	for _, pool := range s.leasePolicy.Pools {
+		for _, c := range pool.CIDRs {
+			if !retired[c.String()] {
+				retired[c.String()] = true
+				s.retired = append(s.retired, c)
+			}
+		}
+	}
+
+	s.leasePolicy = policy
+}
+
+// managedCIDRs returns the CIDRs of the current pools, and of the pools replaced since the server started. Addresses within them
+// are leased by Elvisp.
+func (s *Server) managedCIDRs() (cidrs []lease.CIDR) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, pool := range s.leasePolicy.Pools {
+		cidrs = append(cidrs, pool.CIDRs...)
+	}
+
+	return append(cidrs, s.retired...)
+}
+
+// parseCIDRs parses every CIDR in the list.
+func parseCIDRs(list []string) (cidrs []lease.CIDR, err error) {
+	for _, str := range list {
+		var c lease.CIDR
+		if c, err = lease.ParseCIDR(str); err != nil {
+			return
+		}
+
+		cidrs = append(cidrs, c)
+	}
+
+	return
+}
+
+// parsePools parses the CIDRs for every named pool, sorted by name. The default pool is not named, it holds the CIDRs for leasing.
+func parsePools(named map[string][]string) (pools []tasks.Pool, err error) {
+	var names []string
+	for name := range named {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if name == tasks.DefaultPool {
+			err = fmt.Errorf("Pool: %s can not be named, it holds the CIDRs for leasing", name)
+			return
+		}
+
+		pool := tasks.Pool{Name: name}
+		if pool.CIDRs, err = parseCIDRs(named[name]); err != nil {
+			return
+		}
+
+		pools = append(pools, pool)
+	}
+
+	return
+}
+
+// newPolicy parses the pools in the settings, and returns them with the groups and policies.
+func newPolicy(settings Settings) (policy tasks.Policy, err error) {
+	cidrs, err := parseCIDRs(settings.CIDRs)
+	if err != nil {
+		return
+	}
+
+	if policy.Pools, err = parsePools(settings.Pools); err != nil {
+		return
+	}
+
+	policy.Groups = settings.Groups
+	policy.Allowed = settings.Policies
+	policy.Allocator = settings.Allocator
+	if settings.AllocatorKey != "" {
+		policy.HashKey = []byte(settings.AllocatorKey)
+	}
+	policy = policy.WithCIDRs(cidrs)
+
+	err = policy.Check()
+	return
 }
 
 // authAdmin checks the password with the saved hash in the database.
@@ -51,14 +221,18 @@ func (s *Server) authAdmin(password string) error {
 	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
 }
 
-// initAdmin sets the hashed admin password in the database.
+// initAdmin sets the hashed admin password, and the key derived from it for challenge-response authentication, in the database.
 func (s *Server) initAdmin(password string) error {
 	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
 		return err
 	}
 
-	return s.db.SetAdmin(string(hash))
+	if err = s.db.SetAdmin(string(hash)); err != nil {
+		return err
+	}
+
+	return s.initVerifier(password)
 }
 
 // validCjdnsIPv6 checks if a IPv6 is within the cjdns address space.
@@ -88,44 +262,39 @@ func parseCjdnsIPv6(addr net.Addr) (ip net.IP, err error) {
 	return
 }
 
-// taskFactory creates a new task based on an string which defines the type.
-func (s *Server) taskFactory(conn net.Conn, input string) (task tasks.TaskInterface) {
+// taskFactory creates a new task based on a request which defines the type.
+func (s *Server) taskFactory(conn net.Conn, sess *session, req request) (task tasks.TaskInterface) {
 	var t tasks.Task
 	var err error
 
-	array := strings.Split(input, " ")
-	if len(array) < 1 {
-		err = fmt.Errorf("Invalid length for task: %d", len(array))
-		return tasks.Invalid{Error: err}
+	if req.Command == "" {
+		err = errors.New("No command defined for task")
+		return tasks.Invalid{Error: tasks.Error{Code: tasks.CodeInvalidRequest, Err: err}}
 	}
 
-	var password string
 	var clientIP, serverIP net.IP
 
-	cmd := strings.ToLower(array[0])
-	argv := array[1:]
-
-	// If longer than 3, the second element should be a password for the administrator, and the third the address.
-	if len(array) == 3 {
-		password = array[1]
-		clientIP = net.ParseIP(array[2])
+	// An administrator can run tasks for other nodes, after authenticating the session or using the password.
+	if req.admin() {
+		clientIP = net.ParseIP(req.IP)
 
-		if err = s.authAdmin(password); err != nil {
+		if err = s.authorize(sess, req); err != nil {
 			return tasks.Invalid{Error: err}
 		}
 
 		if clientIP == nil {
-			return tasks.Invalid{Error: err}
+			err = fmt.Errorf("Invalid IP address: %s", req.IP)
+			return tasks.Invalid{Error: tasks.Error{Code: tasks.CodeInvalidRequest, Err: err}}
 		}
 
 		if err = validCjdnsIPv6(clientIP); err != nil {
-			return tasks.Invalid{Error: err}
+			return tasks.Invalid{Error: tasks.Error{Code: tasks.CodeInvalidRequest, Err: err}}
 		}
 	} else {
 		// If not admin, use the remote address that is currently connecting.
 		clientIP, err = parseCjdnsIPv6(conn.RemoteAddr())
 		if err != nil {
-			return tasks.Invalid{Error: err}
+			return tasks.Invalid{Error: tasks.Error{Code: tasks.CodeInvalidRequest, Err: err}}
 		}
 	}
 
@@ -134,130 +303,239 @@ func (s *Server) taskFactory(conn net.Conn, input string) (task tasks.TaskInterf
 		return tasks.Invalid{Error: err}
 	}
 
-	t, err = tasks.Init(argv, s.db, s.admin, clientIP, serverIP, s.cidrs)
+	// A client that has proven its key does not have to be looked up in the cjdns node store.
+	if !req.admin() && sess.client != nil {
+		t, err = tasks.InitKey(req.Args, s.db, s.admin, sess.client, serverIP, s.policy(), s.leaseTime)
+	} else {
+		t, err = tasks.Init(req.Args, s.db, s.admin, clientIP, serverIP, s.policy(), s.leaseTime)
+	}
+	if err != nil {
+		return tasks.Invalid{Error: err}
+	}
+
+	if req.admin() {
+		t = t.WithSource(database.SourceAdmin)
+	}
+
+	return newTask(req.Command, t)
+}
+
+// reservationTask creates the task for a reserve or unreserve request, which manages the reservation for a public key.
+// It can only be run by an administrator, and the node does not have to be known by cjdns.
+func (s *Server) reservationTask(sess *session, req request) tasks.TaskInterface {
+	if err := s.authorize(sess, req); err != nil {
+		return tasks.Invalid{Error: err}
+	}
+
+	pubkey, err := key.DecodePublic(req.Key)
+	if err != nil {
+		err = fmt.Errorf("Invalid public key: %s", req.Key)
+		return tasks.Invalid{Error: tasks.Error{Code: tasks.CodeInvalidRequest, Err: err}}
+	}
+
+	t, err := tasks.InitKey(req.Args, s.db, s.admin, pubkey, nil, s.policy(), s.leaseTime)
 	if err != nil {
 		return tasks.Invalid{Error: err}
 	}
 
-	switch cmd {
+	return newTask(req.Command, t.WithSource(database.SourceAdmin))
+}
+
+// newTask returns the task for a command.
+func newTask(command string, t tasks.Task) (task tasks.TaskInterface) {
+	switch command {
 	case "lease":
 		task = tasks.Lease{Task: t}
 	case "remove":
 		task = tasks.Remove{Task: t}
+	case "release":
+		task = tasks.Release{Task: t}
+	case "renew":
+		task = tasks.Renew{Task: t}
 	case "info":
 		task = tasks.Info{Task: t}
+	case "reserve":
+		task = tasks.Reserve{Task: t}
+	case "unreserve":
+		task = tasks.Unreserve{Task: t}
 	default:
-		task = tasks.Invalid{Error: fmt.Errorf("No task found for command: %s", cmd)}
+		err := fmt.Errorf("No task found for command: %s", command)
+		task = tasks.Invalid{Error: tasks.Error{Code: tasks.CodeUnknownCommand, Err: err}}
 	}
 
 	return
 }
 
-// taskRunner runs a task and inputs its output into a channel.
-func (s *Server) taskRunner(t tasks.TaskInterface, out chan string) {
-	result, err := t.Run()
+// run runs a task, while the cjdns IP tunnel is not being reconciled.
+func (s *Server) run(t tasks.TaskInterface) (result tasks.Result, err error) {
+	s.tunnelMu.RLock()
+	defer s.tunnelMu.RUnlock()
 
-	if err != nil {
-		out <- fmt.Sprintf("%s %v\n", statusError, err)
-	} else {
-		out <- fmt.Sprintf("%s %s\n", statusSuccess, result)
-	}
+	return t.Run()
+}
+
+// taskRunner runs a task and inputs its formatted output into a channel.
+func (s *Server) taskRunner(t tasks.TaskInterface, out chan string, id json.RawMessage, format formatter) {
+	result, err := s.run(t)
+
+	out <- format(id, result, err)
 }
 
-// requestHandler reads from a TCP connection/session and writes it to a channel.
+// requestHandler reads from a TCP connection/session and writes it to a channel. The channel is closed once every task started for
+// the connection has written its result.
 func (s *Server) requestHandler(conn net.Conn, out chan string) error {
+	var running sync.WaitGroup
 	defer close(out)
+	defer running.Wait()
+
+	run := func(t tasks.TaskInterface, id json.RawMessage, format formatter) {
+		running.Add(1)
+		go func() {
+			defer running.Done()
+			s.taskRunner(t, out, id, format)
+		}()
+	}
+
+	sess := &session{version: protocolV2, host: remoteHost(conn.RemoteAddr().String())}
 
 	// Call info task on connection
-	info := s.taskFactory(conn, "info")
-	go s.taskRunner(info, out)
+	info := s.taskFactory(conn, sess, request{Command: "info"})
+	run(info, nil, formatV2)
 
+	reader := bufio.NewReader(conn)
 	for {
-		line, err := bufio.NewReader(conn).ReadBytes('\n')
+		line, err := reader.ReadBytes('\n')
 		msg := strings.TrimSpace(string(line))
 
-		// Exit on error, empty messsage, quit message or exit message
-		if err != nil || msg == "" || msg == "quit" || msg == "exit" {
+		// Exit on error or empty messsage
+		if err != nil || msg == "" {
 			log.Printf("Disconnected: %s", conn.RemoteAddr().String())
 
 			return err
 		}
 
-		t := s.taskFactory(conn, msg)
-		go s.taskRunner(t, out)
+		req, err := sess.parse(msg, s.policy())
+		if err != nil {
+			run(tasks.Invalid{Error: err}, req.ID, sess.format())
+
+			continue
+		}
+
+		switch req.Command {
+		case "quit", "exit":
+			log.Printf("Disconnected: %s", conn.RemoteAddr().String())
+
+			return nil
+		case "version":
+			// Negotiated before reading the next line, as it changes how the line is parsed.
+			out <- sess.negotiate(req)
+		case "auth":
+			// Authenticated before reading the next line, as it changes what the session is allowed to do.
+			out <- s.authenticate(sess, req)
+		case "identify":
+			out <- s.identify(conn, sess, req)
+		case "reserve", "unreserve":
+			run(s.reservationTask(sess, req), req.ID, sess.format())
+		default:
+			run(s.taskFactory(conn, sess, req), req.ID, sess.format())
+		}
 	}
 }
 
-// sendHandler copies all communication from a channel to a TCP connection/session. Empty messages and errors terminates the loop.
+// sendHandler copies all communication from a channel to a TCP connection/session, until the channel is closed. After a write error
+// the messages are discarded, so the tasks writing them are not blocked.
 func (s *Server) sendHandler(conn net.Conn, in <-chan string) {
 	defer conn.Close()
 
-	for {
-		message := <-in
-		rb, err := io.Copy(conn, bytes.NewBufferString(message))
+	var failed bool
+	for message := range in {
+		if failed {
+			continue
+		}
 
-		if rb == 0 || err != nil {
-			return
+		if _, err := io.Copy(conn, bytes.NewBufferString(message)); err != nil {
+			failed = true
 		}
 	}
 }
 
-// Listen starts listening on a defined port using TCP6, connects to a BoltDB database and sets a admin password if defined. It will then initialize two handlers, request and send handler, as goroutines.
-func Listen(settings Settings) (err error) {
-	var s Server
-
-	var c lease.CIDR
-	for _, cidr := range settings.CIDRs {
-		c, err = lease.ParseCIDR(cidr)
-		if err != nil {
-			return
-		}
-		s.cidrs = append(s.cidrs, c)
-	}
+// reap removes every user with a lease that has expired at the time defined by now and revokes the IP tunnel, this frees the user's ID.
+func (s *Server) reap(now time.Time) {
+	s.tunnelMu.RLock()
+	defer s.tunnelMu.RUnlock()
 
-	// First, we need to make sure we are able to communicate with the database.
-	db, err := database.Open(settings.DB)
+	leases, err := s.db.ExpiredLeases(now)
 	if err != nil {
-		log.Printf("Unable to open database: %s", err)
+		log.Printf("Unable to retrieve expired leases: %s", err)
 
 		return
 	}
-	s.db = &db
 
-	if settings.Password != "" {
-		s.initAdmin(settings.Password)
-	}
+	for _, l := range leases {
+		pubkey, err := s.reapLease(l, now)
+		if err != nil {
+			log.Printf("Unable to remove user with expired lease with ID: %d, due to error: %s", l.ID, err)
 
-	// Listen only to IPv6 network. Administrators can connect locally using [::1].
-	ln, err := net.Listen("tcp6", settings.Listen)
-	if err != nil {
-		log.Printf("Unable to listen to port: %s, due to error: %s", settings.Listen, err)
+			continue
+		}
 
-		return
-	}
+		if pubkey == nil {
+			log.Printf("Lease for user with ID: %d was renewed or released before it was removed", l.ID)
 
-	// Connect to the cjdns admin interface.
-	s.admin, err = cjdns.Connect(settings.CjdnsIP, settings.CjdnsPort, settings.CjdnsPassword)
-	if err != nil {
-		log.Printf("Unable to connect to cjdns admin on: %s:%d, due to error: %s", settings.CjdnsIP, settings.CjdnsPort, err)
+			continue
+		}
 
-		return
+		// A tunnel that can not be revoked is left for reconcile to remove, as the user is gone.
+		if err = s.admin.DelUser(pubkey); err != nil {
+			log.Printf("Unable to revoke IP tunnel for user: %s, due to error: %s", pubkey.String(), err)
+
+			continue
+		}
+
+		log.Printf("Lease for user: %s expired at: %v and has been removed", pubkey.String(), l.Expires)
 	}
+}
 
-	var conn net.Conn
-	for {
-		conn, err = ln.Accept()
+// reapLease removes the user with an expired lease from the database. The lease is checked again in the same transaction, so a user
+// that renewed or released since the expired leases were read is kept, and the public key is nil.
+func (s *Server) reapLease(l database.Lease, now time.Time) (pubkey *key.Public, err error) {
+	err = s.db.Update(func(tx database.Tx) error {
+		current, err := tx.GetLease(l.ID)
+		if err != nil || !current.Expired(now) { // The lease was released or renewed
+			return nil
+		}
+
+		u, err := tx.GetUser(l.ID)
 		if err != nil {
-			log.Printf("TCP connection returned error: %s", err)
+			return err
+		}
 
-			continue
+		if err = tx.DelUser(l.ID); err != nil {
+			return err
 		}
 
-		log.Printf("New connection: %s", conn.RemoteAddr().String())
+		pubkey = u.Key
+		return nil
+	})
+
+	if err != nil {
+		pubkey = nil
+	}
+
+	return
+}
 
-		channel := make(chan string)
+// reaper calls reap every interval, until the server is shut down.
+func (s *Server) reaper(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
 
-		go s.requestHandler(conn, channel)
-		go s.sendHandler(conn, channel)
+	for {
+		select {
+		case now := <-ticker.C:
+			s.reap(now)
+		case <-s.quit:
+			return
+		}
 	}
 }
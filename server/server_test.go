@@ -1 +1,535 @@
-package server_test
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/willeponken/elvisp/cjdns"
+	"github.com/willeponken/elvisp/cjdns/cjdnstest"
+	"github.com/willeponken/elvisp/database"
+	"github.com/willeponken/elvisp/lease"
+	"github.com/willeponken/elvisp/tasks"
+	"github.com/willeponken/go-cjdns/key"
+)
+
+// addrConn overrides the addresses for a connection, so a pipe looks like a connection over cjdns.
+type addrConn struct {
+	net.Conn
+	local, remote net.Addr
+}
+
+func (c addrConn) LocalAddr() net.Addr  { return c.local }
+func (c addrConn) RemoteAddr() net.Addr { return c.remote }
+
+// testServer holds a server connected to a fake cjdns admin server and a temporary database.
+type testServer struct {
+	*Server
+	cjdns  *cjdnstest.Server
+	client *key.Public
+	key    *key.Public
+	path   string
+}
+
+func mustServe(t *testing.T) *testServer {
+	c, err := cjdnstest.NewServer("password")
+	if err != nil {
+		t.Fatalf("NewServer returned unexpected error: %v", err)
+	}
+
+	admin, err := cjdns.Connect(c.Addr, c.Port, "password")
+	if err != nil {
+		t.Fatalf("Connect returned unexpected error: %v", err)
+	}
+
+	file, err := ioutil.TempFile("", "elvisp-")
+	if err != nil {
+		t.Fatalf("TempFile returned unexpected error: %v", err)
+	}
+	file.Close()
+	os.Remove(file.Name())
+
+	db, err := database.Open(file.Name())
+	if err != nil {
+		t.Fatalf("Open returned unexpected error: %v", err)
+	}
+
+	s := &testServer{
+		Server: &Server{db: &db, admin: admin, leaseTime: time.Hour},
+		cjdns:  c,
+		client: key.Generate().Pubkey(),
+		key:    key.Generate().Pubkey(),
+		path:   file.Name(),
+	}
+
+	var cidrs []lease.CIDR
+	for _, c := range []string{"10.0.0.0/24", "fd00::/64"} {
+		cidr, _ := lease.ParseCIDR(c)
+		cidrs = append(cidrs, cidr)
+	}
+	s.setPolicy(tasks.Policy{}.WithCIDRs(cidrs))
+
+	c.AddNode(s.client)
+	c.AddNode(s.key)
+
+	return s
+}
+
+func (s *testServer) Close() {
+	s.cjdns.Close()
+	s.db.Close()
+	os.Remove(s.path)
+}
+
+// dial connects the client to the server using a pipe and returns a reader for the responses.
+func (s *testServer) dial() (net.Conn, *bufio.Reader) {
+	client, server := net.Pipe()
+
+	conn := addrConn{
+		Conn:   server,
+		local:  &net.TCPAddr{IP: s.key.IP(), Port: 4132},
+		remote: &net.TCPAddr{IP: s.client.IP(), Port: 43210},
+	}
+
+	channel := make(chan string)
+	go s.requestHandler(conn, channel)
+	go s.sendHandler(conn, channel)
+
+	return client, bufio.NewReader(client)
+}
+
+// mustSend sends a command and returns the response.
+func mustSend(t *testing.T, conn net.Conn, r *bufio.Reader, cmd string) string {
+	if cmd != "" {
+		if _, err := conn.Write([]byte(cmd + "\n")); err != nil {
+			t.Fatalf("Write returned unexpected error: %v", err)
+		}
+	}
+
+	resp, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatalf("ReadString returned unexpected error: %v", err)
+	}
+
+	return strings.TrimSpace(resp)
+}
+
+// TestRequestHandler checks a full session from a user node against cjdns.
+func TestRequestHandler(t *testing.T) {
+	s := mustServe(t)
+	defer s.Close()
+
+	conn, r := s.dial()
+	defer conn.Close()
+
+	var sessionTests = []struct {
+		cmd, resp string
+	}{
+		{"", "success " + s.key.String()}, // Info is sent on connect
+		{"info", "success " + s.key.String()},
+		{"lease", "success 10.0.0.1 fd00::1"},
+		{"release", "success Released user: " + s.client.String()},
+		{"renew", "error No lease found for user with ID: 1"},
+		{"lease", "success 10.0.0.1 fd00::1"},
+		{"remove", "success Removed user: " + s.client.String()},
+		{"lol", "error No task found for command: lol"},
+	}
+
+	for row, test := range sessionTests {
+		if resp := mustSend(t, conn, r, test.cmd); resp != test.resp {
+			t.Errorf("Row: %d returned unexpected response, got: %q, wanted: %q", row, resp, test.resp)
+		}
+	}
+
+	if tunnels := s.cjdns.Tunnels(); len(tunnels) != 0 {
+		t.Errorf("Session left unexpected tunnels: %v", tunnels)
+	}
+}
+
+// TestRequestHandler_v3 checks a session after negotiating protocol v3.
+func TestRequestHandler_v3(t *testing.T) {
+	s := mustServe(t)
+	defer s.Close()
+
+	conn, r := s.dial()
+	defer conn.Close()
+
+	mustSend(t, conn, r, "")
+
+	if resp := mustSend(t, conn, r, "version 3"); resp != "success 3" {
+		t.Fatalf("Unexpected response for version: %q", resp)
+	}
+
+	var resp response
+	if err := json.Unmarshal([]byte(mustSend(t, conn, r, `{"id":"a","command":"lease"}`)), &resp); err != nil {
+		t.Fatalf("Unmarshal returned unexpected error: %v", err)
+	}
+
+	if string(resp.ID) != `"a"` || resp.Status != statusSuccess || resp.Result == nil {
+		t.Fatalf("Unexpected response for lease: %+v", resp)
+	}
+
+	if len(resp.Result.IPv4) != 1 || resp.Result.IPv4[0].Address != "10.0.0.1" || resp.Result.IPv4[0].PrefixLength != 24 {
+		t.Errorf("Unexpected IPv4 addresses: %v", resp.Result.IPv4)
+	}
+
+	if len(resp.Result.IPv6) != 1 || resp.Result.IPv6[0].Address != "fd00::1" || resp.Result.IPv6[0].PrefixLength != 64 {
+		t.Errorf("Unexpected IPv6 addresses: %v", resp.Result.IPv6)
+	}
+
+	if resp.Result.Key != s.client.String() || resp.Result.Expires == nil {
+		t.Errorf("Unexpected key: %s or expiry: %v", resp.Result.Key, resp.Result.Expires)
+	}
+
+	resp = response{}
+	json.Unmarshal([]byte(mustSend(t, conn, r, `{"id":1,"command":"info"}`)), &resp)
+	if resp.Result == nil || resp.Result.User == nil || resp.Result.User.Source != "client" || resp.Result.User.LastSeen == nil || len(resp.Result.User.Assigned) != 2 {
+		t.Errorf("Unexpected user for info: %+v", resp.Result)
+	}
+
+	resp = response{}
+	json.Unmarshal([]byte(mustSend(t, conn, r, `{"id":2,"command":"lol"}`)), &resp)
+	if string(resp.ID) != "2" || resp.Status != statusError || resp.Error == nil || resp.Error.Code != tasks.CodeUnknownCommand {
+		t.Errorf("Unexpected response for unknown command: %+v", resp)
+	}
+
+	resp = response{}
+	json.Unmarshal([]byte(mustSend(t, conn, r, `lease`)), &resp)
+	if resp.Status != statusError || resp.Error == nil || resp.Error.Code != tasks.CodeInvalidRequest {
+		t.Errorf("Unexpected response for invalid JSON: %+v", resp)
+	}
+}
+
+// TestRequestHandler_reserve checks if an administrator can reserve addresses for a node, which are then leased by the node.
+func TestRequestHandler_reserve(t *testing.T) {
+	s := mustServe(t)
+	defer s.Close()
+
+	if err := s.initAdmin("secret"); err != nil {
+		t.Fatalf("initAdmin returned unexpected error: %v", err)
+	}
+
+	conn, r := s.dial()
+	defer conn.Close()
+
+	mustSend(t, conn, r, "")
+
+	var sessionTests = []struct {
+		cmd, resp string
+	}{
+		{"reserve " + s.client.String() + " 10.0.0.42", "error Session is not authenticated as admin, send auth first"},
+		{"version 3", "success 3"},
+		{`{"id":1,"command":"reserve","password":"secret","key":"` + s.client.String() + `","args":["10.0.0.42"]}`,
+			`{"id":1,"status":"success","result":{"message":"Reserved addresses: 10.0.0.42 for user: ` + s.client.String() + `","key":"` + s.client.String() + `","pool":"default","ipv4":[{"address":"10.0.0.42","prefix_length":24}]}}`},
+		{`{"id":2,"command":"lease"}`, `"ipv4":[{"address":"10.0.0.42","prefix_length":24}],"ipv6":[{"address":"fd00::1","prefix_length":64}]`},
+		{`{"id":3,"command":"unreserve","key":"lol","password":"secret"}`, `"code":"invalid_request"`},
+		{`{"id":4,"command":"unreserve","key":"` + s.client.String() + `"}`, `"code":"unauthorized"`},
+	}
+
+	for row, test := range sessionTests {
+		if resp := mustSend(t, conn, r, test.cmd); !strings.Contains(resp, test.resp) {
+			t.Errorf("Row: %d returned unexpected response, got: %q, wanted it to contain: %q", row, resp, test.resp)
+		}
+	}
+}
+
+// TestRequestHandler_unknownNode checks if nodes missing in the cjdns node store get an error.
+func TestRequestHandler_unknownNode(t *testing.T) {
+	s := mustServe(t)
+	defer s.Close()
+
+	s.cjdns.DelNode(s.client)
+
+	conn, r := s.dial()
+	defer conn.Close()
+
+	if resp := mustSend(t, conn, r, ""); !strings.HasPrefix(resp, "error ") {
+		t.Errorf("Unexpected response for unknown node: %q", resp)
+	}
+}
+
+// TestReap checks if only users with expired leases are removed from both cjdns and the database.
+func TestReap(t *testing.T) {
+	s := mustServe(t)
+	defer s.Close()
+
+	conn, r := s.dial()
+	defer conn.Close()
+
+	mustSend(t, conn, r, "")
+	mustSend(t, conn, r, "lease")
+
+	keep := key.Generate().Pubkey()
+	id, _ := s.db.AddUser(keep)
+	s.db.SetLease(id, time.Now(), time.Time{})
+
+	s.reap(time.Now().Add(2 * time.Hour))
+
+	if _, err := s.db.GetID(s.client); err == nil {
+		t.Errorf("GetID expected error for reaped user but got %v", err)
+	}
+
+	if _, err := s.db.GetID(keep); err != nil {
+		t.Errorf("GetID returned unexpected error: %v", err)
+	}
+
+	if tunnels := s.cjdns.Tunnels(); len(tunnels) != 0 {
+		t.Errorf("reap left unexpected tunnels: %v", tunnels)
+	}
+}
+
+// TestReap_renewed checks that a user that renewed after the expired leases were read is kept, until the renewed lease expires.
+func TestReap_renewed(t *testing.T) {
+	s := mustServe(t)
+	defer s.Close()
+
+	conn, r := s.dial()
+	defer conn.Close()
+
+	mustSend(t, conn, r, "")
+	mustSend(t, conn, r, "lease")
+
+	now := time.Now().Add(2 * time.Hour)
+	leases, err := s.db.ExpiredLeases(now)
+	if err != nil || len(leases) != 1 {
+		t.Fatalf("ExpiredLeases returned unexpected leases: %v, error: %v", leases, err)
+	}
+
+	// Renewed after the expired leases were read.
+	if err = s.db.SetLease(leases[0].ID, time.Now(), now.Add(time.Hour)); err != nil {
+		t.Fatalf("SetLease returned unexpected error: %v", err)
+	}
+
+	pubkey, err := s.reapLease(leases[0], now)
+	if err != nil || pubkey != nil {
+		t.Errorf("reapLease removed renewed user: %v, error: %v", pubkey, err)
+	}
+
+	if _, err = s.db.GetID(s.client); err != nil {
+		t.Errorf("GetID returned unexpected error: %v", err)
+	}
+
+	if pubkey, err = s.reapLease(leases[0], now.Add(2*time.Hour)); err != nil || !s.client.Equal(pubkey) {
+		t.Errorf("reapLease returned unexpected public key: %v, error: %v", pubkey, err)
+	}
+}
+
+// TestReconcile_delegate checks if delegated prefixes lost by a cjdroute restart are re-added with their length.
+func TestReconcile_delegate(t *testing.T) {
+	s := mustServe(t)
+	defer s.Close()
+
+	cidrs, err := parseCIDRs([]string{"fd00::/48,delegate=56"})
+	if err != nil {
+		t.Fatalf("parseCIDRs returned unexpected error: %v", err)
+	}
+	s.setPolicy(s.policy().WithCIDRs(cidrs))
+
+	conn, r := s.dial()
+	defer conn.Close()
+
+	mustSend(t, conn, r, "")
+	if resp := mustSend(t, conn, r, "lease"); resp != "success fd00:0:0:100::/56" {
+		t.Errorf("lease returned unexpected response: %q", resp)
+	}
+
+	s.cjdns.Reset()
+
+	if _, err = s.reconcile(false); err != nil {
+		t.Fatalf("reconcile returned unexpected error: %v", err)
+	}
+
+	tunnels := s.cjdns.Tunnels()
+	if len(tunnels) != 1 || tunnels[0].Alloc != 56 || !tunnels[0].IPs[0].Equal(net.ParseIP("fd00:0:0:100::")) {
+		t.Errorf("reconcile left unexpected tunnels: %v", tunnels)
+	}
+}
+
+// TestReconcile checks if allowances lost by a cjdroute restart are re-added and orphans removed, and that a dry run changes nothing.
+func TestReconcile(t *testing.T) {
+	s := mustServe(t)
+	defer s.Close()
+
+	conn, r := s.dial()
+	defer conn.Close()
+
+	mustSend(t, conn, r, "")
+	mustSend(t, conn, r, "lease")
+
+	s.cjdns.Reset()
+	orphan := s.cjdns.AddTunnel(cjdns.Tunnel{Key: key.Generate().Pubkey(), IPs: []net.IP{net.ParseIP("10.0.0.2")}})
+	foreign := key.Generate().Pubkey()
+	s.cjdns.AddTunnel(cjdns.Tunnel{Key: foreign, IPs: []net.IP{net.ParseIP("192.168.1.2")}})
+
+	diff, err := s.reconcile(true)
+	if err != nil {
+		t.Fatalf("reconcile returned unexpected error: %v", err)
+	}
+
+	if len(diff.Missing) != 2 || len(diff.Orphans) != 1 || diff.Orphans[0].Index != orphan {
+		t.Errorf("reconcile returned unexpected difference: %v", diff)
+	}
+
+	if tunnels := s.cjdns.Tunnels(); len(tunnels) != 2 {
+		t.Errorf("reconcile dry run changed tunnels: %v", tunnels)
+	}
+
+	if _, err = s.reconcile(false); err != nil {
+		t.Fatalf("reconcile returned unexpected error: %v", err)
+	}
+
+	// The tunnel outside the pools was not allowed by Elvisp, and is kept.
+	tunnels := s.cjdns.Tunnels()
+	if len(tunnels) != 3 || !foreign.Equal(tunnels[0].Key) || !s.client.Equal(tunnels[1].Key) || !s.client.Equal(tunnels[2].Key) {
+		t.Errorf("reconcile left unexpected tunnels: %v", tunnels)
+	}
+
+	if diff, _ = s.reconcile(false); !diff.Empty() {
+		t.Errorf("reconcile returned unexpected difference after reconciling: %v", diff)
+	}
+}
+
+// TestReconcile_errors checks if reconcile keeps going after cjdns refuses a change, and returns the failure.
+func TestReconcile_errors(t *testing.T) {
+	s := mustServe(t)
+	defer s.Close()
+
+	conn, r := s.dial()
+	defer conn.Close()
+
+	mustSend(t, conn, r, "")
+	mustSend(t, conn, r, "lease")
+
+	s.cjdns.Reset()
+	s.cjdns.AddTunnel(cjdns.Tunnel{Key: key.Generate().Pubkey(), IPs: []net.IP{net.ParseIP("10.0.0.2")}})
+	s.cjdns.Fail("IpTunnel_removeConnection", "refused")
+
+	diff, err := s.reconcile(false)
+	if err == nil {
+		t.Errorf("reconcile expected error but got %v", err)
+	}
+
+	if len(diff.Missing) != 2 || len(diff.Orphans) != 1 {
+		t.Errorf("reconcile returned unexpected difference: %v", diff)
+	}
+
+	if tunnels := s.cjdns.Tunnels(); len(tunnels) != 3 {
+		t.Errorf("reconcile did not add the missing allowances after a failure: %v", tunnels)
+	}
+}
+
+// addedAdmin blocks AddUser after the user has been allowed in cjdns until release is closed, so a lease is caught between
+// changing cjdns and the database.
+type addedAdmin struct {
+	cjdns.Admin
+	added   chan struct{}
+	release chan struct{}
+}
+
+func (a addedAdmin) AddUser(publicKey *key.Public, ip net.IP) error {
+	err := a.Admin.AddUser(publicKey, ip)
+
+	a.added <- struct{}{}
+	<-a.release
+
+	return err
+}
+
+// TestReconcile_lease checks that reconcile waits for a running lease, instead of removing its new tunnel before the lease is
+// stored.
+func TestReconcile_lease(t *testing.T) {
+	s := mustServe(t)
+	defer s.Close()
+
+	admin := addedAdmin{Admin: s.admin, added: make(chan struct{}, 2), release: make(chan struct{})}
+	s.admin = admin
+
+	task, err := tasks.InitKey(nil, s.db, s.admin, s.client, nil, s.policy(), s.leaseTime)
+	if err != nil {
+		t.Fatalf("InitKey returned unexpected error: %v", err)
+	}
+
+	leased := make(chan error, 1)
+	go func() {
+		_, err := s.run(tasks.Lease{Task: task})
+		leased <- err
+	}()
+
+	select {
+	case <-admin.added:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Lease did not allow the user in cjdns")
+	}
+
+	reconciled := make(chan error, 1)
+	go func() {
+		_, err := s.reconcile(false)
+		reconciled <- err
+	}()
+
+	select {
+	case err = <-reconciled:
+		t.Fatalf("reconcile returned before the lease finished: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(admin.release)
+
+	if err = <-leased; err != nil {
+		t.Errorf("Lease returned unexpected error: %v", err)
+	}
+
+	if err = <-reconciled; err != nil {
+		t.Errorf("reconcile returned unexpected error: %v", err)
+	}
+
+	if tunnels := s.cjdns.Tunnels(); len(tunnels) != 2 {
+		t.Errorf("reconcile left unexpected tunnels: %v", tunnels)
+	}
+}
+
+// TestNewPolicy checks that the pools, policies and allocator in the settings are parsed and checked.
+func TestNewPolicy(t *testing.T) {
+	pubkey := key.Generate().Pubkey().String()
+	cidrs := []string{"10.0.0.0/24"}
+
+	var policyTests = []struct {
+		settings Settings
+		pools    []string
+		err      bool
+	}{
+		{Settings{CIDRs: cidrs}, []string{tasks.DefaultPool}, false},
+		{Settings{CIDRs: cidrs, Pools: map[string][]string{"infra": {"10.2.0.0/24"}, "guests": {"10.1.0.0/24"}}, Policies: map[string][]string{pubkey: {"guests"}}},
+			[]string{tasks.DefaultPool, "guests", "infra"}, false},
+		{Settings{CIDRs: cidrs, Allocator: tasks.AllocatorHash, AllocatorKey: "secret"}, []string{tasks.DefaultPool}, false},
+		{Settings{CIDRs: cidrs, Allocator: tasks.AllocatorHash}, nil, true},
+		{Settings{CIDRs: cidrs, Allocator: "random"}, nil, true},
+		{Settings{CIDRs: cidrs, Pools: map[string][]string{tasks.DefaultPool: {"10.1.0.0/24"}}}, nil, true},
+		{Settings{CIDRs: cidrs, Pools: map[string][]string{"guests": {"nope"}}}, nil, true},
+		{Settings{CIDRs: cidrs, Policies: map[string][]string{pubkey: {"guests"}}}, nil, true},
+		{Settings{}, nil, true},
+	}
+
+	for row, test := range policyTests {
+		policy, err := newPolicy(test.settings)
+		if (err != nil) != test.err {
+			t.Errorf("Row: %d returned unexpected error: %v", row, err)
+			continue
+		}
+
+		var pools []string
+		for _, pool := range policy.Pools {
+			pools = append(pools, pool.Name)
+		}
+
+		if err == nil && !reflect.DeepEqual(pools, test.pools) {
+			t.Errorf("Row: %d returned unexpected pools, got: %v, wanted: %v", row, pools, test.pools)
+		}
+	}
+}
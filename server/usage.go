@@ -0,0 +1,80 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/willeponken/elvisp/tasks"
+)
+
+// exhausted is the level recorded for a pool without free IDs, above every threshold.
+const exhausted = 101
+
+// checkUsage logs a warning for every pool that has reached a utilisation threshold, in percent, or is exhausted. Every threshold
+// is only warned about once, until the usage of the pool drops below it again.
+func (s *Server) checkUsage() {
+	usage, err := tasks.Usage(s.db, s.policy())
+	if err != nil {
+		log.Printf("Unable to retrieve pool usage, due to error: %s", err)
+
+		return
+	}
+
+	if s.usageWarned == nil {
+		s.usageWarned = make(map[string]int)
+	}
+
+	for _, u := range usage {
+		pool := fmt.Sprintf("%s (%s)", u.Pool, u.CIDR)
+		percent := u.Percent()
+
+		reached := 0
+		for _, threshold := range s.usageThresholds {
+			if percent >= threshold && threshold > reached {
+				reached = threshold
+			}
+		}
+
+		// An exhausted pool is always warned about, even if it was warned about at the highest threshold.
+		if u.Free == 0 {
+			reached = exhausted
+		}
+
+		if reached > s.usageWarned[pool] {
+			if u.Free == 0 {
+				log.Printf("Warning: pool: %s is exhausted, all %d IDs are used and new users are refused", pool, u.Capacity)
+			} else {
+				log.Printf("Warning: pool: %s is %d%% used, %d of %d IDs are used and %d are free", pool, percent, u.Used, u.Capacity, u.Free)
+			}
+		}
+
+		s.usageWarned[pool] = reached
+	}
+}
+
+// usageChecker calls checkUsage every interval, until the server is shut down.
+func (s *Server) usageChecker(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.checkUsage()
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+// checkThresholds returns an error if a utilisation threshold is not within 1 to 100 percent.
+func checkThresholds(thresholds []int) error {
+	for _, threshold := range thresholds {
+		if threshold < 1 || threshold > 100 {
+			return fmt.Errorf("Invalid pool usage threshold: %d%%, it has to be within 1 to 100%%", threshold)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/willeponken/go-cjdns/key"
+)
+
+// TestCheckUsage checks that every threshold is only warned about once, and warned about again after the usage dropped.
+func TestCheckUsage(t *testing.T) {
+	s := mustServe(t)
+	defer s.Close()
+
+	cidrs, err := parseCIDRs([]string{"10.0.0.0/29"})
+	if err != nil {
+		t.Fatalf("parseCIDRs returned unexpected error: %v", err)
+	}
+	s.setPolicy(s.policy().WithCIDRs(cidrs))
+	s.usageThresholds = []int{50, 80}
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	var users []*key.Public
+	for i, tt := range []struct {
+		users int
+		warn  string
+	}{
+		{1, ""},
+		{3, "is 50% used, 3 of 6 IDs are used and 3 are free"},
+		{3, ""},
+		{4, ""},
+		{5, "is 83% used, 5 of 6 IDs are used and 1 are free"},
+		{6, "is exhausted, all 6 IDs are used"},
+		{6, ""},
+		{2, ""},
+		{3, "is 50% used"},
+	} {
+		for len(users) < tt.users {
+			users = append(users, key.Generate().Pubkey())
+			if _, err := s.db.AddUser(users[len(users)-1]); err != nil {
+				t.Fatalf("AddUser returned unexpected error: %v", err)
+			}
+		}
+
+		for len(users) > tt.users {
+			if err := s.db.DelUser(users[len(users)-1]); err != nil {
+				t.Fatalf("DelUser returned unexpected error: %v", err)
+			}
+			users = users[:len(users)-1]
+		}
+
+		buf.Reset()
+		s.checkUsage()
+
+		if tt.warn == "" && buf.Len() != 0 || !strings.Contains(buf.String(), tt.warn) {
+			t.Errorf("Row: %d returned unexpected warning: %q, expected: %q", i, buf.String(), tt.warn)
+		}
+	}
+}
+
+// TestCheckThresholds checks that thresholds outside of 1 to 100 percent are refused.
+func TestCheckThresholds(t *testing.T) {
+	for i, tt := range []struct {
+		thresholds []int
+		err        bool
+	}{
+		{nil, false},
+		{[]int{80, 95}, false},
+		{[]int{1, 100}, false},
+		{[]int{0}, true},
+		{[]int{80, 101}, true},
+		{[]int{-5}, true},
+	} {
+		if err := checkThresholds(tt.thresholds); (err != nil) != tt.err {
+			t.Errorf("Row: %d returned unexpected error: %v", i, err)
+		}
+	}
+}
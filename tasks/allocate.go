@@ -0,0 +1,72 @@
+package tasks
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/willeponken/go-cjdns/key"
+)
+
+// Allocators for the index of a user within its pool, AllocatorSequential gives the lowest free index, and AllocatorHash derives the
+// index from a keyed hash of the public key, so the addresses are the same after the database is rebuilt, and on every gateway using
+// the same key and pools.
+const (
+	AllocatorSequential = "sequential"
+	AllocatorHash       = "hash"
+)
+
+// poolCapacity returns the number of indexes that have addresses, or prefixes, in every CIDR of the pool.
+func poolCapacity(pool Pool) (capacity uint64) {
+	for i, cidr := range pool.CIDRs {
+		if c := cidr.Capacity(); i == 0 || c < capacity {
+			capacity = c
+		}
+	}
+
+	return
+}
+
+// hashIndex returns the index within the pool derived from the keyed hash of the pool name and the public key, from 1 to capacity.
+func hashIndex(secret []byte, pool Pool, pubkey *key.Public, capacity uint64) uint64 {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(pool.Name))
+	mac.Write([]byte{0})
+	mac.Write([]byte(pubkey.String()))
+
+	return binary.BigEndian.Uint64(mac.Sum(nil))%capacity + 1
+}
+
+// firstIndex returns the index to start probing from for pubkey, and the highest index before wrapping around to 1. The highest index
+// is 0 if the indexes are probed upwards without wrapping.
+func (p Policy) firstIndex(pool Pool, pubkey *key.Public) (start, limit uint64) {
+	if p.Allocator != AllocatorHash {
+		return 1, 0
+	}
+
+	if limit = poolCapacity(pool); limit == 0 {
+		return 1, 0
+	}
+
+	return hashIndex(p.HashKey, pool, pubkey, limit), limit
+}
+
+// probe returns the first index from the start index for pubkey that is not taken, wrapping around to 1 for the hash allocator. A
+// collision is logged by the caller, as the index is stored with the user the probing is only done once.
+func (p Policy) probe(pool Pool, pubkey *key.Public, taken func(uint64) bool) (i uint64, probes uint64, err error) {
+	start, limit := p.firstIndex(pool, pubkey)
+
+	for i = start; taken(i); probes++ {
+		if i++; limit != 0 && i > limit {
+			i = 1
+		}
+
+		if i == start {
+			err = Error{Code: CodeExhausted, Err: fmt.Errorf("Pool: %s has no free index left", pool.Name)}
+			return
+		}
+	}
+
+	return
+}
@@ -0,0 +1,141 @@
+package tasks_test
+
+import (
+	"testing"
+
+	"github.com/willeponken/elvisp/database"
+	"github.com/willeponken/elvisp/lease"
+	"github.com/willeponken/elvisp/tasks"
+	"github.com/willeponken/go-cjdns/key"
+)
+
+// mustHashSetup sets up an environment using the hash allocator, with the CIDRs as the default pool and the keys known by cjdns.
+func mustHashSetup(t *testing.T, cidrs []string, keys []*key.Public) *env {
+	e := mustSetup(t)
+	e.named = tasks.Policy{Allocator: tasks.AllocatorHash, HashKey: []byte("secret")}
+
+	e.cidrs = nil
+	for _, c := range cidrs {
+		cidr, err := lease.ParseCIDR(c)
+		if err != nil {
+			t.Fatalf("ParseCIDR returned unexpected error: %v", err)
+		}
+
+		e.cidrs = append(e.cidrs, cidr)
+	}
+
+	for _, k := range keys {
+		e.cjdns.AddNode(k)
+	}
+
+	return e
+}
+
+// hashLease leases for a key in the environment.
+func hashLease(t *testing.T, e *env, pubkey *key.Public) (tasks.Result, error) {
+	task, err := tasks.InitKey(nil, e.db, e.admin, pubkey, nil, e.policy(), e.leaseTime)
+	if err != nil {
+		t.Fatalf("InitKey returned unexpected error: %v", err)
+	}
+
+	return tasks.Lease{Task: task}.Run()
+}
+
+// mustUser returns the user record for a key in the environment.
+func mustUser(t *testing.T, e *env, pubkey *key.Public) database.User {
+	id, err := e.db.GetID(pubkey)
+	if err != nil {
+		t.Fatalf("GetID returned unexpected error: %v", err)
+	}
+
+	u, err := e.db.GetUser(id)
+	if err != nil {
+		t.Fatalf("GetUser returned unexpected error: %v", err)
+	}
+
+	return u
+}
+
+// TestLease_hashAllocator checks that the hash allocator gives a key the same addresses no matter in which order the users were
+// added, as on another gateway or after the database is rebuilt.
+func TestLease_hashAllocator(t *testing.T) {
+	keys := []*key.Public{key.Generate().Pubkey(), key.Generate().Pubkey(), key.Generate().Pubkey()}
+
+	first := mustHashSetup(t, []string{"fd00::/64"}, keys)
+	defer first.Close()
+
+	second := mustHashSetup(t, []string{"fd00::/64"}, keys)
+	defer second.Close()
+
+	addrs := make(map[string]string)
+	for _, k := range keys {
+		result, err := hashLease(t, first, k)
+		if err != nil {
+			t.Fatalf("Lease returned unexpected error: %v", err)
+		}
+
+		addrs[k.String()] = result.String()
+	}
+
+	for i := len(keys) - 1; i >= 0; i-- {
+		result, err := hashLease(t, second, keys[i])
+		if err != nil {
+			t.Fatalf("Lease returned unexpected error: %v", err)
+		}
+
+		if expected := addrs[keys[i].String()]; result.String() != expected {
+			t.Errorf("Key: %d returned unexpected addresses on the second gateway, got: %q, wanted: %q", i, result.String(), expected)
+		}
+	}
+}
+
+// TestLease_hashAllocatorProbing checks that colliding hashes are probed to the next free index, until the pool is exhausted.
+func TestLease_hashAllocatorProbing(t *testing.T) {
+	var keys []*key.Public
+	for i := 0; i < 7; i++ {
+		keys = append(keys, key.Generate().Pubkey())
+	}
+
+	e := mustHashSetup(t, []string{"10.0.0.0/29"}, keys)
+	defer e.Close()
+
+	seen := make(map[string]bool)
+	for i, k := range keys[:6] {
+		result, err := hashLease(t, e, k)
+		if err != nil {
+			t.Fatalf("Lease returned unexpected error for key: %d: %v", i, err)
+		}
+
+		if seen[result.String()] {
+			t.Errorf("Key: %d returned addresses that are already leased: %q", i, result.String())
+		}
+		seen[result.String()] = true
+	}
+
+	if _, err := hashLease(t, e, keys[6]); tasks.ErrorCode(err) != tasks.CodeExhausted {
+		t.Errorf("Lease returned unexpected error for a full pool, got: %v, wanted code: %s", err, tasks.CodeExhausted)
+	}
+
+	// The probes are recorded, so the index is as far from the index the key hashes to, i.e. its index in an empty pool.
+	for i, k := range keys[:6] {
+		empty := mustHashSetup(t, []string{"10.0.0.0/29"}, []*key.Public{k})
+		if _, err := hashLease(t, empty, k); err != nil {
+			t.Fatalf("Lease returned unexpected error for key: %d: %v", i, err)
+		}
+
+		hashed := mustUser(t, empty, k)
+		empty.Close()
+
+		if u := mustUser(t, e, k); hashed.Probes != 0 || (hashed.Index-1+u.Probes)%6+1 != u.Index {
+			t.Errorf("Key: %d returned unexpected index: %d with probes: %d, hashed index: %d", i, u.Index, u.Probes, hashed.Index)
+		}
+	}
+
+	// A registered user keeps the index it probed to.
+	for i, k := range keys[:6] {
+		result, err := hashLease(t, e, k)
+		if err != nil || !seen[result.String()] {
+			t.Errorf("Key: %d returned unexpected addresses on renewed lease: %q, error: %v", i, result.String(), err)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package tasks
+
+import (
+	"errors"
+
+	"github.com/willeponken/elvisp/cjdns"
+	"github.com/willeponken/elvisp/lease"
+)
+
+// Error codes that describe why a task failed.
+const (
+	CodeInternal         = "internal"
+	CodeInvalidRequest   = "invalid_request"
+	CodeUnknownCommand   = "unknown_command"
+	CodeUnauthorized     = "unauthorized"
+	CodeUnknownNode      = "unknown_node"
+	CodeNotFound         = "not_found"
+	CodeConflict         = "conflict"
+	CodeExhausted        = "exhausted"
+	CodeCjdns            = "cjdns"
+	CodeCjdnsUnavailable = "cjdns_unavailable"
+)
+
+// Error wraps an error with a code describing why a task failed.
+type Error struct {
+	Code string
+	Err  error
+}
+
+// Error returns the message of the wrapped error.
+func (e Error) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the wrapped error.
+func (e Error) Unwrap() error {
+	return e.Err
+}
+
+// wrap wraps err with code, nil is returned for a nil error.
+func wrap(code string, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	return Error{Code: code, Err: err}
+}
+
+// ErrorCode returns the code for an error, an exhausted CIDR without a code is exhausted and other errors without a code are internal.
+// Errors caused by cjdns admin being unavailable always use CodeCjdnsUnavailable, whatever code they were wrapped with.
+func ErrorCode(err error) string {
+	if errors.Is(err, cjdns.ErrUnavailable) {
+		return CodeCjdnsUnavailable
+	}
+
+	var e Error
+	if errors.As(err, &e) {
+		return e.Code
+	}
+
+	var exhausted lease.ExhaustedError
+	if errors.As(err, &exhausted) {
+		return CodeExhausted
+	}
+
+	return CodeInternal
+}
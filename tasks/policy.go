@@ -0,0 +1,202 @@
+package tasks
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/willeponken/elvisp/database"
+	"github.com/willeponken/elvisp/lease"
+	"github.com/willeponken/go-cjdns/key"
+)
+
+// DefaultPool is the name of the pool that users lease from if no policy applies to them.
+const DefaultPool = "default"
+
+// Pool holds a named set of CIDRs, a user leases an address, or a prefix, from every CIDR in its pool.
+type Pool struct {
+	Name  string
+	CIDRs []lease.CIDR
+}
+
+// Policy holds the pools that users lease from, and which of them a public key may lease from. Groups maps a group name to
+// the public keys in it, and Allowed maps a public key or a group name to pools, the first of which is leased from unless
+// another is asked for. Public keys without a policy, directly or through a group, may only lease from DefaultPool.
+// Allocator picks the index for a user within its pool, either AllocatorSequential, the default if empty, or AllocatorHash keyed with
+// HashKey.
+type Policy struct {
+	Pools     []Pool
+	Groups    map[string][]string
+	Allowed   map[string][]string
+	Allocator string
+	HashKey   []byte
+}
+
+// Pool returns the pool with a name.
+func (p Policy) Pool(name string) (pool Pool, err error) {
+	for _, pool = range p.Pools {
+		if pool.Name == name {
+			return
+		}
+	}
+
+	err = Error{Code: CodeNotFound, Err: fmt.Errorf("Pool: %s does not exist", name)}
+	return
+}
+
+// PoolsFor returns the names of the pools that a public key may lease from. A policy for the key itself replaces the
+// policies for its groups, which are merged in the order of the group names.
+func (p Policy) PoolsFor(pubkey *key.Public) (names []string) {
+	if names = p.Allowed[pubkey.String()]; len(names) != 0 {
+		return
+	}
+
+	var groups []string
+	for group, keys := range p.Groups {
+		for _, k := range keys {
+			if k == pubkey.String() {
+				groups = append(groups, group)
+				break
+			}
+		}
+	}
+	sort.Strings(groups)
+
+	seen := make(map[string]bool)
+	for _, group := range groups {
+		for _, name := range p.Allowed[group] {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+
+	if len(names) == 0 {
+		names = []string{DefaultPool}
+	}
+
+	return
+}
+
+// Allows reports if a public key may lease from the pool with a name.
+func (p Policy) Allows(pubkey *key.Public, name string) bool {
+	for _, n := range p.PoolsFor(pubkey) {
+		if n == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// WithCIDRs returns the policy with the CIDRs of DefaultPool replaced.
+func (p Policy) WithCIDRs(cidrs []lease.CIDR) Policy {
+	pools := []Pool{{Name: DefaultPool, CIDRs: cidrs}}
+	for _, pool := range p.Pools {
+		if pool.Name != DefaultPool {
+			pools = append(pools, pool)
+		}
+	}
+
+	p.Pools = pools
+	return p
+}
+
+// Check returns an error if the policy is inconsistent: DefaultPool has to exist, every pool needs an unique name, that can be
+// told apart from an address in a request, and atleast one CIDR, groups have to hold valid public keys, every policy has to be
+// for a valid public key or a group and name existing pools, and the hash allocator needs a key.
+func (p Policy) Check() error {
+	switch p.Allocator {
+	case "", AllocatorSequential:
+	case AllocatorHash:
+		if len(p.HashKey) == 0 {
+			return fmt.Errorf("Allocator: %s needs a key", p.Allocator)
+		}
+	default:
+		return fmt.Errorf("Unknown allocator: %s", p.Allocator)
+	}
+
+	names := make(map[string]bool)
+	for _, pool := range p.Pools {
+		switch {
+		case pool.Name == "":
+			return errors.New("Every pool needs a name")
+		case strings.ContainsAny(pool.Name, " \t,=") || net.ParseIP(pool.Name) != nil:
+			return fmt.Errorf("Invalid pool name: %q, it can neither hold spaces, commas or equal signs nor be an IP address", pool.Name)
+		case names[pool.Name]:
+			return fmt.Errorf("Pool: %s is defined more than once", pool.Name)
+		case len(pool.CIDRs) == 0:
+			return fmt.Errorf("Pool: %s needs atleast one CIDR", pool.Name)
+		}
+
+		names[pool.Name] = true
+	}
+
+	if !names[DefaultPool] {
+		return fmt.Errorf("Pool: %s has to be defined", DefaultPool)
+	}
+
+	for group, keys := range p.Groups {
+		for _, k := range keys {
+			if _, err := key.DecodePublic(k); err != nil {
+				return fmt.Errorf("Invalid public key: %s in group: %s", k, group)
+			}
+		}
+	}
+
+	for subject, pools := range p.Allowed {
+		if _, ok := p.Groups[subject]; !ok {
+			if _, err := key.DecodePublic(subject); err != nil {
+				return fmt.Errorf("Policy for: %s is neither for a group nor a valid public key", subject)
+			}
+		}
+
+		if len(pools) == 0 {
+			return fmt.Errorf("Policy for: %s needs atleast one pool", subject)
+		}
+
+		for _, name := range pools {
+			if !names[name] {
+				return fmt.Errorf("Policy for: %s uses pool: %s, which does not exist", subject, name)
+			}
+		}
+	}
+
+	return nil
+}
+
+// poolName returns the name of the pool that a user leases from, users registered before pools lease from DefaultPool.
+func poolName(u database.User) string {
+	if u.Pool == "" {
+		return DefaultPool
+	}
+
+	return u.Pool
+}
+
+// index returns the position of the addresses for a user within its pool: the reserved ID if there is one, the index given
+// to the user when it started to lease from the pool, or the ID for a user registered before pools.
+func index(u database.User, r database.Reservation) uint64 {
+	switch {
+	case r.ID != 0:
+		return r.ID
+	case u.Index != 0:
+		return u.Index
+	}
+
+	return u.ID
+}
+
+// UserAddresses returns the addresses for a registered user within its pool, at its reserved addresses if any. The reservation
+// is empty for a user without one.
+func (p Policy) UserAddresses(u database.User, r database.Reservation) (addrs []Address, err error) {
+	pool, err := p.Pool(poolName(u))
+	if err != nil {
+		return
+	}
+
+	return Addresses(pool.CIDRs, index(u, r), r)
+}
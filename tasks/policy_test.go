@@ -0,0 +1,183 @@
+package tasks_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/willeponken/elvisp/database"
+	"github.com/willeponken/elvisp/lease"
+	"github.com/willeponken/elvisp/tasks"
+	"github.com/willeponken/go-cjdns/key"
+)
+
+// mustPool parses the CIDRs for a named pool.
+func mustPool(t *testing.T, name string, cidrs ...string) (pool tasks.Pool) {
+	pool.Name = name
+	for _, c := range cidrs {
+		cidr, err := lease.ParseCIDR(c)
+		if err != nil {
+			t.Fatalf("ParseCIDR returned unexpected error: %v", err)
+		}
+
+		pool.CIDRs = append(pool.CIDRs, cidr)
+	}
+
+	return
+}
+
+func TestPolicy_PoolsFor(t *testing.T) {
+	alice, bob, eve := key.Generate().Pubkey(), key.Generate().Pubkey(), key.Generate().Pubkey()
+
+	policy := tasks.Policy{
+		Groups: map[string][]string{
+			"staff":  {alice.String(), bob.String()},
+			"admins": {bob.String()},
+		},
+		Allowed: map[string][]string{
+			"staff":        {"members", "guests"},
+			"admins":       {"infra", "members"},
+			alice.String(): {"guests"},
+		},
+	}
+
+	var poolsTests = []struct {
+		pubkey   *key.Public
+		expected []string
+	}{
+		{alice, []string{"guests"}},
+		{bob, []string{"infra", "members", "guests"}},
+		{eve, []string{tasks.DefaultPool}},
+	}
+
+	for row, test := range poolsTests {
+		if names := policy.PoolsFor(test.pubkey); !reflect.DeepEqual(names, test.expected) {
+			t.Errorf("Row: %d returned unexpected pools, got: %v, wanted: %v", row, names, test.expected)
+		}
+
+		if !policy.Allows(test.pubkey, test.expected[0]) {
+			t.Errorf("Row: %d does not allow pool: %s", row, test.expected[0])
+		}
+	}
+
+	if policy.Allows(alice, "members") || policy.Allows(eve, "guests") {
+		t.Errorf("Allows returned true for a pool that is not allowed")
+	}
+}
+
+func TestPolicy_Check(t *testing.T) {
+	pubkey := key.Generate().Pubkey().String()
+	def := mustPool(t, tasks.DefaultPool, "10.0.0.0/24")
+	guests := mustPool(t, "guests", "10.1.0.0/24")
+
+	var checkTests = []struct {
+		policy tasks.Policy
+		err    bool
+	}{
+		{tasks.Policy{Pools: []tasks.Pool{def}}, false},
+		{tasks.Policy{Pools: []tasks.Pool{def, guests}, Groups: map[string][]string{"staff": {pubkey}}, Allowed: map[string][]string{"staff": {"guests"}, pubkey: {"default", "guests"}}}, false},
+		{tasks.Policy{}, true},
+		{tasks.Policy{Pools: []tasks.Pool{guests}}, true},
+		{tasks.Policy{Pools: []tasks.Pool{def, def}}, true},
+		{tasks.Policy{Pools: []tasks.Pool{def, {Name: "empty"}}}, true},
+		{tasks.Policy{Pools: []tasks.Pool{def, {CIDRs: guests.CIDRs}}}, true},
+		{tasks.Policy{Pools: []tasks.Pool{def, {Name: "10.1.0.1", CIDRs: guests.CIDRs}}}, true},
+		{tasks.Policy{Pools: []tasks.Pool{def, {Name: "my guests", CIDRs: guests.CIDRs}}}, true},
+		{tasks.Policy{Pools: []tasks.Pool{def}, Groups: map[string][]string{"staff": {"nope"}}}, true},
+		{tasks.Policy{Pools: []tasks.Pool{def}, Allowed: map[string][]string{"nope": {"default"}}}, true},
+		{tasks.Policy{Pools: []tasks.Pool{def}, Allowed: map[string][]string{pubkey: {"guests"}}}, true},
+		{tasks.Policy{Pools: []tasks.Pool{def}, Allowed: map[string][]string{pubkey: {}}}, true},
+		{tasks.Policy{Pools: []tasks.Pool{def}, Allocator: tasks.AllocatorHash, HashKey: []byte("secret")}, false},
+		{tasks.Policy{Pools: []tasks.Pool{def}, Allocator: tasks.AllocatorHash}, true},
+		{tasks.Policy{Pools: []tasks.Pool{def}, Allocator: "random"}, true},
+	}
+
+	for row, test := range checkTests {
+		err := test.policy.Check()
+
+		if err != nil && !test.err {
+			t.Errorf("Row: %d returned unexpected error: %v", row, err)
+		}
+
+		if err == nil && test.err {
+			t.Errorf("Row: %d expected error but got %v", row, err)
+		}
+	}
+}
+
+// TestLease_pool checks if clients lease from the pools allowed by the policy, with an index per pool, and can ask for another
+// allowed pool, which moves them.
+func TestLease_pool(t *testing.T) {
+	e := mustSetup(t)
+	defer e.Close()
+
+	guest := key.Generate().Pubkey()
+	e.cjdns.AddNode(guest)
+
+	e.named = tasks.Policy{
+		Pools:   []tasks.Pool{mustPool(t, "guests", "10.1.0.0/24"), mustPool(t, "infra", "10.2.0.0/24", "fd02::/64")},
+		Groups:  map[string][]string{"visitors": {guest.String()}},
+		Allowed: map[string][]string{"visitors": {"guests"}, e.client.String(): {"default", "infra"}},
+	}
+
+	run := func(pubkey *key.Public, source string, argv ...string) (tasks.Result, error) {
+		task, err := tasks.InitKey(argv, e.db, e.admin, pubkey, nil, e.policy(), e.leaseTime)
+		if err != nil {
+			t.Fatalf("InitKey returned unexpected error: %v", err)
+		}
+
+		return tasks.Lease{Task: task.WithSource(source)}.Run()
+	}
+
+	var leaseTests = []struct {
+		pubkey   *key.Public
+		source   string
+		argv     []string
+		expected string
+		pool     string
+		code     string
+	}{
+		{e.client, "", nil, "10.0.0.1 fd00::1 ", tasks.DefaultPool, ""},
+		{guest, "", nil, "10.1.0.1 ", "guests", ""}, // The first index in its own pool, while the ID is 2
+		{guest, "", []string{"infra"}, "", "", tasks.CodeUnauthorized},
+		{guest, "", []string{"nope"}, "", "", tasks.CodeNotFound},
+		{e.client, "", []string{"infra"}, "10.2.0.1 fd02::1 ", "infra", ""},
+		{e.client, "", nil, "10.2.0.1 fd02::1 ", "infra", ""}, // Stays in the pool it asked for
+		{guest, database.SourceAdmin, []string{"infra"}, "10.2.0.2 fd02::2 ", "infra", ""},
+		{guest, "", nil, "10.1.0.1 ", "guests", ""}, // Moved back, as the policy does not allow infra
+	}
+
+	for row, test := range leaseTests {
+		result, err := run(test.pubkey, test.source, test.argv...)
+		if code := tasks.ErrorCode(err); err != nil && code != test.code || err == nil && test.code != "" {
+			t.Errorf("Row: %d returned unexpected error: %v, wanted code: %s", row, err, test.code)
+			continue
+		}
+
+		if err == nil && (result.String() != test.expected || result.Pool != test.pool) {
+			t.Errorf("Row: %d returned unexpected result: %q in pool: %s, wanted: %q in pool: %s", row, result.String(), result.Pool, test.expected, test.pool)
+		}
+	}
+
+	u, err := e.db.GetUser(2)
+	if err != nil || u.Pool != "guests" || u.Index != 1 || len(u.Addresses) != 1 || u.Addresses[0].Pool != "10.1.0.0/24" {
+		t.Errorf("GetUser returned unexpected user: %+v, error: %v", u, err)
+	}
+
+	// Only the addresses from the current pool are allowed in cjdns.
+	for _, tunnel := range e.cjdns.Tunnels() {
+		if tunnel.Key.Equal(guest) && !tunnel.IPs[0].Equal(u.Addresses[0].IP) {
+			t.Errorf("Lease left unexpected tunnel for moved user: %v", tunnel)
+		}
+	}
+
+	usage, err := tasks.Usage(e.db, e.policy())
+	if err != nil {
+		t.Fatalf("Usage returned unexpected error: %v", err)
+	}
+
+	for _, u := range usage {
+		if expected := map[string]uint64{tasks.DefaultPool: 0, "guests": 1, "infra": 1}[u.Pool]; u.Used != expected {
+			t.Errorf("Usage returned unexpected usage for pool: %s, got: %d, wanted: %d", u.Pool, u.Used, expected)
+		}
+	}
+}
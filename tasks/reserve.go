@@ -0,0 +1,410 @@
+package tasks
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/willeponken/elvisp/database"
+	"github.com/willeponken/elvisp/lease"
+	"github.com/willeponken/go-cjdns/key"
+)
+
+// Reserve should implement the reserve task, i.e. pin the client key to the ID and addresses in the arguments
+type Reserve struct{ Task }
+
+// Unreserve should implement the unreserve task
+type Unreserve struct{ Task }
+
+// reservationFor returns the reservation for a public key within the transaction, or an empty reservation if there is none.
+func reservationFor(tx database.Tx, pubkey *key.Public) database.Reservation {
+	r, err := tx.GetReservation(pubkey)
+	if err != nil {
+		return database.Reservation{}
+	}
+
+	return r
+}
+
+// other returns the first public key that is not pubkey, or nil if there is none.
+func other(keys []*key.Public, pubkey *key.Public) *key.Public {
+	for _, k := range keys {
+		if !k.Equal(pubkey) {
+			return k
+		}
+	}
+
+	return nil
+}
+
+// reservedIndex returns the public key, other than pubkey, that an index is reserved for as an ID, or that one of the addresses
+// generated from the index within the CIDRs is reserved for. It is nil if there is none.
+func reservedIndex(tx database.Tx, cidrs []lease.CIDR, i uint64, pubkey *key.Public) (k *key.Public, err error) {
+	if k, err = tx.ReservedID(i); err != nil || (k != nil && !k.Equal(pubkey)) {
+		return
+	}
+
+	for _, cidr := range cidrs {
+		ip, e := lease.Generate(cidr, i)
+		if e != nil {
+			continue
+		}
+
+		keys, err := tx.ReservedWithin(cidr.Prefix(ip))
+		if err != nil {
+			return nil, err
+		}
+
+		if k = other(keys, pubkey); k != nil {
+			return k, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// excluded returns a function reporting if an ID can not be allocated dynamically, as it is reserved, or as one of the addresses
+// generated from it within the CIDRs is reserved, for another public key than pubkey. The first error from the lookups is stored
+// in err, after which every ID is reported as allocatable so the allocation stops.
+func excluded(tx database.Tx, cidrs []lease.CIDR, pubkey *key.Public, err *error) func(id uint64) bool {
+	return func(id uint64) bool {
+		if *err != nil {
+			return false
+		}
+
+		k, e := reservedIndex(tx, cidrs, id, pubkey)
+		*err = e
+		return k != nil
+	}
+}
+
+// poolUser returns the public key of the user leasing from the pool with an index, or nil if there is none. Users registered
+// before pools lease from the default pool.
+func poolUser(tx database.Tx, pool string, i uint64) (k *key.Public, err error) {
+	if k, err = tx.PoolUser(pool, i); err != nil || k != nil || pool != DefaultPool {
+		return
+	}
+
+	return tx.PoolUser("", i)
+}
+
+// parseReservation parses the arguments for the reserve task, an ID and addresses in any order, into a reservation for pubkey.
+func parseReservation(pubkey *key.Public, argv []string) (r database.Reservation, err error) {
+	r.Key = pubkey
+
+	for _, arg := range argv {
+		if ip := net.ParseIP(arg); ip != nil {
+			r.Addresses = append(r.Addresses, ip)
+			continue
+		}
+
+		id, e := strconv.ParseUint(arg, 10, 64)
+		switch {
+		case e != nil:
+			err = fmt.Errorf("Invalid ID or address: %s", arg)
+		case id == 0:
+			err = errors.New("Invalid ID: 0")
+		case r.ID != 0:
+			err = errors.New("Only one ID can be reserved")
+		}
+		if err != nil {
+			return
+		}
+
+		r.ID = id
+	}
+
+	if r.ID == 0 && len(r.Addresses) == 0 {
+		err = errors.New("Atleast one ID or address has to be reserved")
+	}
+
+	return
+}
+
+// freeIndex returns the index within a pool for pubkey: its reserved ID, or the first index from the allocator that is not used by
+// another user leasing from the pool, and is neither reserved nor generates a reserved address within the pool. Probes is the number
+// of taken indexes skipped after the hashed index, it is 0 unless the index is allocated by the hash allocator.
+func (p Policy) freeIndex(tx database.Tx, pool Pool, r database.Reservation, pubkey *key.Public) (i, probes uint64, err error) {
+	if r.ID != 0 {
+		k, err := poolUser(tx, pool.Name, r.ID)
+		if err != nil {
+			return 0, 0, err
+		}
+
+		if k != nil && !k.Equal(pubkey) {
+			return 0, 0, Error{Code: CodeConflict, Err: fmt.Errorf("Reserved ID: %d is already used in pool: %s by user with public key: %s", r.ID, pool.Name, k.String())}
+		}
+
+		return r.ID, 0, nil
+	}
+
+	var e error
+	reserved := excluded(tx, pool.CIDRs, pubkey, &e)
+	i, probes, err = p.probe(pool, pubkey, func(i uint64) bool {
+		if e != nil {
+			return false
+		}
+
+		var k *key.Public
+		if k, e = poolUser(tx, pool.Name, i); k != nil && !k.Equal(pubkey) {
+			return true
+		}
+
+		return reserved(i)
+	})
+	if err == nil {
+		err = e
+	}
+
+	if p.Allocator != AllocatorHash {
+		probes = 0
+	}
+
+	if err == nil && probes != 0 {
+		log.Printf("Hashed index for user: %s collided in pool: %s, probed %d indexes to index: %d", pubkey.String(), pool.Name, probes, i)
+	}
+
+	return
+}
+
+// currentPool returns the pool that the client leases from if it is registered, or the pool it would lease from otherwise.
+func (t Task) currentPool(tx database.Tx) (pool Pool, err error) {
+	id, err := tx.GetID(t.clientKey)
+	if err != nil {
+		return t.policy.Pool(t.policy.PoolsFor(t.clientKey)[0])
+	}
+
+	u, err := tx.GetUser(id)
+	if err != nil {
+		return
+	}
+
+	return t.policy.Pool(poolName(u))
+}
+
+// addressUser returns the public key of the user, other than pubkey, that an address within a CIDR of the pool is leased to or
+// reserved for, or nil if there is none. The address is taken by a reserved address within it, or by a user leasing from the pool
+// or a reserved ID with the index of the address, unless that user has a reserved address within the CIDR instead.
+func addressUser(tx database.Tx, pool Pool, addr Address, pubkey *key.Public) (k *key.Public, err error) {
+	for _, cidr := range pool.CIDRs {
+		if !cidr.Network.Contains(addr.IP) {
+			continue
+		}
+
+		keys, err := tx.ReservedWithin(cidr.Prefix(addr.IP))
+		if err != nil {
+			return nil, err
+		}
+
+		if k = other(keys, pubkey); k != nil {
+			return k, nil
+		}
+
+		i, e := lease.Offset(cidr, addr.IP)
+		if e != nil {
+			continue
+		}
+
+		for _, lookup := range []func() (*key.Public, error){
+			func() (*key.Public, error) { return poolUser(tx, pool.Name, i) },
+			func() (*key.Public, error) { return tx.ReservedID(i) },
+		} {
+			if k, err = lookup(); err != nil {
+				return nil, err
+			}
+
+			if k != nil && !k.Equal(pubkey) && reservationFor(tx, k).Reserved(cidr.Network) == nil {
+				return k, nil
+			}
+		}
+	}
+
+	return nil, nil
+}
+
+// checkPools returns an error if the reservation does not fit within the CIDRs: every address has to be within a CIDR and not
+// excluded from it, with at most one address per CIDR, and the addresses for a reserved ID have to be within every CIDR.
+func checkPools(cidrs []lease.CIDR, r database.Reservation) (err error) {
+	for _, ip := range r.Addresses {
+		within := false
+		for _, cidr := range cidrs {
+			if !cidr.Network.Contains(ip) {
+				continue
+			}
+
+			// Reserved returns the first reserved address within the CIDR.
+			if within = true; !r.Reserved(cidr.Network).Equal(ip) {
+				return fmt.Errorf("Only one address can be reserved within: %s", cidr.String())
+			}
+
+			if cidr.Excludes(ip) {
+				return fmt.Errorf("Address: %s is excluded from: %s", ip, cidr.String())
+			}
+		}
+
+		if !within {
+			return fmt.Errorf("Address: %s is not within any CIDR", ip)
+		}
+	}
+
+	if r.ID != 0 {
+		_, err = Addresses(cidrs, r.ID, r)
+	}
+
+	return
+}
+
+// reserved returns the addresses for a reservation that are known without an ID, i.e. the reserved addresses within the CIDRs.
+func reserved(cidrs []lease.CIDR, r database.Reservation) (addrs []Address) {
+	for _, cidr := range cidrs {
+		if ip := r.Reserved(cidr.Network); ip != nil {
+			addrs = append(addrs, newAddress(cidr, ip))
+		}
+	}
+
+	return
+}
+
+// reallow replaces the allowances in the cjdns IP tunnel, and the assigned addresses, for the client after its reservation has changed.
+// Nothing is done if the client does not have a lease.
+func (t Task) reallow() (err error) {
+	var u database.User
+	var pool Pool
+	var addrs []Address
+
+	err = t.db.View(func(tx database.Tx) error {
+		id, e := tx.GetID(t.clientKey)
+		if e != nil {
+			return nil
+		}
+
+		if _, e = tx.GetLease(id); e != nil {
+			return nil
+		}
+
+		if u, err = tx.GetUser(id); err != nil {
+			return err
+		}
+
+		if pool, err = t.policy.Pool(poolName(u)); err != nil {
+			return err
+		}
+
+		r := reservationFor(tx, t.clientKey)
+		addrs, err = Addresses(pool.CIDRs, index(u, r), r)
+		return err
+	})
+	if err != nil || u.Key == nil {
+		return
+	}
+
+	if err = t.admin.DelUser(t.clientKey); err != nil {
+		return wrap(CodeCjdns, err)
+	}
+
+	for _, addr := range addrs {
+		if err = Allow(t.admin, t.clientKey, addr); err != nil {
+			return wrap(CodeCjdns, err)
+		}
+	}
+
+	return t.db.Update(func(tx database.Tx) error {
+		u, err := tx.GetUser(u.ID)
+		if err != nil {
+			return err
+		}
+
+		u.Addresses = assignments(pool.CIDRs, addrs)
+		return tx.PutUser(u)
+	})
+}
+
+// Run Reserve pins the client key to the ID and addresses in the arguments, replacing any earlier reservation. A reserved address
+// has to be within a CIDR of the pool the client leases from, and may not be leased to another user. If the client has a lease,
+// it is moved to the reserved addresses.
+func (t Reserve) Run() (result Result, err error) {
+	r, err := parseReservation(t.clientKey, t.argv)
+	if err != nil {
+		err = wrap(CodeInvalidRequest, err)
+		return
+	}
+
+	err = t.db.Update(func(tx database.Tx) error {
+		pool, err := t.currentPool(tx)
+		if err != nil {
+			return err
+		}
+
+		if err = checkPools(pool.CIDRs, r); err != nil {
+			return wrap(CodeInvalidRequest, err)
+		}
+
+		if err := database.CheckReservation(tx, r); err != nil {
+			return wrap(CodeConflict, err)
+		}
+
+		addrs := reserved(pool.CIDRs, r)
+		if r.ID != 0 {
+			addrs, _ = Addresses(pool.CIDRs, r.ID, r)
+		}
+
+		for _, addr := range addrs {
+			k, err := addressUser(tx, pool, addr, t.clientKey)
+			if err != nil {
+				return err
+			}
+
+			if k != nil {
+				return wrap(CodeConflict, fmt.Errorf("Address: %s is already used by user with public key: %s", addr.IP, k.String()))
+			}
+		}
+
+		result.Pool = pool.Name
+		result.Addresses = addrs
+		return tx.SetReservation(r)
+	})
+	if err != nil {
+		return
+	}
+
+	if err = t.reallow(); err != nil {
+		return
+	}
+
+	var parts, ips []string
+	if r.ID != 0 {
+		parts = append(parts, fmt.Sprintf("ID: %d", r.ID))
+	}
+
+	for _, ip := range r.Addresses {
+		ips = append(ips, ip.String())
+	}
+
+	if len(ips) != 0 {
+		parts = append(parts, "addresses: "+strings.Join(ips, " "))
+	}
+
+	result.Message = fmt.Sprintf("Reserved %s for user: %s", strings.Join(parts, " and "), t.clientKey.String())
+	result.Key = t.clientKey
+	return
+}
+
+// Run Unreserve removes the reservation for the client key, the user keeps its ID until it is removed. If the client has a lease,
+// it is moved to the addresses generated from its ID.
+func (t Unreserve) Run() (result Result, err error) {
+	if err = t.db.Unreserve(t.clientKey); err != nil {
+		err = wrap(CodeNotFound, err)
+		return
+	}
+
+	if err = t.reallow(); err != nil {
+		return
+	}
+
+	result.Message = fmt.Sprintf("Removed reservation for user: %s", t.clientKey.String())
+	result.Key = t.clientKey
+	return
+}
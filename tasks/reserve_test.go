@@ -0,0 +1,143 @@
+package tasks_test
+
+import (
+	"net"
+	"testing"
+
+	"github.com/willeponken/elvisp/tasks"
+	"github.com/willeponken/go-cjdns/key"
+)
+
+// reserve runs the reserve task for a key with the arguments, and returns the error.
+func (e *env) reserve(t *testing.T, pubkey *key.Public, argv ...string) error {
+	task, err := tasks.InitKey(argv, e.db, e.admin, pubkey, nil, e.policy(), e.leaseTime)
+	if err != nil {
+		t.Fatalf("InitKey returned unexpected error: %v", err)
+	}
+
+	_, err = (tasks.Reserve{Task: task}).Run()
+	return err
+}
+
+// TestReserve checks if a client with a reservation leases the reserved ID and addresses, and that other clients do not.
+func TestReserve(t *testing.T) {
+	e := mustSetup(t)
+	defer e.Close()
+
+	other := key.Generate().Pubkey()
+	e.cjdns.AddNode(other)
+
+	if err := e.reserve(t, e.client, "5", "fd00::beef"); err != nil {
+		t.Fatalf("Reserve returned unexpected error: %v", err)
+	}
+
+	if err := e.reserve(t, other, "10.0.0.1"); err != nil {
+		t.Fatalf("Reserve returned unexpected error: %v", err)
+	}
+
+	if resp := mustRun(t, tasks.Lease{Task: e.mustInit(t)}); resp != "10.0.0.5 fd00::beef " {
+		t.Errorf("Lease returned unexpected result: %q", resp)
+	}
+
+	if id, err := e.db.GetID(e.client); err != nil || id != 5 {
+		t.Errorf("GetID returned unexpected ID: %d, error: %v", id, err)
+	}
+
+	// ID 1 generates the address reserved for other, and ID 5 is reserved, so the next clients get ID 2, 3, 4 and 6.
+	for _, want := range []string{"10.0.0.2 fd00::2 ", "10.0.0.3 fd00::3 ", "10.0.0.4 fd00::4 ", "10.0.0.6 fd00::6 "} {
+		pubkey := key.Generate().Pubkey()
+		e.cjdns.AddNode(pubkey)
+
+		task, err := tasks.InitKey(nil, e.db, e.admin, pubkey, nil, e.policy(), e.leaseTime)
+		if err != nil {
+			t.Fatalf("InitKey returned unexpected error: %v", err)
+		}
+
+		if resp := mustRun(t, tasks.Lease{Task: task}); resp != want {
+			t.Errorf("Lease returned unexpected result: %q, wanted: %q", resp, want)
+		}
+	}
+
+	// The ID reserved for other is allocated as usual, but the reserved address replaces the generated one.
+	task, _ := tasks.InitKey(nil, e.db, e.admin, other, nil, e.policy(), e.leaseTime)
+	if resp := mustRun(t, tasks.Lease{Task: task}); resp != "10.0.0.1 fd00::1 " {
+		t.Errorf("Lease returned unexpected result: %q", resp)
+	}
+}
+
+// TestReserve_invalid checks if reservations that do not fit the pools, or conflict with other users, are refused.
+func TestReserve_invalid(t *testing.T) {
+	e := mustSetup(t)
+	defer e.Close()
+
+	mustRun(t, tasks.Lease{Task: e.mustInit(t)})
+
+	other := key.Generate().Pubkey()
+	if err := e.reserve(t, other, "7"); err != nil {
+		t.Fatalf("Reserve returned unexpected error: %v", err)
+	}
+
+	var reserveTests = []struct {
+		argv []string
+		code string
+	}{
+		{[]string{}, tasks.CodeInvalidRequest},
+		{[]string{"0"}, tasks.CodeInvalidRequest},
+		{[]string{"lol"}, tasks.CodeInvalidRequest},
+		{[]string{"2", "3"}, tasks.CodeInvalidRequest},
+		{[]string{"256"}, tasks.CodeInvalidRequest},                  // Outside of 10.0.0.0/24
+		{[]string{"192.168.1.1"}, tasks.CodeInvalidRequest},          // Not within any pool
+		{[]string{"10.0.0.255"}, tasks.CodeInvalidRequest},           // Broadcast address
+		{[]string{"10.0.0.2", "10.0.0.3"}, tasks.CodeInvalidRequest}, // Two addresses in one pool
+		{[]string{"7"}, tasks.CodeConflict},                          // Reserved for other
+		{[]string{"1"}, tasks.CodeConflict},                          // Used by the client
+		{[]string{"10.0.0.1"}, tasks.CodeConflict},                   // Leased to the client
+		{[]string{"10.0.0.7"}, tasks.CodeConflict},                   // Generated from the ID reserved for other
+		{[]string{"10.0.0.8", "fd00::8"}, ""},
+	}
+
+	for row, test := range reserveTests {
+		err := e.reserve(t, key.Generate().Pubkey(), test.argv...)
+
+		if test.code == "" && err != nil {
+			t.Errorf("Row: %d returned unexpected error: %v", row, err)
+		}
+
+		if code := tasks.ErrorCode(err); test.code != "" && code != test.code {
+			t.Errorf("Row: %d returned unexpected error code: %s, error: %v, wanted: %s", row, code, err, test.code)
+		}
+	}
+}
+
+// TestReserve_leased checks if a client with a lease is moved to the reserved addresses, and back when the reservation is removed.
+func TestReserve_leased(t *testing.T) {
+	e := mustSetup(t)
+	defer e.Close()
+
+	mustRun(t, tasks.Lease{Task: e.mustInit(t)})
+
+	if err := e.reserve(t, e.client, "10.0.0.100"); err != nil {
+		t.Fatalf("Reserve returned unexpected error: %v", err)
+	}
+
+	tunnels := e.cjdns.Tunnels()
+	if len(tunnels) != 2 || !tunnels[0].IPs[0].Equal(net.ParseIP("10.0.0.100")) || !tunnels[1].IPs[0].Equal(net.ParseIP("fd00::1")) {
+		t.Errorf("Reserve left unexpected tunnels: %v", tunnels)
+	}
+
+	if u, _ := e.db.GetUser(1); len(u.Addresses) != 2 || !u.Addresses[0].IP.Equal(net.ParseIP("10.0.0.100")) {
+		t.Errorf("Reserve recorded unexpected addresses: %v", u.Addresses)
+	}
+
+	task, _ := tasks.InitKey(nil, e.db, e.admin, e.client, nil, e.policy(), e.leaseTime)
+	mustRun(t, tasks.Unreserve{Task: task})
+
+	tunnels = e.cjdns.Tunnels()
+	if len(tunnels) != 2 || !tunnels[0].IPs[0].Equal(net.ParseIP("10.0.0.1")) {
+		t.Errorf("Unreserve left unexpected tunnels: %v", tunnels)
+	}
+
+	if _, err := (tasks.Unreserve{Task: task}).Run(); tasks.ErrorCode(err) != tasks.CodeNotFound {
+		t.Errorf("Unreserve returned unexpected error: %v", err)
+	}
+}
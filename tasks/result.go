@@ -0,0 +1,82 @@
+package tasks
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/willeponken/elvisp/cjdns"
+	"github.com/willeponken/elvisp/database"
+	"github.com/willeponken/elvisp/lease"
+	"github.com/willeponken/go-cjdns/key"
+)
+
+// Address holds a leased IP address and the prefix length of the network it was leased from. A delegated address is the first
+// address of an IPv6 prefix leased as a whole, and the prefix length is the length of the delegated prefix.
+type Address struct {
+	IP           net.IP
+	PrefixLength int
+	Delegated    bool
+}
+
+// String returns the IP address, or the prefix in CIDR notation if it is delegated.
+func (a Address) String() string {
+	if a.Delegated {
+		return fmt.Sprintf("%s/%d", a.IP, a.PrefixLength)
+	}
+
+	return a.IP.String()
+}
+
+// newAddress returns the address leased from a CIDR for ip, which is the prefix holding ip if the CIDR delegates prefixes.
+func newAddress(cidr lease.CIDR, ip net.IP) Address {
+	if cidr.Delegate != 0 {
+		return Address{IP: cidr.Prefix(ip).IP, PrefixLength: cidr.Delegate, Delegated: true}
+	}
+
+	prefixLength, _ := cidr.Network.Mask.Size()
+	return Address{IP: ip, PrefixLength: prefixLength}
+}
+
+// Addresses returns the addresses for the index of a user within its pool in every CIDR, an address reserved for the user within
+// a CIDR is used instead of the generated address. The reservation is empty for a user without one.
+func Addresses(cidrs []lease.CIDR, index uint64, r database.Reservation) (addrs []Address, err error) {
+	for _, cidr := range cidrs {
+		ip := r.Reserved(cidr.Network)
+		if ip == nil {
+			if ip, err = lease.Generate(cidr, index); err != nil {
+				return
+			}
+		}
+
+		addrs = append(addrs, newAddress(cidr, ip))
+	}
+
+	return
+}
+
+// Allow allows the IP tunnel connection for the public key with the address, as a prefix if it is delegated.
+func Allow(admin cjdns.Admin, pubkey *key.Public, addr Address) error {
+	if addr.Delegated {
+		return admin.AddPrefix(pubkey, addr.IP, addr.PrefixLength)
+	}
+
+	return admin.AddUser(pubkey, addr.IP)
+}
+
+// Result holds the outcome of a task, Message is the human readable result used by protocol v2. User is the record for the client, if the task returns it.
+// Pool is the name of the pool that the addresses were leased from.
+type Result struct {
+	Message   string
+	Key       *key.Public
+	ServerKey *key.Public
+	Pool      string
+	Addresses []Address
+	Expires   time.Time
+	User      *database.User
+}
+
+// String returns the human readable result.
+func (r Result) String() string {
+	return r.Message
+}
@@ -1,9 +1,11 @@
 package tasks
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"net"
+	"time"
 
 	"github.com/willeponken/elvisp/cjdns"
 	"github.com/willeponken/elvisp/database"
@@ -13,41 +15,68 @@ import (
 
 // TaskInterface defines the methods needed for a default task
 type TaskInterface interface {
-	Run() (result string, err error)
+	Run() (result Result, err error)
 }
 
 // Task needs the arguments to use, and a database to save the changes to
 type Task struct {
 	argv                 []string
 	db                   *database.Database
-	admin                *cjdns.Conn
+	admin                cjdns.Admin
 	clientIP, serverIP   net.IP
 	clientKey, serverKey *key.Public
-	cidrs                []lease.CIDR
+	policy               Policy
+	leaseTime            time.Duration
+	source               string
 }
 
-// Init returns a new task
-func Init(argv []string, db *database.Database, admin *cjdns.Conn, clientIP, serverIP net.IP, cidrs []lease.CIDR) (task Task, err error) {
+// Init returns a new task, a zero leaseTime means that leases never expire. The client key is looked up in the cjdns node store using clientIP.
+// The serverIP can be nil if the task is run outside of cjdns, the info task will then not know the server key. The policy holds the pools to lease from.
+func Init(argv []string, db *database.Database, admin cjdns.Admin, clientIP, serverIP net.IP, policy Policy, leaseTime time.Duration) (task Task, err error) {
+	task.admin = admin
+
+	clientKey, err := task.lookupKey(clientIP)
+	if err != nil {
+		err = wrap(CodeUnknownNode, err)
+		return
+	}
+
+	return InitKey(argv, db, admin, clientKey, serverIP, policy, leaseTime)
+}
+
+// InitKey returns a new task for a client with a known public key, e.g. proven by the client, without looking it up in the cjdns node store.
+func InitKey(argv []string, db *database.Database, admin cjdns.Admin, clientKey *key.Public, serverIP net.IP, policy Policy, leaseTime time.Duration) (task Task, err error) {
 	task.argv = argv
 	task.db = db
 	task.admin = admin
-	task.clientIP = clientIP
-	task.cidrs = cidrs
+	task.clientIP = clientKey.IP()
+	task.clientKey = clientKey
+	task.policy = policy
+	task.leaseTime = leaseTime
 
-	var clientKey, serverKey string
-	clientKey, err = task.admin.LookupPubKey(clientIP.String())
-	serverKey, err = task.admin.LookupPubKey(serverIP.String())
-	if err != nil {
-		return task, err
+	if serverIP == nil {
+		return
 	}
 
-	task.clientKey, err = key.DecodePublic(clientKey)
-	task.serverKey, err = key.DecodePublic(serverKey)
+	task.serverKey, err = task.lookupKey(serverIP)
+	err = wrap(CodeUnknownNode, err)
+	return
+}
+
+// WithSource returns the task with a source of creation for new users, e.g. database.SourceAdmin. The default is database.SourceClient.
+func (t Task) WithSource(source string) Task {
+	t.source = source
+	return t
+}
+
+// lookupKey finds and decodes the public key for a cjdns IPv6 address.
+func (t Task) lookupKey(ip net.IP) (pubkey *key.Public, err error) {
+	k, err := t.admin.LookupPubKey(ip.String())
 	if err != nil {
-		return task, err
+		return
 	}
 
-	return
+	return key.DecodePublic(k)
 }
 
 // Remove should implement the remove task
@@ -56,101 +85,333 @@ type Remove struct{ Task }
 // Lease should implement the lease task
 type Lease struct{ Task }
 
-// Release should implement the release task
+// Release should implement the release task, i.e. revoke the IP tunnel but keep the user
 type Release struct{ Task }
 
+// Renew should implement the renew task
+type Renew struct{ Task }
+
 // Info should implement the info task
 type Info struct{ Task }
 
 // Invalid should implement the invalid task, i.e. take an error
 type Invalid struct{ Error error }
 
-// allowIPTunnel adds the defined IP to the cjdns IP tunnel, if it fails, it will delete the user from the database.
-func (t Lease) allowIPTunnel(ips []net.IP) (err error) {
+// expires returns when a lease granted now expires, the zero time is returned if leases never expire.
+func (t Task) expires() time.Time {
+	if t.leaseTime <= 0 {
+		return time.Time{}
+	}
+
+	return time.Now().Add(t.leaseTime)
+}
+
+// formatExpires formats the expiry time as RFC 3339, or "never" for the zero time.
+func formatExpires(expires time.Time) string {
+	if expires.IsZero() {
+		return "never"
+	}
+
+	return expires.UTC().Format(time.RFC3339)
+}
+
+// allowIPTunnel adds the defined addresses to the cjdns IP tunnel for the user with the ID. If it fails, the user is deleted from the
+// database if it was inserted by this lease, otherwise only its lease is dropped so it keeps its ID.
+func (t Lease) allowIPTunnel(id uint64, addrs []Address, inserted bool) (err error) {
 
-	for _, ip := range ips {
-		if err = t.admin.AddUser(t.clientKey, ip); err != nil {
-			if e := t.db.DelUser(t.clientKey); e != nil {
-				log.Println(err)
+	for _, addr := range addrs {
+		if err = Allow(t.admin, t.clientKey, addr); err != nil {
+			remove := func() error { return t.db.DelLease(id) }
+			if inserted {
+				remove = func() error { return t.db.DelUser(id) }
 			}
 
-			return
+			if e := remove(); e != nil {
+				log.Println(e)
+			}
+
+			return wrap(CodeCjdns, err)
 		}
 	}
 
 	return
 }
 
-func (t Lease) generateIPs(cidrs []lease.CIDR, id uint64) (ips []net.IP, str string, err error) {
-	var ip net.IP
-	for _, cidr := range cidrs {
-		ip, err = lease.Generate(cidr, id)
-		if err != nil {
+func (t Lease) generateIPs(cidrs []lease.CIDR, index uint64, r database.Reservation) (addrs []Address, str string, err error) {
+	addrs, err = Addresses(cidrs, index, r)
+	if err != nil {
+		return
+	}
+
+	for _, addr := range addrs {
+		str += addr.String() + " "
+	}
+
+	return
+}
+
+// assignments returns the addresses assigned from every CIDR, in the same order as the CIDRs.
+func assignments(cidrs []lease.CIDR, addrs []Address) (assigned []database.Assignment) {
+	for i, addr := range addrs {
+		assigned = append(assigned, database.Assignment{Pool: cidrs[i].String(), IP: addr.IP})
+	}
+
+	return
+}
+
+// seen records in the user record that the client was active at now, and the addresses assigned from every CIDR if any.
+func (t Task) seen(tx database.Tx, id uint64, now time.Time, cidrs []lease.CIDR, addrs []Address) (err error) {
+	u, err := tx.GetUser(id)
+	if err != nil {
+		return
+	}
+
+	u.LastSeen = now
+	u.LastIP = t.clientIP
+
+	if addrs != nil {
+		u.Addresses = assignments(cidrs, addrs)
+	}
+
+	return tx.PutUser(u)
+}
+
+// leasePool returns the pool for the client to lease from: the pool in the arguments, the pool of the registered user u, or the
+// first pool that the policy allows. A client may only lease from the pools that the policy allows, an administrator from any.
+// A registered user is moved to the first allowed pool once the policy no longer allows its pool. The user is nil if the client
+// is not registered.
+func (t Task) leasePool(u *database.User) (pool Pool, err error) {
+	admin := t.source == database.SourceAdmin
+
+	if len(t.argv) > 0 {
+		if pool, err = t.policy.Pool(t.argv[0]); err != nil {
 			return
 		}
 
-		ips = append(ips, ip)
-		str += ip.String() + " "
+		if !admin && !t.policy.Allows(t.clientKey, pool.Name) {
+			err = Error{Code: CodeUnauthorized, Err: fmt.Errorf("Not allowed to lease from pool: %s", pool.Name)}
+		}
+
+		return
 	}
 
-	return
+	if u != nil && (admin || t.policy.Allows(t.clientKey, poolName(*u))) {
+		if pool, err = t.policy.Pool(poolName(*u)); err == nil {
+			return
+		}
+	}
+
+	return t.policy.Pool(t.policy.PoolsFor(t.clientKey)[0])
 }
 
-// Run Lease adds a user using the public key and a token.
-func (t Lease) Run() (result string, err error) {
-	var id uint64
-	var ips []net.IP
+// Run Lease adds a user using the public key and a token, or moves a registered user to another pool. A user with a reservation
+// gets the reserved ID and addresses, other users get an ID, and an index within the pool, that is neither reserved nor
+// generates a reserved address.
+func (t Lease) Run() (result Result, err error) {
+	var u database.User
+	var pool Pool
+	var addrs []Address
+	var r database.Reservation
+	var moved, inserted bool
 	db := t.db
 
-	// Check if the user already exists
-	id, exists := db.GetID(t.clientKey)
-	if exists != nil { // User does not exist, add to database
-		id, err = db.AddUser(t.clientKey)
-		if err != nil {
+	// Check if the user already exists, and add it otherwise, in one transaction so concurrent leases for the same key cannot both add it
+	err = db.Update(func(tx database.Tx) (err error) {
+		r = reservationFor(tx, t.clientKey)
+
+		var registered *database.User
+		if id, err := tx.GetID(t.clientKey); err == nil {
+			if u, err = tx.GetUser(id); err != nil {
+				return err
+			}
+			registered = &u
+		}
+
+		if pool, err = t.leasePool(registered); err != nil {
+			return err
+		}
+
+		// A registered user keeps its index as long as it leases from the same pool.
+		if registered != nil && poolName(u) == pool.Name {
+			return nil
+		}
+
+		u.Pool = pool.Name
+		if u.Index, u.Probes, err = t.policy.freeIndex(tx, pool, r, t.clientKey); err != nil {
+			return err
+		}
+
+		// A pool without addresses or prefixes left for the index refuses the user before it is added or moved.
+		if _, err = Addresses(pool.CIDRs, index(u, r), r); err != nil {
+			return wrap(CodeExhausted, err)
+		}
+
+		if registered != nil {
+			moved = true
+			return tx.PutUser(u)
+		}
+
+		u.ID, u.Key, u.Source = r.ID, t.clientKey, t.source
+		if u.ID == 0 {
+			var e error
+			if u.ID, err = tx.FreeID(excluded(tx, pool.CIDRs, t.clientKey, &e)); err == nil {
+				err = e
+			}
+
+			if err != nil {
+				return err
+			}
+		}
+
+		u.ID, err = tx.InsertUser(u)
+		inserted = err == nil
+		return err
+	})
+	if err != nil {
+		return
+	}
+
+	// The addresses from the earlier pool are revoked before the new ones are allowed.
+	if moved {
+		log.Printf("Moving user: %s to pool: %s", t.clientKey.String(), pool.Name)
+
+		if err = t.admin.DelUser(t.clientKey); err != nil {
+			err = wrap(CodeCjdns, err)
 			return
 		}
 	}
 
-	ips, result, err = t.generateIPs(t.cidrs, id)
+	addrs, result.Message, err = t.generateIPs(pool.CIDRs, index(u, r), r)
 	if err != nil {
 		return
 	}
 
-	err = t.allowIPTunnel(ips)
+	err = t.allowIPTunnel(u.ID, addrs, inserted)
 	if err != nil {
 		return
 	}
 
+	now := time.Now()
+
+	result.Key = t.clientKey
+	result.Addresses = addrs
+	result.Expires = t.expires()
+	result.Pool = pool.Name
+
+	err = db.Update(func(tx database.Tx) error {
+		if err := tx.SetLease(u.ID, now, result.Expires); err != nil {
+			return err
+		}
+
+		return t.seen(tx, u.ID, now, pool.CIDRs, addrs)
+	})
 	return
 }
 
 // Run Remove removes a user.
-func (t Remove) Run() (result string, err error) {
+func (t Remove) Run() (result Result, err error) {
 	db := t.db
 	admin := t.admin
 	pubkey := t.clientKey
 
 	if err = db.DelUser(pubkey); err != nil {
+		err = wrap(CodeNotFound, err)
 		return
 	}
 
 	if err = admin.DelUser(pubkey); err != nil {
+		err = wrap(CodeCjdns, err)
 		return
 	}
 
-	result = fmt.Sprintf("Removed user: %s", pubkey.String())
+	result.Message = fmt.Sprintf("Removed user: %s", pubkey.String())
+	result.Key = pubkey
+	return
+}
+
+// Run Release revokes the IP tunnel for a user, but keeps the user in the database so the same addresses are leased again.
+func (t Release) Run() (result Result, err error) {
+	db := t.db
+	admin := t.admin
+	pubkey := t.clientKey
+
+	id, err := db.GetID(pubkey)
+	if err != nil {
+		err = wrap(CodeNotFound, err)
+		return
+	}
+
+	if err = admin.DelUser(pubkey); err != nil {
+		err = wrap(CodeCjdns, err)
+		return
+	}
+
+	if err = db.DelLease(id); err != nil {
+		return
+	}
+
+	result.Message = fmt.Sprintf("Released user: %s", pubkey.String())
+	result.Key = pubkey
+	return
+}
+
+// Run Renew extends the lease for a user that already has a lease.
+func (t Renew) Run() (result Result, err error) {
+	db := t.db
+	pubkey := t.clientKey
+
+	id, err := db.GetID(pubkey)
+	if err != nil {
+		err = wrap(CodeNotFound, err)
+		return
+	}
+
+	l, err := db.GetLease(id)
+	if err != nil {
+		err = wrap(CodeNotFound, err)
+		return
+	}
+
+	expires := t.expires()
+	err = db.Update(func(tx database.Tx) error {
+		if err := tx.SetLease(id, l.Granted, expires); err != nil {
+			return err
+		}
+
+		return t.seen(tx, id, time.Now(), nil, nil)
+	})
+	if err != nil {
+		return
+	}
+
+	result.Message = fmt.Sprintf("Renewed lease for user: %s expires: %s", pubkey.String(), formatExpires(expires))
+	result.Key = pubkey
+	result.Expires = expires
 	return
 }
 
 // Run Info returns information about the Elvisp server
-func (t Info) Run() (result string, err error) {
-	log.Println(t)
-	result = t.serverKey.String()
+func (t Info) Run() (result Result, err error) {
+	if t.serverKey == nil {
+		err = Error{Code: CodeUnknownNode, Err: errors.New("Server key is unknown, not connected over cjdns")}
+		return
+	}
+
+	result.Message = t.serverKey.String()
+	result.ServerKey = t.serverKey
+
+	// The record is included if the client is a registered user.
+	if id, e := t.db.GetID(t.clientKey); e == nil {
+		if u, e := t.db.GetUser(id); e == nil {
+			result.User = &u
+		}
+	}
+
 	return
 }
 
 // Run Invalid returns an error and empty result.
-func (t Invalid) Run() (result string, err error) {
+func (t Invalid) Run() (result Result, err error) {
 	err = t.Error
 	return
 }
@@ -1 +1,537 @@
 package tasks_test
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/willeponken/elvisp/cjdns"
+	"github.com/willeponken/elvisp/cjdns/cjdnstest"
+	"github.com/willeponken/elvisp/database"
+	"github.com/willeponken/elvisp/lease"
+	"github.com/willeponken/elvisp/tasks"
+	"github.com/willeponken/go-cjdns/key"
+)
+
+// env holds a fake cjdns admin server, a temporary database and a known client and server node. The CIDRs are the default pool,
+// and the named pools and policies are used besides it.
+type env struct {
+	cjdns     *cjdnstest.Server
+	admin     *cjdns.Conn
+	db        *database.Database
+	cidrs     []lease.CIDR
+	named     tasks.Policy
+	client    *key.Public
+	server    *key.Public
+	leaseTime time.Duration
+}
+
+func mustSetup(t *testing.T) *env {
+	s, err := cjdnstest.NewServer("password")
+	if err != nil {
+		t.Fatalf("NewServer returned unexpected error: %v", err)
+	}
+
+	admin, err := cjdns.Connect(s.Addr, s.Port, "password")
+	if err != nil {
+		t.Fatalf("Connect returned unexpected error: %v", err)
+	}
+
+	db, err := database.OpenStore(database.BackendMemory, "")
+	if err != nil {
+		t.Fatalf("OpenStore returned unexpected error: %v", err)
+	}
+
+	var cidrs []lease.CIDR
+	for _, c := range []string{"10.0.0.0/24", "fd00::/64"} {
+		cidr, _ := lease.ParseCIDR(c)
+		cidrs = append(cidrs, cidr)
+	}
+
+	e := &env{
+		cjdns:     s,
+		admin:     admin,
+		db:        &db,
+		cidrs:     cidrs,
+		client:    key.Generate().Pubkey(),
+		server:    key.Generate().Pubkey(),
+		leaseTime: time.Hour,
+	}
+
+	s.AddNode(e.client)
+	s.AddNode(e.server)
+
+	return e
+}
+
+func (e *env) Close() {
+	e.cjdns.Close()
+	e.db.Close()
+}
+
+// policy returns the policy with the CIDRs as the default pool.
+func (e *env) policy() tasks.Policy {
+	return e.named.WithCIDRs(e.cidrs)
+}
+
+// mustInit initializes a task for the client.
+func (e *env) mustInit(t *testing.T) tasks.Task {
+	task, err := tasks.Init(nil, e.db, e.admin, e.client.IP(), e.server.IP(), e.policy(), e.leaseTime)
+	if err != nil {
+		t.Fatalf("Init returned unexpected error: %v", err)
+	}
+
+	return task
+}
+
+// mustRun runs a task and fails the test on error, the human readable result is returned.
+func mustRun(t *testing.T, task tasks.TaskInterface) string {
+	result, err := task.Run()
+	if err != nil {
+		t.Fatalf("%T returned unexpected error: %v", task, err)
+	}
+
+	return result.String()
+}
+
+// TestInit_unknownNode checks if a client missing in the node store is refused.
+func TestInit_unknownNode(t *testing.T) {
+	e := mustSetup(t)
+	defer e.Close()
+
+	e.cjdns.DelNode(e.client)
+
+	_, err := tasks.Init(nil, e.db, e.admin, e.client.IP(), e.server.IP(), e.policy(), e.leaseTime)
+	if code := tasks.ErrorCode(err); code != tasks.CodeUnknownNode {
+		t.Errorf("Init returned unexpected error code: %s, error: %v", code, err)
+	}
+}
+
+// TestInitKey checks that a client with a known key can lease, even if it is missing in the node store.
+func TestInitKey(t *testing.T) {
+	e := mustSetup(t)
+	defer e.Close()
+
+	e.cjdns.DelNode(e.client)
+	calls := e.cjdns.Calls("NodeStore_nodeForAddr")
+
+	task, err := tasks.InitKey(nil, e.db, e.admin, e.client, nil, e.policy(), e.leaseTime)
+	if err != nil {
+		t.Fatalf("InitKey returned unexpected error: %v", err)
+	}
+
+	if resp := mustRun(t, tasks.Lease{Task: task}); resp != "10.0.0.1 fd00::1 " {
+		t.Errorf("Lease returned unexpected result: %q", resp)
+	}
+
+	if n := e.cjdns.Calls("NodeStore_nodeForAddr"); n != calls {
+		t.Errorf("InitKey looked up the node store %d times", n-calls)
+	}
+}
+
+// TestLease checks if the first addresses are leased, allowed in cjdns and that the lease expires.
+func TestLease(t *testing.T) {
+	e := mustSetup(t)
+	defer e.Close()
+
+	result := mustRun(t, tasks.Lease{Task: e.mustInit(t)})
+	if result != "10.0.0.1 fd00::1 " {
+		t.Errorf("Lease returned unexpected result: %q", result)
+	}
+
+	tunnels := e.cjdns.Tunnels()
+	if len(tunnels) != 2 || !e.client.Equal(tunnels[0].Key) || !e.client.Equal(tunnels[1].Key) {
+		t.Errorf("Lease added unexpected tunnels: %v", tunnels)
+	}
+
+	l, err := e.db.GetLease(1)
+	if err != nil {
+		t.Fatalf("GetLease returned unexpected error: %v", err)
+	}
+
+	if l.Expires.IsZero() || !l.Expired(time.Now().Add(2*e.leaseTime)) {
+		t.Errorf("Lease returned unexpected expiry: %v", l.Expires)
+	}
+}
+
+// TestLease_result checks if the leased addresses are returned with prefix length, and with the key and expiry.
+func TestLease_result(t *testing.T) {
+	e := mustSetup(t)
+	defer e.Close()
+
+	result, err := (tasks.Lease{Task: e.mustInit(t)}).Run()
+	if err != nil {
+		t.Fatalf("Lease returned unexpected error: %v", err)
+	}
+
+	expected := []tasks.Address{{IP: net.ParseIP("10.0.0.1"), PrefixLength: 24}, {IP: net.ParseIP("fd00::1"), PrefixLength: 64}}
+	if len(result.Addresses) != len(expected) {
+		t.Fatalf("Lease returned unexpected addresses: %v", result.Addresses)
+	}
+
+	for row, addr := range result.Addresses {
+		if !addr.IP.Equal(expected[row].IP) || addr.PrefixLength != expected[row].PrefixLength {
+			t.Errorf("Row: %d returned unexpected address, got: %v, wanted: %v", row, addr, expected[row])
+		}
+	}
+
+	if !e.client.Equal(result.Key) || result.Expires.IsZero() {
+		t.Errorf("Lease returned unexpected key: %s or expiry: %v", result.Key, result.Expires)
+	}
+}
+
+// TestLease_delegate checks if a pool with delegated prefixes leases a prefix per client, allowed with its length in cjdns.
+func TestLease_delegate(t *testing.T) {
+	e := mustSetup(t)
+	defer e.Close()
+
+	cidr, err := lease.ParseCIDR("fd00::/48,delegate=64")
+	if err != nil {
+		t.Fatalf("ParseCIDR returned unexpected error: %v", err)
+	}
+	e.cidrs = []lease.CIDR{e.cidrs[0], cidr}
+
+	result, err := (tasks.Lease{Task: e.mustInit(t)}).Run()
+	if err != nil {
+		t.Fatalf("Lease returned unexpected error: %v", err)
+	}
+
+	if result.String() != "10.0.0.1 fd00:0:0:1::/64 " {
+		t.Errorf("Lease returned unexpected result: %q", result.String())
+	}
+
+	if addr := result.Addresses[1]; !addr.Delegated || addr.PrefixLength != 64 || !addr.IP.Equal(net.ParseIP("fd00:0:0:1::")) {
+		t.Errorf("Lease returned unexpected prefix: %v", addr)
+	}
+
+	tunnels := e.cjdns.Tunnels()
+	if len(tunnels) != 2 || tunnels[0].Alloc != 0 || tunnels[1].Alloc != 64 || !tunnels[1].IPs[0].Equal(net.ParseIP("fd00:0:0:1::")) {
+		t.Errorf("Lease allowed unexpected tunnels: %v", tunnels)
+	}
+
+	// The second client is refused when the only prefix after the gateway's is leased, and is not added.
+	if cidr, err = lease.ParseCIDR("fd00::/63,delegate=64"); err != nil {
+		t.Fatalf("ParseCIDR returned unexpected error: %v", err)
+	}
+	e.cidrs = []lease.CIDR{cidr}
+
+	pubkey := key.Generate().Pubkey()
+	e.cjdns.AddNode(pubkey)
+
+	task, _ := tasks.InitKey(nil, e.db, e.admin, pubkey, nil, e.policy(), e.leaseTime)
+	if _, err = (tasks.Lease{Task: task}).Run(); tasks.ErrorCode(err) != tasks.CodeExhausted {
+		t.Errorf("Lease returned unexpected error for exhausted pool: %v", err)
+	}
+
+	if _, err = e.db.GetID(pubkey); err == nil {
+		t.Errorf("GetID expected error for refused user but got %v", err)
+	}
+}
+
+// TestLease_record checks if the user record is created with the source, and updated with the assigned addresses on lease.
+func TestLease_record(t *testing.T) {
+	e := mustSetup(t)
+	defer e.Close()
+
+	before := time.Now().Add(-time.Second)
+	mustRun(t, tasks.Lease{Task: e.mustInit(t).WithSource(database.SourceAdmin)})
+
+	u, err := e.db.GetUser(1)
+	if err != nil {
+		t.Fatalf("GetUser returned unexpected error: %v", err)
+	}
+
+	if u.Source != database.SourceAdmin || u.Created.Before(before) || u.LastSeen.Before(before) || !u.LastIP.Equal(e.client.IP()) {
+		t.Errorf("Lease recorded unexpected user: %+v", u)
+	}
+
+	expected := []database.Assignment{{Pool: "10.0.0.0/24", IP: net.ParseIP("10.0.0.1")}, {Pool: "fd00::/64", IP: net.ParseIP("fd00::1")}}
+	if len(u.Addresses) != len(expected) {
+		t.Fatalf("Lease recorded unexpected addresses: %v", u.Addresses)
+	}
+
+	for row, a := range u.Addresses {
+		if a.Pool != expected[row].Pool || !a.IP.Equal(expected[row].IP) {
+			t.Errorf("Row: %d recorded unexpected address, got: %v, wanted: %v", row, a, expected[row])
+		}
+	}
+
+	// The source is only recorded for new users.
+	mustRun(t, tasks.Lease{Task: e.mustInit(t)})
+	if u, _ = e.db.GetUser(1); u.Source != database.SourceAdmin {
+		t.Errorf("Lease changed source to: %s", u.Source)
+	}
+}
+
+// TestLease_tunnelFailure checks if the user is removed from the database when cjdns refuses the tunnel.
+func TestLease_tunnelFailure(t *testing.T) {
+	e := mustSetup(t)
+	defer e.Close()
+
+	e.cjdns.Fail("IpTunnel_allowConnection", "out of memory")
+
+	if _, err := (tasks.Lease{Task: e.mustInit(t)}).Run(); err == nil {
+		t.Errorf("Lease expected error but got %v", err)
+	}
+
+	if _, err := e.db.GetID(e.client); err == nil {
+		t.Errorf("GetID expected error but got %v", err)
+	}
+}
+
+// TestLease_tunnelFailureExisting checks if a registered user keeps its ID, and only loses its lease, when cjdns refuses the tunnel.
+func TestLease_tunnelFailureExisting(t *testing.T) {
+	e := mustSetup(t)
+	defer e.Close()
+
+	mustRun(t, tasks.Lease{Task: e.mustInit(t)})
+	mustRun(t, tasks.Release{Task: e.mustInit(t)})
+
+	e.cjdns.Fail("IpTunnel_allowConnection", "out of memory")
+
+	if _, err := (tasks.Lease{Task: e.mustInit(t)}).Run(); tasks.ErrorCode(err) != tasks.CodeCjdns {
+		t.Errorf("Lease returned unexpected error: %v", err)
+	}
+
+	id, err := e.db.GetID(e.client)
+	if err != nil {
+		t.Fatalf("GetID returned unexpected error: %v", err)
+	}
+
+	if _, err = e.db.GetLease(id); err == nil {
+		t.Errorf("GetLease expected error but got %v", err)
+	}
+
+	e.cjdns.Recover("IpTunnel_allowConnection")
+
+	if result := mustRun(t, tasks.Lease{Task: e.mustInit(t)}); result != "10.0.0.1 fd00::1 " {
+		t.Errorf("Lease returned unexpected result: %q", result)
+	}
+}
+
+// TestRelease checks if the tunnel is revoked and that a later lease returns the same addresses.
+func TestRelease(t *testing.T) {
+	e := mustSetup(t)
+	defer e.Close()
+
+	other := key.Generate().Pubkey()
+	e.db.AddUser(other) // Takes ID 1, so the client gets ID 2
+
+	leased := mustRun(t, tasks.Lease{Task: e.mustInit(t)})
+
+	result := mustRun(t, tasks.Release{Task: e.mustInit(t)})
+	if result != "Released user: "+e.client.String() {
+		t.Errorf("Release returned unexpected result: %q", result)
+	}
+
+	if tunnels := e.cjdns.Tunnels(); len(tunnels) != 0 {
+		t.Errorf("Release left unexpected tunnels: %v", tunnels)
+	}
+
+	if _, err := e.db.GetLease(2); err == nil {
+		t.Errorf("GetLease expected error but got %v", err)
+	}
+
+	e.db.DelUser(other) // The gap should not be filled by the released client
+	if id, _ := e.db.AddUser(key.Generate().Pubkey()); id != 1 {
+		t.Errorf("AddUser returned unexpected ID: %d, wanted: 1", id)
+	}
+
+	if relet := mustRun(t, tasks.Lease{Task: e.mustInit(t)}); relet != leased {
+		t.Errorf("Lease returned unexpected result after release, got: %q, wanted: %q", relet, leased)
+	}
+}
+
+// TestRelease_run checks that releasing a user that never leased returns a not found error, and that releasing twice succeeds
+// without touching the tunnels or the reserved ID.
+func TestRelease_run(t *testing.T) {
+	var releaseTests = []struct {
+		leases   int
+		releases int
+		code     string
+	}{
+		{0, 1, tasks.CodeNotFound},
+		{1, 1, ""},
+		{1, 2, ""},
+	}
+
+	for row, test := range releaseTests {
+		e := mustSetup(t)
+
+		for i := 0; i < test.leases; i++ {
+			mustRun(t, tasks.Lease{Task: e.mustInit(t)})
+		}
+
+		var result tasks.Result
+		var err error
+		for i := 0; i < test.releases; i++ {
+			result, err = (tasks.Release{Task: e.mustInit(t)}).Run()
+		}
+
+		if test.code != "" {
+			if code := tasks.ErrorCode(err); code != test.code {
+				t.Errorf("Row: %d returned unexpected error code: %s, wanted: %s, error: %v", row, code, test.code, err)
+			}
+		} else if err != nil {
+			t.Errorf("Row: %d returned unexpected error: %v", row, err)
+		} else {
+			if result.String() != "Released user: "+e.client.String() {
+				t.Errorf("Row: %d returned unexpected result: %q", row, result.String())
+			}
+
+			if tunnels := e.cjdns.Tunnels(); len(tunnels) != 0 {
+				t.Errorf("Row: %d left unexpected tunnels: %v", row, tunnels)
+			}
+
+			if _, err = e.db.GetID(e.client); err != nil {
+				t.Errorf("Row: %d did not keep the user's ID, due to error: %v", row, err)
+			}
+		}
+
+		e.Close()
+	}
+}
+
+// TestRenew checks if only existing leases are renewed.
+func TestRenew(t *testing.T) {
+	e := mustSetup(t)
+	defer e.Close()
+
+	if _, err := (tasks.Renew{Task: e.mustInit(t)}).Run(); err == nil {
+		t.Errorf("Renew expected error but got %v", err)
+	}
+
+	mustRun(t, tasks.Lease{Task: e.mustInit(t)})
+	before, _ := e.db.GetLease(1)
+
+	e.leaseTime = 2 * time.Hour
+	result := mustRun(t, tasks.Renew{Task: e.mustInit(t)})
+	if !strings.HasPrefix(result, "Renewed lease for user: "+e.client.String()+" expires: ") {
+		t.Errorf("Renew returned unexpected result: %q", result)
+	}
+
+	after, _ := e.db.GetLease(1)
+	if !after.Expires.After(before.Expires) || !after.Granted.Equal(before.Granted) {
+		t.Errorf("Renew returned unexpected lease, before: %v, after: %v", before, after)
+	}
+}
+
+// TestRemove checks if both the user and the tunnel are removed.
+func TestRemove(t *testing.T) {
+	e := mustSetup(t)
+	defer e.Close()
+
+	mustRun(t, tasks.Lease{Task: e.mustInit(t)})
+
+	result := mustRun(t, tasks.Remove{Task: e.mustInit(t)})
+	if result != "Removed user: "+e.client.String() {
+		t.Errorf("Remove returned unexpected result: %q", result)
+	}
+
+	if tunnels := e.cjdns.Tunnels(); len(tunnels) != 0 {
+		t.Errorf("Remove left unexpected tunnels: %v", tunnels)
+	}
+
+	if _, err := e.db.GetID(e.client); err == nil {
+		t.Errorf("GetID expected error but got %v", err)
+	}
+}
+
+// TestInfo checks if the server's public key is returned.
+func TestInfo(t *testing.T) {
+	e := mustSetup(t)
+	defer e.Close()
+
+	result, err := (tasks.Info{Task: e.mustInit(t)}).Run()
+	if err != nil || result.String() != e.server.String() || !e.server.Equal(result.ServerKey) || result.User != nil {
+		t.Errorf("Info returned unexpected result: %v, error: %v", result, err)
+	}
+
+	mustRun(t, tasks.Lease{Task: e.mustInit(t)})
+
+	result, err = (tasks.Info{Task: e.mustInit(t)}).Run()
+	if err != nil || result.User == nil || !e.client.Equal(result.User.Key) {
+		t.Errorf("Info returned unexpected user: %+v, error: %v", result.User, err)
+	}
+}
+
+// TestInfo_noServer checks that tasks can run without a server IP, but info then fails.
+func TestInfo_noServer(t *testing.T) {
+	e := mustSetup(t)
+	defer e.Close()
+
+	task, err := tasks.Init(nil, e.db, e.admin, e.client.IP(), nil, e.policy(), e.leaseTime)
+	if err != nil {
+		t.Fatalf("Init returned unexpected error: %v", err)
+	}
+
+	if resp := mustRun(t, tasks.Lease{Task: task}); resp != "10.0.0.1 fd00::1 " {
+		t.Errorf("Lease returned unexpected result: %q", resp)
+	}
+
+	_, err = (tasks.Info{Task: task}).Run()
+	if code := tasks.ErrorCode(err); code != tasks.CodeUnknownNode {
+		t.Errorf("Info returned unexpected error code: %s, error: %v", code, err)
+	}
+}
+
+// TestLease_recorder checks if a lease only allows the leased addresses, using the in-memory admin.
+func TestLease_recorder(t *testing.T) {
+	e := mustSetup(t)
+	defer e.Close()
+
+	r := cjdns.NewRecorder(nil)
+	r.AddNode(e.client)
+	r.AddNode(e.server)
+
+	task, err := tasks.Init(nil, e.db, r, e.client.IP(), e.server.IP(), e.policy(), e.leaseTime)
+	if err != nil {
+		t.Fatalf("Init returned unexpected error: %v", err)
+	}
+
+	mustRun(t, tasks.Lease{Task: task})
+
+	expected := []string{
+		"AddUser " + e.client.String() + " 10.0.0.1",
+		"AddUser " + e.client.String() + " fd00::1",
+	}
+
+	calls := r.Calls()
+	if len(calls) != len(expected) {
+		t.Fatalf("Lease made unexpected calls: %v", calls)
+	}
+
+	for row, call := range calls {
+		if call.String() != expected[row] {
+			t.Errorf("Row: %d returned unexpected call, got: %s, wanted: %s", row, call, expected[row])
+		}
+	}
+}
+
+// TestInvalid checks if the error is returned.
+func TestInvalid(t *testing.T) {
+	if _, err := (tasks.Invalid{Error: net.UnknownNetworkError("lol")}).Run(); err == nil {
+		t.Errorf("Invalid expected error but got %v", err)
+	}
+}
+
+func TestErrorCode(t *testing.T) {
+	var codeTests = []struct {
+		err  error
+		code string
+	}{
+		{tasks.Error{Code: tasks.CodeNotFound, Err: net.UnknownNetworkError("lol")}, tasks.CodeNotFound},
+		{fmt.Errorf("wrapped: %w", tasks.Error{Code: tasks.CodeCjdns, Err: net.UnknownNetworkError("lol")}), tasks.CodeCjdns},
+		{net.UnknownNetworkError("lol"), tasks.CodeInternal},
+		{fmt.Errorf("wrapped: %w", lease.ExhaustedError{}), tasks.CodeExhausted},
+		{tasks.Error{Code: tasks.CodeUnknownNode, Err: cjdns.ErrUnavailable}, tasks.CodeCjdnsUnavailable},
+	}
+
+	for row, test := range codeTests {
+		if code := tasks.ErrorCode(test.err); code != test.code {
+			t.Errorf("Row: %d returned unexpected code, got: %s, wanted: %s", row, code, test.code)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package tasks
+
+import (
+	"github.com/willeponken/elvisp/database"
+	"github.com/willeponken/elvisp/lease"
+)
+
+// PoolUsage holds how many of the indexes that a CIDR in a pool has addresses or prefixes for are used, and how many are free.
+type PoolUsage struct {
+	Pool     string
+	CIDR     lease.CIDR
+	Capacity uint64
+	Used     uint64
+	Free     uint64
+}
+
+// Percent returns how much of the pool is used, in percent rounded down. A pool without capacity is fully used.
+func (u PoolUsage) Percent() int {
+	if u.Capacity == 0 {
+		return 100
+	}
+
+	return int(float64(u.Used) / float64(u.Capacity) * 100)
+}
+
+// Usage returns the usage of every CIDR in every pool. An index is used if a user leasing from the pool has it, if it is reserved,
+// or if it generates an address that is reserved, as it is then never given to another user. Only indexes within the capacity
+// of a CIDR are counted for it.
+func Usage(db *database.Database, policy Policy) (usage []PoolUsage, err error) {
+	used := make(map[string]map[uint64]bool)
+
+	err = db.View(func(tx database.Tx) error {
+		reservations, err := tx.Reservations()
+		if err != nil {
+			return err
+		}
+
+		users, err := tx.Users()
+		if err != nil {
+			return err
+		}
+
+		reserved := make(map[string]database.Reservation)
+		for _, r := range reservations {
+			reserved[r.Key.String()] = r
+		}
+
+		for _, pool := range policy.Pools {
+			used[pool.Name] = reservedIDs(pool.CIDRs, reservations)
+		}
+
+		for _, u := range users {
+			if indexes := used[poolName(u)]; indexes != nil {
+				indexes[index(u, reserved[u.Key.String()])] = true
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	for _, pool := range policy.Pools {
+		for _, cidr := range pool.CIDRs {
+			u := PoolUsage{Pool: pool.Name, CIDR: cidr, Capacity: cidr.Capacity()}
+			for i := range used[pool.Name] {
+				if i != 0 && i <= u.Capacity {
+					u.Used++
+				}
+			}
+
+			u.Free = u.Capacity - u.Used
+			usage = append(usage, u)
+		}
+	}
+
+	return
+}
+
+// reservedIDs returns the IDs that are reserved, or generate a reserved address within the CIDRs.
+func reservedIDs(cidrs []lease.CIDR, reservations []database.Reservation) (ids map[uint64]bool) {
+	ids = make(map[uint64]bool)
+	for _, r := range reservations {
+		if r.ID != 0 {
+			ids[r.ID] = true
+		}
+
+		for _, ip := range r.Addresses {
+			for _, cidr := range cidrs {
+				if id, err := lease.Offset(cidr, ip); err == nil {
+					ids[id] = true
+				}
+			}
+		}
+	}
+
+	return
+}
@@ -0,0 +1,60 @@
+package tasks_test
+
+import (
+	"testing"
+
+	"github.com/willeponken/elvisp/lease"
+	"github.com/willeponken/elvisp/tasks"
+	"github.com/willeponken/go-cjdns/key"
+)
+
+// TestUsage checks if users and reservations are counted as used in every pool, up to the capacity of the pool.
+func TestUsage(t *testing.T) {
+	e := mustSetup(t)
+	defer e.Close()
+
+	small, err := lease.ParseCIDR("10.1.0.0/30")
+	if err != nil {
+		t.Fatalf("ParseCIDR returned unexpected error: %v", err)
+	}
+	e.cidrs = append(e.cidrs, small)
+
+	usage, err := tasks.Usage(e.db, e.policy())
+	if err != nil {
+		t.Fatalf("Usage returned unexpected error: %v", err)
+	}
+
+	if len(usage) != 3 || usage[0].Capacity != 254 || usage[0].Used != 0 || usage[0].Free != 254 || usage[2].Capacity != 2 {
+		t.Fatalf("Usage returned unexpected usage: %v", usage)
+	}
+
+	mustRun(t, tasks.Lease{Task: e.mustInit(t)})
+
+	// ID 2 is reserved, and ID 4 generates the address reserved for another key, which is beyond the capacity of the small pool.
+	if err = e.reserve(t, key.Generate().Pubkey(), "2"); err != nil {
+		t.Fatalf("Reserve returned unexpected error: %v", err)
+	}
+
+	if err = e.reserve(t, key.Generate().Pubkey(), "10.0.0.4"); err != nil {
+		t.Fatalf("Reserve returned unexpected error: %v", err)
+	}
+
+	if usage, err = tasks.Usage(e.db, e.policy()); err != nil {
+		t.Fatalf("Usage returned unexpected error: %v", err)
+	}
+
+	var expected = []struct {
+		used, free uint64
+		percent    int
+	}{
+		{3, 251, 1},
+		{3, 18446744073709551612, 0},
+		{2, 0, 100},
+	}
+
+	for row, u := range usage {
+		if u.Used != expected[row].used || u.Free != expected[row].free || u.Percent() != expected[row].percent {
+			t.Errorf("Row: %d returned unexpected usage, got: %+v, wanted: %+v", row, u, expected[row])
+		}
+	}
+}